@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Scopes of the admin accounts,
+// * allows all of them.
+const (
+	ScopeCancel      = "cancel"
+	ScopeApprove     = "approve"
+	ScopeDeadLetters = "deadletters"
+	ScopeRedact      = "redact"
+	ScopeStats       = "stats"
+)
+
+var adminConfig = &AdminConfig{}
+
+// AdminConfig lists the operators of the mail
+// e.g. ops:TOKEN:cancel|approve, the token is
+// sent as the bearer. Without the accounts
+// the admin endpoints refuse everyone. Their
+// actions are kept in the AuditPath file,
+// one JSON per line.
+type AdminConfig struct {
+	Accounts  []string
+	AuditPath string `default:"./admin.audit.jsonl"`
+}
+
+func init() {
+	RegisterConfig("admin", adminConfig)
+}
+
+// authorizeAdmin returns the account of the
+// request allowed the scope, else it answers
+// the request by 401 or 403 and returns nil.
+func authorizeAdmin(rw http.ResponseWriter, req *http.Request, accounts []*TemplateAccount, scope string) *TemplateAccount {
+	account := authenticateTemplateAccount(accounts, req)
+	if account == nil {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil
+	}
+	if !account.Allows(scope) {
+		log.Warnf("Account %s denied %s", account.Name, scope)
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil
+	}
+	return account
+}
+
+// AdminAction is the audited
+// decision of the operator.
+type AdminAction struct {
+	Time   time.Time
+	Actor  string
+	Action string
+	Target string
+	Reason string `json:",omitempty"`
+}
+
+// AdminAudit appends the actions of the
+// operators to the file, nil keeps none.
+type AdminAudit struct {
+	mutex sync.Mutex
+	path  string
+}
+
+func NewAdminAudit(path string) *AdminAudit {
+	return &AdminAudit{path: path}
+}
+
+// Record appends the action by the actor
+// to the file, the failure is logged
+// and returned.
+func (a *AdminAudit) Record(actor, action, target, reason string) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err == nil {
+		err = json.NewEncoder(f).Encode(AdminAction{time.Now(), actor, action, target, reason})
+		f.Close()
+	}
+	if err != nil {
+		log.Errorf("Cannot audit %s of %s by %s: %s", action, target, actor, err)
+	}
+	return err
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// ApprovalPath lists the pending mail, its ID
+// approves it by POST or rejects it by DELETE.
+const ApprovalPath = "/v1/approvals/"
+
+var (
+	ErrNotPending = fmt.Errorf("approvalmailer: Mail is not pending, it was decided or expired")
+
+	approvalConfig = &ApprovalConfig{}
+	approvalBucket = []byte("approvals")
+)
+
+// ApprovalConfig names the templates whose
+// mail waits for the operator, the mail not
+// decided within the Expiry is dropped. The
+// pending mail is kept in the BoltDB file of
+// the Path across restarts.
+type ApprovalConfig struct {
+	Templates []string
+	Expiry    time.Duration `default:"72h"`
+	Path      string
+}
+
+func init() {
+	RegisterConfig("approval", approvalConfig)
+}
+
+// PendingMail is the parked mail
+// as listed to the operator.
+type PendingMail struct {
+	ID        string
+	Template  string
+	Recipient string
+	Subject   string
+	Expires   time.Time
+}
+
+type pendingMail struct {
+	mail    mailStruct
+	expires time.Time
+	timer   *time.Timer
+}
+
+// storedApproval is the pending
+// mail as kept by the store.
+type storedApproval struct {
+	Mail    mailStruct
+	Expires time.Time
+}
+
+// ApprovalMailer parks the rendered mail of the
+// sensitive templates until it is approved.
+// The pending mail is lost on restart
+// unless it is persisted.
+type ApprovalMailer struct {
+	mailer    Mailer
+	templates map[string]bool
+	expiry    time.Duration
+	db        *bolt.DB
+	keyring   *Keyring
+
+	mutex   sync.Mutex
+	pending map[string]*pendingMail
+}
+
+func NewApprovalMailer(mailer Mailer, templates []string, expiry time.Duration) *ApprovalMailer {
+	am := &ApprovalMailer{
+		mailer:    mailer,
+		templates: make(map[string]bool),
+		expiry:    expiry,
+		pending:   make(map[string]*pendingMail),
+	}
+	for _, name := range templates {
+		am.templates[strings.TrimSpace(name)] = true
+	}
+	return am
+}
+
+func (am *ApprovalMailer) SendMail(mail *mailStruct) error {
+	if !am.templates[mail.Template] {
+		return am.mailer.SendMail(mail)
+	}
+
+	m := *mail
+	if len(m.ID) == 0 {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		m.ID = hex.EncodeToString(random)
+	}
+
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if _, ok := am.pending[m.ID]; ok {
+		log.Infof("Mail %s is already pending approval", m.ID)
+		return nil
+	}
+	expires := time.Now().Add(am.expiry)
+	if err := am.store(m, expires); err != nil {
+		return err
+	}
+	am.park(m, expires)
+	log.Infof("Mail %s of %s to %s pending approval", m.ID, m.Template, m.Recipient)
+	return nil
+}
+
+// park keeps the mail until it expires,
+// the mutex is held by the caller.
+func (am *ApprovalMailer) park(m mailStruct, expires time.Time) {
+	id := m.ID
+	am.pending[id] = &pendingMail{
+		mail:    m,
+		expires: expires,
+		timer: time.AfterFunc(expires.Sub(time.Now()), func() {
+			if am.take(id) != nil {
+				log.Warnf("Mail %s of %s expired without approval", id, m.Template)
+			}
+		}),
+	}
+}
+
+func (am *ApprovalMailer) take(id string) *pendingMail {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	p, ok := am.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(am.pending, id)
+	p.timer.Stop()
+	if err := am.forget(id); err != nil {
+		log.Errorf("Cannot remove the decided mail %s: %s", id, err)
+	}
+	return p
+}
+
+// Persist keeps the pending mail in the BoltDB
+// file of the path sealed by the keyring, the
+// mail left there by the previous run waits
+// for the approval again.
+func (am *ApprovalMailer) Persist(path string, keyring *Keyring) error {
+	db, err := openBolt(path, "approvals", approvalMigrations, keyring, approvalBucket)
+	if err != nil {
+		return err
+	}
+	stored := []storedApproval{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(approvalBucket).ForEach(func(key, value []byte) error {
+			value, err := keyring.Open(value)
+			if err != nil {
+				return err
+			}
+			s := storedApproval{}
+			if err := json.Unmarshal(value, &s); err != nil {
+				return err
+			}
+			stored = append(stored, s)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	am.db = db
+	am.keyring = keyring
+	for _, s := range stored {
+		if s.Expires.Before(time.Now()) {
+			log.Warnf("Mail %s of %s expired without approval", s.Mail.ID, s.Mail.Template)
+			am.forget(s.Mail.ID)
+			continue
+		}
+		am.park(s.Mail, s.Expires)
+	}
+	if len(am.pending) > 0 {
+		log.Infof("Resuming %d mails pending approval before restart", len(am.pending))
+	}
+	return nil
+}
+
+func (am *ApprovalMailer) store(m mailStruct, expires time.Time) error {
+	if am.db == nil {
+		return nil
+	}
+	value, err := json.Marshal(storedApproval{m, expires})
+	if err != nil {
+		return err
+	}
+	if value, err = am.keyring.Seal(value); err != nil {
+		return err
+	}
+	return am.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(approvalBucket).Put([]byte(m.ID), value)
+	})
+}
+
+func (am *ApprovalMailer) forget(id string) error {
+	if am.db == nil {
+		return nil
+	}
+	return am.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(approvalBucket).Delete([]byte(id))
+	})
+}
+
+// Pending lists the mail waiting
+// for approval, oldest first.
+func (am *ApprovalMailer) Pending() []PendingMail {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	list := make([]PendingMail, 0, len(am.pending))
+	for id, p := range am.pending {
+		list = append(list, PendingMail{id, p.mail.Template, p.mail.Recipient, p.mail.Subject, p.expires})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	return list
+}
+
+// Approve passes the pending mail on,
+// ErrNotPending if there is none. The
+// mail the mailer fails is parked again.
+func (am *ApprovalMailer) Approve(id string) error {
+	p := am.take(id)
+	if p == nil {
+		return ErrNotPending
+	}
+	err := am.mailer.SendMail(&p.mail)
+	if err != nil {
+		am.mutex.Lock()
+		defer am.mutex.Unlock()
+		if storeErr := am.store(p.mail, p.expires); storeErr != nil {
+			log.Errorf("Cannot keep the approved mail %s: %s", id, storeErr)
+		}
+		am.park(p.mail, p.expires)
+	}
+	return err
+}
+
+// Reject drops the pending mail,
+// ErrNotPending if there is none.
+func (am *ApprovalMailer) Reject(id string) error {
+	if am.take(id) == nil {
+		return ErrNotPending
+	}
+	return nil
+}
+
+// Close keeps the pending mail in the
+// store for the next run, without
+// one the pending mail is dropped.
+func (am *ApprovalMailer) Close() {
+	am.mutex.Lock()
+	for id, p := range am.pending {
+		p.timer.Stop()
+		if am.db == nil {
+			log.Warnf("Dropping mail %s pending approval", id)
+		}
+	}
+	am.pending = make(map[string]*pendingMail)
+	if am.db != nil {
+		am.db.Close()
+		am.db = nil
+	}
+	am.mutex.Unlock()
+	am.mailer.Close()
+}
+
+// ApprovalFunc lists the pending mail to GET of
+// ApprovalPath, approves the mail by POST and
+// rejects it by DELETE with its ID. Only the
+// admin of the approve scope is let in, the
+// decisions go to the audit.
+func ApprovalFunc(am *ApprovalMailer, admins []*TemplateAccount, audit *AdminAudit) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		admin := authorizeAdmin(rw, req, admins, ScopeApprove)
+		if admin == nil {
+			return
+		}
+		id := strings.TrimPrefix(req.URL.Path, ApprovalPath)
+		var err error
+		var verb string
+		switch {
+		case req.Method == "GET" && len(id) == 0:
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(am.Pending())
+			return
+		case req.Method == "POST" && len(id) > 0:
+			err, verb = am.Approve(id), "approved"
+		case req.Method == "DELETE" && len(id) > 0:
+			err, verb = am.Reject(id), "rejected"
+		default:
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		switch err {
+		case nil:
+		case ErrNotPending:
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(rw, err.Error(), errorStatus(err))
+			return
+		}
+		log.Infof("Mail %s %s by %s", id, verb, admin.Name)
+		audit.Record(admin.Name, verb, id, "")
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApprovalMailer(t *testing.T) {
+	fake := &syncMailer{}
+	mailer := NewApprovalMailer(fake, []string{"contract"}, 20*time.Millisecond)
+
+	mailer.SendMail(&mailStruct{ID: "1", Template: "welcome"})
+	if fake.count() != 1 {
+		t.Fatal("Mail of other templates should go right away")
+	}
+
+	mailer.SendMail(&mailStruct{ID: "2", Template: "contract"})
+	mailer.SendMail(&mailStruct{ID: "3", Template: "contract"})
+	mailer.SendMail(&mailStruct{ID: "4", Template: "contract"})
+	if fake.count() != 1 || len(mailer.Pending()) != 3 {
+		t.Fatalf("Mail of the template should be pending, got %v", mailer.Pending())
+	}
+
+	dir, _ := ioutil.TempDir("", "approval")
+	defer os.RemoveAll(dir)
+	admins, _ := ParseTemplateAccounts([]string{"ops:admin:approve", "support:help:cancel"})
+	audit := NewAdminAudit(filepath.Join(dir, "audit.jsonl"))
+	decide := func(method, id, token string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, ApprovalPath+id, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		ApprovalFunc(mailer, admins, audit)(rec, req)
+		return rec.Code
+	}
+	if code := decide("POST", "2", "guess"); code != http.StatusUnauthorized || fake.count() != 1 {
+		t.Errorf("Unknown approver should be refused, got %d", code)
+	}
+	if code := decide("GET", "", "help"); code != http.StatusForbidden {
+		t.Errorf("Admin without the scope should be refused, got %d", code)
+	}
+	if code := decide("POST", "2", "admin"); code != http.StatusNoContent || fake.count() != 2 {
+		t.Errorf("Approved mail should be sent, got %d", code)
+	}
+	if code := decide("DELETE", "3", "admin"); code != http.StatusNoContent {
+		t.Errorf("Pending mail should be rejected, got %d", code)
+	}
+	if code := decide("POST", "3", "admin"); code != http.StatusConflict {
+		t.Errorf("Rejected mail cannot be approved, got %d", code)
+	}
+	recorded, _ := ioutil.ReadFile(filepath.Join(dir, "audit.jsonl"))
+	if lines := strings.Split(strings.TrimSpace(string(recorded)), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"Actor":"ops","Action":"approved","Target":"2"`) {
+		t.Errorf("Decisions should be audited with the approver, got %s", recorded)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if fake.count() != 2 || len(mailer.Pending()) != 0 {
+		t.Errorf("Undecided mail should expire, sent %v", fake.sent)
+	}
+}
+
+func TestApprovalMailerPersist(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "approval")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "approval.db")
+
+	fake := &syncMailer{}
+	mailer := NewApprovalMailer(fake, []string{"contract"}, time.Hour)
+	if err := mailer.Persist(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	mailer.SendMail(&mailStruct{ID: "1", Template: "contract"})
+	mailer.SendMail(&mailStruct{ID: "2", Template: "contract"})
+	mailer.Reject("2")
+	mailer.Close()
+
+	mailer = NewApprovalMailer(fake, []string{"contract"}, time.Hour)
+	if err := mailer.Persist(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer mailer.Close()
+	pending := mailer.Pending()
+	if len(pending) != 1 || pending[0].ID != "1" || pending[0].Template != "contract" {
+		t.Fatalf("Pending mail should wait for approval after restart, got %v", pending)
+	}
+	if err := mailer.Approve("1"); err != nil || fake.count() != 1 {
+		t.Errorf("Resumed mail should be approved, got %v", err)
+	}
+}
+
+func TestApprovalMailerApproveFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "approval")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "approval.db")
+
+	outage := ErrQueueFull
+	failing := &failingMailer{errors: []error{outage}}
+	mailer := NewApprovalMailer(failing, []string{"contract"}, time.Hour)
+	if err := mailer.Persist(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	mailer.SendMail(&mailStruct{ID: "1", Template: "contract"})
+	if err := mailer.Approve("1"); err != outage {
+		t.Fatalf("Failure of the mailer should be returned, got %v", err)
+	}
+	mailer.Close()
+
+	mailer = NewApprovalMailer(failing, []string{"contract"}, time.Hour)
+	if err := mailer.Persist(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer mailer.Close()
+	if pending := mailer.Pending(); len(pending) != 1 || pending[0].ID != "1" {
+		t.Fatalf("Failed approved mail should be pending again, got %v", pending)
+	}
+	if err := mailer.Approve("1"); err != nil || failing.sent != 1 {
+		t.Errorf("Pending mail should be approved again, got %v", err)
+	}
+}
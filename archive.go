@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrUnknownArchive = fmt.Errorf("archive: Unknown archive format")
+
+	archiveConfig = &ArchiveConfig{}
+)
+
+type ArchiveConfig struct {
+	// maildir or mbox, empty disables archiving
+	Format  string
+	Dir     string `default:"./archive"`
+	MaxSize int64  `default:"104857600"`
+}
+
+func init() {
+	RegisterConfig("archive", archiveConfig)
+}
+
+// Archive keeps a copy of every sent message
+// under the archive ID it returns, the ID of
+// the mail or a random one without it. The
+// body of the message can be redacted by it.
+type Archive interface {
+	Store(mail *mailStruct) (string, error)
+	Redact(id string, now time.Time) error
+}
+
+// ArchivingMailer stores the message into
+// the archive once the mailer sent it.
+type ArchivingMailer struct {
+	mailer  Mailer
+	archive Archive
+}
+
+func NewArchivingMailer(mailer Mailer, archive Archive) Mailer {
+	return &ArchivingMailer{
+		mailer,
+		archive,
+	}
+}
+
+func (am *ArchivingMailer) SendMail(mail *mailStruct) error {
+	if err := am.mailer.SendMail(mail); err != nil {
+		return err
+	}
+	// Failed archiving must not make
+	// the already sent mail fail.
+	id, err := am.archive.Store(mail)
+	if err != nil {
+		log.Errorf("Cannot archive mail to %s: %s", mail.Recipient, err)
+		return nil
+	}
+	log.Infof("Mail to %s archived as %s", mail.Recipient, id)
+	return nil
+}
+
+func (am *ArchivingMailer) Close() {
+	am.mailer.Close()
+}
+
+// NewArchive opens the archive of the format,
+// the messages are sealed by the keyring,
+// the nil one keeps them plain.
+func NewArchive(format, dir string, maxSize int64, keyring *Keyring) (Archive, error) {
+	switch format {
+	case "maildir":
+		md, err := newMaildir(dir)
+		if err != nil {
+			return nil, err
+		}
+		return &MaildirArchive{md, keyring}, nil
+	case "mbox":
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		return &MboxArchive{
+			path:    filepath.Join(dir, "sent.mbox"),
+			maxSize: maxSize,
+			keyring: keyring,
+		}, nil
+	}
+	return nil, ErrUnknownArchive
+}
+
+type MaildirArchive struct {
+	maildir *maildir
+	keyring *Keyring
+}
+
+func (ma *MaildirArchive) Store(mail *mailStruct) (string, error) {
+	id, err := archiveID(mail)
+	if err != nil {
+		return "", err
+	}
+	message, err := ma.keyring.Seal(archivedMessage(mail, id, time.Now()))
+	if err != nil {
+		return "", err
+	}
+	if _, err := ma.maildir.write(message); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// MboxArchive appends the messages to a single
+// mbox file which is rotated once it grows over
+// the max size. The sealed message is the
+// single line after its separator.
+type MboxArchive struct {
+	path    string
+	maxSize int64
+	keyring *Keyring
+	mutex   sync.Mutex
+}
+
+func (ma *MboxArchive) Store(mail *mailStruct) (string, error) {
+	id, err := archiveID(mail)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", mail.Sender, now.Format(time.ANSIC))
+	if ma.keyring != nil {
+		sealed, err := ma.keyring.Seal(archivedMessage(mail, id, now))
+		if err != nil {
+			return "", err
+		}
+		buf.Write(sealed)
+		buf.WriteByte('\n')
+	} else {
+		for _, line := range bytes.Split(archivedMessage(mail, id, now), []byte("\r\n")) {
+			// Escape lines which would start a new message
+			if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+				buf.WriteByte('>')
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+	buf.WriteByte('\n')
+
+	ma.mutex.Lock()
+	defer ma.mutex.Unlock()
+
+	if err := ma.rotate(now); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(ma.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// rotate renames the full mbox by the time,
+// the one rotated in the same second gets
+// the counter so no archive is overwritten.
+func (ma *MboxArchive) rotate(now time.Time) error {
+	if ma.maxSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(ma.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Size() < ma.maxSize {
+		return nil
+	}
+	rotated := fmt.Sprintf("%s.%s", ma.path, now.Format("20060102150405"))
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s.%d", ma.path, now.Format("20060102150405"), i)
+	}
+	return os.Rename(ma.path, rotated)
+}
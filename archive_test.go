@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMboxArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := NewArchive("mbox", dir, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mail := &mailStruct{
+		Sender:    "info@suricata.com",
+		Recipient: "radek@suricata.com",
+		Subject:   "Hello",
+		Message:   "Hi\r\nFrom now on",
+	}
+	archive.Store(mail)
+
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "sent.mbox"))
+	if !strings.HasPrefix(string(content), "From info@suricata.com ") {
+		t.Errorf("Missing mbox separator: %s", content)
+	}
+	if !strings.Contains(string(content), "\n>From now on\n") {
+		t.Errorf("From line in body not escaped: %s", content)
+	}
+
+	// Second message rotates the full file
+	archive.Store(mail)
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("Expected rotated archive, got %d files", len(files))
+	}
+}
+
+func TestArchiveRedact(t *testing.T) {
+	for _, format := range []string{"maildir", "mbox"} {
+		dir, err := ioutil.TempDir("", "archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		archive, err := NewArchive(format, dir, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive.Store(&mailStruct{ID: "1", Recipient: "radek@suricata.com", Subject: "Hello", Message: "Public"})
+		archive.Store(&mailStruct{
+			ID:          "2",
+			Recipient:   "radek@suricata.com",
+			Subject:     "Contract",
+			Message:     "Secret",
+			Attachments: []Attachment{{Filename: "contract.pdf", Data: []byte("Secret")}},
+		})
+
+		if err := archive.Redact("3", time.Now()); err != ErrNotArchived {
+			t.Errorf("%s: Unknown mail should not be found, got %v", format, err)
+		}
+		auditDir, _ := ioutil.TempDir("", "audit")
+		defer os.RemoveAll(auditDir)
+		admins, _ := ParseTemplateAccounts([]string{"dpo:admin:redact", "ops:help:approve"})
+		audit := NewAdminAudit(filepath.Join(auditDir, "audit.jsonl"))
+		redact := func(token string) int {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", RedactPath+"2?reason=erasure", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			RedactFunc(archive, admins, audit)(rec, req)
+			return rec.Code
+		}
+		if code := redact("help"); code != http.StatusForbidden {
+			t.Errorf("%s: Admin without the scope should be refused, got %d", format, code)
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", RedactPath+"2", nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		RedactFunc(archive, admins, NewAdminAudit(filepath.Join(auditDir, "missing", "audit.jsonl")))(rec, req)
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: Mail should not be redacted unaudited, got %d", format, rec.Code)
+		}
+		if code := redact("admin"); code != http.StatusNoContent {
+			t.Fatalf("%s: Archived mail should be redacted, got %d", format, code)
+		}
+		recorded, _ := ioutil.ReadFile(filepath.Join(auditDir, "audit.jsonl"))
+		if !strings.Contains(string(recorded), `"Actor":"dpo","Action":"redact","Target":"2","Reason":"erasure"`) {
+			t.Errorf("%s: Redaction should be audited with the admin, got %s", format, recorded)
+		}
+
+		var content string
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				data, _ := ioutil.ReadFile(path)
+				content += string(data)
+			}
+			return nil
+		})
+		if strings.Contains(content, "Secret") || strings.Contains(content, "contract.pdf") {
+			t.Errorf("%s: Body and attachments should be redacted: %s", format, content)
+		}
+		if !strings.Contains(content, "Subject: Contract") || !strings.Contains(content, redactedBody) {
+			t.Errorf("%s: Headers should be kept: %s", format, content)
+		}
+		if !strings.Contains(content, "Public") {
+			t.Errorf("%s: Other mail should be kept: %s", format, content)
+		}
+	}
+}
+
+func TestArchiveRedactAll(t *testing.T) {
+	for _, format := range []string{"maildir", "mbox"} {
+		dir, err := ioutil.TempDir("", "archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Each message of the mbox goes
+		// to its own rotated file
+		archive, err := NewArchive(format, dir, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive.Store(&mailStruct{ID: "1", Subject: "First", Message: "Secret"})
+		archive.Store(&mailStruct{ID: "1", Subject: "Again", Message: "Secret"})
+		id, err := archive.Store(&mailStruct{Subject: "Anonymous", Message: "Private"})
+		if err != nil || len(id) == 0 {
+			t.Fatalf("%s: Mail without ID should get the archive ID, got %q %v", format, id, err)
+		}
+
+		if err := archive.Redact("1", time.Now()); err != nil {
+			t.Fatalf("%s: Archived mail should be redacted, got %v", format, err)
+		}
+		if err := archive.Redact(id, time.Now()); err != nil {
+			t.Fatalf("%s: Mail should be redacted by its archive ID, got %v", format, err)
+		}
+		var content string
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				data, _ := ioutil.ReadFile(path)
+				content += string(data)
+			}
+			return nil
+		})
+		if strings.Contains(content, "Secret") || strings.Contains(content, "Private") || strings.Count(content, redactedBody) != 3 {
+			t.Errorf("%s: All the messages with the ID should be redacted: %s", format, content)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrAttachmentTooLarge = fmt.Errorf("attachment: Attachment exceeds the size limit")
+
+	attachmentConfig = &AttachmentConfig{}
+)
+
+// AttachmentConfig limits the
+// attachments fetched by URL.
+type AttachmentConfig struct {
+	FetchTimeout time.Duration `default:"30s"`
+	MaxSize      int64         `default:"10485760"`
+}
+
+func init() {
+	RegisterConfig("attachment", attachmentConfig)
+}
+
+// Attachment of the mail, the Data are
+// base64 encoded in the JSON payload.
+// Attachment without Data is downloaded
+// from the URL before sending. Attachment
+// with ContentID is inline image referenced
+// from the HTML as cid:ContentID.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	URL         string
+	ContentID   string
+}
+
+func (a Attachment) Inline() bool {
+	return len(a.ContentID) > 0
+}
+
+// MIMEType returns the content type of the
+// attachment, guessed by the file extension
+// when the caller did not set it.
+func (a Attachment) MIMEType() string {
+	if len(a.ContentType) > 0 {
+		return a.ContentType
+	}
+	if byExt := mime.TypeByExtension(filepath.Ext(a.Filename)); len(byExt) > 0 {
+		return byExt
+	}
+	return "application/octet-stream"
+}
+
+// FetchingMailer downloads the attachments
+// given by URL and passes the complete mail
+// to the wrapped mailer.
+type FetchingMailer struct {
+	mailer  Mailer
+	client  *http.Client
+	maxSize int64
+}
+
+func NewFetchingMailer(mailer Mailer, timeout time.Duration, maxSize int64) Mailer {
+	return &FetchingMailer{
+		mailer:  mailer,
+		client:  &http.Client{Timeout: timeout},
+		maxSize: maxSize,
+	}
+}
+
+func (fm *FetchingMailer) SendMail(mail *mailStruct) error {
+	m := *mail
+	m.Attachments = make([]Attachment, len(mail.Attachments))
+	for i, attachment := range mail.Attachments {
+		if len(attachment.Data) == 0 && len(attachment.URL) > 0 {
+			if err := fm.fetch(&attachment); err != nil {
+				return fmt.Errorf("attachment: Cannot fetch %s: %s", attachment.URL, err)
+			}
+		}
+		m.Attachments[i] = attachment
+	}
+	return fm.mailer.SendMail(&m)
+}
+
+func (fm *FetchingMailer) fetch(attachment *Attachment) error {
+	resp, err := fm.client.Get(attachment.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("attachment: Download returned %d", resp.StatusCode)
+	}
+	if fm.maxSize > 0 && resp.ContentLength > fm.maxSize {
+		return ErrAttachmentTooLarge
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, fm.maxSize+1))
+	if err != nil {
+		return err
+	}
+	if fm.maxSize > 0 && int64(len(data)) > fm.maxSize {
+		return ErrAttachmentTooLarge
+	}
+
+	attachment.Data = data
+	if len(attachment.ContentType) == 0 {
+		attachment.ContentType = resp.Header.Get("Content-Type")
+	}
+	if len(attachment.Filename) == 0 {
+		if u, err := url.Parse(attachment.URL); err == nil {
+			attachment.Filename = path.Base(u.Path)
+		}
+	}
+	return nil
+}
+
+func (fm *FetchingMailer) Close() {
+	fm.mailer.Close()
+}
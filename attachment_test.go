@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchingMailer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/pdf")
+		if req.URL.Path == "/large.pdf" {
+			rw.Write([]byte(strings.Repeat("x", 100)))
+			return
+		}
+		rw.Write([]byte("%PDF-1.4"))
+	}))
+	defer server.Close()
+
+	sent := &FakeMailer{}
+	mailer := NewFetchingMailer(sent, time.Second, 10)
+
+	err := mailer.SendMail(&mailStruct{
+		Attachments: []Attachment{{URL: server.URL + "/reports/invoice.pdf"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment := sent.sent[0].Attachments[0]
+	if string(attachment.Data) != "%PDF-1.4" ||
+		attachment.Filename != "invoice.pdf" ||
+		attachment.ContentType != "application/pdf" {
+		t.Errorf("Bad attachment fetched %+v", attachment)
+	}
+
+	err = mailer.SendMail(&mailStruct{
+		Attachments: []Attachment{{URL: server.URL + "/large.pdf"}},
+	})
+	if err == nil {
+		t.Error("Attachment over the limit should fail")
+	}
+}
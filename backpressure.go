@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Bounds of the Retry-After in seconds
+const (
+	minRetryAfter = 1
+	maxRetryAfter = 300
+)
+
+// Backpressure rejects new mail while the
+// queue is too deep, telling the caller when
+// to retry based on the current drain rate.
+type Backpressure struct {
+	queue *QueuedMailer
+	soft  int
+	hard  int
+}
+
+func NewBackpressure(queue *QueuedMailer, soft, hard int) *Backpressure {
+	return &Backpressure{
+		queue: queue,
+		soft:  soft,
+		hard:  hard,
+	}
+}
+
+// Func answers 429 over the soft limit
+// and 503 over the hard limit instead
+// of calling the handler.
+func (b *Backpressure) Func(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		depth := b.queue.Depth()
+		status := 0
+		if b.hard > 0 && depth >= b.hard {
+			status = http.StatusServiceUnavailable
+		} else if b.soft > 0 && depth >= b.soft {
+			status = http.StatusTooManyRequests
+		}
+		if status == 0 {
+			h(rw, req)
+			return
+		}
+
+		retryAfter := b.retryAfter(depth)
+		log.Warnf("Queue depth %d over limit, retry after %ds", depth, retryAfter)
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(rw, http.StatusText(status), status)
+	}
+}
+
+// retryAfter estimates the seconds needed
+// to drain the queue below the soft limit.
+func (b *Backpressure) retryAfter(depth int) int {
+	rate := b.queue.DrainRate()
+	if rate <= 0 {
+		return maxRetryAfter
+	}
+	excess := depth - b.soft + 1
+	if excess < 1 {
+		excess = 1
+	}
+	seconds := int(math.Ceil(float64(excess) / rate))
+	if seconds < minRetryAfter {
+		return minRetryAfter
+	}
+	if seconds > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return seconds
+}
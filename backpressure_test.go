@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBackpressure(t *testing.T) {
+	queue := &QueuedMailer{}
+	queue.drain.rate = 10
+	backpressure := NewBackpressure(queue, 100, 200)
+	handler := backpressure.Func(func(rw http.ResponseWriter, req *http.Request) {})
+
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("POST", "/", nil))
+		return rec
+	}
+
+	if rec := serve(); rec.Code != http.StatusOK {
+		t.Errorf("Empty queue should accept, got %d", rec.Code)
+	}
+
+	queue.pending = 149
+	rec := serve()
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "5" {
+		t.Errorf("Expected 429 retry after 5s, got %d %s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	queue.pending = 200
+	if rec := serve(); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	NDJSONMIMEType = "application/x-ndjson"
+
+	// Longest accepted line of the batch stream
+	maxBatchLine = 10 * 1024 * 1024
+)
+
+type batchResult struct {
+	Line   int
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+// BatchStreamFunc accepts newline delimited JSON
+// mails and answers each line as soon as it is
+// queued, so the batch is never held in memory.
+func BatchStreamFunc(m Mailer) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		rw.Header().Set("Content-Type", NDJSONMIMEType)
+		flusher, _ := rw.(http.Flusher)
+		encoder := json.NewEncoder(rw)
+
+		scanner := bufio.NewScanner(req.Body)
+		scanner.Buffer(make([]byte, 64*1024), maxBatchLine)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+
+			result := batchResult{Line: line, Status: "queued"}
+			if err := sendLine(m, scanner.Bytes(), req.Header.Get(TokenHeader)); err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+			}
+			encoder.Encode(result)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Errorf("Batch stream broken at line %d: %s", line+1, err)
+			encoder.Encode(batchResult{Line: line + 1, Status: "error", Error: err.Error()})
+		}
+	}
+}
+
+func sendLine(m Mailer, line []byte, token string) error {
+	mail := mailStruct{}
+	if err := json.Unmarshal(line, &mail); err != nil {
+		return err
+	}
+	mail.Token = token
+	if err := mail.Validate(); err != nil {
+		return err
+	}
+	return m.SendMail(&mail)
+}
+
+// BulkPath takes the single mail
+// personalized per recipient.
+const BulkPath = "/v1/mail/bulk"
+
+// BulkRecipient overrides the shared
+// Data of the bulk mail by its own.
+type BulkRecipient struct {
+	Recipient string
+	Data      map[string]interface{}
+}
+
+type bulkStruct struct {
+	mailStruct
+	Recipients []BulkRecipient
+}
+
+type bulkResult struct {
+	Recipient string
+	Status    string
+	Error     string `json:",omitempty"`
+}
+
+// BulkFunc sends the mail to every recipient
+// rendered with the merged Data, one by one,
+// so each of them is validated, counted to
+// the quota and unsubscribed on its own.
+// The mail is bulk priority unless it says.
+func BulkFunc(m Mailer) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		bulk := bulkStruct{}
+		if err := json.NewDecoder(req.Body).Decode(&bulk); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(bulk.Priority) == 0 {
+			bulk.Priority = PriorityBulk
+		}
+		bulk.Token = req.Header.Get(TokenHeader)
+
+		results := make([]bulkResult, 0, len(bulk.Recipients))
+		for _, recipient := range bulk.Recipients {
+			result := bulkResult{Recipient: recipient.Recipient, Status: "queued"}
+			if err := sendBulk(m, &bulk.mailStruct, recipient); err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+			}
+			results = append(results, result)
+		}
+		log.Infof("Bulk mail %q sent to %d recipients", bulk.Subject, len(results))
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(results)
+	}
+}
+
+func sendBulk(m Mailer, shared *mailStruct, recipient BulkRecipient) error {
+	mail := *shared
+	mail.Recipient = recipient.Recipient
+	if len(recipient.Data) > 0 {
+		mail.Data = make(map[string]interface{}, len(shared.Data)+len(recipient.Data))
+		for key, value := range shared.Data {
+			mail.Data[key] = value
+		}
+		for key, value := range recipient.Data {
+			mail.Data[key] = value
+		}
+	}
+	// The keys of the shared mail
+	// must not drop the other copies
+	if len(mail.ID) > 0 {
+		mail.ID += ":" + mail.Recipient
+	}
+	if len(mail.IdempotencyKey) > 0 {
+		mail.IdempotencyKey += ":" + mail.Recipient
+	}
+	if err := mail.Validate(); err != nil {
+		return err
+	}
+	return m.SendMail(&mail)
+}
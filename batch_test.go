@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchStream(t *testing.T) {
+	mailer := &FakeMailer{}
+	body := strings.Join([]string{
+		`{"Recipient":"radek@suricata.com","Subject":"Hello"}`,
+		`{"Recipient":"radek"}`,
+		``,
+		`{broken`,
+		`{"Recipient":"info@suricata.com"}`,
+	}, "\n")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/mail/batch-stream", strings.NewReader(body))
+	BatchStreamFunc(mailer)(rec, req)
+
+	results := []batchResult{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		result := batchResult{}
+		json.Unmarshal(scanner.Bytes(), &result)
+		results = append(results, result)
+	}
+
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+	expected := []string{"queued", "error", "error", "queued"}
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Errorf("Line %d expected %s, got %+v", result.Line, expected[i], result)
+		}
+	}
+	if len(mailer.sent) != 2 {
+		t.Errorf("Expected 2 mails sent, got %d", len(mailer.sent))
+	}
+}
+
+func TestBulk(t *testing.T) {
+	mailer := &FakeMailer{}
+	body := `{
+		"Subject": "Hello {{.Name}}",
+		"Message": "Your code is {{.Code}}",
+		"Data": {"Code": "1234"},
+		"IdempotencyKey": "welcome",
+		"Recipients": [
+			{"Recipient": "radek@suricata.com", "Data": {"Name": "Radek"}},
+			{"Recipient": "radek"},
+			{"Recipient": "info@suricata.com", "Data": {"Name": "Info", "Code": "5678"}}
+		]
+	}`
+
+	rec := httptest.NewRecorder()
+	BulkFunc(mailer)(rec, httptest.NewRequest("POST", BulkPath, strings.NewReader(body)))
+
+	results := []bulkResult{}
+	json.NewDecoder(rec.Body).Decode(&results)
+	expected := []string{"queued", "error", "queued"}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected result per recipient, got %v", results)
+	}
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Errorf("Recipient %s expected %s, got %+v", result.Recipient, expected[i], result)
+		}
+	}
+
+	if len(mailer.sent) != 2 {
+		t.Fatalf("Expected 2 mails sent, got %d", len(mailer.sent))
+	}
+	last := mailer.sent[1]
+	if last.Data["Name"] != "Info" || last.Data["Code"] != "5678" || last.Priority != PriorityBulk {
+		t.Errorf("Recipient data should override the shared, got %+v", last)
+	}
+	if mailer.sent[0].Data["Code"] != "1234" || mailer.sent[0].IdempotencyKey == last.IdempotencyKey {
+		t.Errorf("Each recipient should get own copy, got %+v", mailer.sent[0])
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// blobBucket keeps the attachment data by
+	// its SHA-256, blobRefBucket the count of
+	// the stored mail referencing it
+	blobBucket    = []byte("blobs")
+	blobRefBucket = []byte("blobrefs")
+)
+
+// putBlobs moves the data of the attachments
+// to the blobs, so the attachment sent to many
+// recipients is kept once. The returned copy
+// of the mail has the digests instead.
+func putBlobs(tx *bolt.Tx, mail *mailStruct, keyring *Keyring) (*mailStruct, error) {
+	m := *mail
+	m.Attachments = append([]Attachment{}, mail.Attachments...)
+	m.blobs = nil
+	for i, attachment := range m.Attachments {
+		if len(attachment.Data) == 0 {
+			m.blobs = append(m.blobs, "")
+			continue
+		}
+		sum := sha256.Sum256(attachment.Data)
+		digest := hex.EncodeToString(sum[:])
+		if tx.Bucket(blobBucket).Get([]byte(digest)) == nil {
+			value, err := keyring.Seal(attachment.Data)
+			if err != nil {
+				return nil, err
+			}
+			if err := tx.Bucket(blobBucket).Put([]byte(digest), value); err != nil {
+				return nil, err
+			}
+		}
+		if err := addBlobRef(tx, digest, 1); err != nil {
+			return nil, err
+		}
+		m.blobs = append(m.blobs, digest)
+		m.Attachments[i].Data = nil
+	}
+	return &m, nil
+}
+
+// loadBlobs fills the data of the
+// attachments kept in the blobs.
+func loadBlobs(tx *bolt.Tx, m *mailStruct, keyring *Keyring) error {
+	for i, digest := range m.blobs {
+		if len(digest) == 0 || i >= len(m.Attachments) {
+			continue
+		}
+		data, err := keyring.Open(tx.Bucket(blobBucket).Get([]byte(digest)))
+		if err != nil {
+			return err
+		}
+		m.Attachments[i].Data = append([]byte{}, data...)
+	}
+	return nil
+}
+
+// releaseBlobs drops the references of the
+// stored mail, the blob no mail references
+// anymore is removed.
+func releaseBlobs(tx *bolt.Tx, m *mailStruct) error {
+	for _, digest := range m.blobs {
+		if len(digest) == 0 {
+			continue
+		}
+		if err := addBlobRef(tx, digest, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addBlobRef(tx *bolt.Tx, digest string, delta int64) error {
+	refs := tx.Bucket(blobRefBucket)
+	count := int64(0)
+	if value := refs.Get([]byte(digest)); len(value) == 8 {
+		count = int64(binary.BigEndian.Uint64(value))
+	}
+	count += delta
+	if count > 0 {
+		return refs.Put([]byte(digest), boltKey(uint64(count)))
+	}
+	if err := refs.Delete([]byte(digest)); err != nil {
+		return err
+	}
+	return tx.Bucket(blobBucket).Delete([]byte(digest))
+}
+
+// collectBlobs counts the references of the
+// stored mail anew and removes the blobs
+// none of it references, e.g. left by the
+// store of the older version.
+func collectBlobs(db *bolt.DB, keyring *Keyring) error {
+	collected := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		counts := map[string]uint64{}
+		err := tx.Bucket(boltQueueBucket).ForEach(func(key, value []byte) error {
+			m, err := decodeStored(value, keyring)
+			if err != nil {
+				return err
+			}
+			for _, digest := range m.blobs {
+				if len(digest) > 0 {
+					counts[digest]++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		orphans := [][]byte{}
+		tx.Bucket(blobBucket).ForEach(func(digest, value []byte) error {
+			if counts[string(digest)] == 0 {
+				orphans = append(orphans, append([]byte{}, digest...))
+			}
+			return nil
+		})
+		for _, digest := range orphans {
+			if err := tx.Bucket(blobBucket).Delete(digest); err != nil {
+				return err
+			}
+			if err := tx.Bucket(blobRefBucket).Delete(digest); err != nil {
+				return err
+			}
+		}
+		for digest, count := range counts {
+			if err := tx.Bucket(blobRefBucket).Put([]byte(digest), boltKey(count)); err != nil {
+				return err
+			}
+		}
+		collected = len(orphans)
+		return nil
+	})
+	if collected > 0 {
+		log.Infof("Collected %d unreferenced attachment blobs", collected)
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func countBlobs(store *BoltQueue) (blobs, refs int) {
+	store.db.View(func(tx *bolt.Tx) error {
+		blobs = tx.Bucket(blobBucket).Stats().KeyN
+		tx.Bucket(blobRefBucket).ForEach(func(key, value []byte) error {
+			refs += int(value[7])
+			return nil
+		})
+		return nil
+	})
+	return blobs, refs
+}
+
+func TestBoltQueueBlobs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+	store, err := NewBoltQueue(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := Attachment{Filename: "report.pdf", Data: bytes.Repeat([]byte("PDF"), 1000)}
+	first, _ := store.Put(&mailStruct{ID: "1", Attachments: []Attachment{report}})
+	second, _ := store.Put(&mailStruct{ID: "2", Attachments: []Attachment{{Filename: "logo.png", URL: "https://example.com/logo.png"}, report}})
+	if blobs, refs := countBlobs(store); blobs != 1 || refs != 2 {
+		t.Fatalf("Same attachment should be kept once, got %d blobs of %d refs", blobs, refs)
+	}
+	store.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(boltQueueBucket).Get(boltKey(first)); bytes.Contains(value, []byte("UERGUERG")) {
+			t.Errorf("Attachment data should not be stored with the mail: %s", value)
+		}
+		return nil
+	})
+
+	pending, _ := store.Pending()
+	if len(pending) != 2 || !bytes.Equal(pending[1].Attachments[1].Data, report.Data) || len(pending[1].Attachments[0].Data) != 0 {
+		t.Fatalf("Stored mail should get its attachments back, got %+v", pending)
+	}
+	pending[1].notBefore = time.Now().Add(time.Hour)
+	store.Delay(&pending[1])
+	if blobs, refs := countBlobs(store); blobs != 1 || refs != 2 {
+		t.Errorf("Delayed mail should keep its reference, got %d blobs of %d refs", blobs, refs)
+	}
+
+	store.Delete(first)
+	if blobs, refs := countBlobs(store); blobs != 1 || refs != 1 {
+		t.Errorf("Blob should stay while referenced, got %d blobs of %d refs", blobs, refs)
+	}
+	store.Delete(second)
+	if blobs, _ := countBlobs(store); blobs != 0 {
+		t.Errorf("Unreferenced blob should be removed, got %d", blobs)
+	}
+
+	// Orphan left behind is collected on open
+	store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(blobBucket).Put([]byte("orphan"), []byte("data"))
+	})
+	store.Close()
+	if store, err = NewBoltQueue(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if blobs, _ := countBlobs(store); blobs != 0 {
+		t.Errorf("Orphan blob should be collected, got %d", blobs)
+	}
+}
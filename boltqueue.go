@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+var boltQueueBucket = []byte("queue")
+
+// BoltQueue keeps the accepted mail on the disk
+// until it is sent, so the mail queued at the
+// crash or restart is not lost. Every write is
+// synced before the mail is acknowledged. The
+// mail is sealed by the keyring, the nil one
+// keeps it plain. The attachments are kept
+// once in the blobs by their content.
+type BoltQueue struct {
+	db      *bolt.DB
+	keyring *Keyring
+}
+
+func NewBoltQueue(path string, keyring *Keyring) (*BoltQueue, error) {
+	db, err := openBolt(path, "queue", queueMigrations, keyring, boltQueueBucket, blobBucket)
+	if err != nil {
+		return nil, err
+	}
+	if err := collectBlobs(db, keyring); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltQueue{db, keyring}, nil
+}
+
+// put stores the mail under the key
+// with its attachments in the blobs.
+func (b *BoltQueue) put(tx *bolt.Tx, key uint64, mail *mailStruct) error {
+	stored, err := putBlobs(tx, mail, b.keyring)
+	if err != nil {
+		return err
+	}
+	value, err := encodeStored(stored, b.keyring)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltQueueBucket).Put(boltKey(key), value)
+}
+
+// release removes the mail of the key
+// with its references to the blobs.
+func (b *BoltQueue) release(tx *bolt.Tx, key uint64) error {
+	bucket := tx.Bucket(boltQueueBucket)
+	value := bucket.Get(boltKey(key))
+	if value == nil {
+		return nil
+	}
+	m, err := decodeStored(value, b.keyring)
+	if err != nil {
+		return err
+	}
+	if err := releaseBlobs(tx, &m); err != nil {
+		return err
+	}
+	return bucket.Delete(boltKey(key))
+}
+
+// Put stores the mail under the
+// next key in the order accepted.
+func (b *BoltQueue) Put(mail *mailStruct) (uint64, error) {
+	var key uint64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if key, err = tx.Bucket(boltQueueBucket).NextSequence(); err != nil {
+			return err
+		}
+		return b.put(tx, key, mail)
+	})
+	return key, err
+}
+
+// Delay keeps the mail put off
+// under its key until it is due.
+func (b *BoltQueue) Delay(mail *mailStruct) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := b.release(tx, mail.queueKey); err != nil {
+			return err
+		}
+		return b.put(tx, mail.queueKey, mail)
+	})
+}
+
+func (b *BoltQueue) Delete(key uint64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return b.release(tx, key)
+	})
+}
+
+// Pending returns the stored mail oldest
+// first with their keys set, also the
+// delayed mail not due yet.
+func (b *BoltQueue) Pending() ([]mailStruct, error) {
+	pending := []mailStruct{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltQueueBucket).ForEach(func(key, value []byte) error {
+			m, err := decodeStored(value, b.keyring)
+			if err != nil {
+				return err
+			}
+			if err := loadBlobs(tx, &m, b.keyring); err != nil {
+				return err
+			}
+			m.queueKey = binary.BigEndian.Uint64(key)
+			pending = append(pending, m)
+			return nil
+		})
+	})
+	return pending, err
+}
+
+func (b *BoltQueue) Close() {
+	b.db.Close()
+}
+
+// boltKey sorts in the
+// order of the sequence.
+func boltKey(key uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, key)
+	return buf
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltQueueResumes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+
+	store, err := NewBoltQueue(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, _ := store.Put(&mailStruct{ID: "1"})
+	store.Put(&mailStruct{ID: "2", Data: map[string]interface{}{"Name": "Radek"}})
+	store.Delete(sent)
+	store.Close()
+
+	if store, err = NewBoltQueue(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, nil, 1, 0)
+	defer queue.Close()
+	if err := queue.Persist(store); err != nil {
+		t.Fatal(err)
+	}
+	queue.SendMail(&mailStruct{ID: "3"})
+	for i := 0; i < 100 && (fake.count() < 2 || queue.Depth() > 0); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if fake.count() != 2 {
+		t.Fatalf("Stored and new mail should be sent, sent %v", fake.sent)
+	}
+	if pending, _ := store.Pending(); len(pending) != 0 {
+		t.Errorf("Sent mail should be removed from the store, left %v", pending)
+	}
+}
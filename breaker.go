@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/mailgun-go"
+)
+
+// States of the circuit breaker.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+var ErrCircuitOpen = fmt.Errorf("compositemailer: Provider circuit is open")
+
+// CircuitBreaker opens after the consecutive
+// failures of the provider, so it is not called
+// while it is down. After the cooldown, or once
+// the health check passes, the single trial
+// call closes it again or keeps it open.
+type CircuitBreaker struct {
+	mutex    sync.Mutex
+	failures int
+	cooldown time.Duration
+	state    string
+	failed   int
+	opened   time.Time
+	trips    uint64
+}
+
+func NewCircuitBreaker(failures int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		failures: failures,
+		cooldown: cooldown,
+		state:    CircuitClosed,
+	}
+}
+
+// Allow tells whether the provider can be
+// called, the first call after the cooldown
+// is let through as the trial.
+func (b *CircuitBreaker) Allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if now.Sub(b.opened) < b.cooldown {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		// The trial call is in flight
+		return false
+	}
+	return true
+}
+
+// Record closes the circuit after the success
+// and opens it after the failures in a row or
+// the failed trial. It reports whether the
+// circuit changed its state.
+func (b *CircuitBreaker) Record(err error, now time.Time) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err == nil || !tripsBreaker(err) {
+		b.failed = 0
+		changed := b.state != CircuitClosed
+		b.state = CircuitClosed
+		return changed
+	}
+	b.failed++
+	if b.state == CircuitHalfOpen || (b.state == CircuitClosed && b.failed >= b.failures) {
+		b.state = CircuitOpen
+		b.opened = now
+		b.trips++
+		return true
+	}
+	return false
+}
+
+// Probed lets the next call through as the
+// trial once the health check passes,
+// without waiting for the cooldown.
+func (b *CircuitBreaker) Probed() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == CircuitOpen {
+		b.opened = time.Time{}
+	}
+}
+
+// Open tells whether the calls are
+// rejected until the cooldown passes.
+func (b *CircuitBreaker) Open(now time.Time) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state == CircuitOpen && now.Sub(b.opened) < b.cooldown
+}
+
+// State returns the state and the number
+// of times the circuit opened.
+func (b *CircuitBreaker) State() (string, uint64) {
+	if b == nil {
+		return "", 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state, b.trips
+}
+
+// tripsBreaker counts the failures of the
+// provider, not the mail rejected or
+// put off by it.
+func tripsBreaker(err error) bool {
+	if _, ok := err.(*RetryError); ok {
+		return false
+	}
+	if response, ok := err.(*mailgun.UnexpectedResponseError); ok {
+		return response.Actual == http.StatusTooManyRequests || response.Actual >= 500
+	}
+	return true
+}
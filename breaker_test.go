@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(2, time.Minute)
+	now := time.Now()
+	down := fmt.Errorf("provider down")
+
+	breaker.Record(down, now)
+	if !breaker.Allow(now) {
+		t.Error("Single failure should not open the circuit")
+	}
+	if !breaker.Record(down, now) || breaker.Allow(now.Add(time.Second)) {
+		t.Error("Failures in a row should open the circuit")
+	}
+
+	later := now.Add(time.Minute)
+	if !breaker.Allow(later) || breaker.Allow(later) {
+		t.Error("Single trial should be let through after the cooldown")
+	}
+	breaker.Record(down, later)
+	if state, trips := breaker.State(); state != CircuitOpen || trips != 2 {
+		t.Errorf("Failed trial should open the circuit again, got %s after %d trips", state, trips)
+	}
+
+	breaker.Probed()
+	if !breaker.Allow(later) {
+		t.Error("Passed health check should let the trial through")
+	}
+	breaker.Record(nil, later)
+	if state, _ := breaker.State(); state != CircuitClosed {
+		t.Errorf("Successful trial should close the circuit, got %s", state)
+	}
+}
+
+func TestCompositeMailerBreaker(t *testing.T) {
+	broken := &FakeMailer{err: fmt.Errorf("provider down")}
+	working := &FakeMailer{}
+
+	composite := NewCompositeMailer(0)
+	composite.Add("broken", broken)
+	composite.Add("working", working)
+	composite.SetBreaker(2, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		composite.SendMail(&mailStruct{})
+	}
+	if errors := composite.Errors(); errors["broken"] != 2 || len(working.sent) != 3 {
+		t.Errorf("Open circuit should stop calling the provider, got %v errors", errors)
+	}
+	if status := composite.Status(); status[0].Circuit != CircuitOpen || status[1].Circuit != CircuitClosed {
+		t.Errorf("Bad status %+v", status)
+	}
+}
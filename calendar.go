@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+)
+
+const (
+	// CalendarFilename of the invitation for
+	// the providers taking no MIME parts
+	CalendarFilename = "invite.ics"
+
+	// DefaultCalendarMethod asks the
+	// recipient to accept the meeting
+	DefaultCalendarMethod = "REQUEST"
+)
+
+// calendarMethod returns the METHOD of the
+// iCalendar object, which must match the
+// method of its content type.
+func calendarMethod(ics string) string {
+	scanner := bufio.NewScanner(strings.NewReader(ics))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(strings.ToUpper(line), "METHOD:") {
+			return strings.ToUpper(strings.TrimSpace(line[len("METHOD:"):]))
+		}
+	}
+	return DefaultCalendarMethod
+}
+
+func calendarContentType(ics string) string {
+	return "text/calendar; charset=UTF-8; method=" + calendarMethod(ics)
+}
+
+// calendarAttachment is the invitation of the
+// mail as the file, ok is false without one.
+func calendarAttachment(m *mailStruct) (Attachment, bool) {
+	if len(m.Calendar) == 0 {
+		return Attachment{}, false
+	}
+	return Attachment{
+		Filename:    CalendarFilename,
+		ContentType: calendarContentType(m.Calendar),
+		Data:        []byte(m.Calendar),
+	}, true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrBadCaller     = fmt.Errorf("callermailer: Caller must be name:token or name:token:scope|scope")
+	ErrUnknownCaller = fmt.Errorf("callermailer: Caller token is not known")
+
+	callerConfig = &CallerConfig{}
+)
+
+// CallerConfig lists the sending services as
+// name:token, the token comes in the TokenHeader
+// over HTTP and in the Token over NATS. Without
+// the callers every mail is of the DefaultCaller.
+// The scopes of name:token:scope|scope grant the
+// templates whose policy requires them.
+type CallerConfig struct {
+	Tokens []string
+}
+
+func init() {
+	RegisterConfig("caller", callerConfig)
+}
+
+// CallerAccount is the sending
+// service known by its token.
+type CallerAccount struct {
+	Name   string
+	token  string
+	scopes []string
+}
+
+// ParseCallers reads the accounts of the
+// name:token and name:token:scope|scope entries.
+func ParseCallers(entries []string) ([]*CallerAccount, error) {
+	callers := make([]*CallerAccount, 0, len(entries))
+	for _, entry := range entries {
+		fields := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(fields) < 2 || len(fields[0]) == 0 || len(fields[1]) == 0 {
+			return nil, ErrBadCaller
+		}
+		caller := &CallerAccount{Name: fields[0], token: fields[1]}
+		if len(fields) == 3 {
+			for _, scope := range strings.Split(fields[2], "|") {
+				if len(scope) == 0 {
+					return nil, ErrBadCaller
+				}
+				caller.scopes = append(caller.scopes, scope)
+			}
+		}
+		callers = append(callers, caller)
+	}
+	return callers, nil
+}
+
+// callerAllows tells whether the named
+// caller was granted the scope.
+func callerAllows(callers []*CallerAccount, name, scope string) bool {
+	for _, caller := range callers {
+		if caller.Name != name {
+			continue
+		}
+		for _, granted := range caller.scopes {
+			if granted == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authenticateCaller returns the
+// caller of the token, or nil.
+func authenticateCaller(callers []*CallerAccount, token string) *CallerAccount {
+	for _, caller := range callers {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(caller.token)) == 1 {
+			return caller
+		}
+	}
+	return nil
+}
+
+// callerTokens lists the
+// tokens for the log scrubber.
+func callerTokens(callers []*CallerAccount) []string {
+	tokens := make([]string, 0, len(callers))
+	for _, caller := range callers {
+		tokens = append(tokens, caller.token)
+	}
+	return tokens
+}
+
+// CallerMailer sets the Caller of the mail by its
+// Token, so the quota and the templates of other
+// service cannot be used by naming it. The Token
+// is not passed on.
+type CallerMailer struct {
+	mailer  Mailer
+	callers []*CallerAccount
+}
+
+func NewCallerMailer(mailer Mailer, callers []*CallerAccount) *CallerMailer {
+	return &CallerMailer{mailer, callers}
+}
+
+func (cm *CallerMailer) SendMail(mail *mailStruct) error {
+	m := *mail
+	m.Token = ""
+	m.Caller = ""
+	if len(cm.callers) > 0 {
+		caller := authenticateCaller(cm.callers, mail.Token)
+		if caller == nil {
+			log.Warnf("Rejecting mail of unknown caller for %s", mail.Recipient)
+			return ErrUnknownCaller
+		}
+		m.Caller = caller.Name
+	}
+	return cm.mailer.SendMail(&m)
+}
+
+func (cm *CallerMailer) Close() {
+	cm.mailer.Close()
+}
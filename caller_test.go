@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCallerMailer(t *testing.T) {
+	callers, err := ParseCallers([]string{"billing:secret", "chat:other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeMailer{}
+	mailer := NewCallerMailer(fake, callers)
+
+	if err := mailer.SendMail(&mailStruct{Caller: "chat", Token: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.sent[0].Caller != "billing" || len(fake.sent[0].Token) > 0 {
+		t.Errorf("Caller should be set by its token, got %q", fake.sent[0].Caller)
+	}
+	if err := mailer.SendMail(&mailStruct{Caller: "billing", Token: "guess"}); err != ErrUnknownCaller || len(fake.sent) != 1 {
+		t.Errorf("Unknown token should be rejected, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"Recipient":"radek@example.com","Caller":"billing","Token":"secret"}`))
+	HttpMailerFunc(mailer)(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Token in the body should not authenticate, got %d", rec.Code)
+	}
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"Recipient":"radek@example.com"}`))
+	req.Header.Set(TokenHeader, "other")
+	HttpMailerFunc(mailer)(httptest.NewRecorder(), req)
+	if len(fake.sent) != 2 || fake.sent[1].Caller != "chat" {
+		t.Errorf("Caller should be authenticated by the header, got %v", fake.sent)
+	}
+
+	anonymous := NewCallerMailer(fake, nil)
+	anonymous.SendMail(&mailStruct{Caller: "billing"})
+	if fake.sent[2].Caller != "" {
+		t.Errorf("Caller should not be trusted without the callers, got %q", fake.sent[2].Caller)
+	}
+
+	if _, err := ParseCallers([]string{"billing"}); err != ErrBadCaller {
+		t.Errorf("Expected ErrBadCaller, got %v", err)
+	}
+	if _, err := ParseCallers([]string{"billing:secret:"}); err != ErrBadCaller {
+		t.Errorf("Empty scope should be refused, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// EmailChannel is the channel
+// of the configured mail providers.
+const EmailChannel = "email"
+
+var ErrUnknownChannel = fmt.Errorf("channelmailer: Requested channel not enabled")
+
+// ChannelError keeps the failure of every
+// channel failed for the mail, so the
+// retry can tell them and resend only to
+// the failed channels.
+type ChannelError struct {
+	Failed map[string]error
+}
+
+// Channels returns the names
+// of the failed channels.
+func (e *ChannelError) Channels() []string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *ChannelError) Error() string {
+	failed := []string{}
+	for _, name := range e.Channels() {
+		failed = append(failed, fmt.Sprintf("%s: %s", name, e.Failed[name]))
+	}
+	return fmt.Sprintf("channelmailer: %s", strings.Join(failed, ", "))
+}
+
+// ChannelMailer delivers the message to every
+// channel listed in its Channels. The mail
+// without channels goes to the first working
+// channel preferred by the recipient for its
+// urgency, or only by email. The critical mail
+// of the recipient without preferences escalates
+// through the configured policy.
+type ChannelMailer struct {
+	channels      map[string]Mailer
+	preferences   PreferenceStore
+	escalation    []string
+	escalateAfter time.Duration
+}
+
+func NewChannelMailer(email Mailer) *ChannelMailer {
+	return &ChannelMailer{
+		channels: map[string]Mailer{EmailChannel: email},
+	}
+}
+
+func (cm *ChannelMailer) Add(name string, channel Mailer) {
+	cm.channels[name] = channel
+}
+
+func (cm *ChannelMailer) SetPreferences(store PreferenceStore) {
+	cm.preferences = store
+}
+
+func (cm *ChannelMailer) SendMail(mail *mailStruct) error {
+	names := mail.Channels
+	if len(names) == 0 {
+		if preferred := preferredChannels(cm.preferences, mail); len(preferred) > 0 {
+			return cm.sendPreferred(mail, preferred)
+		}
+		if mail.Urgency == UrgencyCritical && len(cm.escalation) > 0 {
+			return cm.escalate(mail)
+		}
+		names = []string{EmailChannel}
+	}
+
+	for _, name := range names {
+		if _, ok := cm.channels[name]; !ok {
+			return ErrUnknownChannel
+		}
+	}
+
+	if len(names) == 1 {
+		// The error of the only channel
+		// is returned as it is
+		return cm.channels[names[0]].SendMail(mail)
+	}
+
+	failed := map[string]error{}
+	for _, name := range names {
+		if err := cm.channels[name].SendMail(mail); err != nil {
+			log.Errorf("Channel %s failed for %s: %s", name, mail.Recipient, err)
+			failed[name] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &ChannelError{failed}
+	}
+	return nil
+}
+
+// sendPreferred falls back to the next
+// preferred channel when one fails.
+func (cm *ChannelMailer) sendPreferred(mail *mailStruct, names []string) error {
+	err := ErrUnknownChannel
+	for _, name := range names {
+		channel, ok := cm.channels[name]
+		if !ok {
+			log.Warnf("Preferred channel %s of %s not enabled", name, mail.Recipient)
+			continue
+		}
+		if err = channel.SendMail(mail); err == nil {
+			return nil
+		}
+		log.Errorf("Preferred channel %s failed for %s: %s", name, mail.Recipient, err)
+	}
+	return err
+}
+
+func (cm *ChannelMailer) Close() {
+	for _, channel := range cm.channels {
+		channel.Close()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go"
+)
+
+func TestChannelMailer(t *testing.T) {
+	email := &FakeMailer{}
+	slack := &FakeMailer{}
+
+	channels := NewChannelMailer(email)
+	channels.Add("slack", slack)
+
+	channels.SendMail(&mailStruct{})
+	if len(email.sent) != 1 || len(slack.sent) != 0 {
+		t.Error("Mail without channels should go only by email")
+	}
+
+	channels.SendMail(&mailStruct{Channels: []string{"email", "slack"}})
+	if len(email.sent) != 2 || len(slack.sent) != 1 {
+		t.Error("Mail should fan out to all channels")
+	}
+
+	if channels.SendMail(&mailStruct{Channels: []string{"sms"}}) != ErrUnknownChannel {
+		t.Error("Disabled channel should be rejected")
+	}
+
+	slack.err = fmt.Errorf("webhook gone")
+	if channels.SendMail(&mailStruct{Channels: []string{"email", "slack"}}) == nil {
+		t.Error("Failed channel should be reported")
+	}
+	if len(email.sent) != 3 {
+		t.Error("Failed channel should not stop the others")
+	}
+}
+
+func TestChannelMailerRetry(t *testing.T) {
+	greylisted := &textproto.Error{Code: 451, Msg: "Greylisted"}
+	email := &failingMailer{errors: []error{greylisted}}
+	slack := &failingMailer{errors: []error{&mailgun.UnexpectedResponseError{Actual: 503}}}
+
+	channels := NewChannelMailer(email)
+	channels.Add("slack", slack)
+	if err := channels.SendMail(&mailStruct{}); err != greylisted {
+		t.Errorf("Error of the only channel should be kept, got %v", err)
+	}
+
+	mailer := NewRetryMailer(channels, &RetryConfig{Attempts: 3, Initial: 2 * time.Millisecond, Max: 4 * time.Millisecond})
+	queue := NewQueuedMailer(mailer, nil, 1, 0)
+	defer queue.Close()
+	if err := queue.SendMail(&mailStruct{Channels: []string{"email", "slack"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && slack.count() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if slack.count() != 1 || email.count() != 1 {
+		t.Errorf("Only the failed channel should be retried, sent %d by email and %d by slack", email.count(), slack.count())
+	}
+
+	slack.errors = []error{fmt.Errorf("webhook gone")}
+	err := mailer.SendMail(&mailStruct{Channels: []string{"email", "slack"}})
+	if failure, ok := err.(*ChannelError); !ok || len(failure.Channels()) != 1 || failure.Channels()[0] != "slack" {
+		t.Errorf("Permanent channel failure should be returned, got %v", err)
+	}
+}
+
+// FakePreferenceStore returns
+// the same preferences for everyone.
+type FakePreferenceStore struct {
+	prefs Preferences
+}
+
+func (fs *FakePreferenceStore) Preferences(recipient string) (Preferences, error) {
+	return fs.prefs, nil
+}
+
+func TestChannelMailerPreferences(t *testing.T) {
+	email := &FakeMailer{}
+	sms := &FakeMailer{err: fmt.Errorf("twilio down")}
+	push := &FakeMailer{}
+
+	channels := NewChannelMailer(email)
+	channels.Add("sms", sms)
+	channels.Add("push", push)
+	channels.SetPreferences(&FakePreferenceStore{Preferences{
+		UrgencyCritical: {"sms", "push", "email"},
+	}})
+
+	if err := channels.SendMail(&mailStruct{Urgency: UrgencyCritical}); err != nil {
+		t.Fatal(err)
+	}
+	if len(push.sent) != 1 || len(email.sent) != 0 {
+		t.Error("Critical mail should fall back from sms to push only")
+	}
+
+	channels.SendMail(&mailStruct{})
+	if len(email.sent) != 1 {
+		t.Error("Mail without preference should go by email")
+	}
+}
+
+func TestChannelMailerEscalation(t *testing.T) {
+	email := &FakeMailer{delay: 50 * time.Millisecond}
+	sms := &FakeMailer{}
+	push := &FakeMailer{}
+
+	channels := NewChannelMailer(email)
+	channels.Add("sms", sms)
+	channels.Add("push", push)
+	channels.SetEscalation([]string{"email", "sms", "push"}, 10*time.Millisecond)
+
+	if err := channels.SendMail(&mailStruct{Urgency: UrgencyCritical}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sms.sent) != 1 || len(push.sent) != 0 {
+		t.Error("Critical mail should escalate to sms after email timed out")
+	}
+
+	// Slow email may still be sending
+	channels.Add(EmailChannel, &FakeMailer{})
+	channels.SendMail(&mailStruct{})
+	if len(sms.sent) != 1 {
+		t.Error("Normal mail should not escalate")
+	}
+}
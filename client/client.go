@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/nats-io/nats"
 	"github.com/sohlich/etcd_service_discovery"
@@ -14,17 +19,121 @@ import (
 
 const (
 	MailServiceType = "mail"
+	TokenHeader     = "X-AUTH"
 )
 
 var (
 	ErrMailServiceNotFound      = fmt.Errorf("mailclient: Cannot resolve service host")
 	ErrMailClientNotInitialized = fmt.Errorf("mailclient: MailClient not initialized")
+	ErrMailServiceOverloaded    = fmt.Errorf("mailclient: Mail service overloaded")
 )
 
+// RejectedError is the email refused by the
+// mail service e.g. for the bad recipient,
+// sending it again does not help. The
+// StatusCode is zero over NATS.
+type RejectedError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RejectedError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("mailclient: Mail rejected: %s", e.Message)
+	}
+	return fmt.Sprintf("mailclient: Mail rejected with %d: %s", e.StatusCode, e.Message)
+}
+
+// Attachment of the email, the Data
+// are sent base64 encoded in JSON.
+// Instead of the Data the URL can be
+// set and the service downloads it.
+// ContentID makes it an inline image
+// referenced as cid:ContentID from Html.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	URL         string
+	ContentID   string
+}
+
 type Email struct {
 	Recipient string
 	Subject   string
 	Message   string
+	// Html alternative, Message is
+	// kept as the text fallback
+	Html string
+	// Markdown rendered to the styled Html
+	// by the service, and the Message if
+	// it is empty
+	Markdown    string
+	Attachments []Attachment
+	// Calendar invitation in the iCalendar
+	// format, shown as the actionable invite
+	Calendar string
+	// Channels to deliver to e.g. email,
+	// slack, sms, push, webhook, empty
+	// sends only email
+	Channels []string
+	// Phone of the recipient for sms
+	Phone string
+	// Devices of the recipient for push
+	DeviceTokens []string
+	// URL of the recipient for webhook
+	WebhookURL string
+	// Urgency low, normal or critical picks
+	// the channels preferred by the recipient
+	Urgency string
+	// Provider forces the mail service backend
+	// e.g. "mailgun", empty uses the configured chain
+	Provider string
+	// ReplyTo address for replies when
+	// it differs from the sender
+	ReplyTo string
+	// Headers added to the message, the
+	// service allows only configured names
+	Headers map[string]string
+	// Tags of the email type e.g. welcome,
+	// reset, for the provider analytics
+	Tags []string
+	// Variables returned in the delivery
+	// webhooks e.g. user and request ID
+	Variables map[string]string
+	// DeliveryTime defers the email,
+	// zero sends it right away
+	DeliveryTime time.Time
+	// Priority high e.g. for password
+	// reset, normal or bulk
+	Priority string
+	// IdempotencyKey lets the service drop
+	// the email sent twice e.g. on retry
+	IdempotencyKey string
+	// Template of the service rendered from
+	// the Data instead of Subject and Message,
+	// without it they are rendered themselves
+	// e.g. Subject "Hello {{.Name}}"
+	Template string
+	Data     map[string]interface{}
+	// Tracking toggles of the provider "on"
+	// or "off", empty keeps the default
+	Tracking       string
+	TrackingOpens  string
+	TrackingClicks string
+	// Caller is set by the mail service
+	// from the Token of the client
+	Caller string
+	// Token of the client, sent in the
+	// TokenHeader over HTTP
+	Token string `json:"-"`
+	// ID cancels the email within the hold
+	// window by DELETE /v1/mail/{ID}
+	ID string
+	// ExpiresAt drops the email not sent
+	// by then e.g. the 2FA code, zero
+	// never expires
+	ExpiresAt time.Time
 }
 
 type MailClient interface {
@@ -32,6 +141,15 @@ type MailClient interface {
 	SendMail(recipient, subject, message string) error
 }
 
+// EmailClient sends the whole Email, both
+// clients implement it. It is kept apart
+// from the MailClient, so its existing
+// implementations still satisfy it.
+type EmailClient interface {
+	MailClient
+	SendEmail(email *Email) error
+}
+
 type MessageComposer interface {
 	ComposeSubject(data interface{}) string
 	ComposeMessage(data interface{}) string
@@ -61,20 +179,72 @@ func NewMailComposer(sbjTmp, msgTmp *template.Template) *SuricataMessageComposer
 	}
 }
 
+// MultipartMessageComposer composes
+// also the HTML alternative of the message.
+type MultipartMessageComposer struct {
+	*SuricataMessageComposer
+	HtmlTemplate *htmltemplate.Template
+}
+
+func (mc *MultipartMessageComposer) ComposeHtml(data interface{}) string {
+	var html bytes.Buffer
+	mc.HtmlTemplate.Execute(&html, data)
+	return html.String()
+}
+
+// ComposeEmail fills the subject, the text
+// and the HTML of the email for the recipient.
+func (mc *MultipartMessageComposer) ComposeEmail(recipient string, data interface{}) *Email {
+	return &Email{
+		Recipient: recipient,
+		Subject:   mc.ComposeSubject(data),
+		Message:   mc.ComposeMessage(data),
+		Html:      mc.ComposeHtml(data),
+	}
+}
+
+func NewMultipartMailComposer(sbjTmp, msgTmp *template.Template, htmlTmp *htmltemplate.Template) *MultipartMessageComposer {
+	return &MultipartMessageComposer{
+		NewMailComposer(sbjTmp, msgTmp),
+		htmlTmp,
+	}
+}
+
 // REST Client
 const (
 	HttpMIMEBodyType = "application/json"
+
+	// Longest wait for the overloaded service
+	MaxRetryAfter = time.Minute
+
+	// Longest error message read
+	// from the rejected response
+	maxRejectionSize = 1024
 )
 
+// sleep waits for the overloaded service,
+// replaced in the tests
+var sleep = time.Sleep
+
 type SuricataMailClient struct {
 	discoveryClient discovery.RegistryClient
+	// MaxRetries of the send rejected
+	// by the overloaded service
+	MaxRetries int
+	// Weights of the instances, the first
+	// resolved instance is used if nil
+	Weights WeightSource
+	// Token the service knows
+	// the sending service by
+	Token string
 }
 
 func NewSuricataMailClient(disc discovery.RegistryClient) *SuricataMailClient {
 	// subjectTemp, _ := template.New("subject").Parse("Suricata: Registration confirmation")
 	// messageTemp, _ := template.New("message").Parse("Please confirm the registration on Suricata Talk website with click on this link {{.ConfirmationLink}}")
 	return &SuricataMailClient{
-		disc,
+		discoveryClient: disc,
+		MaxRetries:      3,
 	}
 }
 
@@ -97,6 +267,14 @@ func (client *SuricataMailClient) IsConnected() (bool, error) {
 }
 
 func (client *SuricataMailClient) SendMail(recipient, subject, message string) error {
+	return client.SendEmail(&Email{
+		Recipient: recipient,
+		Subject:   subject,
+		Message:   message,
+	})
+}
+
+func (client *SuricataMailClient) SendEmail(eMsg *Email) error {
 
 	// Resolve service discovery
 	serviceURL, err := client.resolveUrl()
@@ -104,27 +282,65 @@ func (client *SuricataMailClient) SendMail(recipient, subject, message string) e
 		return err
 	}
 
-	//Compose email
-	eMsg := Email{
-		Recipient: recipient,
-		Subject:   subject,
-		Message:   message,
-	}
-
 	// Serialize
 	out, jsonError := json.Marshal(eMsg)
 	if jsonError != nil {
-		return err
+		return jsonError
+	}
+
+	// Send to mail microservice, waiting
+	// as told while it is overloaded
+	for attempt := 0; ; attempt++ {
+		req, reqErr := http.NewRequest("POST", serviceURL, strings.NewReader(string(out)))
+		if reqErr != nil {
+			return reqErr
+		}
+		req.Header.Set("Content-Type", HttpMIMEBodyType)
+		if len(client.Token) > 0 {
+			req.Header.Set(TokenHeader, client.Token)
+		}
+		resp, postErr := http.DefaultClient.Do(req)
+		if postErr != nil {
+			return postErr
+		}
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			resp.Body.Close()
+			return nil
+		case resp.StatusCode != http.StatusTooManyRequests &&
+			resp.StatusCode != http.StatusServiceUnavailable:
+			return rejected(resp)
+		}
+		resp.Body.Close()
+		if attempt >= client.MaxRetries {
+			return ErrMailServiceOverloaded
+		}
+		sleep(retryAfter(resp))
 	}
-	jsonReader := strings.NewReader(string(out))
+}
 
-	// Send to mail microservice
-	_, postErr := http.Post(serviceURL, HttpMIMEBodyType, jsonReader)
-	if postErr != nil {
-		return postErr
+// rejected reads the error
+// message of the response.
+func rejected(resp *http.Response) error {
+	defer resp.Body.Close()
+	message, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRejectionSize))
+	if err != nil {
+		return err
 	}
+	return &RejectedError{resp.StatusCode, strings.TrimSpace(string(message))}
+}
 
-	return nil
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		return time.Second
+	}
+	wait := time.Duration(seconds) * time.Second
+	if wait > MaxRetryAfter {
+		return MaxRetryAfter
+	}
+	return wait
 }
 
 func (client *SuricataMailClient) resolveUrl() (string, error) {
@@ -136,13 +352,34 @@ func (client *SuricataMailClient) resolveUrl() (string, error) {
 	if len(mailURL) == 0 {
 		return "", ErrMailServiceNotFound
 	}
-	return fmt.Sprintf("http://%s", mailURL[0]), nil
+	if client.Weights == nil {
+		return fmt.Sprintf("http://%s", mailURL[0]), nil
+	}
+
+	weights, err := client.Weights.Weights()
+	if err != nil {
+		// Any instance is better than none
+		weights = nil
+	}
+	return fmt.Sprintf("http://%s", pickWeighted(mailURL, weights)), nil
 }
 
 // NATS Client
+const (
+	// DefaultRequestTimeout of the
+	// service accepting the email
+	DefaultRequestTimeout = 5 * time.Second
+)
+
 type NatsMailClient struct {
 	conn        *nats.Conn
 	encodedConn *nats.EncodedConn
+	// Timeout of the reply of the service,
+	// the email may still be sent after it
+	Timeout time.Duration
+	// Token the service knows
+	// the sending service by
+	Token string
 }
 
 func NewNatsMailClient(url string) (*NatsMailClient, error) {
@@ -158,8 +395,9 @@ func NewNatsMailClient(url string) (*NatsMailClient, error) {
 	// defer conn.Close() TODO on close client
 
 	return &NatsMailClient{
-		nc,
-		conn,
+		conn:        nc,
+		encodedConn: conn,
+		Timeout:     DefaultRequestTimeout,
 	}, nil
 }
 
@@ -175,6 +413,21 @@ func (client *NatsMailClient) SendMail(recipient, subject, message string) error
 		Subject:   subject,
 		Message:   message,
 	}
-	err := client.encodedConn.Publish(MailServiceType, eMsg)
-	return err
+	return client.SendEmail(eMsg)
+}
+
+// SendEmail waits for the service to accept
+// the email, it replies with the error
+// message or empty one.
+func (client *NatsMailClient) SendEmail(eMsg *Email) error {
+	email := *eMsg
+	email.Token = client.Token
+	result := ""
+	if err := client.encodedConn.Request(MailServiceType, &email, &result, client.Timeout); err != nil {
+		return err
+	}
+	if len(result) > 0 {
+		return &RejectedError{Message: result}
+	}
+	return nil
 }
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"text/template"
 	"time"
@@ -48,12 +50,25 @@ func TestNatsClient(t *testing.T) {
 		timeout <- true
 	}()
 
-	conn.Subscribe(MailServiceType, func(mail *Email) {
+	conn.Subscribe(MailServiceType, func(subject, reply string, mail *Email) {
+		if len(mail.Recipient) == 0 {
+			conn.Publish(reply, "mail: Recipient is missing")
+			return
+		}
 		testChan <- mail
+		conn.Publish(reply, "")
 	})
 
-	client := NewNatsMailClient()
-	client.SendMail("radek", "Hello", "Test")
+	client, err := NewNatsMailClient(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendMail("radek", "Hello", "Test"); err != nil {
+		t.Errorf("Accepted mail should not fail, got %s", err)
+	}
+	if _, ok := client.SendMail("", "Hello", "Test").(*RejectedError); !ok {
+		t.Error("Rejected mail should fail")
+	}
 
 	select {
 	case <-timeout:
@@ -107,3 +122,91 @@ func TestRestClient(t *testing.T) {
 		return
 	}
 }
+
+// hostRegistry resolves the
+// mail service to the host.
+type hostRegistry struct {
+	host string
+}
+
+func (hr *hostRegistry) Register() error {
+	return nil
+}
+
+func (hr *hostRegistry) ServicesByName(name string) ([]string, error) {
+	return []string{hr.host}, nil
+}
+
+func (hr *hostRegistry) Unregister() error {
+	return nil
+}
+
+func TestRestClientStatus(t *testing.T) {
+	statuses := []int{}
+	tokens := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		tokens = append(tokens, req.Header.Get(TokenHeader))
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == http.StatusServiceUnavailable {
+			rw.Header().Set("Retry-After", "2")
+		}
+		if status >= 300 {
+			http.Error(rw, "mail: Recipient is missing", status)
+			return
+		}
+		rw.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	waits := []time.Duration{}
+	sleep = func(wait time.Duration) { waits = append(waits, wait) }
+	defer func() { sleep = time.Sleep }()
+
+	mailClient := NewSuricataMailClient(&hostRegistry{strings.TrimPrefix(server.URL, "http://")})
+	mailClient.Token = "secret"
+	statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusAccepted}
+	if err := mailClient.SendMail("radek@example.com", "Subj", "Message"); err != nil {
+		t.Fatalf("Mail should be sent once the service recovers, got %s", err)
+	}
+	if len(tokens) != 3 || tokens[2] != "secret" {
+		t.Errorf("Token should be sent with every attempt, got %v", tokens)
+	}
+	if len(waits) != 2 || waits[0] != 2*time.Second || waits[1] != time.Second {
+		t.Errorf("Expected to wait as told and a second without Retry-After, waited %v", waits)
+	}
+
+	statuses = []int{http.StatusBadRequest}
+	err := mailClient.SendMail("", "Subj", "Message")
+	if rejection, ok := err.(*RejectedError); !ok || rejection.StatusCode != http.StatusBadRequest || rejection.Message != "mail: Recipient is missing" {
+		t.Errorf("Rejected mail should fail with the reason, got %v", err)
+	}
+
+	statuses = []int{http.StatusInternalServerError}
+	if _, ok := mailClient.SendMail("radek@example.com", "Subj", "Message").(*RejectedError); !ok {
+		t.Error("Failed mail should not pass")
+	}
+
+	mailClient.MaxRetries = 1
+	statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+	if err := mailClient.SendMail("radek@example.com", "Subj", "Message"); err != ErrMailServiceOverloaded {
+		t.Errorf("Expected ErrMailServiceOverloaded, got %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for header, expected := range map[string]time.Duration{
+		"":                              time.Second,
+		"0":                             time.Second,
+		"soon":                          time.Second,
+		"Wed, 21 Oct 2015 07:28:00 GMT": time.Second,
+		"5":                             5 * time.Second,
+		"3600":                          MaxRetryAfter,
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Retry-After", header)
+		if wait := retryAfter(resp); wait != expected {
+			t.Errorf("Retry-After %q should wait %s, got %s", header, expected, wait)
+		}
+	}
+}
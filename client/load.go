@@ -0,0 +1,108 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+const (
+	// LoadKey is the etcd directory where the
+	// mail instances report their weight
+	LoadKey = "/mail/load"
+
+	// DefaultWeight of the instance
+	// which does not report its load
+	DefaultWeight = 100
+)
+
+// WeightSource provides the weights of the mail
+// instances keyed by their registered URL,
+// the higher weight the less loaded instance.
+type WeightSource interface {
+	Weights() (map[string]int, error)
+}
+
+// EtcdWeightSource reads the weights
+// reported by the instances to etcd.
+type EtcdWeightSource struct {
+	endpoint string
+}
+
+func NewEtcdWeightSource(endpoint string) WeightSource {
+	return &EtcdWeightSource{endpoint}
+}
+
+func (s *EtcdWeightSource) Weights() (map[string]int, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/v2/keys%s", s.endpoint, LoadKey))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	weights := map[string]int{}
+	if resp.StatusCode == http.StatusNotFound {
+		return weights, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mailclient: Load weights returned %d", resp.StatusCode)
+	}
+
+	result := struct {
+		Node struct {
+			Nodes []struct {
+				Key   string
+				Value string
+			}
+		}
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	for _, node := range result.Node.Nodes {
+		instance, err := url.PathUnescape(path.Base(node.Key))
+		if err != nil {
+			continue
+		}
+		if weight, err := strconv.Atoi(node.Value); err == nil {
+			weights[instance] = weight
+		}
+	}
+	return weights, nil
+}
+
+// pickWeighted picks the instance randomly by
+// weight, so the less loaded instances get
+// more mail but the clients do not all
+// rush to the same one.
+func pickWeighted(instances []string, weights map[string]int) string {
+	total := 0
+	for _, instance := range instances {
+		total += weightOf(instance, weights)
+	}
+	if total <= 0 {
+		return instances[0]
+	}
+	n := rand.Intn(total)
+	for _, instance := range instances {
+		n -= weightOf(instance, weights)
+		if n < 0 {
+			return instance
+		}
+	}
+	return instances[0]
+}
+
+func weightOf(instance string, weights map[string]int) int {
+	if weight, ok := weights[instance]; ok {
+		if weight < 0 {
+			return 0
+		}
+		return weight
+	}
+	return DefaultWeight
+}
@@ -0,0 +1,29 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestPickWeighted(t *testing.T) {
+	instances := []string{"a:5050", "b:5050", "c:5050"}
+	weights := map[string]int{"a:5050": 300, "b:5050": 0}
+
+	picked := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		picked[pickWeighted(instances, weights)]++
+	}
+	if picked["b:5050"] != 0 {
+		t.Errorf("Instance without weight should not be picked, got %v", picked)
+	}
+	// c has the default weight 100
+	if ratio := float64(picked["a:5050"]) / float64(picked["c:5050"]); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("Instances should be picked by weight, got %v", picked)
+	}
+
+	if instance := pickWeighted(instances, map[string]int{"a:5050": -1, "b:5050": 0, "c:5050": 0}); instance != "a:5050" {
+		t.Errorf("First instance should be picked without any weight, got %s", instance)
+	}
+	if instance := pickWeighted([]string{"a:5050"}, nil); instance != "a:5050" {
+		t.Errorf("Only instance should be picked, got %s", instance)
+	}
+}
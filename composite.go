@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrNoProvider      = fmt.Errorf("compositemailer: No provider configured")
+	ErrUnknownProvider = fmt.Errorf("compositemailer: Requested provider not configured")
+	ErrProviderTimeout = fmt.Errorf("compositemailer: Provider timed out")
+)
+
+// CompositeMailer tries the providers in order
+// they were added and fails over to the next one
+// when the send fails or times out. If the providers
+// have weights, the first provider is picked randomly
+// by weight and the rest is kept for the failover.
+// Mail with the Provider set goes only through
+// that provider. Providers failing the health probe
+// are skipped until they recover. Each provider
+// can be throttled by its own rate limit and
+// skipped while its circuit breaker is open
+// or when the mail exceeds its size limit.
+type CompositeMailer struct {
+	providers []*provider
+	timeout   time.Duration
+	random    func(n int) int
+}
+
+type provider struct {
+	name    string
+	mailer  Mailer
+	weight  int
+	errors  uint64
+	healthy int32
+	limiter *TokenBucket
+	breaker *CircuitBreaker
+	maxSize int64
+	near    uint64
+	over    uint64
+}
+
+// HealthChecker is implemented by the mailers
+// which can verify the provider is usable
+// without sending any mail.
+type HealthChecker interface {
+	Check() error
+}
+
+type ProviderStatus struct {
+	Name    string
+	Healthy bool
+	Errors  uint64
+	// Circuit state and the number of times
+	// it opened, empty without the breaker
+	Circuit      string `json:",omitempty"`
+	CircuitTrips uint64 `json:",omitempty"`
+	// Messages over the size limit and
+	// over nearSizeLimit of it
+	MaxSize   int64  `json:",omitempty"`
+	Oversized uint64 `json:",omitempty"`
+	NearLimit uint64 `json:",omitempty"`
+}
+
+// nearSizeLimit is the share of the size
+// limit the message is reported above.
+const nearSizeLimit = 0.9
+
+func NewCompositeMailer(timeout time.Duration) *CompositeMailer {
+	return &CompositeMailer{
+		timeout: timeout,
+		random:  rand.Intn,
+	}
+}
+
+func (c *CompositeMailer) Add(name string, mailer Mailer) {
+	c.providers = append(c.providers, &provider{
+		name:    name,
+		mailer:  mailer,
+		healthy: 1,
+	})
+}
+
+// SetWeight sets the share of traffic
+// the named provider gets as the first choice.
+func (c *CompositeMailer) SetWeight(name string, weight int) {
+	for _, p := range c.providers {
+		if p.name == name {
+			p.weight = weight
+		}
+	}
+}
+
+// SetRate limits the named provider
+// to rate messages per second.
+func (c *CompositeMailer) SetRate(name string, rate float64) {
+	for _, p := range c.providers {
+		if p.name == name {
+			p.limiter = NewTokenBucket(rate, int(rate))
+		}
+	}
+}
+
+// SetMaxSize skips the named provider for the
+// message over size bytes once composed.
+func (c *CompositeMailer) SetMaxSize(name string, size int64) {
+	for _, p := range c.providers {
+		if p.name == name {
+			p.maxSize = size
+		}
+	}
+}
+
+// SetBreaker opens the circuit of each provider
+// after the failures in a row, it is tried
+// again after the cooldown.
+func (c *CompositeMailer) SetBreaker(failures int, cooldown time.Duration) {
+	for _, p := range c.providers {
+		p.breaker = NewCircuitBreaker(failures, cooldown)
+	}
+}
+
+func (c *CompositeMailer) SendMail(mail *mailStruct) error {
+	providers, err := c.order(mail.Provider)
+	if err != nil {
+		return err
+	}
+
+	size := c.measure(mail)
+	err = ErrNoProvider
+	for _, p := range providers {
+		if !p.fits(size) {
+			log.Warnf("Skipping provider %s for mail to %s of %d bytes, limit is %d", p.name, mail.Recipient, size, p.maxSize)
+			err = ErrMessageTooLarge
+			continue
+		}
+		if err = c.send(p, mail); err == nil {
+			return nil
+		}
+		if err == ErrCircuitOpen {
+			continue
+		}
+		count := atomic.AddUint64(&p.errors, 1)
+		log.Errorf("Provider %s failed (%d errors so far): %s", p.name, count, err)
+	}
+	return err
+}
+
+// measure composes the message and reports its
+// MIME size and structure, only if any of the
+// providers limits the size.
+func (c *CompositeMailer) measure(mail *mailStruct) int64 {
+	limited := false
+	for _, p := range c.providers {
+		limited = limited || p.maxSize > 0
+	}
+	if !limited {
+		return 0
+	}
+	message := composeMessage(mail, time.Now())
+	log.Infof("Mail to %s is %d bytes of %s", mail.Recipient, len(message), describeMessage(message))
+	return int64(len(message))
+}
+
+// fits tells whether the provider takes the
+// message of the size and counts the ones
+// over and near its limit.
+func (p *provider) fits(size int64) bool {
+	if p.maxSize <= 0 {
+		return true
+	}
+	if size > p.maxSize {
+		atomic.AddUint64(&p.over, 1)
+		return false
+	}
+	if float64(size) > nearSizeLimit*float64(p.maxSize) {
+		atomic.AddUint64(&p.near, 1)
+	}
+	return true
+}
+
+// order returns the healthy providers with
+// the closed circuit and the weighted pick
+// moved to the front.
+func (c *CompositeMailer) order(requested string) ([]*provider, error) {
+	ordered, err := c.weighted(requested)
+	if err != nil || len(requested) > 0 {
+		return ordered, err
+	}
+
+	now := time.Now()
+	healthy := make([]*provider, 0, len(ordered))
+	for _, p := range ordered {
+		if atomic.LoadInt32(&p.healthy) == 1 && !p.breaker.Open(now) {
+			healthy = append(healthy, p)
+		}
+	}
+	// Trying the unhealthy ones is still
+	// better than dropping the mail
+	if len(healthy) == 0 {
+		return ordered, nil
+	}
+	return healthy, nil
+}
+
+func (c *CompositeMailer) weighted(requested string) ([]*provider, error) {
+	if len(requested) > 0 {
+		for _, p := range c.providers {
+			if p.name == requested {
+				return []*provider{p}, nil
+			}
+		}
+		return nil, ErrUnknownProvider
+	}
+
+	total := 0
+	for _, p := range c.providers {
+		total += p.weight
+	}
+	if total <= 0 {
+		return c.providers, nil
+	}
+
+	pick := c.random(total)
+	for i, p := range c.providers {
+		if pick < p.weight {
+			ordered := make([]*provider, 0, len(c.providers))
+			ordered = append(ordered, p)
+			ordered = append(ordered, c.providers[:i]...)
+			return append(ordered, c.providers[i+1:]...), nil
+		}
+		pick -= p.weight
+	}
+	return c.providers, nil
+}
+
+// send calls the provider through its
+// circuit breaker, which records the result.
+func (c *CompositeMailer) send(p *provider, mail *mailStruct) error {
+	if !p.breaker.Allow(time.Now()) {
+		return ErrCircuitOpen
+	}
+	err := c.call(p, mail)
+	if p.breaker.Record(err, time.Now()) {
+		if state, _ := p.breaker.State(); state == CircuitOpen {
+			log.Errorf("Provider %s circuit opened: %s", p.name, err)
+		} else {
+			log.Infof("Provider %s circuit closed", p.name)
+		}
+	}
+	return err
+}
+
+// call waits for the provider rate limit,
+// calls the provider and gives up after
+// the timeout. The call itself is not cancelled,
+// so a slow provider may still deliver the mail.
+func (c *CompositeMailer) call(p *provider, mail *mailStruct) error {
+	p.limiter.Wait()
+	if c.timeout <= 0 {
+		return p.mailer.SendMail(mail)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- p.mailer.SendMail(mail)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(c.timeout):
+		return ErrProviderTimeout
+	}
+}
+
+// Probe checks the health of the providers
+// in given interval until stop is closed.
+func (c *CompositeMailer) Probe(interval time.Duration, stop <-chan struct{}) {
+	for {
+		c.probe()
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (c *CompositeMailer) probe() {
+	for _, p := range c.providers {
+		checker, ok := p.mailer.(HealthChecker)
+		if !ok {
+			continue
+		}
+		if err := checker.Check(); err != nil {
+			if atomic.SwapInt32(&p.healthy, 0) == 1 {
+				log.Errorf("Provider %s disabled, health check failed: %s", p.name, err)
+			}
+			continue
+		}
+		if atomic.SwapInt32(&p.healthy, 1) == 0 {
+			log.Infof("Provider %s recovered", p.name)
+		}
+		p.breaker.Probed()
+	}
+}
+
+func (c *CompositeMailer) Status() []ProviderStatus {
+	status := make([]ProviderStatus, 0, len(c.providers))
+	for _, p := range c.providers {
+		circuit, trips := p.breaker.State()
+		status = append(status, ProviderStatus{
+			Name:         p.name,
+			Healthy:      atomic.LoadInt32(&p.healthy) == 1,
+			Errors:       atomic.LoadUint64(&p.errors),
+			Circuit:      circuit,
+			CircuitTrips: trips,
+			MaxSize:      p.maxSize,
+			Oversized:    atomic.LoadUint64(&p.over),
+			NearLimit:    atomic.LoadUint64(&p.near),
+		})
+	}
+	return status
+}
+
+// Errors returns the number of failed
+// sends per provider name.
+func (c *CompositeMailer) Errors() map[string]uint64 {
+	errors := make(map[string]uint64, len(c.providers))
+	for _, p := range c.providers {
+		errors[p.name] = atomic.LoadUint64(&p.errors)
+	}
+	return errors
+}
+
+func (c *CompositeMailer) Close() {
+	for _, p := range c.providers {
+		p.mailer.Close()
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FakeMailer records the mails
+// and fails with configured error.
+type FakeMailer struct {
+	sent  []mailStruct
+	err   error
+	delay time.Duration
+}
+
+func (fm *FakeMailer) SendMail(mail *mailStruct) error {
+	time.Sleep(fm.delay)
+	if fm.err != nil {
+		return fm.err
+	}
+	fm.sent = append(fm.sent, *mail)
+	return nil
+}
+
+func (fm *FakeMailer) Close() {}
+
+func TestCompositeMailerFailover(t *testing.T) {
+	broken := &FakeMailer{err: fmt.Errorf("provider down")}
+	slow := &FakeMailer{delay: time.Second}
+	working := &FakeMailer{}
+
+	composite := NewCompositeMailer(100 * time.Millisecond)
+	composite.Add("broken", broken)
+	composite.Add("slow", slow)
+	composite.Add("working", working)
+
+	if err := composite.SendMail(&mailStruct{Recipient: "radek"}); err != nil {
+		t.Error(err)
+	}
+
+	if len(working.sent) != 1 {
+		t.Error("Mail should be sent by the last provider")
+	}
+
+	errors := composite.Errors()
+	if errors["broken"] != 1 || errors["slow"] != 1 || errors["working"] != 0 {
+		t.Errorf("Bad error counts %v", errors)
+	}
+}
+
+func TestCompositeMailerAllFailed(t *testing.T) {
+	composite := NewCompositeMailer(0)
+	if composite.SendMail(&mailStruct{}) != ErrNoProvider {
+		t.Error("Empty composite should fail")
+	}
+
+	composite.Add("broken", &FakeMailer{err: fmt.Errorf("provider down")})
+	if err := composite.SendMail(&mailStruct{}); err == nil || err.Error() != "provider down" {
+		t.Errorf("Last provider error expected, got %v", err)
+	}
+}
+
+func TestCompositeMailerWeights(t *testing.T) {
+	mailgun := &FakeMailer{}
+	ses := &FakeMailer{}
+
+	composite := NewCompositeMailer(0)
+	composite.Add("mailgun", mailgun)
+	composite.Add("ses", ses)
+	composite.SetWeight("mailgun", 80)
+	composite.SetWeight("ses", 20)
+
+	for pick := 0; pick < 100; pick++ {
+		composite.random = func(n int) int { return pick }
+		composite.SendMail(&mailStruct{})
+	}
+
+	if len(mailgun.sent) != 80 || len(ses.sent) != 20 {
+		t.Errorf("Bad distribution mailgun: %d ses: %d", len(mailgun.sent), len(ses.sent))
+	}
+
+	// Failover still reaches the other provider
+	ses.err = fmt.Errorf("provider down")
+	composite.random = func(n int) int { return 99 }
+	composite.SendMail(&mailStruct{})
+	if len(mailgun.sent) != 81 {
+		t.Error("Failed weighted pick should fail over")
+	}
+}
+
+func TestCompositeMailerRequestedProvider(t *testing.T) {
+	mailgun := &FakeMailer{}
+	ses := &FakeMailer{}
+
+	composite := NewCompositeMailer(0)
+	composite.Add("mailgun", mailgun)
+	composite.Add("ses", ses)
+
+	composite.SendMail(&mailStruct{Provider: "ses"})
+	if len(ses.sent) != 1 || len(mailgun.sent) != 0 {
+		t.Error("Mail should go through requested provider")
+	}
+
+	if composite.SendMail(&mailStruct{Provider: "smtp"}) != ErrUnknownProvider {
+		t.Error("Unknown provider should be rejected")
+	}
+}
+
+// FakeCheckedMailer fails
+// the health check with err.
+type FakeCheckedMailer struct {
+	FakeMailer
+	checkErr error
+}
+
+func (fm *FakeCheckedMailer) Check() error {
+	return fm.checkErr
+}
+
+func TestCompositeMailerHealth(t *testing.T) {
+	down := &FakeCheckedMailer{checkErr: fmt.Errorf("domain not verified")}
+	working := &FakeMailer{}
+
+	composite := NewCompositeMailer(0)
+	composite.Add("down", down)
+	composite.Add("working", working)
+	composite.probe()
+
+	composite.SendMail(&mailStruct{})
+	if len(down.sent) != 0 || len(working.sent) != 1 {
+		t.Error("Unhealthy provider should be skipped")
+	}
+
+	status := composite.Status()
+	if status[0].Healthy || !status[1].Healthy {
+		t.Errorf("Bad status %+v", status)
+	}
+
+	down.checkErr = nil
+	composite.probe()
+	composite.SendMail(&mailStruct{})
+	if len(down.sent) != 1 {
+		t.Error("Recovered provider should be used again")
+	}
+}
+
+func TestCompositeMailerMaxSize(t *testing.T) {
+	small := &FakeMailer{}
+	large := &FakeMailer{}
+
+	composite := NewCompositeMailer(0)
+	composite.Add("small", small)
+	composite.Add("large", large)
+	composite.SetMaxSize("small", 1000)
+	composite.SetMaxSize("large", 2000)
+
+	mail := &mailStruct{Recipient: "radek@suricata.com", Message: strings.Repeat("x", 1200)}
+	if err := composite.SendMail(mail); err != nil || len(small.sent) != 0 || len(large.sent) != 1 {
+		t.Errorf("Mail over the limit should fail over, got %v", err)
+	}
+	mail.Message = strings.Repeat("x", 3000)
+	if err := composite.SendMail(mail); err != ErrMessageTooLarge {
+		t.Errorf("Mail over all the limits should be rejected, got %v", err)
+	}
+
+	status := composite.Status()
+	if status[0].Oversized != 2 || status[1].Oversized != 1 || status[1].NearLimit != 0 {
+		t.Errorf("Bad status %+v", status)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// CredentialsKey is the etcd directory with
+// the overrides of the env config, keyed by
+// the env var name e.g. MAIL_APIKEY.
+const CredentialsKey = "/mail/credentials"
+
+// ReloadableMailer rebuilds the named provider
+// from the current configuration on Reload, so
+// the credentials can rotate without restart.
+type ReloadableMailer struct {
+	name   string
+	mutex  sync.RWMutex
+	mailer Mailer
+}
+
+func NewReloadableMailer(name string) (*ReloadableMailer, error) {
+	mailer, err := newProvider(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadableMailer{
+		name:   name,
+		mailer: mailer,
+	}, nil
+}
+
+func (r *ReloadableMailer) current() Mailer {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.mailer
+}
+
+func (r *ReloadableMailer) SendMail(mail *mailStruct) error {
+	return r.current().SendMail(mail)
+}
+
+func (r *ReloadableMailer) Check() error {
+	if checker, ok := r.current().(HealthChecker); ok {
+		return checker.Check()
+	}
+	return nil
+}
+
+// Reload swaps in the new provider, the old
+// one is closed and the sends in progress
+// finish with the old credentials.
+func (r *ReloadableMailer) Reload() error {
+	mailer, err := newProvider(r.name)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	old := r.mailer
+	r.mailer = mailer
+	r.mutex.Unlock()
+	old.Close()
+	return nil
+}
+
+func (r *ReloadableMailer) Close() {
+	r.current().Close()
+}
+
+// WatchCredentials polls etcd for the config
+// overrides and reloads the providers once
+// they change, until stop is closed.
+func WatchCredentials(endpoint string, interval time.Duration, stop <-chan struct{}) {
+	last := ""
+	for {
+		values, err := loadEtcdDir(endpoint, CredentialsKey)
+		if err != nil {
+			log.Errorf("Cannot load credentials: %s", err)
+		} else if current := fingerprint(values); current != last {
+			last = current
+			applyCredentials(values)
+		}
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func applyCredentials(values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+	for key, value := range values {
+		os.Setenv(key, value)
+	}
+
+	if err := envconfig.Process("mail", appConfig); err != nil {
+		log.Errorf("Cannot reload config: %s", err)
+		return
+	}
+	for prefix, component := range componentConfigs {
+		if err := envconfig.Process(prefix, component); err != nil {
+			log.Errorf("Cannot reload %s config: %s", prefix, err)
+			return
+		}
+	}
+	if err := applyProfile(appConfig, smtpConfig); err != nil {
+		log.Errorf("Cannot apply profile: %s", err)
+		return
+	}
+	scrubber.AddSecrets(configSecrets(appConfig)...)
+
+	for _, provider := range reloadableProviders {
+		if err := provider.Reload(); err != nil {
+			log.Errorf("Cannot reload provider %s: %s", provider.name, err)
+			continue
+		}
+		log.Infof("Provider %s reloaded with new credentials", provider.name)
+	}
+}
+
+// fingerprint identifies the set of values,
+// so the unchanged set is not applied again.
+func fingerprint(values map[string]string) string {
+	pairs := make([]string, 0, len(values))
+	for key, value := range values {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\n")
+}
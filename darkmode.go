@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// darkModeHead declares the mail supports both
+// color schemes, so the clients do not invert
+// its colors on their own.
+const darkModeHead = `<meta name="color-scheme" content="light dark">
+<meta name="supported-color-schemes" content="light dark">
+<style>:root{color-scheme:light dark;supported-color-schemes:light dark;}</style>
+`
+
+// DarkModeMailer declares the dark mode
+// support in the head of the Html, the
+// document declaring it already is kept.
+type DarkModeMailer struct {
+	mailer Mailer
+}
+
+func NewDarkModeMailer(mailer Mailer) Mailer {
+	return &DarkModeMailer{mailer}
+}
+
+func (dm *DarkModeMailer) SendMail(mail *mailStruct) error {
+	if len(mail.Html) == 0 {
+		return dm.mailer.SendMail(mail)
+	}
+	m := *mail
+	m.Html = injectDarkMode(m.Html)
+	return dm.mailer.SendMail(&m)
+}
+
+func (dm *DarkModeMailer) Close() {
+	dm.mailer.Close()
+}
+
+// injectDarkMode adds the darkModeHead at the
+// start of the head, the head is added
+// if the document has none.
+func injectDarkMode(doc string) string {
+	if scheme, _ := darkModeSupport(doc); scheme {
+		return doc
+	}
+	lower := strings.ToLower(doc)
+	if end := tagEnd(lower, "head"); end >= 0 {
+		return doc[:end] + darkModeHead + doc[end:]
+	}
+	if end := tagEnd(lower, "html"); end >= 0 {
+		return doc[:end] + "<head>" + darkModeHead + "</head>" + doc[end:]
+	}
+	return darkModeHead + doc
+}
+
+// tagEnd returns the offset after the
+// first start tag of the name, or -1.
+func tagEnd(lower, name string) int {
+	offset := 0
+	for {
+		start := strings.Index(lower[offset:], "<"+name)
+		if start < 0 {
+			return -1
+		}
+		start += offset + len(name) + 1
+		end := strings.Index(lower[start:], ">")
+		if end < 0 {
+			return -1
+		}
+		// Skip e.g. the header for the head
+		if next := lower[start]; next == '>' || next == '/' || next == ' ' || next == '\t' || next == '\n' || next == '\r' {
+			return start + end + 1
+		}
+		offset = start
+	}
+}
+
+// darkModeSupport tells whether the document
+// declares the color schemes by the meta and
+// whether it styles the dark mode itself.
+func darkModeSupport(doc string) (scheme bool, styled bool) {
+	inStyle := false
+	tokenizer := html.NewTokenizer(strings.NewReader(doc))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			inStyle = token.Data == "style"
+			if token.Data != "meta" {
+				continue
+			}
+			name := ""
+			for _, attr := range token.Attr {
+				if attr.Key == "name" {
+					name = strings.ToLower(attr.Val)
+				}
+			}
+			if name == "color-scheme" || name == "supported-color-schemes" {
+				scheme = true
+			}
+		case html.EndTagToken:
+			inStyle = false
+		case html.TextToken:
+			if inStyle && strings.Contains(strings.Replace(string(tokenizer.Text()), " ", "", -1), "prefers-color-scheme:dark") {
+				styled = true
+			}
+		}
+	}
+}
+
+// lintDarkMode checks the hard-coded white
+// backgrounds the document does not restyle
+// for the dark mode and the PNG images which
+// may be transparent with dark content, both
+// unreadable once the client darkens the mail.
+func lintDarkMode(doc string) []LintIssue {
+	issues := []LintIssue{}
+	report := func(rule, format string, args ...interface{}) {
+		issues = append(issues, LintIssue{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	_, styled := darkModeSupport(doc)
+	tokenizer := html.NewTokenizer(strings.NewReader(doc))
+	for {
+		kind := tokenizer.Next()
+		if kind == html.ErrorToken {
+			break
+		}
+		if kind != html.StartTagToken && kind != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		attrs := map[string]string{}
+		for _, attr := range token.Attr {
+			attrs[attr.Key] = attr.Val
+		}
+		style := parseStyle(attrs["style"])
+
+		background := style["background-color"]
+		if len(background) == 0 {
+			background = style["background"]
+		}
+		if len(background) == 0 {
+			background = strings.ToLower(attrs["bgcolor"])
+		}
+		if color, ok := parseColor(background); ok && color == namedColors["white"] && !styled {
+			report("dark-mode-background", "%s has hard-coded white background without the prefers-color-scheme: dark style", token.Data)
+		}
+
+		if token.Data == "img" && isPng(attrs["src"]) && len(style["background-color"]) == 0 {
+			report("dark-mode-image", "img %q may be transparent with dark content, set its background-color or use the dark variant", attrs["src"])
+		}
+	}
+	return issues
+}
+
+func isPng(src string) bool {
+	if i := strings.IndexAny(src, "?#"); i >= 0 {
+		src = src[:i]
+	}
+	return strings.EqualFold(path.Ext(src), ".png")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintDarkMode(t *testing.T) {
+	doc := `<html lang="en"><body bgcolor="#FFFFFF">
+<div style="background: #fff">Hello</div>
+<img src="https://example.com/logo.PNG?v=2" alt="Logo">
+<img src="banner.png" alt="" style="background-color:#ffffff">
+<img src="photo.jpg" alt="">
+</body></html>`
+	rules := map[string]int{}
+	for _, issue := range lintDarkMode(doc) {
+		rules[issue.Rule]++
+	}
+	if rules["dark-mode-background"] != 3 || rules["dark-mode-image"] != 1 {
+		t.Errorf("Unexpected issues %v", rules)
+	}
+
+	styled := `<html><head><style>@media (prefers-color-scheme : dark) { body { background:#000 } }</style></head><body style="background-color:white"></body></html>`
+	if issues := lintDarkMode(styled); len(issues) != 0 {
+		t.Errorf("Background restyled for the dark mode should pass, got %+v", issues)
+	}
+
+	html, err := renderMarkdown("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issues := lintDarkMode(html); len(issues) != 0 {
+		t.Errorf("Markdown layout should be dark mode safe, got %+v", issues)
+	}
+}
+
+func TestInjectDarkMode(t *testing.T) {
+	injected := injectDarkMode(`<html><header></header><HEAD lang="en"><title>Hi</title></HEAD></html>`)
+	if !strings.Contains(injected, `<HEAD lang="en"><meta name="color-scheme"`) {
+		t.Errorf("Meta should open the head %s", injected)
+	}
+	if again := injectDarkMode(injected); again != injected {
+		t.Errorf("Declared support should be kept %s", again)
+	}
+	if injected := injectDarkMode(`<html lang="en"><body></body></html>`); !strings.HasPrefix(injected, `<html lang="en"><head><meta`) {
+		t.Errorf("Missing head should be added %s", injected)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// DeadLetterPath lists the dead letters, its ID
+// re-drives one by POST or purges it by DELETE.
+const DeadLetterPath = "/v1/deadletters/"
+
+// Reasons the mail ended up as the dead
+// letter, the operator filters them by.
+const (
+	ReasonValidation  = "validation"
+	ReasonSuppression = "suppression"
+	ReasonPermanent   = "provider-permanent"
+	ReasonExhausted   = "retries-exhausted"
+	ReasonExpired     = "expired"
+)
+
+var (
+	ErrNoDeadLetter = fmt.Errorf("deadletter: No such dead letter")
+
+	deadLetterConfig = &DeadLetterConfig{}
+
+	deadLetterBucket = []byte("deadletters")
+)
+
+// DeadLetterConfig points to the BoltDB file
+// the mail given up by the retries is kept
+// in, empty only logs the failure.
+type DeadLetterConfig struct {
+	Path string
+}
+
+func init() {
+	RegisterConfig("deadletter", deadLetterConfig)
+}
+
+// DeadLetter is the failed mail
+// as listed to the operator.
+type DeadLetter struct {
+	ID        uint64
+	Recipient string
+	Subject   string
+	Reason    string
+	Error     string
+	Attempts  int
+	Failed    time.Time
+}
+
+// deadLetter is the failed mail as kept
+// by the store, its whole payload is
+// shown to the operator by its ID.
+type deadLetter struct {
+	Mail     mailStruct
+	Reason   string
+	Error    string
+	Attempts int
+	Failed   time.Time
+}
+
+// failureReason tells the validation error of
+// the mail and the refusal of the recipient by
+// the provider from the other permanent failures.
+func failureReason(err error) string {
+	if channels, ok := err.(*ChannelError); ok && len(channels.Failed) > 0 {
+		for _, failure := range channels.Failed {
+			err = failure
+			break
+		}
+	}
+	switch err {
+	case ErrBadSender, ErrSenderNotAllowed, ErrHeaderNotAllowed, ErrBadHeader, ErrAttachmentTooLarge,
+		ErrMissingPhone, ErrMissingDeviceTokens, ErrMissingWebhookURL:
+		return ReasonValidation
+	}
+	if status := errorStatus(err); status == http.StatusBadRequest || status == http.StatusRequestEntityTooLarge {
+		return ReasonValidation
+	}
+	// The enhanced status 5.7.x is the
+	// recipient refusing the sender
+	if reply, ok := err.(*textproto.Error); ok && strings.HasPrefix(reply.Msg, "5.7.") {
+		return ReasonSuppression
+	}
+	return ReasonPermanent
+}
+
+// DeadLetterStore keeps the mail that
+// failed for good until the operator
+// re-drives or purges it. The mail is sealed
+// by the keyring, the nil one keeps it plain.
+type DeadLetterStore struct {
+	db      *bolt.DB
+	keyring *Keyring
+}
+
+func NewDeadLetterStore(path string, keyring *Keyring) (*DeadLetterStore, error) {
+	db, err := openBolt(path, "deadletters", deadLetterMigrations, keyring, deadLetterBucket)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterStore{db, keyring}, nil
+}
+
+func (d *DeadLetterStore) decode(value []byte, letter *deadLetter) error {
+	value, err := d.keyring.Open(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(value, letter)
+}
+
+func (d *DeadLetterStore) Add(mail *mailStruct, reason string, failure error, attempts int, now time.Time) error {
+	value, err := json.Marshal(deadLetter{*mail, reason, failure.Error(), attempts, now})
+	if err != nil {
+		return err
+	}
+	if value, err = d.keyring.Seal(value); err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deadLetterBucket)
+		key, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		return bucket.Put(boltKey(key), value)
+	})
+}
+
+// List returns the dead letters of the reason,
+// all for empty one, in the order they failed.
+func (d *DeadLetterStore) List(reason string) ([]DeadLetter, error) {
+	list := []DeadLetter{}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLetterBucket).ForEach(func(key, value []byte) error {
+			letter := deadLetter{}
+			if err := d.decode(value, &letter); err != nil {
+				return err
+			}
+			if len(reason) > 0 && letter.Reason != reason {
+				return nil
+			}
+			list = append(list, DeadLetter{
+				ID:        binary.BigEndian.Uint64(key),
+				Recipient: letter.Mail.Recipient,
+				Subject:   letter.Mail.Subject,
+				Reason:    letter.Reason,
+				Error:     letter.Error,
+				Attempts:  letter.Attempts,
+				Failed:    letter.Failed,
+			})
+			return nil
+		})
+	})
+	return list, err
+}
+
+// Get returns the dead letter with its mail.
+func (d *DeadLetterStore) Get(id uint64) (*deadLetter, error) {
+	letter := deadLetter{}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(deadLetterBucket).Get(boltKey(id))
+		if value == nil {
+			return ErrNoDeadLetter
+		}
+		return d.decode(value, &letter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// Take removes the dead letter
+// and returns it with its mail.
+func (d *DeadLetterStore) Take(id uint64) (*deadLetter, error) {
+	letter := deadLetter{}
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deadLetterBucket)
+		value := bucket.Get(boltKey(id))
+		if value == nil {
+			return ErrNoDeadLetter
+		}
+		if err := d.decode(value, &letter); err != nil {
+			return err
+		}
+		return bucket.Delete(boltKey(id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// Purge removes all the dead letters, the
+// bucket and its sequence stay so that
+// the IDs are never given out again.
+func (d *DeadLetterStore) Purge() error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(deadLetterBucket).Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.First() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *DeadLetterStore) Close() {
+	d.db.Close()
+}
+
+// DeadLetterFunc lists the dead letters to GET of
+// DeadLetterPath, of the reason given by the query,
+// and shows the one with the ID with its mail. It
+// re-drives the one by POST through the mailer
+// and purges it by DELETE.
+// DELETE of DeadLetterPath itself purges them all.
+// Only the admin of the deadletters scope is let
+// in, the changes go to the audit.
+func DeadLetterFunc(store *DeadLetterStore, mailer Mailer, admins []*TemplateAccount, audit *AdminAudit) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		admin := authorizeAdmin(rw, req, admins, ScopeDeadLetters)
+		if admin == nil {
+			return
+		}
+		path := strings.TrimPrefix(req.URL.Path, DeadLetterPath)
+		if req.Method == "GET" && len(path) == 0 {
+			list, err := store.List(req.URL.Query().Get("reason"))
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(list)
+			return
+		}
+		if req.Method == "DELETE" && len(path) == 0 {
+			if err := store.Purge(); err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Infof("Dead letters purged by %s", admin.Name)
+			audit.Record(admin.Name, "purged", "*", "")
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if req.Method != "GET" && req.Method != "POST" && req.Method != "DELETE" {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := strconv.ParseUint(path, 10, 64)
+		if err != nil {
+			http.NotFound(rw, req)
+			return
+		}
+		var letter *deadLetter
+		if req.Method == "GET" {
+			letter, err = store.Get(id)
+		} else {
+			letter, err = store.Take(id)
+		}
+		switch err {
+		case nil:
+		case ErrNoDeadLetter:
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		default:
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if req.Method == "GET" {
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(letter)
+			return
+		}
+		if req.Method == "DELETE" {
+			log.Infof("Dead letter %d purged by %s", id, admin.Name)
+			audit.Record(admin.Name, "purged", path, "")
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		mail := &letter.Mail
+		if err := mailer.SendMail(mail); err != nil {
+			// Keep it for the next try
+			store.Add(mail, letter.Reason, err, letter.Attempts, time.Now())
+			http.Error(rw, err.Error(), errorStatus(err))
+			return
+		}
+		log.Infof("Dead letter %d to %s re-driven by %s", id, mail.Recipient, admin.Name)
+		audit.Record(admin.Name, "re-driven", path, "")
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
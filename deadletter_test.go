@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go"
+)
+
+func TestDeadLetters(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "deadletter")
+	defer os.RemoveAll(dir)
+	store, err := NewDeadLetterStore(filepath.Join(dir, "deadletter.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outage := &mailgun.UnexpectedResponseError{Actual: 503}
+	failing := &failingMailer{errors: []error{outage, outage}}
+	retry := NewRetryMailer(failing, &RetryConfig{Attempts: 1, Initial: time.Millisecond, Max: time.Millisecond})
+	retry.deadLetters = store
+	defer retry.Close()
+	m := &mailStruct{Recipient: "radek@example.com", Subject: "Hello"}
+	if _, ok := retry.SendMail(m).(*RetryError); !ok {
+		t.Fatal("Transient failure should be put off")
+	}
+	m.attempts = 1
+	retry.SendMail(m)
+
+	fake := &FakeMailer{}
+	admins, _ := ParseTemplateAccounts([]string{"ops:admin:deadletters", "support:help:approve"})
+	audit := NewAdminAudit(filepath.Join(dir, "audit.jsonl"))
+	deadLetters := DeadLetterFunc(store, fake, admins, audit)
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		req.Header.Set("Authorization", "Bearer admin")
+		deadLetters(rw, req)
+	}
+	for token, code := range map[string]int{"": http.StatusUnauthorized, "help": http.StatusForbidden} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", DeadLetterPath+"1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		deadLetters(rw, req)
+		if rw.Code != code || len(fake.sent) != 0 {
+			t.Errorf("Dead letter should be re-driven by the admin only, got %d", rw.Code)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", DeadLetterPath, nil))
+	list := []DeadLetter{}
+	json.NewDecoder(rw.Body).Decode(&list)
+	if len(list) != 1 || list[0].Recipient != "radek@example.com" || list[0].Attempts != 2 || list[0].Reason != ReasonExhausted {
+		t.Fatalf("Mail given up should be dead letter, got %+v", list)
+	}
+	store.Add(&mailStruct{Recipient: "bad"}, ReasonValidation, ErrBadSender, 1, time.Now())
+	rw = httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", DeadLetterPath+"?reason=validation", nil))
+	list = []DeadLetter{}
+	json.NewDecoder(rw.Body).Decode(&list)
+	if len(list) != 1 || list[0].ID != 2 {
+		t.Fatalf("Dead letters should be filtered by the reason, got %+v", list)
+	}
+	rw = httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", DeadLetterPath+"1", nil))
+	letter := deadLetter{}
+	json.NewDecoder(rw.Body).Decode(&letter)
+	if letter.Mail.Subject != "Hello" || letter.Reason != ReasonExhausted {
+		t.Fatalf("Dead letter should be shown with its mail, got %+v", letter)
+	}
+
+	rw = httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("POST", DeadLetterPath+"1", nil))
+	if rw.Code != http.StatusNoContent || len(fake.sent) != 1 || fake.sent[0].Subject != "Hello" {
+		t.Errorf("Dead letter should be re-driven, got %d", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("POST", DeadLetterPath+"1", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Re-driven dead letter should be gone, got %d", rw.Code)
+	}
+
+	store.Add(&mailStruct{}, ReasonExhausted, outage, 1, time.Now())
+	handler(httptest.NewRecorder(), httptest.NewRequest("DELETE", DeadLetterPath, nil))
+	if list, _ := store.List(""); len(list) != 0 {
+		t.Errorf("Dead letters should be purged, left %+v", list)
+	}
+	if recorded, _ := ioutil.ReadFile(filepath.Join(dir, "audit.jsonl")); !strings.Contains(string(recorded), `"Actor":"ops","Action":"re-driven","Target":"1"`) {
+		t.Errorf("Re-drive should be audited with the admin, got %s", recorded)
+	}
+
+	store.Add(&mailStruct{Recipient: "radek@example.com"}, ReasonExhausted, outage, 3, time.Now())
+	list, _ = store.List("")
+	if len(list) != 1 || list[0].ID <= 3 {
+		t.Fatalf("Purged IDs should not be given out again, got %+v", list)
+	}
+	down := DeadLetterFunc(store, &failingMailer{errors: []error{outage}}, admins, audit)
+	req := httptest.NewRequest("POST", DeadLetterPath+strconv.FormatUint(list[0].ID, 10), nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	down(httptest.NewRecorder(), req)
+	if list, _ = store.List(""); len(list) != 1 || list[0].Attempts != 3 || list[0].Reason != ReasonExhausted {
+		t.Errorf("Failed re-drive should keep the attempts and reason, got %+v", list)
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	reasons := map[error]string{
+		ErrBadSender:        ReasonValidation,
+		ErrMissingRecipient: ReasonValidation,
+		&textproto.Error{Code: 550, Msg: "5.7.1 Recipient refuses the sender"}: ReasonSuppression,
+		&textproto.Error{Code: 550, Msg: "5.1.1 No such user"}:                 ReasonPermanent,
+		&mailgun.UnexpectedResponseError{Actual: 401}:                          ReasonPermanent,
+	}
+	for err, reason := range reasons {
+		if got := failureReason(err); got != reason {
+			t.Errorf("Reason of %v should be %s, got %s", err, reason, got)
+		}
+	}
+}
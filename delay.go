@@ -0,0 +1,136 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// idleRelease is how long the queue waits
+// for the delayed mail when it has none.
+const idleRelease = time.Hour
+
+// delayQueue holds the mail until its
+// notBefore, the earliest one first. The
+// mail taken as due is counted until it is
+// released to the workers.
+type delayQueue struct {
+	mutex     sync.Mutex
+	mails     delayHeap
+	releasing int
+	wake      chan struct{}
+}
+
+func newDelayQueue() *delayQueue {
+	return &delayQueue{wake: make(chan struct{}, 1)}
+}
+
+func (d *delayQueue) push(m mailStruct) {
+	d.mutex.Lock()
+	heap.Push(&d.mails, m)
+	d.mutex.Unlock()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due takes the mail due by now and
+// returns the wait for the next one.
+func (d *delayQueue) due(now time.Time) ([]mailStruct, time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	due := []mailStruct{}
+	for len(d.mails) > 0 && !d.mails[0].notBefore.After(now) {
+		due = append(due, heap.Pop(&d.mails).(mailStruct))
+	}
+	d.releasing += len(due)
+	if len(d.mails) == 0 {
+		return due, idleRelease
+	}
+	return due, d.mails[0].notBefore.Sub(now)
+}
+
+func (d *delayQueue) released() {
+	d.mutex.Lock()
+	d.releasing--
+	d.mutex.Unlock()
+}
+
+func (d *delayQueue) size() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.mails) + d.releasing
+}
+
+// dueBy tells whether any of the
+// mail is due by the deadline.
+func (d *delayQueue) dueBy(deadline time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.releasing > 0 || (len(d.mails) > 0 && !d.mails[0].notBefore.After(deadline))
+}
+
+type delayHeap []mailStruct
+
+func (h delayHeap) Len() int           { return len(h) }
+func (h delayHeap) Less(i, j int) bool { return h[i].notBefore.Before(h[j].notBefore) }
+func (h delayHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *delayHeap) Push(x interface{}) {
+	*h = append(*h, x.(mailStruct))
+}
+
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+// storedMail is the mail kept by the queue
+// store with the state of its delivery.
+type storedMail struct {
+	Mail      *mailStruct
+	Attempts  int `json:",omitempty"`
+	NotBefore time.Time
+	Booked    bool `json:",omitempty"`
+	// Blobs are the digests of the attachments
+	// whose data the store keeps apart
+	Blobs []string `json:",omitempty"`
+}
+
+// encodeStored seals the stored
+// mail by the optional keyring.
+func encodeStored(m *mailStruct, keyring *Keyring) ([]byte, error) {
+	value, err := json.Marshal(storedMail{m, m.attempts, m.notBefore, m.booked, m.blobs})
+	if err != nil {
+		return nil, err
+	}
+	return keyring.Seal(value)
+}
+
+// decodeStored reads the stored mail, also
+// the plain one stored by the older version.
+func decodeStored(value []byte, keyring *Keyring) (mailStruct, error) {
+	value, err := keyring.Open(value)
+	if err != nil {
+		return mailStruct{}, err
+	}
+	stored := storedMail{}
+	if err := json.Unmarshal(value, &stored); err != nil {
+		return mailStruct{}, err
+	}
+	if stored.Mail == nil {
+		m := mailStruct{}
+		err := json.Unmarshal(value, &m)
+		return m, err
+	}
+	m := *stored.Mail
+	m.attempts = stored.Attempts
+	m.notBefore = stored.NotBefore
+	m.booked = stored.Booked
+	m.blobs = stored.Blobs
+	return m, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var directConfig = &DirectConfig{}
+
+// DirectConfig of the delivery straight to
+// the MX of the recipient domain, without
+// any relay or provider in between.
+type DirectConfig struct {
+	// Name the service greets the MX by,
+	// the hostname of the machine if empty
+	Hostname string
+	Port     string        `default:"25"`
+	Timeout  time.Duration `default:"1m"`
+	// Idle connections kept per MX host
+	MaxIdle     int           `default:"2"`
+	IdleTimeout time.Duration `default:"30s"`
+}
+
+func init() {
+	RegisterConfig("direct", directConfig)
+	RegisterMailer("direct", func() (Mailer, error) {
+		mailer := NewDirectMailer(directConfig, appConfig.Sender)
+		mailer.returnPath = appConfig.ReturnPath
+		signer, err := configuredDKIMSigner(smtpConfig, appConfig.Sender)
+		if err != nil {
+			return nil, err
+		}
+		mailer.signer = signer
+		if mailer.smime, err = configuredSMIMESigner(smimeConfig); err != nil {
+			return nil, err
+		}
+		return NewGreylistMailer(mailer, smtpConfig.RetrySchedule), nil
+	})
+}
+
+// DirectMailer delivers the mail to the MX hosts
+// of the recipient domain in order of preference,
+// over STARTTLS when the host offers it. The MX
+// must present the valid certificate then. The
+// mail is signed as by the SMTP mailer.
+type DirectMailer struct {
+	sender     string
+	returnPath string
+	signer     *DKIMSigner
+	smime      *SMIMESigner
+	hostname   string
+	port       string
+	lookupMX   func(domain string) ([]*net.MX, error)
+	pool       *smtpPool
+}
+
+func NewDirectMailer(config *DirectConfig, sender string) *DirectMailer {
+	hostname := config.Hostname
+	if len(hostname) == 0 {
+		hostname, _ = os.Hostname()
+	}
+	dm := &DirectMailer{
+		sender:   sender,
+		hostname: hostname,
+		port:     config.Port,
+		lookupMX: net.LookupMX,
+	}
+	dm.pool = newSmtpPool(func(addr string) (net.Conn, *smtp.Client, error) {
+		return dialSmtp(addr, hostname, nil, config.Timeout)
+	}, config.Timeout, config.MaxIdle, config.IdleTimeout)
+	return dm
+}
+
+// mxHosts returns the hosts accepting the mail
+// for the domain, the domain itself without
+// MX records, none for the null MX.
+func (dm *DirectMailer) mxHosts(domain string) ([]string, error) {
+	records, err := dm.lookupMX(domain)
+	if err != nil && !notFound(err) {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []string{domain}, nil
+	}
+	if len(records) == 1 && records[0].Host == "." {
+		return nil, ErrNoMX
+	}
+	hosts := make([]string, 0, len(records))
+	for _, record := range records {
+		hosts = append(hosts, strings.TrimSuffix(record.Host, "."))
+	}
+	return hosts, nil
+}
+
+func (dm *DirectMailer) SendMail(mail *mailStruct) error {
+	m := *mail
+	m.Sender = senderOf(mail, dm.sender)
+
+	recipient, err := addressOf(m.Recipient)
+	if err != nil {
+		return ErrBadRecipient
+	}
+	from := m.Sender
+	if len(dm.returnPath) > 0 {
+		from = dm.returnPath
+	}
+	if from, err = addressOf(from); err != nil {
+		return ErrBadSender
+	}
+	domain, err := recipientDomain(recipient)
+	if err != nil {
+		return err
+	}
+	hosts, err := dm.mxHosts(domain)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	message, err := signMessage(composeMessage(&m, now), now, dm.smime, dm.signer)
+	if err != nil {
+		return err
+	}
+
+	for _, host := range hosts {
+		addr := net.JoinHostPort(host, dm.port)
+		err = dm.pool.send(addr, from, []string{recipient}, message)
+		if err == nil {
+			log.Infof("Mail to %s delivered to %s", m.Recipient, addr)
+			return nil
+		}
+		if !isTemporary(err) && !isUnreachable(err) && !isTLSFailure(err) {
+			return err
+		}
+		log.Warnf("MX %s failed for %s: %s", addr, m.Recipient, err)
+	}
+	return err
+}
+
+// addressOf returns the bare address
+// of e.g. "Radek <radek@suricata.com>".
+func addressOf(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Address, nil
+}
+
+func (dm *DirectMailer) Close() {
+	dm.pool.close()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSmtpServer accepts every mail
+// and counts the connections, with
+// brokenTLS it offers STARTTLS but
+// hangs up on the handshake.
+type fakeSmtpServer struct {
+	listener net.Listener
+
+	mutex       sync.Mutex
+	brokenTLS   bool
+	connections int
+	senders     []string
+	recipients  []string
+}
+
+func newFakeSmtpServer(t *testing.T) *fakeSmtpServer {
+	return listenFakeSmtp(t, "127.0.0.1:0")
+}
+
+func listenFakeSmtp(t *testing.T, addr string) *fakeSmtpServer {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSmtpServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mutex.Lock()
+			server.connections++
+			server.mutex.Unlock()
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeSmtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 fake ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			s.mutex.Lock()
+			brokenTLS := s.brokenTLS
+			s.mutex.Unlock()
+			if brokenTLS {
+				reply("250-fake")
+				reply("250 STARTTLS")
+			} else {
+				reply("250 fake")
+			}
+		case command == "STARTTLS":
+			reply("220 Go ahead")
+			return
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			s.mutex.Lock()
+			s.senders = append(s.senders, strings.TrimSpace(line)[len("MAIL FROM:"):])
+			s.mutex.Unlock()
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			s.mutex.Lock()
+			s.recipients = append(s.recipients, strings.TrimSpace(line)[len("RCPT TO:"):])
+			s.mutex.Unlock()
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 Go ahead")
+			for {
+				data, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if data == ".\r\n" {
+					break
+				}
+			}
+			reply("250 Queued")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *fakeSmtpServer) port() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+func TestDirectMailer(t *testing.T) {
+	server := newFakeSmtpServer(t)
+	defer server.listener.Close()
+
+	mailer := NewDirectMailer(&DirectConfig{
+		Hostname:    "mail.suricata.com",
+		Port:        server.port(),
+		Timeout:     time.Second,
+		MaxIdle:     1,
+		IdleTimeout: time.Minute,
+	}, "Suricata <info@suricata.com>")
+	defer mailer.Close()
+	mailer.lookupMX = func(domain string) ([]*net.MX, error) {
+		switch domain {
+		case "example.com":
+			// Unreachable MX first fails over to the next
+			return []*net.MX{{Host: "127.0.0.2.", Pref: 10}, {Host: "127.0.0.1.", Pref: 20}}, nil
+		case "null.example.com":
+			return []*net.MX{{Host: ".", Pref: 0}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: domain}
+	}
+
+	for _, recipient := range []string{"Radek <radek@example.com>", "info@example.com"} {
+		if err := mailer.SendMail(&mailStruct{Recipient: recipient, Subject: "Hello", Message: "Hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mailer.SendMail(&mailStruct{Recipient: "radek@null.example.com"}); err != ErrNoMX {
+		t.Errorf("Null MX should refuse the mail, got %v", err)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.recipients) != 2 || server.recipients[0] != "<radek@example.com>" {
+		t.Errorf("Expected bare recipients, got %v", server.recipients)
+	}
+	if server.connections != 1 {
+		t.Errorf("Connection should be reused, got %d", server.connections)
+	}
+}
+
+func TestDirectMailerBrokenTLS(t *testing.T) {
+	broken := newFakeSmtpServer(t)
+	defer broken.listener.Close()
+	broken.mutex.Lock()
+	broken.brokenTLS = true
+	broken.mutex.Unlock()
+	working := listenFakeSmtp(t, net.JoinHostPort("127.0.0.3", broken.port()))
+	defer working.listener.Close()
+
+	mailer := NewDirectMailer(&DirectConfig{
+		Hostname:    "mail.suricata.com",
+		Port:        broken.port(),
+		Timeout:     time.Second,
+		MaxIdle:     1,
+		IdleTimeout: time.Minute,
+	}, "Suricata <info@suricata.com>")
+	defer mailer.Close()
+	mailer.lookupMX = func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "127.0.0.1.", Pref: 10}, {Host: "127.0.0.3.", Pref: 20}}, nil
+	}
+
+	if err := mailer.SendMail(&mailStruct{Recipient: "radek@example.com", Message: "Hi"}); err != nil {
+		t.Fatalf("Failed STARTTLS should fail over to the next MX, got %s", err)
+	}
+	working.mutex.Lock()
+	defer working.mutex.Unlock()
+	if len(working.recipients) != 1 {
+		t.Errorf("Next MX should get the mail, got %v", working.recipients)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrBadDKIMKey = fmt.Errorf("dkim: Key is not RSA private key")
+
+// dkimHeaders are signed when
+// present in the message.
+var dkimHeaders = []string{
+	"From", "To", "Reply-To", "Subject", "Date",
+	"Message-ID", "MIME-Version", "Content-Type",
+}
+
+// DKIMSigner signs the composed messages
+// with rsa-sha256 and relaxed/relaxed
+// canonicalization as in RFC 6376.
+type DKIMSigner struct {
+	domain   string
+	selector string
+	key      *rsa.PrivateKey
+}
+
+func NewDKIMSigner(domain, selector, key string) (*DKIMSigner, error) {
+	rsaKey, err := parseRSAKey(key)
+	if err != nil {
+		return nil, ErrBadDKIMKey
+	}
+	return &DKIMSigner{
+		domain:   domain,
+		selector: selector,
+		key:      rsaKey,
+	}, nil
+}
+
+// configuredDKIMSigner is nil without the key,
+// the domain defaults to the one of the sender.
+func configuredDKIMSigner(config *SmtpConfig, sender string) (*DKIMSigner, error) {
+	if len(config.DKIMKey) == 0 {
+		return nil, nil
+	}
+	domain := config.DKIMDomain
+	if len(domain) == 0 {
+		domain, _ = senderDomain(sender)
+	}
+	return NewDKIMSigner(domain, config.DKIMSelector, config.DKIMKey)
+}
+
+// Sign returns the message with the DKIM-Signature
+// header prepended, its line ends are made CRLF
+// first, so the body hash is of the body sent.
+func (s *DKIMSigner) Sign(message []byte, now time.Time) ([]byte, error) {
+	message = canonicalLines(message)
+	header, body := message, []byte{}
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+		header, body = message[:i+2], message[i+4:]
+	}
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	fields := parseHeaderFields(header)
+	signed := []string{}
+	hash := sha256.New()
+	for _, name := range dkimHeaders {
+		if field, ok := fields[strings.ToLower(name)]; ok {
+			hash.Write([]byte(relaxedHeader(field)))
+			signed = append(signed, strings.ToLower(name))
+		}
+	}
+
+	signature := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%s; h=%s; bh=%s; b=",
+		s.domain,
+		s.selector,
+		strconv.FormatInt(now.Unix(), 10),
+		strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	// Signature header itself is hashed
+	// without the b= value and the CRLF
+	hash.Write([]byte(strings.TrimSuffix(relaxedHeader("DKIM-Signature: "+signature), "\r\n")))
+
+	b, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "DKIM-Signature: %s%s\r\n", signature, base64.StdEncoding.EncodeToString(b))
+	buf.Write(message)
+	return buf.Bytes(), nil
+}
+
+// parseHeaderFields returns the unfolded header
+// fields keyed by the lower case name, the last
+// occurrence wins as the signers sign bottom up.
+func parseHeaderFields(header []byte) map[string]string {
+	fields := map[string]string{}
+	last := ""
+	for _, line := range strings.Split(string(header), "\r\n") {
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(last) > 0 {
+			fields[last] += "\r\n" + line
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		last = strings.ToLower(strings.TrimSpace(line[:colon]))
+		fields[last] = line
+	}
+	return fields
+}
+
+// relaxedHeader canonicalizes the field
+// "Name: value" as name:value CRLF.
+func relaxedHeader(field string) string {
+	colon := strings.Index(field, ":")
+	name := strings.ToLower(strings.TrimSpace(field[:colon]))
+	value := strings.Replace(field[colon+1:], "\r\n", "", -1)
+	value = strings.Join(strings.Fields(value), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// relaxedBody compresses the whitespace, strips
+// it at the line ends and drops the trailing
+// empty lines of the body.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		line = strings.Replace(line, "\t", " ", -1)
+		for strings.Contains(line, "  ") {
+			line = strings.Replace(line, "  ", " ", -1)
+		}
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
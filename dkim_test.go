@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelaxedBody(t *testing.T) {
+	canonical := string(relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n")))
+	if canonical != " C\r\nD E\r\n" {
+		t.Errorf("Unexpected canonical body %q", canonical)
+	}
+	// Known hash of the empty body
+	hash := sha256.Sum256(relaxedBody(nil))
+	if base64.StdEncoding.EncodeToString(hash[:]) != "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=" {
+		t.Error("Unexpected hash of the empty body")
+	}
+}
+
+func TestDKIMSigner(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	signer, err := NewDKIMSigner("suricata.com", "mail", string(pemKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := composeMessage(&mailStruct{
+		Sender:    "info@suricata.com",
+		Recipient: "radek@suricata.com",
+		Subject:   "Hello",
+		Message:   "Hello Radek",
+	}, time.Now())
+	signed, err := signer.Sign(message, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]string{}
+	for _, tag := range strings.Split(msg.Header.Get("DKIM-Signature"), ";") {
+		kv := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		tags[kv[0]] = kv[1]
+	}
+	if tags["d"] != "suricata.com" || tags["h"] != "from:to:subject:date:mime-version:content-type" {
+		t.Errorf("Unexpected signature tags %v", tags)
+	}
+
+	// Verify as the receiving server would
+	fields := parseHeaderFields(message)
+	hash := sha256.New()
+	for _, name := range strings.Split(tags["h"], ":") {
+		hash.Write([]byte(relaxedHeader(fields[name])))
+	}
+	unsigned := strings.TrimSuffix(strings.SplitN(string(signed), "\r\n", 2)[0], tags["b"])
+	hash.Write([]byte(strings.TrimSuffix(relaxedHeader(unsigned), "\r\n")))
+	b, _ := base64.StdEncoding.DecodeString(tags["b"])
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash.Sum(nil), b); err != nil {
+		t.Errorf("Signature does not verify: %s", err)
+	}
+
+	// The body hash holds for the multi-line
+	// body as received over the SMTP DATA
+	message = composeMessage(&mailStruct{
+		Sender:    "info@suricata.com",
+		Recipient: "radek@suricata.com",
+		Subject:   "Hello",
+		Message:   "Hello Radek,\n.dot starts the line\nand the Unix line ends \n\nBye",
+	}, time.Now())
+	signed, err = signer.Sign(message, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wire bytes.Buffer
+	data := textproto.NewWriter(bufio.NewWriter(&wire)).DotWriter()
+	data.Write(signed)
+	data.Close()
+	received, _ := ioutil.ReadAll(textproto.NewReader(bufio.NewReader(&wire)).DotReader())
+	msg, err = mail.ReadMessage(bytes.NewReader(canonicalLines(received)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range strings.Split(msg.Header.Get("DKIM-Signature"), ";") {
+		kv := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		tags[kv[0]] = kv[1]
+	}
+	body, _ := ioutil.ReadAll(msg.Body)
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Errorf("Body hash does not match the received body %q", body)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Longest accepted DMARC report
+const maxDmarcReport = 10 * 1024 * 1024
+
+var ErrBadDmarcReport = fmt.Errorf("dmarc: Report is not aggregate XML")
+
+// dmarcFeedback is the part of the aggregate
+// report (RFC 7489 appendix C) which is kept.
+type dmarcFeedback struct {
+	Metadata struct {
+		OrgName  string `xml:"org_name"`
+		ReportID string `xml:"report_id"`
+		Begin    int64  `xml:"date_range>begin"`
+		End      int64  `xml:"date_range>end"`
+	} `xml:"report_metadata"`
+	Domain  string `xml:"policy_published>domain"`
+	Records []struct {
+		SourceIP    string `xml:"row>source_ip"`
+		Count       int    `xml:"row>count"`
+		Disposition string `xml:"row>policy_evaluated>disposition"`
+		DKIM        string `xml:"row>policy_evaluated>dkim"`
+		SPF         string `xml:"row>policy_evaluated>spf"`
+	} `xml:"record"`
+}
+
+// DmarcSummary aggregates the reports
+// of the domain. The messages failing
+// both DKIM and SPF alignment are counted
+// per source IP to spot the spoofing.
+type DmarcSummary struct {
+	Domain      string
+	Reports     int
+	Messages    int
+	DKIMAligned int
+	SPFAligned  int
+	Failed      int
+	Quarantined int
+	Rejected    int
+	FailedBy    map[string]int
+	LastReport  time.Time
+}
+
+// DmarcStore keeps the summaries in memory,
+// each report is counted once.
+type DmarcStore struct {
+	mutex     sync.RWMutex
+	summaries map[string]*DmarcSummary
+	seen      map[string]bool
+}
+
+func NewDmarcStore() *DmarcStore {
+	return &DmarcStore{
+		summaries: make(map[string]*DmarcSummary),
+		seen:      make(map[string]bool),
+	}
+}
+
+// Add parses the report, plain or
+// compressed by gzip or zip, into the summary.
+func (s *DmarcStore) Add(report []byte) error {
+	content, err := uncompressReport(report)
+	if err != nil {
+		return err
+	}
+	feedback := dmarcFeedback{}
+	if err := xml.Unmarshal(content, &feedback); err != nil || len(feedback.Domain) == 0 {
+		return ErrBadDmarcReport
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := feedback.Metadata.OrgName + "/" + feedback.Metadata.ReportID
+	if s.seen[id] {
+		return nil
+	}
+	s.seen[id] = true
+
+	summary, ok := s.summaries[feedback.Domain]
+	if !ok {
+		summary = &DmarcSummary{Domain: feedback.Domain, FailedBy: map[string]int{}}
+		s.summaries[feedback.Domain] = summary
+	}
+	summary.Reports++
+	if end := time.Unix(feedback.Metadata.End, 0); end.After(summary.LastReport) {
+		summary.LastReport = end
+	}
+	for _, record := range feedback.Records {
+		summary.Messages += record.Count
+		if record.DKIM == "pass" {
+			summary.DKIMAligned += record.Count
+		}
+		if record.SPF == "pass" {
+			summary.SPFAligned += record.Count
+		}
+		if record.DKIM != "pass" && record.SPF != "pass" {
+			summary.Failed += record.Count
+			summary.FailedBy[record.SourceIP] += record.Count
+		}
+		switch record.Disposition {
+		case "quarantine":
+			summary.Quarantined += record.Count
+		case "reject":
+			summary.Rejected += record.Count
+		}
+	}
+	return nil
+}
+
+// Summaries returns the copies
+// of the domain summaries.
+func (s *DmarcStore) Summaries() []DmarcSummary {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	summaries := make([]DmarcSummary, 0, len(s.summaries))
+	for _, summary := range s.summaries {
+		copied := *summary
+		copied.FailedBy = make(map[string]int, len(summary.FailedBy))
+		for ip, count := range summary.FailedBy {
+			copied.FailedBy[ip] = count
+		}
+		summaries = append(summaries, copied)
+	}
+	return summaries
+}
+
+func uncompressReport(report []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(report, []byte{0x1f, 0x8b}):
+		reader, err := gzip.NewReader(bytes.NewReader(report))
+		if err != nil {
+			return nil, ErrBadDmarcReport
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(io.LimitReader(reader, maxDmarcReport))
+	case bytes.HasPrefix(report, []byte("PK")):
+		archive, err := zip.NewReader(bytes.NewReader(report), int64(len(report)))
+		if err != nil || len(archive.File) == 0 {
+			return nil, ErrBadDmarcReport
+		}
+		reader, err := archive.File[0].Open()
+		if err != nil {
+			return nil, ErrBadDmarcReport
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(io.LimitReader(reader, maxDmarcReport))
+	}
+	return report, nil
+}
+
+// DmarcFunc accepts the aggregate report by POST
+// and answers the summaries to GET.
+func DmarcFunc(store *DmarcStore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(store.Summaries())
+		case "POST":
+			report, err := ioutil.ReadAll(io.LimitReader(req.Body, maxDmarcReport))
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := store.Add(report); err != nil {
+				log.Warnf("Rejecting DMARC report: %s", err)
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rw.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+const dmarcReport = `<?xml version="1.0" encoding="UTF-8" ?>
+<feedback>
+  <report_metadata>
+    <org_name>google.com</org_name>
+    <report_id>42</report_id>
+    <date_range><begin>1500000000</begin><end>1500086400</end></date_range>
+  </report_metadata>
+  <policy_published><domain>suricata.com</domain><p>reject</p></policy_published>
+  <record>
+    <row>
+      <source_ip>209.61.151.1</source_ip>
+      <count>10</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>pass</spf></policy_evaluated>
+    </row>
+  </record>
+  <record>
+    <row>
+      <source_ip>203.0.113.7</source_ip>
+      <count>3</count>
+      <policy_evaluated><disposition>reject</disposition><dkim>fail</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+  </record>
+</feedback>`
+
+func TestDmarcStore(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(dmarcReport))
+	writer.Close()
+
+	store := NewDmarcStore()
+	if err := store.Add(compressed.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	// Same report again is not counted
+	store.Add([]byte(dmarcReport))
+
+	summaries := store.Summaries()
+	if len(summaries) != 1 {
+		t.Fatalf("Expected one domain, got %d", len(summaries))
+	}
+	summary := summaries[0]
+	if summary.Reports != 1 || summary.Messages != 13 || summary.DKIMAligned != 10 || summary.Rejected != 3 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+	if summary.FailedBy["203.0.113.7"] != 3 {
+		t.Errorf("Failing source should be counted, got %v", summary.FailedBy)
+	}
+
+	if store.Add([]byte("<html></html>")) != ErrBadDmarcReport {
+		t.Error("Other XML should be rejected")
+	}
+}
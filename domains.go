@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DomainStatus tells which DNS records of the
+// sending domain are missing, e.g. "spf: missing".
+type DomainStatus struct {
+	Domain   string
+	Problems []string `json:",omitempty"`
+}
+
+// DomainChecker verifies the SPF, DKIM and
+// DMARC records of the sending domains.
+type DomainChecker struct {
+	domains   []string
+	selector  string
+	lookupTXT func(name string) ([]string, error)
+
+	mutex  sync.RWMutex
+	status []DomainStatus
+}
+
+func NewDomainChecker(domains []string, selector string) *DomainChecker {
+	return &DomainChecker{
+		domains:   domains,
+		selector:  selector,
+		lookupTXT: net.LookupTXT,
+	}
+}
+
+// Watch checks the domains in given
+// interval until stop is closed.
+func (d *DomainChecker) Watch(interval time.Duration, stop <-chan struct{}) {
+	for {
+		d.check()
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (d *DomainChecker) check() {
+	status := make([]DomainStatus, 0, len(d.domains))
+	for _, domain := range d.domains {
+		problems := []string{}
+		if problem := d.record(domain, hasPrefix("v=spf1")); len(problem) > 0 {
+			problems = append(problems, "spf: "+problem)
+		}
+		// Version tag of DKIM is optional
+		if problem := d.record(d.selector+"._domainkey."+domain, hasTag("p")); len(problem) > 0 {
+			problems = append(problems, "dkim: "+problem)
+		}
+		if problem := d.record("_dmarc."+domain, hasPrefix("v=DMARC1")); len(problem) > 0 {
+			problems = append(problems, "dmarc: "+problem)
+		}
+		if len(problems) > 0 {
+			log.Warnf("Sending domain %s misconfigured: %s", domain, strings.Join(problems, ", "))
+		}
+		status = append(status, DomainStatus{Domain: domain, Problems: problems})
+	}
+
+	d.mutex.Lock()
+	d.status = status
+	d.mutex.Unlock()
+}
+
+// record returns the problem of the TXT record
+// which matches, empty when the record is present.
+func (d *DomainChecker) record(name string, match func(record string) bool) string {
+	records, err := d.lookupTXT(name)
+	if err != nil && !notFound(err) {
+		return err.Error()
+	}
+	for _, record := range records {
+		if match(strings.TrimSpace(record)) {
+			return ""
+		}
+	}
+	return "missing"
+}
+
+func hasPrefix(prefix string) func(string) bool {
+	return func(record string) bool {
+		return strings.HasPrefix(record, prefix)
+	}
+}
+
+func hasTag(tag string) func(string) bool {
+	return func(record string) bool {
+		for _, field := range strings.Split(record, ";") {
+			if strings.HasPrefix(strings.TrimSpace(field), tag+"=") {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Status returns the result
+// of the last check.
+func (d *DomainChecker) Status() []DomainStatus {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.status
+}
+
+type readyStruct struct {
+	Ready   bool
+	Domains []DomainStatus
+}
+
+// ReadyFunc reports the instance ready with the
+// details of the sending domains. The broken
+// DNS is only reported, the instance still
+// sends the mail.
+func ReadyFunc(domains *DomainChecker) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(readyStruct{
+			Ready:   true,
+			Domains: domains.Status(),
+		})
+	}
+}
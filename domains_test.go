@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDomainChecker(t *testing.T) {
+	records := map[string][]string{
+		"suricata.com":                 {"google-site-verification=x", "v=spf1 include:mailgun.org ~all"},
+		"mail._domainkey.suricata.com": {"k=rsa; p=MIGfMA0"},
+		"_dmarc.suricata.com":          {"v=DMARC1; p=reject"},
+		"example.com":                  {"v=spf1 -all"},
+		"mail._domainkey.example.com":  {"v=DKIM1; k=rsa; p=MIGf"},
+	}
+	checker := NewDomainChecker([]string{"suricata.com", "example.com"}, "mail")
+	checker.lookupTXT = func(name string) ([]string, error) {
+		if txt, ok := records[name]; ok {
+			return txt, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name}
+	}
+
+	checker.check()
+	status := checker.Status()
+	if len(status) != 2 || len(status[0].Problems) != 0 {
+		t.Fatalf("First domain should be valid, got %+v", status)
+	}
+	if len(status[1].Problems) != 1 || status[1].Problems[0] != "dmarc: missing" {
+		t.Errorf("Second domain should miss DMARC, got %v", status[1].Problems)
+	}
+}
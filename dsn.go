@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Kinds of the bounce, the hard one
+// will fail again, the soft one may not.
+const (
+	BounceHard = "hard"
+	BounceSoft = "soft"
+)
+
+var (
+	ErrNotDSN       = fmt.Errorf("dsn: Message is not a delivery status notification")
+	ErrNotComplaint = fmt.Errorf("dsn: Message is not an abuse feedback report")
+
+	bounceConfig = &BounceConfig{}
+)
+
+// BounceConfig points to the maildir the
+// Return-Path mailbox is delivered to,
+// empty disables reading the bounces.
+type BounceConfig struct {
+	Maildir  string
+	Interval time.Duration `default:"1m"`
+}
+
+func init() {
+	RegisterConfig("bounce", bounceConfig)
+}
+
+// Bounce is the failed or delayed
+// delivery to the recipient.
+type Bounce struct {
+	Recipient  string
+	Kind       string
+	Status     string
+	Diagnostic string
+}
+
+// ParseDSN reads the bounces of the RFC 3464
+// multipart/report message, the recipients
+// delivered fine are left out.
+func ParseDSN(r io.Reader) ([]Bounce, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		return nil, ErrNotDSN
+	}
+
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil, ErrNotDSN
+		}
+		if err != nil {
+			return nil, err
+		}
+		if mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); mediaType == "message/delivery-status" {
+			return parseDeliveryStatus(part)
+		}
+	}
+}
+
+// ParseComplaint reads the recipient complaining
+// by the RFC 5965 abuse feedback report of the
+// mailbox provider feedback loop.
+func ParseComplaint(r io.Reader) (string, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return "", err
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "feedback-report" {
+		return "", ErrNotComplaint
+	}
+
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return "", ErrNotComplaint
+		}
+		if err != nil {
+			return "", err
+		}
+		if mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); mediaType != "message/feedback-report" {
+			continue
+		}
+		fields, err := textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		recipient := strings.Trim(strings.TrimSpace(fields.Get("Original-Rcpt-To")), "<>")
+		if !strings.EqualFold(strings.TrimSpace(fields.Get("Feedback-Type")), "abuse") || len(recipient) == 0 {
+			return "", ErrNotComplaint
+		}
+		return recipient, nil
+	}
+}
+
+// parseDeliveryStatus skips the per-message fields
+// and classifies each per-recipient field group.
+func parseDeliveryStatus(r io.Reader) ([]Bounce, error) {
+	reader := textproto.NewReader(bufio.NewReader(r))
+	if _, err := reader.ReadMIMEHeader(); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	bounces := []Bounce{}
+	for {
+		fields, err := reader.ReadMIMEHeader()
+		if len(fields) > 0 {
+			if bounce, ok := classifyBounce(fields); ok {
+				bounces = append(bounces, bounce)
+			}
+		}
+		if err == io.EOF {
+			return bounces, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func classifyBounce(fields textproto.MIMEHeader) (Bounce, bool) {
+	bounce := Bounce{
+		Recipient:  typedValue(fields.Get("Final-Recipient")),
+		Status:     strings.TrimSpace(fields.Get("Status")),
+		Diagnostic: typedValue(fields.Get("Diagnostic-Code")),
+	}
+	switch action := strings.ToLower(strings.TrimSpace(fields.Get("Action"))); {
+	case action == "failed" && strings.HasPrefix(bounce.Status, "5."):
+		bounce.Kind = BounceHard
+	case action == "failed" || action == "delayed":
+		bounce.Kind = BounceSoft
+	default:
+		return bounce, false
+	}
+	return bounce, len(bounce.Recipient) > 0
+}
+
+// typedValue drops the type of
+// the field e.g. rfc822; or smtp;
+func typedValue(field string) string {
+	if i := strings.Index(field, ";"); i >= 0 {
+		field = field[i+1:]
+	}
+	return strings.TrimSpace(field)
+}
+
+// BounceReader parses the new messages of the
+// maildir and moves them to cur once read.
+// The abuse reports of the feedback loop
+// may come to the same maildir.
+type BounceReader struct {
+	dir string
+	// OnBounce is called with
+	// every bounce found
+	OnBounce func(Bounce)
+	// OnComplaint is called with the
+	// recipient of every abuse report
+	OnComplaint func(recipient string)
+}
+
+func NewBounceReader(dir string) *BounceReader {
+	return &BounceReader{
+		dir: dir,
+		OnBounce: func(bounce Bounce) {
+			log.Warnf("Mail to %s bounced %s: %s %s", bounce.Recipient, bounce.Kind, bounce.Status, bounce.Diagnostic)
+		},
+		OnComplaint: func(recipient string) {
+			log.Warnf("Mail to %s reported as spam", recipient)
+		},
+	}
+}
+
+// Watch reads the maildir every interval
+// until the stop channel is closed.
+func (b *BounceReader) Watch(interval time.Duration, stop <-chan struct{}) {
+	for {
+		b.read()
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (b *BounceReader) read() {
+	files, err := ioutil.ReadDir(filepath.Join(b.dir, "new"))
+	if err != nil {
+		log.Errorf("Cannot read bounces: %s", err)
+		return
+	}
+	for _, file := range files {
+		path := filepath.Join(b.dir, "new", file.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Errorf("Cannot read bounce %s: %s", file.Name(), err)
+			continue
+		}
+		bounces, err := ParseDSN(bytes.NewReader(content))
+		if err == ErrNotDSN {
+			var recipient string
+			if recipient, err = ParseComplaint(bytes.NewReader(content)); err == nil {
+				b.OnComplaint(recipient)
+			}
+		}
+		if err != nil {
+			log.Infof("Skipping %s in the bounce mailbox: %s", file.Name(), err)
+		}
+		for _, bounce := range bounces {
+			b.OnBounce(bounce)
+		}
+		// Seen flag of the maildir
+		os.Rename(path, filepath.Join(b.dir, "cur", file.Name()+":2,S"))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDSN = "From: MAILER-DAEMON@suricata.com\r\n" +
+	"To: bounces@suricata.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b\"\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Delivery failed.\r\n" +
+	"--b\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.suricata.com\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; radek@example.com\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; info@example.com\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.2.2\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; ok@example.com\r\n" +
+	"Action: delivered\r\n" +
+	"Status: 2.0.0\r\n" +
+	"--b--\r\n"
+
+const testComplaint = "From: fbl@mail.example.com\r\n" +
+	"To: bounces@suricata.com\r\n" +
+	"Subject: Complaint\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=feedback-report; boundary=\"b\"\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"This is an abuse report.\r\n" +
+	"--b\r\n" +
+	"Content-Type: message/feedback-report\r\n" +
+	"\r\n" +
+	"Feedback-Type: abuse\r\n" +
+	"Version: 1\r\n" +
+	"Original-Rcpt-To: <Radek@example.com>\r\n" +
+	"--b--\r\n"
+
+func TestParseDSN(t *testing.T) {
+	bounces, err := ParseDSN(strings.NewReader(testDSN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bounces) != 2 {
+		t.Fatalf("Expected 2 bounces, got %+v", bounces)
+	}
+	if bounces[0].Recipient != "radek@example.com" || bounces[0].Kind != BounceHard || bounces[0].Diagnostic != "550 5.1.1 User unknown" {
+		t.Errorf("Expected hard bounce, got %+v", bounces[0])
+	}
+	if bounces[1].Recipient != "info@example.com" || bounces[1].Kind != BounceSoft {
+		t.Errorf("Expected soft bounce, got %+v", bounces[1])
+	}
+
+	if _, err := ParseDSN(strings.NewReader("Subject: Hello\r\n\r\nHi")); err != ErrNotDSN {
+		t.Errorf("Plain message is not DSN, got %v", err)
+	}
+}
+
+func TestBounceReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bounces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	md, _ := newMaildir(dir)
+	md.write([]byte(testDSN))
+
+	md.write([]byte(testComplaint))
+
+	reader := NewBounceReader(dir)
+	bounces := []Bounce{}
+	complaints := []string{}
+	reader.OnBounce = func(bounce Bounce) { bounces = append(bounces, bounce) }
+	reader.OnComplaint = func(recipient string) { complaints = append(complaints, recipient) }
+	reader.read()
+	reader.read()
+
+	if len(bounces) != 2 {
+		t.Errorf("Bounces should be read once, got %+v", bounces)
+	}
+	if len(complaints) != 1 || complaints[0] != "Radek@example.com" {
+		t.Errorf("Complaint should be read once, got %v", complaints)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "cur")); len(files) != 2 {
+		t.Error("Read messages should be moved to cur")
+	}
+	if _, err := ParseComplaint(strings.NewReader(testDSN)); err != ErrNotComplaint {
+		t.Errorf("DSN is not the complaint, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// sealedPrefix marks the encrypted value,
+// the value without it is stored plain.
+const sealedPrefix = "sealed:"
+
+var (
+	ErrBadEncryptionKey = fmt.Errorf("encryption: Key must be id:base64 of 32 bytes")
+	ErrUnknownKey       = fmt.Errorf("encryption: Value is sealed by the key not configured")
+
+	encryptionConfig = &EncryptionConfig{}
+)
+
+// EncryptionConfig lists the keys the stored
+// mail is encrypted with e.g. 2024:base64,
+// the first one seals the new values and
+// the others only open the older ones until
+// they are sealed again. Empty keeps the
+// stores plain.
+type EncryptionConfig struct {
+	Keys []string
+}
+
+func init() {
+	RegisterConfig("encryption", encryptionConfig)
+}
+
+// Keyring seals the stored mail by AES-GCM.
+// The nil Keyring stores it plain.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+func ParseKeyring(keys []string) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, value := range keys {
+		parts := strings.SplitN(strings.TrimSpace(value), ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, ErrBadEncryptionKey
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(secret) != 32 {
+			return nil, ErrBadEncryptionKey
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(k.active) == 0 {
+			k.active = parts[0]
+		}
+		k.keys[parts[0]] = aead
+	}
+	return k, nil
+}
+
+// keyringSecrets lists the keys
+// which must never be logged.
+func keyringSecrets(keys []string) []string {
+	secrets := []string{}
+	for _, value := range keys {
+		if parts := strings.SplitN(value, ":", 2); len(parts) == 2 {
+			secrets = append(secrets, parts[1])
+		}
+	}
+	return secrets
+}
+
+// Seal encrypts the value by the active key
+// as sealed:id:base64 of the nonce and
+// the ciphertext.
+func (k *Keyring) Seal(plain []byte) ([]byte, error) {
+	if k == nil {
+		return plain, nil
+	}
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, []byte(k.active))
+	return []byte(sealedPrefix + k.active + ":" + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Open decrypts the sealed value by its
+// key, the plain value is returned as is.
+func (k *Keyring) Open(value []byte) ([]byte, error) {
+	id, ok := sealedKey(value)
+	if !ok {
+		return value, nil
+	}
+	if k == nil || k.keys[id] == nil {
+		return nil, ErrUnknownKey
+	}
+	aead := k.keys[id]
+	sealed, err := base64.StdEncoding.DecodeString(string(value[len(sealedPrefix)+len(id)+1:]))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encryption: Sealed value is malformed")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(id))
+}
+
+// Stale tells whether the value should be sealed
+// again, it is plain or sealed by the old key.
+func (k *Keyring) Stale(value []byte) bool {
+	if k == nil {
+		return false
+	}
+	id, ok := sealedKey(value)
+	return !ok || id != k.active
+}
+
+func sealedKey(value []byte) (string, bool) {
+	if !bytes.HasPrefix(value, []byte(sealedPrefix)) {
+		return "", false
+	}
+	rest := value[len(sealedPrefix):]
+	end := bytes.IndexByte(rest, ':')
+	if end < 0 {
+		return "", false
+	}
+	return string(rest[:end]), true
+}
+
+// resealBucket seals again the values of the
+// bucket which are plain or sealed by the
+// old key, so the old key can be retired.
+func (k *Keyring) resealBucket(db *bolt.DB, bucket []byte) error {
+	if k == nil {
+		return nil
+	}
+	resealed := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		stale := map[string][]byte{}
+		err := b.ForEach(func(key, value []byte) error {
+			if k.Stale(value) {
+				stale[string(key)] = append([]byte{}, value...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, value := range stale {
+			plain, err := k.Open(value)
+			if err != nil {
+				return err
+			}
+			if value, err = k.Seal(plain); err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		resealed = len(stale)
+		return nil
+	})
+	if resealed > 0 {
+		log.Infof("Sealed %d values of %s by the key %s", resealed, bucket, k.active)
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func testKey(seed byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{seed}, 32))
+}
+
+func TestKeyring(t *testing.T) {
+	for _, keys := range [][]string{{"a"}, {"a:short"}, {":" + testKey(1)}} {
+		if _, err := ParseKeyring(keys); err != ErrBadEncryptionKey {
+			t.Errorf("Key %v should be refused, got %v", keys, err)
+		}
+	}
+	if keyring, err := ParseKeyring(nil); keyring != nil || err != nil {
+		t.Error("No keys should keep the values plain")
+	}
+
+	old, _ := ParseKeyring([]string{"old:" + testKey(1)})
+	sealed, err := old.Seal([]byte("Secret"))
+	if err != nil || bytes.Contains(sealed, []byte("Secret")) || !strings.HasPrefix(string(sealed), "sealed:old:") {
+		t.Fatalf("Value should be sealed by the key, got %s %v", sealed, err)
+	}
+	rotated, _ := ParseKeyring([]string{"new:" + testKey(2), "old:" + testKey(1)})
+	if plain, err := rotated.Open(sealed); err != nil || string(plain) != "Secret" {
+		t.Errorf("Old key should open the value, got %s %v", plain, err)
+	}
+	if !rotated.Stale(sealed) || !rotated.Stale([]byte("plain")) {
+		t.Error("Value of the old key should be sealed again")
+	}
+	if plain, err := rotated.Open([]byte("plain")); err != nil || string(plain) != "plain" {
+		t.Errorf("Plain value should be read as is, got %s %v", plain, err)
+	}
+	retired, _ := ParseKeyring([]string{"new:" + testKey(2)})
+	if _, err := retired.Open(sealed); err != ErrUnknownKey {
+		t.Errorf("Value of the retired key should not open, got %v", err)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-2] ^= 1
+	if _, err := old.Open(tampered); err == nil {
+		t.Error("Tampered value should not open")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "encryption")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadletter.db")
+
+	old, _ := ParseKeyring([]string{"old:" + testKey(1)})
+	store, err := NewDeadLetterStore(path, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(&mailStruct{Recipient: "radek@example.com", Message: "Secret"}, ReasonPermanent, ErrBadSender, 1, time.Now())
+	store.Close()
+	if content, _ := ioutil.ReadFile(path); bytes.Contains(content, []byte("Secret")) {
+		t.Fatal("Dead letter should be sealed on the disk")
+	}
+
+	rotated, _ := ParseKeyring([]string{"new:" + testKey(2), "old:" + testKey(1)})
+	if store, err = NewDeadLetterStore(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	db, _ := bolt.Open(path, 0600, nil)
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLetterBucket).ForEach(func(key, value []byte) error {
+			if !strings.HasPrefix(string(value), "sealed:new:") {
+				t.Errorf("Dead letter should be sealed by the new key, got %s", value)
+			}
+			return nil
+		})
+	})
+	db.Close()
+
+	retired, _ := ParseKeyring([]string{"new:" + testKey(2)})
+	if store, err = NewDeadLetterStore(path, retired); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	letter, err := store.Get(1)
+	if err != nil || letter.Mail.Message != "Secret" {
+		t.Errorf("Dead letter should open without the retired key, got %+v %v", letter, err)
+	}
+}
+
+func TestArchiveEncryption(t *testing.T) {
+	keyring, _ := ParseKeyring([]string{"a:" + testKey(1)})
+	for _, format := range []string{"maildir", "mbox"} {
+		dir, err := ioutil.TempDir("", "archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		archive, err := NewArchive(format, dir, 0, keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive.Store(&mailStruct{ID: "1", Subject: "Hello", Message: "Public"})
+		archive.Store(&mailStruct{ID: "2", Subject: "Contract", Message: "Secret"})
+		read := func() string {
+			var content string
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					data, _ := ioutil.ReadFile(path)
+					content += string(data) + "\n"
+				}
+				return nil
+			})
+			return content
+		}
+		if content := read(); strings.Contains(content, "Secret") || strings.Contains(content, "Contract") {
+			t.Errorf("%s: Archived mail should be sealed: %s", format, content)
+		}
+
+		if err := archive.Redact("2", time.Now()); err != nil {
+			t.Fatalf("%s: Sealed mail should be redacted, got %v", format, err)
+		}
+		opened := ""
+		for _, line := range strings.Split(read(), "\n") {
+			if plain, err := keyring.Open([]byte(line)); err == nil {
+				opened += string(plain)
+			}
+		}
+		if !strings.Contains(opened, "Public") || !strings.Contains(opened, "Subject: Contract") || strings.Contains(opened, "Secret") {
+			t.Errorf("%s: Only the body of the sealed mail should be redacted: %s", format, opened)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrEscalationTimeout = fmt.Errorf("channelmailer: Channel did not deliver in time")
+
+	escalationConfig = &EscalationConfig{}
+)
+
+// EscalationConfig is the policy of the critical
+// mail e.g. email,sms,push. Each channel has After
+// to deliver before the next one is tried.
+type EscalationConfig struct {
+	Channels []string
+	After    time.Duration `default:"5m"`
+}
+
+func init() {
+	RegisterConfig("escalation", escalationConfig)
+}
+
+// SetEscalation sets the policy for the critical
+// mail of the recipients without preferences.
+func (cm *ChannelMailer) SetEscalation(channels []string, after time.Duration) {
+	cm.escalation = channels
+	cm.escalateAfter = after
+}
+
+// escalate tries the policy channels in order
+// and moves to the next when the channel fails
+// or does not deliver in time. The service has
+// no delivery or open receipts, so the channel
+// accepting the message counts as delivered.
+func (cm *ChannelMailer) escalate(mail *mailStruct) error {
+	err := ErrUnknownChannel
+	for _, name := range cm.escalation {
+		channel, ok := cm.channels[name]
+		if !ok {
+			log.Warnf("Escalation channel %s not enabled", name)
+			continue
+		}
+		if err = cm.sendWithin(channel, mail); err == nil {
+			return nil
+		}
+		log.Errorf("Escalating %s after channel %s: %s", mail.Recipient, name, err)
+	}
+	return err
+}
+
+// sendWithin gives up on the channel after the
+// escalation timeout. The call itself is not
+// cancelled, so the recipient may be notified
+// by both channels.
+func (cm *ChannelMailer) sendWithin(channel Mailer, mail *mailStruct) error {
+	if cm.escalateAfter <= 0 {
+		return channel.SendMail(mail)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- channel.SendMail(mail)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(cm.escalateAfter):
+		return ErrEscalationTimeout
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type etcdNode struct {
+	Key   string
+	Value string
+	Nodes []etcdNode
+}
+
+// loadEtcdDir reads the values of the etcd
+// directory through the v2 keys API, keyed
+// by the last element of their key. Missing
+// directory is not an error.
+func loadEtcdDir(endpoint, key string) (map[string]string, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/v2/keys%s?recursive=true", endpoint, key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	values := map[string]string{}
+	if resp.StatusCode == http.StatusNotFound {
+		return values, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("etcd: %s returned %d", key, resp.StatusCode)
+	}
+
+	result := struct{ Node etcdNode }{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	for _, node := range result.Node.Nodes {
+		values[path.Base(node.Key)] = node.Value
+	}
+	return values, nil
+}
+
+// loadEtcdValue reads single etcd key,
+// the missing key is reported by ok.
+func loadEtcdValue(endpoint, key string) (value string, ok bool, err error) {
+	resp, err := http.Get(fmt.Sprintf("%s/v2/keys%s", endpoint, key))
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("etcd: %s returned %d", key, resp.StatusCode)
+	}
+
+	result := struct{ Node etcdNode }{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", false, err
+	}
+	return result.Node.Value, true, nil
+}
+
+// storeEtcdValue sets single etcd key
+// which expires after ttl unless refreshed.
+func storeEtcdValue(endpoint, key, value string, ttl time.Duration) error {
+	status, err := putEtcdValue(endpoint, key, value, ttl, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		return fmt.Errorf("etcd: %s returned %d", key, status)
+	}
+	return nil
+}
+
+// swapEtcdValue sets the key only if the
+// conditions e.g. prevExist=false hold,
+// the failed condition is reported by ok.
+func swapEtcdValue(endpoint, key, value string, ttl time.Duration, conditions url.Values) (ok bool, err error) {
+	status, err := putEtcdValue(endpoint, key, value, ttl, conditions)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusPreconditionFailed, http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("etcd: %s returned %d", key, status)
+}
+
+func putEtcdValue(endpoint, key, value string, ttl time.Duration, conditions url.Values) (int, error) {
+	form := url.Values{}
+	for name, values := range conditions {
+		form[name] = values
+	}
+	form.Set("value", value)
+	if ttl > 0 {
+		form.Set("ttl", strconv.Itoa(int(ttl.Seconds())))
+	}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/v2/keys%s", endpoint, key), strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
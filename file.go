@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var fileConfig = &FileConfig{}
+
+type FileConfig struct {
+	Dir string `default:"./maildir"`
+}
+
+func init() {
+	RegisterConfig("file", fileConfig)
+	RegisterMailer("file", func() (Mailer, error) {
+		return NewFileMailer(fileConfig.Dir, appConfig.Sender)
+	})
+}
+
+// FileMailer writes every message into
+// a maildir-like directory structure instead of
+// sending it, so the tests can assert on it.
+type FileMailer struct {
+	maildir *maildir
+	sender  string
+}
+
+func NewFileMailer(dir, sender string) (Mailer, error) {
+	md, err := newMaildir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &FileMailer{
+		maildir: md,
+		sender:  sender,
+	}, nil
+}
+
+func (fm *FileMailer) SendMail(mail *mailStruct) error {
+	m := *mail
+	m.Sender = senderOf(mail, fm.sender)
+
+	path, err := fm.maildir.write(composeMessage(&m, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Mail to %s written to %s", m.Recipient, path)
+	return nil
+}
+
+func (fm *FileMailer) Check() error {
+	_, err := os.Stat(filepath.Join(fm.maildir.dir, "new"))
+	return err
+}
+
+func (fm *FileMailer) Close() {}
+
+type maildir struct {
+	dir      string
+	hostname string
+	counter  uint64
+}
+
+func newMaildir(dir string) (*maildir, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return &maildir{
+		dir:      dir,
+		hostname: hostname,
+	}, nil
+}
+
+// write stores the message in new
+// and returns the path of the file.
+func (md *maildir) write(content []byte) (string, error) {
+	name := fmt.Sprintf("%d.%d_%d.%s",
+		time.Now().UnixNano(),
+		os.Getpid(),
+		atomic.AddUint64(&md.counter, 1),
+		md.hostname)
+
+	// Write to tmp first and move to new,
+	// so readers never see partial messages.
+	tmpPath := filepath.Join(md.dir, "tmp", name)
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return "", err
+	}
+	newPath := filepath.Join(md.dir, "new", name)
+	if err := os.Rename(tmpPath, newPath); err != nil {
+		return "", err
+	}
+	return newPath, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mailer, err := NewFileMailer(dir, "info@suricata.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer.SendMail(&mailStruct{
+		Recipient: "radek@suricata.com",
+		Subject:   "Hello",
+		Message:   "Test",
+	})
+
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message, got %d", len(files))
+	}
+
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	msg := string(content)
+	if !strings.Contains(msg, "From: info@suricata.com\r\n") ||
+		!strings.Contains(msg, "To: radek@suricata.com\r\n") ||
+		!strings.Contains(msg, "Subject: Hello\r\n") ||
+		!strings.HasSuffix(msg, "\r\n\r\nTest") {
+		t.Errorf("Message bad written: %s", msg)
+	}
+}
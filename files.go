@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FilesPath serves the files
+// of the download links.
+const FilesPath = "/files/"
+
+// SetSingleUse makes the
+// next stored files single use.
+func (s *LinkStore) SetSingleUse(singleUse bool) {
+	s.singleUse = singleUse
+}
+
+// Open returns the stored file of the valid
+// token and the path to its data. The single
+// use file is taken out of the store, the
+// caller removes it once it is served.
+func (s *LinkStore) Open(token string) (*storedFile, string, error) {
+	id, err := s.verify(token)
+	if err != nil {
+		return nil, "", err
+	}
+	file, err := s.meta(id)
+	if os.IsNotExist(err) {
+		return nil, "", ErrFileGone
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	data := filepath.Join(s.dir, id)
+	if !file.SingleUse {
+		return file, data, nil
+	}
+	// Rename is atomic, so only
+	// one download can take it
+	taken := data + ".taken"
+	if err := os.Rename(data, taken); err != nil {
+		return nil, "", ErrFileGone
+	}
+	os.Remove(data + ".json")
+	return file, taken, nil
+}
+
+func (s *LinkStore) meta(id string) (*storedFile, error) {
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	file := &storedFile{}
+	if err := json.Unmarshal(content, file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Sweep removes the expired files in
+// given interval until stop is closed.
+func (s *LinkStore) Sweep(interval time.Duration, stop <-chan struct{}) {
+	for {
+		s.sweep()
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *LinkStore) sweep() {
+	metas, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	for _, path := range metas {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		file, err := s.meta(id)
+		if err != nil || s.now().After(file.Expires) {
+			os.Remove(filepath.Join(s.dir, id))
+			os.Remove(path)
+		}
+	}
+}
+
+// FilesFunc serves the file of the download
+// link token and logs every download.
+func FilesFunc(store *LinkStore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.TrimPrefix(req.URL.Path, FilesPath)
+		file, path, err := store.Open(token)
+		switch err {
+		case nil:
+		case ErrBadToken:
+			http.NotFound(rw, req)
+			return
+		case ErrLinkExpired, ErrFileGone:
+			http.Error(rw, err.Error(), http.StatusGone)
+			return
+		default:
+			log.Errorf("Cannot open file: %s", err)
+			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if file.SingleUse {
+			defer os.Remove(path)
+		}
+
+		log.Infof("Download of %s from %s by %s", file.Filename, req.RemoteAddr, req.UserAgent())
+		rw.Header().Set("Content-Type", file.ContentType)
+		rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename}))
+		http.ServeFile(rw, req, path)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilesFunc(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "files")
+	defer os.RemoveAll(dir)
+	store, _ := NewLinkStore(dir, "", "secret", time.Hour)
+	store.SetSingleUse(true)
+	link, _, err := store.Put(Attachment{Filename: "report.pdf", Data: []byte("report")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		FilesFunc(store)(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	rec := download(link)
+	if rec.Code != http.StatusOK || rec.Body.String() != "report" {
+		t.Fatalf("Expected the file, got %d %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), "report.pdf") {
+		t.Errorf("Unexpected Content-Disposition %s", rec.Header().Get("Content-Disposition"))
+	}
+	if rec := download(link); rec.Code != http.StatusGone {
+		t.Errorf("Single use file should be gone, got %d", rec.Code)
+	}
+	if rec := download(FilesPath + "forged.1.x"); rec.Code != http.StatusNotFound {
+		t.Errorf("Forged token should not be found, got %d", rec.Code)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Downloaded file should be removed, got %d files", len(files))
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FixturesPath returns the bundle of
+// the templates rendered with their
+// sample data.
+const FixturesPath = "/v1/templates/fixtures"
+
+// TemplateSampleFile declares the Data the
+// template is rendered with for the fixtures,
+// the template without it is left out.
+const TemplateSampleFile = "sample.json"
+
+// Names lists the templates of the directory
+// and of its namespaces, sorted.
+func (s *DirTemplateStore) Names() ([]string, error) {
+	names := []string{}
+	var walk func(namespace string) error
+	walk = func(namespace string) error {
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, namespace))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			name := path.Join(namespace, file.Name())
+			if !file.IsDir() || !validTemplateName(name) {
+				continue
+			}
+			if _, err := latestModTime(filepath.Join(s.dir, name)); err == nil {
+				names = append(names, name)
+			} else if len(namespace) == 0 {
+				if err := walk(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Sample returns the sample Data of the
+// template, nil if it declares none.
+func (s *DirTemplateStore) Sample(name string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, name, TemplateSampleFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{}
+	return data, json.Unmarshal(content, &data)
+}
+
+// renderFixture renders the template
+// as the mail would be sent.
+func renderFixture(t *Template, data map[string]interface{}) (*mailStruct, error) {
+	m := &mailStruct{Data: data}
+	if err := t.Render(m); err != nil {
+		return nil, err
+	}
+	if err := applyMarkdown(m); err != nil {
+		return nil, err
+	}
+	if templateConfig.DarkMode && len(m.Html) > 0 {
+		m.Html = injectDarkMode(m.Html)
+	}
+	return m, nil
+}
+
+// renderSamples renders each template with the
+// sample data the filter allows, in order.
+func renderSamples(store *DirTemplateStore, allowed func(name string) bool, rendered func(name string, m *mailStruct) error) error {
+	names, err := store.Names()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !allowed(name) {
+			continue
+		}
+		data, err := store.Sample(name)
+		if err != nil {
+			return &RenderError{name, err}
+		}
+		if data == nil {
+			continue
+		}
+		t, err := store.Template(name)
+		if err != nil {
+			return err
+		}
+		m, err := renderFixture(t, data)
+		if err != nil {
+			return &RenderError{name, err}
+		}
+		if err := rendered(name, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFixtures zips the subject, text and
+// HTML of every template with the sample
+// data the filter allows, in the template
+// file layout e.g. welcome/message.html.
+func WriteFixtures(buf *bytes.Buffer, store *DirTemplateStore, allowed func(name string) bool) error {
+	bundle := zip.NewWriter(buf)
+	err := renderSamples(store, allowed, func(name string, m *mailStruct) error {
+		// Same order every time, so
+		// the bundle is reproducible
+		files := []struct{ name, content string }{
+			{TemplateSubjectFile, m.Subject},
+			{TemplateMessageFile, m.Message},
+			{TemplateHtmlFile, m.Html},
+		}
+		for _, file := range files {
+			if len(file.content) == 0 {
+				continue
+			}
+			w, err := bundle.Create(path.Join(name, file.name))
+			if err != nil {
+				return err
+			}
+			w.Write([]byte(file.content))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bundle.Close()
+}
+
+// templateFilter allows the templates of the
+// account of the request, all of them without
+// the accounts. It answers 401 to the request
+// without the account.
+func templateFilter(accounts []*TemplateAccount, rw http.ResponseWriter, req *http.Request) (func(name string) bool, bool) {
+	if len(accounts) == 0 {
+		return func(name string) bool { return true }, true
+	}
+	account := authenticateTemplateAccount(accounts, req)
+	if account == nil {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+	return account.Allows, true
+}
+
+// renderErrorStatus answers the template failing
+// with its sample data by 422, else by 500.
+func renderErrorStatus(rw http.ResponseWriter, err error) {
+	if _, ok := err.(*RenderError); ok {
+		http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Errorf("Cannot render the templates: %s", err)
+	http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// FixturesFunc returns the fixtures bundle to GET,
+// with the accounts only the templates of the
+// account asking for it.
+func FixturesFunc(store *DirTemplateStore, accounts []*TemplateAccount) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		allowed, ok := templateFilter(accounts, rw, req)
+		if !ok {
+			return
+		}
+		var buf bytes.Buffer
+		if err := WriteFixtures(&buf, store, allowed); err != nil {
+			renderErrorStatus(rw, err)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/zip")
+		rw.Header().Set("Content-Disposition", "attachment; filename=fixtures.zip")
+		rw.Write(buf.Bytes())
+	}
+}
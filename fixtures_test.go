@@ -0,0 +1,48 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixturesFunc(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	write := func(name, file, content string) {
+		os.MkdirAll(filepath.Join(dir, name), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name, file), []byte(content), 0644)
+	}
+	write("welcome", TemplateSubjectFile, "Welcome {{.Name}}")
+	write("welcome", TemplateMarkdownFile, "Hello **{{.Name}}**")
+	write("welcome", TemplateSampleFile, `{"Name": "Radek"}`)
+	write("marketing/newsletter", TemplateSubjectFile, "News for {{.Name}}")
+	write("marketing/newsletter", TemplateSampleFile, `{"Name": "Radek"}`)
+	write("reset", TemplateSubjectFile, "Reset {{.Code}}")
+
+	rw := httptest.NewRecorder()
+	FixturesFunc(NewDirTemplateStore(dir), nil)(rw, httptest.NewRequest("GET", FixturesPath, nil))
+	bundle, err := zip.NewReader(bytes.NewReader(rw.Body.Bytes()), int64(rw.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, file := range bundle.File {
+		r, _ := file.Open()
+		content, _ := ioutil.ReadAll(r)
+		files[file.Name] = string(content)
+	}
+	if len(files) != 4 {
+		t.Errorf("Templates with sample data should be rendered, got %v", files)
+	}
+	if files["welcome/subject.txt"] != "Welcome Radek" || files["marketing/newsletter/subject.txt"] != "News for Radek" {
+		t.Errorf("Unexpected subjects %v", files)
+	}
+	if files["welcome/message.txt"] != "Hello **Radek**" || !bytes.Contains([]byte(files["welcome/message.html"]), []byte("<strong>Radek</strong>")) {
+		t.Errorf("Markdown should be rendered as sent, got %v", files)
+	}
+}
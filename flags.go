@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FlagsKey is the etcd directory holding
+// one JSON encoded Flag per key.
+const FlagsKey = "/mail/flags"
+
+// Flag enables the feature for listed
+// tenants and the percentage of the others.
+type Flag struct {
+	Percent int
+	Tenants []string
+}
+
+// FeatureFlags gate the new behaviors so they
+// can be rolled out gradually. Unknown flags
+// are always disabled.
+type FeatureFlags struct {
+	mutex sync.RWMutex
+	flags map[string]Flag
+}
+
+func NewFeatureFlags() *FeatureFlags {
+	return &FeatureFlags{
+		flags: map[string]Flag{},
+	}
+}
+
+// Enabled tells whether the flag is on for the
+// tenant. The same tenant always falls into the
+// same bucket, so raising the percentage only
+// adds tenants.
+func (f *FeatureFlags) Enabled(name, tenant string) bool {
+	f.mutex.RLock()
+	flag, ok := f.flags[name]
+	f.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+
+	for _, t := range flag.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name + "/" + tenant))
+	return int(h.Sum32()%100) < flag.Percent
+}
+
+func (f *FeatureFlags) Set(flags map[string]Flag) {
+	f.mutex.Lock()
+	f.flags = flags
+	f.mutex.Unlock()
+}
+
+// Watch reloads the flags from etcd
+// in given interval until stop is closed.
+func (f *FeatureFlags) Watch(endpoint string, interval time.Duration, stop <-chan struct{}) {
+	for {
+		if flags, err := loadFlags(endpoint); err != nil {
+			log.Errorf("Cannot load feature flags: %s", err)
+		} else {
+			f.Set(flags)
+		}
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func loadFlags(endpoint string) (map[string]Flag, error) {
+	values, err := loadEtcdDir(endpoint, FlagsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := map[string]Flag{}
+	for name, value := range values {
+		flag := Flag{}
+		if err := json.Unmarshal([]byte(value), &flag); err != nil {
+			log.Errorf("Bad feature flag %s: %s", name, err)
+			continue
+		}
+		flags[name] = flag
+	}
+	return flags, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	flags := NewFeatureFlags()
+	flags.Set(map[string]Flag{
+		"digest":  {Tenants: []string{"suricata"}},
+		"rewrite": {Percent: 50},
+	})
+
+	if !flags.Enabled("digest", "suricata") || flags.Enabled("digest", "other") {
+		t.Error("Tenant list not respected")
+	}
+	if flags.Enabled("unknown", "suricata") {
+		t.Error("Unknown flag should be disabled")
+	}
+
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		if flags.Enabled("rewrite", fmt.Sprint(i)) {
+			enabled++
+		}
+	}
+	if enabled < 400 || enabled > 600 {
+		t.Errorf("Expected about half of tenants enabled, got %d", enabled)
+	}
+}
+
+func TestLoadFlags(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/keys"+FlagsKey {
+			t.Errorf("Bad etcd key requested %s", req.URL.Path)
+		}
+		rw.Write([]byte(`{"node":{"key":"/mail/flags","dir":true,"nodes":[
+			{"key":"/mail/flags/digest","value":"{\"Percent\":10}"}]}}`))
+	}))
+	defer server.Close()
+
+	flags, err := loadFlags(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags["digest"].Percent != 10 {
+		t.Errorf("Bad flags loaded %v", flags)
+	}
+}
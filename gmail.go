@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	GmailScope   = "https://www.googleapis.com/auth/gmail.send"
+	GmailSendURL = "https://gmail.googleapis.com/gmail/v1/users/me/messages/send"
+)
+
+var (
+	ErrBadServiceAccountKey = fmt.Errorf("gmailmailer: Service account key is not RSA private key")
+
+	gmailConfig = &GmailConfig{}
+)
+
+type GmailConfig struct {
+	// Service account JSON key with
+	// the domain-wide delegation
+	CredentialsFile string
+	// User the service account acts as,
+	// the sender is used if empty
+	User string
+}
+
+func init() {
+	RegisterConfig("gmail", gmailConfig)
+	RegisterMailer("gmail", func() (Mailer, error) {
+		user := gmailConfig.User
+		if len(user) == 0 {
+			user = appConfig.Sender
+		}
+		return NewGmailMailer(gmailConfig.CredentialsFile, user)
+	})
+}
+
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// GmailMailer sends the mail through the Gmail
+// API on behalf of the delegated user.
+type GmailMailer struct {
+	account serviceAccount
+	key     *rsa.PrivateKey
+	user    string
+	sendURL string
+	client  *http.Client
+	tokens  tokenCache
+}
+
+func NewGmailMailer(credentialsFile, user string) (Mailer, error) {
+	content, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	account := serviceAccount{}
+	if err := json.Unmarshal(content, &account); err != nil {
+		return nil, err
+	}
+	key, err := parseRSAKey(account.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(account.TokenURI) == 0 {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &GmailMailer{
+		account: account,
+		key:     key,
+		user:    user,
+		sendURL: GmailSendURL,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (gm *GmailMailer) SendMail(mail *mailStruct) error {
+	token, err := gm.tokens.get(gm.requestToken)
+	if err != nil {
+		return err
+	}
+
+	m := *mail
+	// Other sender than the user
+	// must be its send-as alias
+	m.Sender = senderOf(mail, gm.user)
+	out, err := json.Marshal(map[string]string{
+		"raw": base64.URLEncoding.EncodeToString(composeMessage(&m, time.Now())),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", gm.sendURL, bytes.NewReader(out))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := gm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("gmailmailer: Send returned %d %s", resp.StatusCode, body)
+	}
+
+	log.Infof("Mail to %s sent through Gmail as %s", m.Recipient, gm.user)
+	return nil
+}
+
+// requestToken exchanges the signed JWT
+// assertion for the access token.
+func (gm *GmailMailer) requestToken() (string, int, error) {
+	assertion, err := gm.assertion(time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+
+	resp, err := gm.client.Post(gm.account.TokenURI, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("gmailmailer: Token request returned %d", resp.StatusCode)
+	}
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, err
+	}
+	return token.AccessToken, token.ExpiresIn, nil
+}
+
+func (gm *GmailMailer) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   gm.account.ClientEmail,
+		"sub":   gm.user,
+		"scope": GmailScope,
+		"aud":   gm.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, gm.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
+
+// Check verifies the delegation is granted.
+func (gm *GmailMailer) Check() error {
+	_, err := gm.tokens.get(gm.requestToken)
+	return err
+}
+
+func (gm *GmailMailer) Close() {}
+
+func parseRSAKey(key string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, ErrBadServiceAccountKey
+	}
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if rsaKey, ok := parsed.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, ErrBadServiceAccountKey
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	GraphTokenURL = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
+	GraphAPIURL   = "https://graph.microsoft.com/v1.0"
+	GraphScope    = "https://graph.microsoft.com/.default"
+)
+
+var graphConfig = &GraphConfig{}
+
+type GraphConfig struct {
+	Tenant       string
+	ClientID     string
+	ClientSecret string
+	// Mailbox the mail is sent from,
+	// the sender is used if empty
+	User string
+}
+
+func init() {
+	RegisterConfig("graph", graphConfig)
+	RegisterMailer("graph", func() (Mailer, error) {
+		user := graphConfig.User
+		if len(user) == 0 {
+			user = appConfig.Sender
+		}
+		return NewGraphMailer(graphConfig.Tenant, graphConfig.ClientID, graphConfig.ClientSecret, user), nil
+	})
+}
+
+// GraphMailer sends the mail through the
+// Microsoft Graph sendMail API of the O365
+// tenant, authenticated by client credentials.
+type GraphMailer struct {
+	tokenURL     string
+	apiURL       string
+	clientID     string
+	clientSecret string
+	user         string
+	client       *http.Client
+	tokens       tokenCache
+}
+
+func NewGraphMailer(tenant, clientID, clientSecret, user string) Mailer {
+	return &GraphMailer{
+		tokenURL:     fmt.Sprintf(GraphTokenURL, tenant),
+		apiURL:       GraphAPIURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		user:         user,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type graphAddress struct {
+	EmailAddress struct {
+		Address string `json:"address"`
+	} `json:"emailAddress"`
+}
+
+type graphAttachment struct {
+	Type         string `json:"@odata.type"`
+	Name         string `json:"name"`
+	ContentType  string `json:"contentType"`
+	ContentBytes []byte `json:"contentBytes"`
+	ContentID    string `json:"contentId,omitempty"`
+	IsInline     bool   `json:"isInline,omitempty"`
+}
+
+type graphHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type graphMessage struct {
+	Message struct {
+		Subject    string `json:"subject"`
+		Importance string `json:"importance,omitempty"`
+		Body       struct {
+			ContentType string `json:"contentType"`
+			Content     string `json:"content"`
+		} `json:"body"`
+		From         *graphAddress     `json:"from,omitempty"`
+		ToRecipients []graphAddress    `json:"toRecipients"`
+		ReplyTo      []graphAddress    `json:"replyTo,omitempty"`
+		Attachments  []graphAttachment `json:"attachments,omitempty"`
+		// Graph accepts only X- prefixed headers
+		InternetMessageHeaders []graphHeader `json:"internetMessageHeaders,omitempty"`
+	} `json:"message"`
+	SaveToSentItems bool `json:"saveToSentItems"`
+}
+
+func (gm *GraphMailer) SendMail(mail *mailStruct) error {
+	token, err := gm.accessToken()
+	if err != nil {
+		return err
+	}
+
+	msg := graphMessage{}
+	msg.Message.Subject = mail.Subject
+	// Graph takes single body, HTML wins
+	msg.Message.Body.ContentType = "Text"
+	msg.Message.Body.Content = mail.Message
+	if len(mail.Html) > 0 {
+		msg.Message.Body.ContentType = "HTML"
+		msg.Message.Body.Content = mail.Html
+	}
+	if len(mail.Sender) > 0 {
+		// Mailbox needs the Send As
+		// permission for the sender
+		from := &graphAddress{}
+		from.EmailAddress.Address = mail.Sender
+		msg.Message.From = from
+	}
+	switch mail.Priority {
+	case PriorityHigh:
+		msg.Message.Importance = "high"
+	case PriorityBulk:
+		msg.Message.Importance = "low"
+	}
+	recipient := graphAddress{}
+	recipient.EmailAddress.Address = mail.Recipient
+	msg.Message.ToRecipients = []graphAddress{recipient}
+	if len(mail.ReplyTo) > 0 {
+		replyTo := graphAddress{}
+		replyTo.EmailAddress.Address = mail.ReplyTo
+		msg.Message.ReplyTo = []graphAddress{replyTo}
+	}
+	for _, name := range sortedHeaders(mail.Headers) {
+		msg.Message.InternetMessageHeaders = append(msg.Message.InternetMessageHeaders, graphHeader{
+			Name:  name,
+			Value: mail.Headers[name],
+		})
+	}
+	attachments := mail.Attachments
+	if calendar, ok := calendarAttachment(mail); ok {
+		attachments = append(append([]Attachment{}, attachments...), calendar)
+	}
+	for _, attachment := range attachments {
+		msg.Message.Attachments = append(msg.Message.Attachments, graphAttachment{
+			Type:         "#microsoft.graph.fileAttachment",
+			Name:         attachment.Filename,
+			ContentType:  attachment.MIMEType(),
+			ContentBytes: attachment.Data,
+			ContentID:    attachment.ContentID,
+			IsInline:     attachment.Inline(),
+		})
+	}
+
+	out, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/users/%s/sendMail", gm.apiURL, url.PathEscape(gm.user)), bytes.NewReader(out))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := gm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("graphmailer: sendMail returned %d %s", resp.StatusCode, body)
+	}
+
+	log.Infof("Mail to %s sent through Graph as %s", mail.Recipient, gm.user)
+	return nil
+}
+
+func (gm *GraphMailer) accessToken() (string, error) {
+	return gm.tokens.get(gm.requestToken)
+}
+
+func (gm *GraphMailer) requestToken() (string, int, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", gm.clientID)
+	form.Set("client_secret", gm.clientSecret)
+	form.Set("scope", GraphScope)
+
+	resp, err := gm.client.Post(gm.tokenURL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("graphmailer: Token request returned %d", resp.StatusCode)
+	}
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, err
+	}
+	return token.AccessToken, token.ExpiresIn, nil
+}
+
+// Check verifies the client credentials.
+func (gm *GraphMailer) Check() error {
+	_, err := gm.accessToken()
+	return err
+}
+
+func (gm *GraphMailer) Close() {}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGraphMailer(t *testing.T) {
+	tokenRequests := 0
+	var sent graphMessage
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, req *http.Request) {
+		tokenRequests++
+		if req.FormValue("grant_type") != "client_credentials" {
+			t.Error("Client credentials grant expected")
+		}
+		rw.Write([]byte(`{"access_token":"abc","expires_in":3600}`))
+	})
+	mux.HandleFunc("/users/info@suricata.com/sendMail", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer abc" {
+			t.Error("Missing access token")
+		}
+		json.NewDecoder(req.Body).Decode(&sent)
+		rw.WriteHeader(http.StatusAccepted)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mailer := NewGraphMailer("tenant", "id", "secret", "info@suricata.com").(*GraphMailer)
+	mailer.tokenURL = server.URL + "/token"
+	mailer.apiURL = server.URL
+
+	for i := 0; i < 2; i++ {
+		if err := mailer.SendMail(&mailStruct{Recipient: "radek@suricata.com", Subject: "Hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tokenRequests != 1 {
+		t.Errorf("Token should be cached, requested %d times", tokenRequests)
+	}
+	if sent.Message.Subject != "Hello" || sent.Message.ToRecipients[0].EmailAddress.Address != "radek@suricata.com" {
+		t.Errorf("Bad message sent %+v", sent)
+	}
+}
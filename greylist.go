@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var ErrDeferred = fmt.Errorf("greylistmailer: Destination is deferred until its retry")
+
+// isTemporary tells the 4xx SMTP reply
+// e.g. greylisting, the same mail is
+// expected to pass later.
+func isTemporary(err error) bool {
+	reply, ok := err.(*textproto.Error)
+	return ok && reply.Code >= 400 && reply.Code < 500
+}
+
+// isUnreachable tells the failed
+// connection to the server.
+func isUnreachable(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// GreylistMailer puts the mail temporarily
+// rejected by the destination off along the
+// schedule by the RetryError, so the queue keeps
+// it meanwhile. The destination domain is
+// deferred until its next retry, so the new
+// mail to it waits as well.
+type GreylistMailer struct {
+	mailer   Mailer
+	schedule []time.Duration
+	now      func() time.Time
+
+	mutex    sync.Mutex
+	deferred map[string]time.Time
+}
+
+func NewGreylistMailer(mailer Mailer, schedule []time.Duration) *GreylistMailer {
+	return &GreylistMailer{
+		mailer:   mailer,
+		schedule: schedule,
+		now:      time.Now,
+		deferred: make(map[string]time.Time),
+	}
+}
+
+func (gm *GreylistMailer) SendMail(mail *mailStruct) error {
+	domain, _ := recipientDomain(mail.Recipient)
+	now := gm.now()
+	gm.mutex.Lock()
+	until, ok := gm.deferred[domain]
+	if ok && !until.After(now) {
+		delete(gm.deferred, domain)
+	}
+	gm.mutex.Unlock()
+	if until.After(now) {
+		return &RetryError{Err: ErrDeferred, At: until, Attempts: mail.attempts}
+	}
+
+	err := gm.mailer.SendMail(mail)
+	if err == nil {
+		gm.mutex.Lock()
+		delete(gm.deferred, domain)
+		gm.mutex.Unlock()
+	}
+	// attempts counts the
+	// rejections so far
+	attempt := mail.attempts
+	if !isTemporary(err) || len(gm.schedule) == 0 {
+		return err
+	}
+	if attempt >= len(gm.schedule) {
+		log.Errorf("Mail to %s given up after %d attempts: %s", mail.Recipient, attempt+1, err)
+		return err
+	}
+	log.Infof("Mail to %s temporarily rejected: %s", mail.Recipient, err)
+	next := now.Add(gm.schedule[attempt])
+	gm.mutex.Lock()
+	if next.After(gm.deferred[domain]) {
+		gm.deferred[domain] = next
+	}
+	gm.mutex.Unlock()
+	return &RetryError{Err: err, At: next, Attempts: attempt + 1}
+}
+
+func (gm *GreylistMailer) Check() error {
+	if checker, ok := gm.mailer.(HealthChecker); ok {
+		return checker.Check()
+	}
+	return nil
+}
+
+func (gm *GreylistMailer) Close() {
+	gm.mailer.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+)
+
+// greylistingMailer rejects each recipient
+// the first times, every attempt is
+// reported to the tried channel.
+type greylistingMailer struct {
+	mutex    sync.Mutex
+	rejects  int
+	attempts map[string]int
+	sent     []string
+	tried    chan string
+}
+
+func newGreylistingMailer(rejects int) *greylistingMailer {
+	return &greylistingMailer{
+		rejects:  rejects,
+		attempts: map[string]int{},
+		tried:    make(chan string, 10),
+	}
+}
+
+func (gm *greylistingMailer) SendMail(mail *mailStruct) error {
+	gm.mutex.Lock()
+	defer func() {
+		gm.mutex.Unlock()
+		gm.tried <- mail.Recipient
+	}()
+	gm.attempts[mail.Recipient]++
+	if gm.attempts[mail.Recipient] <= gm.rejects {
+		return &textproto.Error{Code: 451, Msg: "4.7.1 Greylisted, try again later"}
+	}
+	gm.sent = append(gm.sent, mail.Recipient)
+	return nil
+}
+
+func (gm *greylistingMailer) Close() {}
+
+func (gm *greylistingMailer) count() int {
+	gm.mutex.Lock()
+	defer gm.mutex.Unlock()
+	return len(gm.sent)
+}
+
+func (gm *greylistingMailer) attemptsOf(recipient string) int {
+	gm.mutex.Lock()
+	defer gm.mutex.Unlock()
+	return gm.attempts[recipient]
+}
+
+// wait waits for the attempts.
+func (gm *greylistingMailer) wait(t *testing.T, attempts int) {
+	for i := 0; i < attempts; i++ {
+		select {
+		case <-gm.tried:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %d more attempts", attempts-i)
+		}
+	}
+}
+
+func TestGreylistMailer(t *testing.T) {
+	fake := newGreylistingMailer(2)
+	mailer := NewGreylistMailer(fake, []time.Duration{time.Minute, 2 * time.Minute})
+	now := time.Now()
+	mailer.now = func() time.Time { return now }
+	defer mailer.Close()
+
+	m := &mailStruct{Recipient: "radek@example.com"}
+	retry, ok := mailer.SendMail(m).(*RetryError)
+	if !ok || retry.Attempts != 1 || !retry.At.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Greylisted mail should be put off, got %v", retry)
+	}
+	fake.wait(t, 1)
+	// Deferred destination is not tried right away
+	other, ok := mailer.SendMail(&mailStruct{Recipient: "info@example.com"}).(*RetryError)
+	if !ok || other.Err != ErrDeferred || other.Attempts != 0 || fake.attemptsOf("info@example.com") != 0 {
+		t.Errorf("Mail to deferred destination should wait, got %v", other)
+	}
+
+	now = retry.At
+	m.attempts = retry.Attempts
+	if retry, ok = mailer.SendMail(m).(*RetryError); !ok || retry.Attempts != 2 || !retry.At.Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("Mail should be put off along the schedule, got %v", retry)
+	}
+	now = retry.At
+	m.attempts = retry.Attempts
+	if err := mailer.SendMail(m); err != nil || fake.count() != 1 {
+		t.Errorf("Retried mail should pass, got %v", err)
+	}
+	if err := mailer.SendMail(&mailStruct{Recipient: "info@example.com", attempts: 2}); !isTemporary(err) {
+		t.Errorf("Mail should be given up after the schedule, got %v", err)
+	}
+	fake.wait(t, 3)
+
+	permanent := NewGreylistMailer(&FakeMailer{err: fmt.Errorf("550 User unknown")}, nil)
+	if permanent.SendMail(&mailStruct{Recipient: "radek@example.com"}) == nil {
+		t.Error("Permanent failure should be returned")
+	}
+}
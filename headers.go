@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrHeaderNotAllowed = fmt.Errorf("headermailer: Header is not allowed")
+	ErrBadHeader        = fmt.Errorf("headermailer: Header contains line break")
+
+	headerConfig = &HeaderConfig{}
+)
+
+// HeaderConfig lists the custom
+// headers the mail can carry.
+type HeaderConfig struct {
+	Allowed []string `default:"X-Campaign-ID,List-Id"`
+}
+
+func init() {
+	RegisterConfig("header", headerConfig)
+}
+
+// HeaderMailer rejects the mail with custom
+// headers outside of the allowlist, so the
+// caller cannot override From, To and the
+// other headers set by the service.
+type HeaderMailer struct {
+	mailer  Mailer
+	allowed map[string]bool
+}
+
+func NewHeaderMailer(mailer Mailer, allowed []string) Mailer {
+	hm := &HeaderMailer{
+		mailer:  mailer,
+		allowed: make(map[string]bool),
+	}
+	for _, name := range allowed {
+		hm.allowed[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = true
+	}
+	return hm
+}
+
+func (hm *HeaderMailer) SendMail(mail *mailStruct) error {
+	for name, value := range mail.Headers {
+		if !hm.allowed[textproto.CanonicalMIMEHeaderKey(name)] {
+			return fmt.Errorf("%s: %s", ErrHeaderNotAllowed, name)
+		}
+		// Line break would inject another header
+		if strings.ContainsAny(name+value, "\r\n") {
+			return ErrBadHeader
+		}
+	}
+	return hm.mailer.SendMail(mail)
+}
+
+func (hm *HeaderMailer) Close() {
+	hm.mailer.Close()
+}
+
+// sortedHeaders returns the header names
+// in stable order for the composed message.
+func sortedHeaders(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
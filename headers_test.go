@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestHeaderMailer(t *testing.T) {
+	fake := &FakeMailer{}
+	mailer := NewHeaderMailer(fake, []string{"X-Campaign-ID", "List-Id"})
+
+	err := mailer.SendMail(&mailStruct{
+		Recipient: "radek@suricata.com",
+		Headers:   map[string]string{"x-campaign-id": "welcome", "List-Id": "<news.suricata.com>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.sent) != 1 {
+		t.Errorf("Expected mail to be sent, got %d", len(fake.sent))
+	}
+
+	err = mailer.SendMail(&mailStruct{
+		Recipient: "radek@suricata.com",
+		Headers:   map[string]string{"Bcc": "eve@example.com"},
+	})
+	if err == nil {
+		t.Error("Header outside of the allowlist should be rejected")
+	}
+
+	err = mailer.SendMail(&mailStruct{
+		Recipient: "radek@suricata.com",
+		Headers:   map[string]string{"List-Id": "news\r\nBcc: eve@example.com"},
+	})
+	if err != ErrBadHeader {
+		t.Errorf("Expected ErrBadHeader, got %v", err)
+	}
+}
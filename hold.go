@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// MailPath takes the ID of the
+	// held mail to cancel it
+	MailPath = "/v1/mail/"
+
+	// DefaultCampaign is the key of the window
+	// of the campaigns without their own
+	DefaultCampaign = "*"
+)
+
+var (
+	ErrNotHeld     = fmt.Errorf("holdingmailer: Mail is not held, it was sent or never seen")
+	ErrAlreadyHeld = fmt.Errorf("holdingmailer: Mail with the ID is already held")
+
+	// holdRetry puts the held mail off
+	// again while the queue is full
+	holdRetry = 5 * time.Second
+
+	holdConfig = &HoldConfig{}
+)
+
+// HoldConfig sets the undo window per
+// Campaign e.g. chat:30s,*:10s, the
+// mail without ID is never held.
+type HoldConfig struct {
+	Windows map[string]time.Duration
+}
+
+func init() {
+	RegisterConfig("hold", holdConfig)
+}
+
+// HoldingMailer keeps the mail for the window
+// of its campaign before passing it on, so
+// it can be cancelled by its ID meanwhile.
+// On the shutdown the held mail is released
+// to the queue, which keeps it until the
+// end of its window. The mail is held by its
+// caller and ID, the mail the queue refuses
+// goes to the optional deadLetters.
+type HoldingMailer struct {
+	mailer      Mailer
+	windows     map[string]time.Duration
+	deadLetters *DeadLetterStore
+
+	mutex sync.Mutex
+	held  map[string]*heldMail
+}
+
+type heldMail struct {
+	mail  mailStruct
+	due   time.Time
+	timer *time.Timer
+}
+
+func NewHoldingMailer(mailer Mailer, windows map[string]time.Duration) *HoldingMailer {
+	return &HoldingMailer{
+		mailer:  mailer,
+		windows: windows,
+		held:    make(map[string]*heldMail),
+	}
+}
+
+func (hm *HoldingMailer) window(campaign string) time.Duration {
+	if window, ok := hm.windows[campaign]; ok {
+		return window
+	}
+	return hm.windows[DefaultCampaign]
+}
+
+func (hm *HoldingMailer) SendMail(mail *mailStruct) error {
+	window := hm.window(mail.Campaign)
+	if len(mail.ID) == 0 || window <= 0 {
+		return hm.mailer.SendMail(mail)
+	}
+
+	m := *mail
+	key := heldKey(m.Caller, m.ID)
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	if _, ok := hm.held[key]; ok {
+		return ErrAlreadyHeld
+	}
+	hm.hold(key, m, time.Now().Add(window))
+	return nil
+}
+
+func heldKey(caller, id string) string {
+	return caller + "/" + id
+}
+
+// hold passes the mail on when it is due,
+// the mutex is held by the caller.
+func (hm *HoldingMailer) hold(key string, m mailStruct, due time.Time) {
+	hm.held[key] = &heldMail{
+		mail: m,
+		due:  due,
+		timer: time.AfterFunc(due.Sub(time.Now()), func() {
+			hm.mutex.Lock()
+			delete(hm.held, key)
+			hm.mutex.Unlock()
+			err := hm.mailer.SendMail(&m)
+			if err == ErrQueueFull {
+				log.Warnf("Queue is full, holding mail %s for %s more", m.ID, holdRetry)
+				hm.mutex.Lock()
+				hm.hold(key, m, time.Now().Add(holdRetry))
+				hm.mutex.Unlock()
+				return
+			}
+			hm.fail(&m, err)
+		}),
+	}
+}
+
+// fail keeps the held mail the
+// queue refused as the dead letter.
+func (hm *HoldingMailer) fail(m *mailStruct, err error) {
+	if err == nil {
+		return
+	}
+	log.Errorf("Held mail %s failed: %s", m.ID, err)
+	if hm.deadLetters == nil {
+		return
+	}
+	if err := hm.deadLetters.Add(m, failureReason(err), err, m.attempts, time.Now()); err != nil {
+		log.Errorf("Cannot keep the dead letter to %s: %s", m.Recipient, err)
+	}
+}
+
+// Cancel drops the held mail of the caller,
+// ErrNotHeld if it is too late. The empty
+// caller is the admin cancelling the mail
+// with the ID of any caller.
+func (hm *HoldingMailer) Cancel(id, caller string) error {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	cancelled := false
+	for key, h := range hm.held {
+		if h.mail.ID != id || (len(caller) > 0 && key != heldKey(caller, id)) {
+			continue
+		}
+		if h.timer.Stop() {
+			delete(hm.held, key)
+			cancelled = true
+		}
+	}
+	if !cancelled {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// Release passes the held mail on with the
+// end of its window as the DeliveryTime, it
+// cannot be cancelled anymore then.
+func (hm *HoldingMailer) Release() {
+	hm.mutex.Lock()
+	released := []heldMail{}
+	for _, h := range hm.held {
+		// The fired timer sends
+		// the mail on its own
+		if h.timer.Stop() {
+			released = append(released, *h)
+		}
+	}
+	hm.held = make(map[string]*heldMail)
+	hm.mutex.Unlock()
+
+	for _, h := range released {
+		m := h.mail
+		if h.due.After(m.DeliveryTime) {
+			m.DeliveryTime = h.due
+		}
+		hm.fail(&m, hm.mailer.SendMail(&m))
+	}
+	if len(released) > 0 {
+		log.Infof("Released %d held mails", len(released))
+	}
+}
+
+func (hm *HoldingMailer) Close() {
+	hm.Release()
+	hm.mailer.Close()
+}
+
+// CancelFunc cancels the held mail by DELETE of
+// MailPath with its ID. The caller of the mail
+// cancels it by its token in the TokenHeader,
+// the admin of the cancel scope any mail.
+func CancelFunc(hm *HoldingMailer, callers []*CallerAccount, admins []*TemplateAccount) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "DELETE" {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(req.URL.Path, MailPath)
+		caller, actor := "", ""
+		if account := authenticateCaller(callers, req.Header.Get(TokenHeader)); account != nil {
+			caller, actor = account.Name, account.Name
+		} else if admin := authorizeAdmin(rw, req, admins, ScopeCancel); admin != nil {
+			actor = admin.Name
+		} else {
+			return
+		}
+		if err := hm.Cancel(id, caller); err != nil {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Infof("Mail %s cancelled by %s", id, actor)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
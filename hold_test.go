@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncMailer is the FakeMailer
+// safe for the timer goroutines.
+type syncMailer struct {
+	mutex sync.Mutex
+	sent  []string
+}
+
+func (sm *syncMailer) SendMail(mail *mailStruct) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.sent = append(sm.sent, mail.ID)
+	return nil
+}
+
+func (sm *syncMailer) Close() {}
+
+func (sm *syncMailer) count() int {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return len(sm.sent)
+}
+
+func TestHoldingMailer(t *testing.T) {
+	fake := &syncMailer{}
+	mailer := NewHoldingMailer(fake, map[string]time.Duration{"chat": 20 * time.Millisecond})
+
+	mailer.SendMail(&mailStruct{Campaign: "chat"})
+	mailer.SendMail(&mailStruct{ID: "1", Campaign: "reset"})
+	if fake.count() != 2 {
+		t.Fatal("Mail without ID or window should go right away")
+	}
+
+	mailer.SendMail(&mailStruct{ID: "2", Campaign: "chat", Caller: "chat"})
+	mailer.SendMail(&mailStruct{ID: "3", Campaign: "chat", Caller: "chat"})
+	mailer.SendMail(&mailStruct{ID: "4", Campaign: "chat", Caller: "billing"})
+	if err := mailer.SendMail(&mailStruct{ID: "4", Campaign: "chat", Caller: "billing"}); err != ErrAlreadyHeld {
+		t.Errorf("Same mail of the caller should conflict, got %v", err)
+	}
+	if err := mailer.SendMail(&mailStruct{ID: "2", Campaign: "chat", Caller: "billing"}); err != nil {
+		t.Errorf("Mail of other caller should be held with the same ID, got %v", err)
+	}
+	callers, _ := ParseCallers([]string{"chat:secret", "billing:other"})
+	admins, _ := ParseTemplateAccounts([]string{"ops:admin:cancel", "support:help:approve"})
+	cancel := func(id string, header, value string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("DELETE", MailPath+id, nil)
+		req.Header.Set(header, value)
+		CancelFunc(mailer, callers, admins)(rec, req)
+		return rec.Code
+	}
+	if code := cancel("3", TokenHeader, "other"); code != http.StatusConflict {
+		t.Errorf("Mail of other caller should not be cancelled, got %d", code)
+	}
+	if code := cancel("2", TokenHeader, "secret"); code != http.StatusNoContent {
+		t.Errorf("Held mail should be cancelled by its caller, got %d", code)
+	}
+	if code := cancel("4", "Authorization", ""); code != http.StatusUnauthorized {
+		t.Errorf("Anonymous cancel should be refused, got %d", code)
+	}
+	if code := cancel("4", "Authorization", "Bearer help"); code != http.StatusForbidden {
+		t.Errorf("Admin without the scope should be refused, got %d", code)
+	}
+	if code := cancel("4", "Authorization", "Bearer admin"); code != http.StatusNoContent {
+		t.Errorf("Admin should cancel any mail, got %d", code)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if fake.count() != 4 || fake.sent[2] == "4" || fake.sent[3] == "4" {
+		t.Errorf("Only the not cancelled mail should be sent, got %v", fake.sent)
+	}
+	if mailer.Cancel("3", "") != ErrNotHeld {
+		t.Error("Sent mail cannot be cancelled")
+	}
+}
+
+func TestHoldingMailerRelease(t *testing.T) {
+	fake := &FakeMailer{}
+	mailer := NewHoldingMailer(fake, map[string]time.Duration{"chat": time.Hour})
+	before := time.Now()
+
+	mailer.SendMail(&mailStruct{ID: "1", Campaign: "chat"})
+	mailer.Close()
+	if len(fake.sent) != 1 || fake.sent[0].DeliveryTime.Before(before.Add(time.Hour)) {
+		t.Fatalf("Held mail should be released with the end of its window, got %v", fake.sent)
+	}
+	if mailer.Cancel("1", "") != ErrNotHeld {
+		t.Error("Released mail cannot be cancelled")
+	}
+}
+
+func TestHoldingMailerFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hold")
+	defer os.RemoveAll(dir)
+	deadLetters, err := NewDeadLetterStore(filepath.Join(dir, "deadletter.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deadLetters.Close()
+	retry := holdRetry
+	holdRetry = 10 * time.Millisecond
+	defer func() { holdRetry = retry }()
+
+	failing := &failingMailer{errors: []error{ErrQueueFull, ErrScheduledTooFar}}
+	mailer := NewHoldingMailer(failing, map[string]time.Duration{"chat": 10 * time.Millisecond})
+	mailer.deadLetters = deadLetters
+	mailer.SendMail(&mailStruct{ID: "1", Campaign: "chat"})
+	mailer.SendMail(&mailStruct{ID: "2", Campaign: "chat"})
+	time.Sleep(80 * time.Millisecond)
+
+	list, _ := deadLetters.List("")
+	failing.mutex.Lock()
+	defer failing.mutex.Unlock()
+	if failing.sent != 1 || len(list) != 1 || list[0].Reason != ReasonValidation {
+		t.Errorf("Held mail should be retried on full queue and dead letter otherwise, sent %d, got %+v", failing.sent, list)
+	}
+}
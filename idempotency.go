@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// IdempotentMailer drops the mail with the
+// IdempotencyKey seen within the TTL, so the
+// NATS redeliveries and the client retries
+// do not send the same mail twice. The key is
+// reserved as the mail is accepted and released
+// once the mail fails for good, by this
+// instance only.
+type IdempotentMailer struct {
+	mailer Mailer
+	ttl    time.Duration
+	now    func() time.Time
+
+	mutex     sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewIdempotentMailer(mailer Mailer, ttl time.Duration) *IdempotentMailer {
+	return &IdempotentMailer{
+		mailer: mailer,
+		ttl:    ttl,
+		now:    time.Now,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+func (im *IdempotentMailer) SendMail(mail *mailStruct) error {
+	if len(mail.IdempotencyKey) == 0 || im.ttl <= 0 {
+		return im.mailer.SendMail(mail)
+	}
+	if !im.reserve(mail.IdempotencyKey) {
+		log.Infof("Dropping duplicate mail %s for %s", mail.IdempotencyKey, mail.Recipient)
+		return nil
+	}
+	if err := im.mailer.SendMail(mail); err != nil {
+		// Rejected mail can be retried
+		im.Release(mail.IdempotencyKey)
+		return err
+	}
+	return nil
+}
+
+// reserve records the key unless it was seen
+// within the TTL and sweeps the expired
+// ones once per TTL.
+func (im *IdempotentMailer) reserve(key string) bool {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+
+	now := im.now()
+	if seen, ok := im.seen[key]; ok && now.Sub(seen) <= im.ttl {
+		return false
+	}
+	if now.Sub(im.lastSweep) > im.ttl {
+		for k, seen := range im.seen {
+			if now.Sub(seen) > im.ttl {
+				delete(im.seen, k)
+			}
+		}
+		im.lastSweep = now
+	}
+	im.seen[key] = now
+	return true
+}
+
+// Release forgets the key of the mail
+// failed for good, so it can be sent again.
+func (im *IdempotentMailer) Release(key string) {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	delete(im.seen, key)
+}
+
+func (im *IdempotentMailer) Close() {
+	im.mailer.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go"
+)
+
+func TestIdempotentMailer(t *testing.T) {
+	fake := &FakeMailer{}
+	mailer := NewIdempotentMailer(fake, time.Hour)
+	now := time.Now()
+	mailer.now = func() time.Time { return now }
+
+	mailer.SendMail(&mailStruct{IdempotencyKey: "reset-42"})
+	mailer.SendMail(&mailStruct{IdempotencyKey: "reset-42"})
+	mailer.SendMail(&mailStruct{})
+	mailer.SendMail(&mailStruct{})
+	if len(fake.sent) != 3 {
+		t.Errorf("Duplicate should be dropped, sent %d", len(fake.sent))
+	}
+
+	fake.err = fmt.Errorf("provider down")
+	mailer.SendMail(&mailStruct{IdempotencyKey: "welcome-42"})
+	fake.err = nil
+	mailer.SendMail(&mailStruct{IdempotencyKey: "welcome-42"})
+	if len(fake.sent) != 4 {
+		t.Error("Failed mail should not be remembered")
+	}
+
+	now = now.Add(2 * time.Hour)
+	mailer.SendMail(&mailStruct{IdempotencyKey: "reset-42"})
+	if len(fake.sent) != 5 {
+		t.Error("Key should expire after the TTL")
+	}
+	if len(mailer.seen) != 1 {
+		t.Errorf("Expired keys should be swept, got %d", len(mailer.seen))
+	}
+}
+
+func TestIdempotentMailerConcurrent(t *testing.T) {
+	fake := &syncMailer{}
+	mailer := NewIdempotentMailer(fake, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mailer.SendMail(&mailStruct{IdempotencyKey: "reset-42"})
+		}()
+	}
+	wg.Wait()
+	if fake.count() != 1 {
+		t.Errorf("Concurrent duplicates should be accepted once, sent %d", fake.count())
+	}
+}
+
+func TestIdempotentMailerReleased(t *testing.T) {
+	fake := &failingMailer{errors: []error{&mailgun.UnexpectedResponseError{Actual: 400}}}
+	retry := NewRetryMailer(fake, &RetryConfig{Attempts: 3, Initial: time.Hour, Max: time.Hour})
+	queue := NewQueuedMailer(retry, nil, 1, 0)
+	defer queue.Close()
+	mailer := NewIdempotentMailer(queue, time.Hour)
+	retry.idempotency = mailer
+
+	mailer.SendMail(&mailStruct{IdempotencyKey: "reset-42"})
+	for i := 0; i < 100 && queue.Depth() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	mailer.SendMail(&mailStruct{IdempotencyKey: "reset-42"})
+	for i := 0; i < 100 && fake.count() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if fake.count() != 1 {
+		t.Errorf("Mail failed for good should be accepted again, sent %d", fake.count())
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	InstanceHeader = "X-Mail-Instance"
+	VersionHeader  = "X-Mail-Version"
+)
+
+// IdentityHandler marks every response
+// with the instance which handled it.
+func IdentityHandler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(InstanceHeader, name)
+		rw.Header().Set(VersionHeader, Version)
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// InstanceHook adds the instance name and
+// version to every log entry, so the delivery
+// events can be attributed to the node.
+type InstanceHook struct {
+	name string
+}
+
+func NewInstanceHook(name string) *InstanceHook {
+	return &InstanceHook{name}
+}
+
+func (h *InstanceHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
+	}
+}
+
+func (h *InstanceHook) Fire(entry *log.Entry) error {
+	entry.Data["instance"] = h.name
+	entry.Data["version"] = Version
+	return nil
+}
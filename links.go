@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingLinkSecret = fmt.Errorf("links: Secret is required to sign the links")
+	ErrBadToken          = fmt.Errorf("links: Token is not valid")
+	ErrLinkExpired       = fmt.Errorf("links: Link expired")
+	ErrFileGone          = fmt.Errorf("links: File was already downloaded")
+
+	linkConfig = &LinkConfig{}
+)
+
+// LinkConfig enables the download links by
+// the Secret, the attachments larger than
+// Threshold are replaced by the links of
+// BaseURL, zero disables the replacement.
+type LinkConfig struct {
+	Threshold int64
+	Dir       string `default:"./files"`
+	BaseURL   string `default:"http://127.0.0.1:5050"`
+	Secret    string
+	TTL       time.Duration `default:"168h"`
+	// File is deleted after
+	// the first download
+	SingleUse bool
+}
+
+func init() {
+	RegisterConfig("link", linkConfig)
+}
+
+// storedFile describes the
+// file kept next to its data.
+type storedFile struct {
+	Filename    string
+	ContentType string
+	Expires     time.Time
+	SingleUse   bool
+}
+
+// LinkStore keeps the files in the directory
+// and signs the expiring links to them.
+type LinkStore struct {
+	dir       string
+	baseURL   string
+	secret    []byte
+	ttl       time.Duration
+	singleUse bool
+	now       func() time.Time
+}
+
+func NewLinkStore(dir, baseURL, secret string, ttl time.Duration) (*LinkStore, error) {
+	if len(secret) == 0 {
+		return nil, ErrMissingLinkSecret
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &LinkStore{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  []byte(secret),
+		ttl:     ttl,
+		now:     time.Now,
+	}, nil
+}
+
+// Put stores the attachment and returns
+// the link valid until it expires.
+func (s *LinkStore) Put(attachment Attachment) (string, time.Time, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", time.Time{}, err
+	}
+	id := hex.EncodeToString(random)
+	expires := s.now().Add(s.ttl)
+
+	meta, _ := json.Marshal(storedFile{
+		Filename:    attachment.Filename,
+		ContentType: attachment.MIMEType(),
+		Expires:     expires,
+		SingleUse:   s.singleUse,
+	})
+	if err := ioutil.WriteFile(filepath.Join(s.dir, id), attachment.Data, 0600); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.dir, id+".json"), meta, 0600); err != nil {
+		return "", time.Time{}, err
+	}
+	return fmt.Sprintf("%s/files/%s", s.baseURL, s.token(id, expires)), expires, nil
+}
+
+// token is the id with the expiry
+// signed by HMAC-SHA256.
+func (s *LinkStore) token(id string, expires time.Time) string {
+	payload := id + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + s.sign(payload)
+}
+
+func (s *LinkStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the id of the file
+// if the token is valid and not expired.
+func (s *LinkStore) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrBadToken
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(s.sign(payload)), []byte(parts[2])) {
+		return "", ErrBadToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", ErrBadToken
+	}
+	if s.now().Unix() > expires {
+		return "", ErrLinkExpired
+	}
+	return parts[0], nil
+}
+
+// LinkMailer replaces the large attachments
+// by the download links appended to the
+// bodies, so the mail stays small.
+type LinkMailer struct {
+	mailer    Mailer
+	store     *LinkStore
+	threshold int64
+}
+
+func NewLinkMailer(mailer Mailer, store *LinkStore, threshold int64) Mailer {
+	return &LinkMailer{
+		mailer:    mailer,
+		store:     store,
+		threshold: threshold,
+	}
+}
+
+func (lm *LinkMailer) SendMail(mail *mailStruct) error {
+	m := *mail
+	m.Attachments = make([]Attachment, 0, len(mail.Attachments))
+	var text, markup bytes.Buffer
+	for _, attachment := range mail.Attachments {
+		if attachment.Inline() || int64(len(attachment.Data)) <= lm.threshold {
+			m.Attachments = append(m.Attachments, attachment)
+			continue
+		}
+		link, expires, err := lm.store.Put(attachment)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&text, "\n%s: %s (until %s)", attachment.Filename, link, expires.Format("2006-01-02"))
+		fmt.Fprintf(&markup, "<p><a href=\"%s\">%s</a> (until %s)</p>",
+			html.EscapeString(link),
+			html.EscapeString(attachment.Filename),
+			expires.Format("2006-01-02"))
+	}
+
+	if text.Len() > 0 {
+		m.Message += "\n" + text.String()
+		if len(m.Html) > 0 {
+			m.Html += markup.String()
+		}
+	}
+	return lm.mailer.SendMail(&m)
+}
+
+func (lm *LinkMailer) Close() {
+	lm.mailer.Close()
+}
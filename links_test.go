@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLinkMailer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "files")
+	defer os.RemoveAll(dir)
+	store, err := NewLinkStore(dir, "https://mail.suricata.com/", "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &FakeMailer{}
+	mailer := NewLinkMailer(fake, store, 4)
+	mailer.SendMail(&mailStruct{
+		Message: "Your report",
+		Html:    "<p>Your report</p>",
+		Attachments: []Attachment{
+			{Filename: "small.txt", Data: []byte("1234")},
+			{Filename: "report.pdf", Data: []byte("12345")},
+		},
+	})
+
+	sent := fake.sent[0]
+	if len(sent.Attachments) != 1 || sent.Attachments[0].Filename != "small.txt" {
+		t.Errorf("Only the large attachment should be replaced, got %v", sent.Attachments)
+	}
+	if !strings.Contains(sent.Message, "report.pdf: https://mail.suricata.com/files/") || !strings.Contains(sent.Html, "report.pdf</a>") {
+		t.Errorf("Link should be appended to the bodies, got %q %q", sent.Message, sent.Html)
+	}
+
+	token := sent.Message[strings.Index(sent.Message, "/files/")+len("/files/"):]
+	token = token[:strings.Index(token, " ")]
+	if _, err := store.verify(token); err != nil {
+		t.Errorf("Token should be valid, got %s", err)
+	}
+	if _, err := store.verify(token + "x"); err != ErrBadToken {
+		t.Error("Tampered token should be rejected")
+	}
+	store.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := store.verify(token); err != ErrLinkExpired {
+		t.Error("Token should expire")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// LintPath lists the issues of the templates
+// rendered with their sample data.
+const LintPath = "/v1/templates/lint"
+
+// minContrast is the WCAG AA
+// ratio of the normal text.
+const minContrast = 4.5
+
+// LintIssue is the problem of the
+// rendered HTML found by the rule.
+type LintIssue struct {
+	Template string `json:",omitempty"`
+	Rule     string
+	Message  string
+}
+
+// lintHtml checks the rendered HTML, the
+// rules are hints, the mail is sent anyway.
+func lintHtml(doc string) []LintIssue {
+	return append(lintAccessibility(doc), lintDarkMode(doc)...)
+}
+
+// lintAccessibility checks the lang of the
+// document, the alt text of the images, the
+// order of the headings, the layout tables
+// and the contrast of the inline colors.
+func lintAccessibility(doc string) []LintIssue {
+	issues := []LintIssue{}
+	report := func(rule, format string, args ...interface{}) {
+		issues = append(issues, LintIssue{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	heading := 0
+	hasHtml := false
+	tokenizer := html.NewTokenizer(strings.NewReader(doc))
+	for {
+		kind := tokenizer.Next()
+		if kind == html.ErrorToken {
+			break
+		}
+		if kind != html.StartTagToken && kind != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		attrs := map[string]string{}
+		for _, attr := range token.Attr {
+			attrs[attr.Key] = attr.Val
+		}
+
+		switch token.Data {
+		case "html":
+			hasHtml = true
+			if len(strings.TrimSpace(attrs["lang"])) == 0 {
+				report("lang", "html element has no lang attribute")
+			}
+		case "img":
+			if _, ok := attrs["alt"]; !ok {
+				report("img-alt", "img %q has no alt text, use alt=\"\" for the decorative one", attrs["src"])
+			}
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			level := int(token.Data[1] - '0')
+			if level > heading+1 {
+				report("heading-order", "%s follows h%d, heading levels should not be skipped", token.Data, heading)
+			}
+			heading = level
+		case "table":
+			if attrs["role"] != "presentation" {
+				report("layout-table", "table without role=\"presentation\" is read as data table")
+			}
+		}
+
+		style := parseStyle(attrs["style"])
+		foreground, okForeground := parseColor(style["color"])
+		background, okBackground := parseColor(style["background-color"])
+		if okForeground && okBackground {
+			if ratio := contrast(foreground, background); ratio < minContrast {
+				report("contrast", "%s on %s has contrast %.1f:1, below %.1f:1", style["color"], style["background-color"], ratio, minContrast)
+			}
+		}
+	}
+	if !hasHtml {
+		report("lang", "document has no html element with the lang attribute")
+	}
+	return issues
+}
+
+// parseStyle reads the inline style
+// declarations, lower case.
+func parseStyle(style string) map[string]string {
+	declarations := map[string]string{}
+	for _, declaration := range strings.Split(style, ";") {
+		parts := strings.SplitN(declaration, ":", 2)
+		if len(parts) == 2 {
+			value := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(parts[1]), "!important"))
+			declarations[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.ToLower(value)
+		}
+	}
+	return declarations
+}
+
+var namedColors = map[string][3]float64{
+	"white": {255, 255, 255},
+	"black": {0, 0, 0},
+}
+
+// parseColor reads the #rgb, #rrggbb
+// and the white and black colors.
+func parseColor(value string) ([3]float64, bool) {
+	if color, ok := namedColors[value]; ok {
+		return color, true
+	}
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == len(value) {
+		return [3]float64{}, false
+	}
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return [3]float64{}, false
+	}
+	var color [3]float64
+	for i := range color {
+		channel, err := strconv.ParseUint(hex[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return color, false
+		}
+		color[i] = float64(channel)
+	}
+	return color, true
+}
+
+// contrast is the WCAG ratio of the
+// relative luminances of the colors.
+func contrast(a, b [3]float64) float64 {
+	luminance := func(color [3]float64) float64 {
+		weights := [3]float64{0.2126, 0.7152, 0.0722}
+		l := 0.0
+		for i, channel := range color {
+			c := channel / 255
+			if c <= 0.03928 {
+				c /= 12.92
+			} else {
+				c = math.Pow((c+0.055)/1.055, 2.4)
+			}
+			l += weights[i] * c
+		}
+		return l
+	}
+	la, lb := luminance(a), luminance(b)
+	if la < lb {
+		la, lb = lb, la
+	}
+	return (la + 0.05) / (lb + 0.05)
+}
+
+// LintTemplates lints the HTML of the templates
+// rendered with the sample data the filter
+// allows, as for the fixtures.
+func LintTemplates(store *DirTemplateStore, allowed func(name string) bool) ([]LintIssue, error) {
+	issues := []LintIssue{}
+	err := renderSamples(store, allowed, func(name string, m *mailStruct) error {
+		if len(m.Html) == 0 {
+			return nil
+		}
+		for _, issue := range lintHtml(m.Html) {
+			issue.Template = name
+			issues = append(issues, issue)
+		}
+		return nil
+	})
+	return issues, err
+}
+
+// LintFunc lists the issues of the templates to
+// GET, with the accounts only of the templates
+// of the account asking for it.
+func LintFunc(store *DirTemplateStore, accounts []*TemplateAccount) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		allowed, ok := templateFilter(accounts, rw, req)
+		if !ok {
+			return
+		}
+		issues, err := LintTemplates(store, allowed)
+		if err != nil {
+			renderErrorStatus(rw, err)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(issues)
+	}
+}
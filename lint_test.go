@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLintAccessibility(t *testing.T) {
+	doc := `<html><body>
+<table><tr><td>
+<h1>Hello</h1><h3>Order</h3>
+<img src="logo.png"><img src="spacer.gif" alt="">
+<p style="color: #999; background-color: #fff">Fine print</p>
+<p style="color:#000;background-color:white">Body</p>
+</td></tr></table>
+</body></html>`
+	rules := map[string]int{}
+	for _, issue := range lintAccessibility(doc) {
+		rules[issue.Rule]++
+	}
+	expected := map[string]int{"lang": 1, "layout-table": 1, "heading-order": 1, "img-alt": 1, "contrast": 1}
+	for rule, count := range expected {
+		if rules[rule] != count {
+			t.Errorf("Expected %d %s issues, got %v", count, rule, rules)
+		}
+	}
+	if len(rules) != len(expected) {
+		t.Errorf("Unexpected issues %v", rules)
+	}
+
+	clean := `<html lang="cs"><body><table role="presentation"><tr><td><h1>Ahoj</h1><h2>Objednávka</h2><img src="logo.png" alt="Suricata"></td></tr></table></body></html>`
+	if issues := lintAccessibility(clean); len(issues) != 0 {
+		t.Errorf("Accessible mail should pass, got %+v", issues)
+	}
+}
+
+func TestContrast(t *testing.T) {
+	black, _ := parseColor("#000")
+	white, _ := parseColor("white")
+	if ratio := contrast(black, white); ratio < 20.9 || ratio > 21.1 {
+		t.Errorf("Black on white should be 21:1, got %.2f", ratio)
+	}
+}
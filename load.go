@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// LoadKey is the etcd directory with the weight
+// of each instance keyed by its registered URL.
+// Higher weight means less loaded instance.
+const LoadKey = "/mail/load"
+
+// MaxLoadWeight is the weight
+// of the idle healthy instance.
+const MaxLoadWeight = 100
+
+// LoadReporter publishes the weight of the
+// instance derived from its queue depth and
+// provider error rate, so the clients can
+// prefer the less loaded instances.
+type LoadReporter struct {
+	endpoint  string
+	key       string
+	queue     *QueuedMailer
+	chain     *CompositeMailer
+	hardLimit int
+
+	lastErrors uint64
+}
+
+func NewLoadReporter(endpoint, baseURL string, queue *QueuedMailer, chain *CompositeMailer, hardLimit int) *LoadReporter {
+	return &LoadReporter{
+		endpoint:  endpoint,
+		key:       LoadKey + "/" + url.PathEscape(baseURL),
+		queue:     queue,
+		chain:     chain,
+		hardLimit: hardLimit,
+	}
+}
+
+// Report stores the weight in given interval
+// until stop is closed. The key expires when
+// the instance stops reporting.
+func (r *LoadReporter) Report(interval time.Duration, stop <-chan struct{}) {
+	ttl := 3 * interval
+	for {
+		weight := r.weight(interval)
+		if err := storeEtcdValue(r.endpoint, r.key, strconv.Itoa(weight), ttl); err != nil {
+			log.Errorf("Cannot report load: %s", err)
+		}
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// weight scales MaxLoadWeight down by the queue
+// fill up to the hard limit and by the share
+// of failed sends since the last report.
+// It never drops to zero, so the loaded
+// instance still gets some traffic.
+func (r *LoadReporter) weight(interval time.Duration) int {
+	free := 1.0
+	if r.hardLimit > 0 {
+		free -= float64(r.queue.Depth()) / float64(r.hardLimit)
+	}
+
+	if r.chain != nil {
+		total := uint64(0)
+		for _, errors := range r.chain.Errors() {
+			total += errors
+		}
+		failed := float64(total - r.lastErrors)
+		r.lastErrors = total
+		sent := r.queue.DrainRate() * interval.Seconds()
+		if failed > 0 {
+			free *= sent / (sent + failed)
+		}
+	}
+
+	weight := int(free * MaxLoadWeight)
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
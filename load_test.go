@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoadReporterWeight(t *testing.T) {
+	queue := &QueuedMailer{}
+	chain := NewCompositeMailer(0)
+	failing := &FakeMailer{err: fmt.Errorf("provider down")}
+	chain.Add("mailgun", failing)
+	reporter := NewLoadReporter("", "127.0.0.1:5050", queue, chain, 200)
+
+	if weight := reporter.weight(time.Second); weight != MaxLoadWeight {
+		t.Errorf("Idle instance should have full weight, got %d", weight)
+	}
+
+	queue.pending = 100
+	if weight := reporter.weight(time.Second); weight != 50 {
+		t.Errorf("Half full queue should halve the weight, got %d", weight)
+	}
+
+	queue.drain.rate = 3
+	chain.SendMail(&mailStruct{})
+	if weight := reporter.weight(time.Second); weight != 37 {
+		t.Errorf("Failed send should lower the weight, got %d", weight)
+	}
+
+	queue.pending = 500
+	if weight := reporter.weight(time.Second); weight != 1 {
+		t.Errorf("Overloaded instance should keep minimal weight, got %d", weight)
+	}
+}
@@ -5,14 +5,16 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/kelseyhightower/envconfig"
-	"github.com/mailgun/mailgun-go"
 	"github.com/nats-io/nats"
 	"github.com/sebest/logrusly"
 	"github.com/sohlich/etcd_service_discovery"
-	"golang.org/x/net/context"
 )
 
 const (
@@ -21,17 +23,40 @@ const (
 
 	//Configuration keys
 	KeyLogly = "LOGLY_TOKEN"
+
+	// NATS subject for liveness checks
+	PingSubject = ServiceName + ".ping"
 )
 
 var (
+	// Version is set at build time
+	// with -ldflags "-X main.Version=..."
+	Version   = "dev"
+	startTime = time.Now()
+
 	// ErrMailerNotInitialized is
 	ErrMailerNotInitialized = fmt.Errorf("mailgunmailer: Mailer not initialized yet")
+	ErrMissingRecipient     = fmt.Errorf("mail: Recipient is missing")
+	ErrBadRecipient         = fmt.Errorf("mail: Recipient is not an email address")
+	ErrBadReplyTo           = fmt.Errorf("mail: ReplyTo is not an email address")
 
 	// Configs
 	etcdConfig = &EtcdConfig{}
 	natsConfig = &NatsConfig{}
 	appConfig  = &AppConfig{}
 
+	// Configs of the optional components
+	// keyed by their env prefix
+	componentConfigs = map[string]interface{}{}
+
+	scrubber = NewScrubber(nil)
+
+	featureFlags = NewFeatureFlags()
+
+	// Providers built by newMailer,
+	// rebuilt when credentials change
+	reloadableProviders []*ReloadableMailer
+
 	// Service discovery vars
 	registryConfig discovery.EtcdRegistryConfig = discovery.EtcdRegistryConfig{
 		ServiceName: ServiceName,
@@ -46,10 +71,108 @@ type AppConfig struct {
 	Domain string
 	ApiKey string
 	Sender string `default:"info@suricata.com"`
+	// Domains the mail can be sent from
+	// besides the domain of the Sender
+	SenderDomains []string
+	// Envelope sender (Return-Path) of the SMTP
+	// and sendmail mailers the bounces go to e.g.
+	// bounces@suricata.com, empty uses the From
+	ReturnPath string
+
+	// Environment profile dev, staging, prod
+	// or mailhog, which sends all mail to
+	// MailHog/smtp4dev over SMTP
+	Profile string
+	// Recipient of all the mail in staging
+	CatchAll string
+
+	// Log fields never reported
+	ScrubFields []string `default:"ApiKey,Message,Password,Token"`
+
+	// Providers tried in order, the next
+	// one is used when the previous fails.
+	// Mail can force one of them by Provider
+	Mailers         []string      `default:"mailgun"`
+	FailoverTimeout time.Duration `default:"30s"`
+	// Share of the traffic per provider
+	// e.g. mailgun:80,file:20
+	MailerWeights map[string]int
+	// Messages per second per provider
+	// e.g. mailgun:10,smtp:2.5
+	MailerRates map[string]float64
+	// Largest composed MIME message per provider
+	// in bytes, the larger mail fails over or
+	// is rejected before the submission
+	MailerSizes map[string]int64 `default:"mailgun:26214400"`
+	// Failures in a row opening the circuit of
+	// the provider, it is tried again after
+	// the cooldown, zero disables the breaker
+	BreakerFailures int           `default:"5"`
+	BreakerCooldown time.Duration `default:"30s"`
+	// Routes by recipient domain e.g.
+	// *.corp.example.com=smtp,example.org=file
+	Routes []string
+	// Queue depth answered with 429
+	// and 503 Retry-After, zero disables
+	QueueSoftLimit int `default:"1000"`
+	QueueHardLimit int `default:"5000"`
+	// Mail buffered per priority before the
+	// QueuePolicy block, reject or shed applies
+	QueueBuffer int
+	QueuePolicy string `default:"block"`
+	// Goroutines sending the queued
+	// mail to the providers at once
+	Workers int `default:"1"`
+	// Outbound messages of all the providers
+	// e.g. 50/s or 1000/m, the rest waits
+	// in the queue, empty is unlimited
+	SendRate string
+	// Rates of the recipient domains throttling
+	// the bursts e.g. gmail.com:100/m,seznam.cz:5/s,
+	// each sent from its own queue
+	DomainRates map[string]string
+	// Longest wait for the DeliveryTime, the
+	// scheduled mail waits in the queue store
+	ScheduleMax time.Duration `default:"72h"`
+	// BoltDB file the queued mail is kept in
+	// across restarts, empty keeps it in memory
+	QueuePath string
+	// Non-email channels enabled for
+	// the mail with Channels e.g. slack,sms,push,webhook
+	Channels []string
+	// How often providers are health checked
+	HealthInterval time.Duration `default:"1m"`
+	// How long the IdempotencyKey is remembered
+	IdempotencyTTL time.Duration `default:"24h"`
+	// Largest accepted bodies and attachments
+	// in bytes, zero disables the limit
+	MaxMessageSize int64 `default:"26214400"`
+	// Reject recipient domains without MX,
+	// the answers are cached for MXCacheTTL
+	CheckMX    bool
+	MXCacheTTL time.Duration `default:"1h"`
+
+	// Campaign warm-up ramp, disabled
+	// while WarmupInitial is zero
+	WarmupInitial int
+	WarmupFactor  float64       `default:"2"`
+	WarmupPeriod  time.Duration `default:"1h"`
+
+	// Active-passive mode, only the instance
+	// holding the etcd lease dispatches mail
+	Standby bool
+
+	// How long SIGTERM waits for the queued
+	// mail to be sent before the exit
+	ShutdownTimeout time.Duration `default:"30s"`
 }
 
 type EtcdConfig struct {
-	Endpoint string `default:"http://127.0.0.1:4001"`
+	Endpoint           string        `default:"http://127.0.0.1:4001"`
+	FlagsRefresh       time.Duration `default:"30s"`
+	CredentialsRefresh time.Duration `default:"1m"`
+	LoadRefresh        time.Duration `default:"15s"`
+	LeaseRefresh       time.Duration `default:"5s"`
 }
 
 type NatsConfig struct {
@@ -57,7 +180,7 @@ type NatsConfig struct {
 }
 
 type Mailer interface {
-	SendMail(subject, message, recipient string) error
+	SendMail(mail *mailStruct) error
 	Close()
 }
 
@@ -66,6 +189,18 @@ func loadConfig(config *AppConfig, etcd *EtcdConfig, nats *NatsConfig) {
 	mustLoad("mail", config)
 	mustLoad("etcd", etcd)
 	mustLoad("nats", nats)
+	for prefix, component := range componentConfigs {
+		mustLoad(prefix, component)
+	}
+	if err := applyProfile(config, smtpConfig); err != nil {
+		log.Panic(err)
+	}
+
+	// Scrubbing must go first, so the
+	// other hooks get the clean entries
+	scrubber = NewScrubber(config.ScrubFields, configSecrets(config)...)
+	log.AddHook(NewScrubHook(scrubber))
+	log.AddHook(NewInstanceHook(config.Name))
 
 	if len(os.Getenv(KeyLogly)) > 0 {
 		hook := logrusly.NewLogglyHook(os.Getenv(KeyLogly),
@@ -77,6 +212,31 @@ func loadConfig(config *AppConfig, etcd *EtcdConfig, nats *NatsConfig) {
 
 }
 
+// configSecrets lists the values
+// which must never be logged.
+func configSecrets(config *AppConfig) []string {
+	accounts, _ := ParseTemplateAccounts(templateConfig.Accounts)
+	callers, _ := ParseCallers(callerConfig.Tokens)
+	admins, _ := ParseTemplateAccounts(adminConfig.Accounts)
+	secrets := append(templateAccountTokens(accounts), callerTokens(callers)...)
+	secrets = append(secrets, templateAccountTokens(admins)...)
+	secrets = append(secrets, keyringSecrets(encryptionConfig.Keys)...)
+	return append(secrets,
+		config.ApiKey,
+		smtpConfig.Password,
+		smtpConfig.DKIMKey,
+		smimeConfig.Key,
+		sandboxConfig.Password,
+		graphConfig.ClientSecret,
+		twilioConfig.AuthToken,
+		fcmConfig.ServerKey,
+		webhookConfig.Secret,
+		linkConfig.Secret,
+		screenshotConfig.Token,
+		os.Getenv(KeyLogly),
+	)
+}
+
 func mustLoad(prefix string, config interface{}) {
 	err := envconfig.Process(prefix, config)
 	if err != nil {
@@ -88,6 +248,13 @@ func main() {
 
 	loadConfig(appConfig, etcdConfig, natsConfig)
 
+	if len(os.Args) > 1 && os.Args[1] == MigrateCommand {
+		if err := MigrateStores(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.SetLevel(log.DebugLevel)
 
 	var registryErr error
@@ -101,24 +268,352 @@ func main() {
 	}
 	registryClient.Register()
 
+	admins, adminsErr := ParseTemplateAccounts(adminConfig.Accounts)
+	if adminsErr != nil {
+		log.Panic(adminsErr)
+	}
+	callers, callersErr := ParseCallers(callerConfig.Tokens)
+	if callersErr != nil {
+		log.Panic(callersErr)
+	}
+	audit := NewAdminAudit(adminConfig.AuditPath)
+	keyring, keyringErr := ParseKeyring(encryptionConfig.Keys)
+	if keyringErr != nil {
+		log.Panic(keyringErr)
+	}
+
+	shutdown := NewShutdown(appConfig.ShutdownTimeout)
+	go featureFlags.Watch(etcdConfig.Endpoint, etcdConfig.FlagsRefresh, shutdown.Done())
+	go WatchCredentials(etcdConfig.Endpoint, etcdConfig.CredentialsRefresh, shutdown.Done())
+
 	log.SetLevel(log.DebugLevel)
-	mailer := NewMailGun(appConfig.Domain, appConfig.ApiKey, appConfig.Sender)
+	ramp := NewWarmupRamp(appConfig.WarmupInitial, appConfig.WarmupFactor, appConfig.WarmupPeriod)
+	provider, chain, providerErr := newMailer(appConfig)
+	if providerErr != nil {
+		log.Panic(providerErr)
+	}
+	if chain != nil {
+		go chain.Probe(appConfig.HealthInterval, shutdown.Done())
+	}
+	if len(archiveConfig.Format) > 0 {
+		archive, archiveErr := NewArchive(archiveConfig.Format, archiveConfig.Dir, archiveConfig.MaxSize, keyring)
+		if archiveErr != nil {
+			log.Panic(archiveErr)
+		}
+		provider = NewArchivingMailer(provider, archive)
+		http.HandleFunc(RedactPath, RecoverFunc(scrubber, RedactFunc(archive, admins, audit)))
+	}
+	channels := NewChannelMailer(provider)
+	for _, name := range appConfig.Channels {
+		channel, channelErr := newChannel(name)
+		if channelErr != nil {
+			log.Panic(channelErr)
+		}
+		channels.Add(name, channel)
+	}
+	channels.SetPreferences(NewEtcdPreferenceStore(etcdConfig.Endpoint))
+	channels.SetEscalation(escalationConfig.Channels, escalationConfig.After)
+	provider = channels
+	if len(appConfig.CatchAll) > 0 {
+		provider = NewCatchAllMailer(provider, appConfig.CatchAll)
+	}
+	if len(unsubscribeConfig.URL) > 0 {
+		var unsubscribeErr error
+		provider, unsubscribeErr = NewUnsubscribeMailer(provider, unsubscribeConfig.URL, unsubscribeConfig.Mailto)
+		if unsubscribeErr != nil {
+			log.Panic(unsubscribeErr)
+		}
+	}
+	provider = NewHeaderMailer(provider, headerConfig.Allowed)
+	provider = NewSenderMailer(provider, sendingDomains(appConfig))
+	provider = NewFetchingMailer(provider, attachmentConfig.FetchTimeout, attachmentConfig.MaxSize)
+	retry := NewRetryMailer(provider, retryConfig)
+	var deadLetters *DeadLetterStore
+	if len(deadLetterConfig.Path) > 0 {
+		var deadLetterErr error
+		if deadLetters, deadLetterErr = NewDeadLetterStore(deadLetterConfig.Path, keyring); deadLetterErr != nil {
+			log.Panic(deadLetterErr)
+		}
+		retry.deadLetters = deadLetters
+	}
+	mailer := NewQueuedMailer(retry, ramp, appConfig.Workers, appConfig.QueueBuffer)
+	mailer.policy = appConfig.QueuePolicy
+	mailer.scheduleMax = appConfig.ScheduleMax
+	mailer.deadLetters = deadLetters
+	reputation, reputationErr := NewReputationGuard(*reputationConfig)
+	if reputationErr != nil {
+		log.Panic(reputationErr)
+	}
+	if len(reputationConfig.AlertWebhookURL) > 0 {
+		reputation.alert = NewSlackChannel(reputationConfig.AlertWebhookURL)
+	}
+	mailer.reputation = reputation
+	sendRate, rateErr := ParseRate(appConfig.SendRate)
+	if rateErr != nil {
+		log.Panic(rateErr)
+	}
+	if sendRate > 0 {
+		mailer.limiter = NewTokenBucket(sendRate, int(sendRate))
+	}
+	for domain, value := range appConfig.DomainRates {
+		domainRate, domainErr := ParseRate(value)
+		if domainErr != nil {
+			log.Panic(domainErr)
+		}
+		mailer.Throttle(strings.ToLower(domain), domainRate)
+	}
+	shutdown.queue = mailer
+	if deadLetters != nil {
+		http.HandleFunc(DeadLetterPath, RecoverFunc(scrubber, DeadLetterFunc(deadLetters, mailer, admins, audit)))
+	}
+	if len(redisConfig.URL) > 0 {
+		if storeErr := mailer.Persist(NewRedisQueue(redisConfig.URL, redisConfig.Prefix, appConfig.Name, keyring)); storeErr != nil {
+			log.Panic(storeErr)
+		}
+	} else if len(appConfig.QueuePath) > 0 {
+		store, storeErr := NewBoltQueue(appConfig.QueuePath, keyring)
+		if storeErr != nil {
+			log.Panic(storeErr)
+		}
+		if storeErr = mailer.Persist(store); storeErr != nil {
+			log.Panic(storeErr)
+		}
+	}
+	load := NewLoadReporter(etcdConfig.Endpoint, registryConfig.BaseURL, mailer, chain, appConfig.QueueHardLimit)
+	go load.Report(etcdConfig.LoadRefresh, shutdown.Done())
 
 	// Configure NATS
 	nc, _ := nats.Connect(natsConfig.Endpoint)
 	conn, _ := nats.NewEncodedConn(nc, nats.GOB_ENCODER)
-	defer conn.Close()
+	shutdown.conn = conn
+
+	var mx *MXChecker
+	if appConfig.CheckMX {
+		mx = NewMXChecker(appConfig.MXCacheTTL)
+	}
+	holding := NewHoldingMailer(mailer, holdConfig.Windows)
+	holding.deadLetters = deadLetters
+	shutdown.holding = holding
+	http.HandleFunc(MailPath, RecoverFunc(scrubber, CancelFunc(holding, callers, admins)))
+	intake := NewSizeLimitMailer(holding, appConfig.MaxMessageSize)
+	if len(linkConfig.Secret) > 0 {
+		links, linksErr := NewLinkStore(linkConfig.Dir, linkConfig.BaseURL, linkConfig.Secret, linkConfig.TTL)
+		if linksErr != nil {
+			log.Panic(linksErr)
+		}
+		links.SetSingleUse(linkConfig.SingleUse)
+		go links.Sweep(time.Hour, shutdown.Done())
+		http.HandleFunc(FilesPath, RecoverFunc(scrubber, FilesFunc(links)))
+		if linkConfig.Threshold > 0 {
+			intake = NewLinkMailer(intake, links, linkConfig.Threshold)
+		}
+	} else if linkConfig.Threshold > 0 {
+		log.Panic(ErrMissingLinkSecret)
+	}
+	approval := NewApprovalMailer(intake, approvalConfig.Templates, approvalConfig.Expiry)
+	if len(approvalConfig.Path) > 0 {
+		if approvalErr := approval.Persist(approvalConfig.Path, keyring); approvalErr != nil {
+			log.Panic(approvalErr)
+		}
+	}
+	http.HandleFunc(ApprovalPath, RecoverFunc(scrubber, ApprovalFunc(approval, admins, audit)))
+	templates := NewDirTemplateStore(templateConfig.Dir)
+	templateAccounts, accountsErr := ParseTemplateAccounts(templateConfig.Accounts)
+	if accountsErr != nil {
+		log.Panic(accountsErr)
+	}
+	var screenshots *Screenshotter
+	if len(screenshotConfig.URL) > 0 {
+		viewports, viewportErr := ParseViewports(screenshotConfig.Viewports)
+		if viewportErr != nil {
+			log.Panic(viewportErr)
+		}
+		screenshots = NewScreenshotter(screenshotConfig.URL, screenshotConfig.Token, viewports, screenshotConfig.Timeout)
+	}
+	http.HandleFunc(TemplatesPath, RecoverFunc(scrubber, TemplatesFunc(templates, templateAccounts, screenshots)))
+	http.HandleFunc(FixturesPath, RecoverFunc(scrubber, FixturesFunc(templates, templateAccounts)))
+	http.HandleFunc(LintPath, RecoverFunc(scrubber, LintFunc(templates, templateAccounts)))
+	rendered := Mailer(approval)
+	if templateConfig.DarkMode {
+		rendered = NewDarkModeMailer(rendered)
+	}
+	templating := NewTemplateMailer(NewMarkdownMailer(rendered), templates)
+	if templateConfig.Namespaces {
+		if len(callers) == 0 {
+			log.Panic(ErrNoCallers)
+		}
+		templating.shared = templateConfig.Shared
+	}
+	templating.callers = callers
+	rateClasses, rateClassErr := ParseRateClasses(templateConfig.RateClasses)
+	if rateClassErr != nil {
+		log.Panic(rateClassErr)
+	}
+	templating.rateClasses = rateClasses
+	templating.stats = NewTemplateStats()
+	templating.renders = NewRenderCache(templateConfig.RenderCacheSize)
+	http.HandleFunc(StatsPath, RecoverFunc(scrubber, StatsFunc(templating.stats, templates, templating.renders, reputation, admins)))
+	idempotent := NewIdempotentMailer(templating, appConfig.IdempotencyTTL)
+	retry.idempotency = idempotent
+	intake = NewRecipientValidator(idempotent, mx)
+	intake = NewQuotaMailer(intake, quotaConfig)
+	intake = NewCallerMailer(intake, callers)
+	shutdown.intake = intake
+	subscribe := func() (*nats.Subscription, error) {
+		return conn.QueueSubscribe(ServiceName, "mailgun", NatsMailerFunc(conn, intake))
+	}
+	dispatching := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	if appConfig.Standby {
+		standby := NewStandby(etcdConfig.Endpoint, appConfig.Name)
+		var sub *nats.Subscription
+		standby.OnChange = func(active bool) {
+			if active {
+				sub, _ = shutdown.Subscribe(subscribe)
+			} else if sub != nil {
+				sub.Unsubscribe()
+			}
+		}
+		go standby.Watch(etcdConfig.LeaseRefresh, shutdown.Done())
+		dispatching = standby.Func
+	} else {
+		shutdown.Subscribe(subscribe)
+	}
+	shutdown.Subscribe(func() (*nats.Subscription, error) {
+		return nc.Subscribe(PingSubject, PingFunc(nc, mailer))
+	})
+
+	if len(bounceConfig.Maildir) > 0 {
+		bounces := NewBounceReader(bounceConfig.Maildir)
+		onBounce, onComplaint := bounces.OnBounce, bounces.OnComplaint
+		bounces.OnBounce = func(bounce Bounce) {
+			onBounce(bounce)
+			reputation.Bounce(bounce, time.Now())
+		}
+		bounces.OnComplaint = func(recipient string) {
+			onComplaint(recipient)
+			reputation.Complaint(recipient, time.Now())
+		}
+		go bounces.Watch(bounceConfig.Interval, shutdown.Done())
+	}
+
+	domains := NewDomainChecker(sendingDomains(appConfig), smtpConfig.DKIMSelector)
+	go domains.Watch(appConfig.HealthInterval, shutdown.Done())
+
+	backpressure := NewBackpressure(mailer, appConfig.QueueSoftLimit, appConfig.QueueHardLimit)
+	http.HandleFunc("/v1/mail/batch-stream", RecoverFunc(scrubber, dispatching(backpressure.Func(BatchStreamFunc(intake)))))
+	http.HandleFunc(BulkPath, RecoverFunc(scrubber, dispatching(backpressure.Func(BulkFunc(intake)))))
+	http.HandleFunc("/status", StatusFunc(appConfig, smtpConfig, chain))
+	http.HandleFunc("/ready", ReadyFunc(domains))
+	http.HandleFunc("/v1/dmarc", RecoverFunc(scrubber, DmarcFunc(NewDmarcStore())))
+	http.HandleFunc("/", RecoverFunc(scrubber, dispatching(backpressure.Func(HttpMailerFunc(intake)))))
+	server := &http.Server{Addr: ":5050", Handler: IdentityHandler(appConfig.Name, http.DefaultServeMux)}
+	shutdown.server = server
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Panic(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	shutdown.Run(signals)
+}
+
+// newMailer builds the failover chain of configured
+// providers and the routes by recipient domain.
+// In sandbox mode all of it is replaced by
+// the capturing SMTP server and no chain
+// is returned.
+func newMailer(config *AppConfig) (Mailer, *CompositeMailer, error) {
+	if len(sandboxConfig.Addr) > 0 {
+		sandbox, err := newSandboxMailer(sandboxConfig, config.Sender)
+		return sandbox, nil, err
+	}
+
+	providers := map[string]Mailer{}
+	providerByName := func(name string) (Mailer, error) {
+		if provider, ok := providers[name]; ok {
+			return provider, nil
+		}
+		reloadable, err := NewReloadableMailer(name)
+		if err != nil {
+			return nil, err
+		}
+		reloadableProviders = append(reloadableProviders, reloadable)
+		providers[name] = reloadable
+		return reloadable, nil
+	}
 
-	conn.QueueSubscribe(ServiceName, "mailgun", NatsMailerFunc(mailer))
+	composite := NewCompositeMailer(config.FailoverTimeout)
+	for _, name := range config.Mailers {
+		provider, err := providerByName(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		composite.Add(name, provider)
+	}
+	for name, weight := range config.MailerWeights {
+		composite.SetWeight(name, weight)
+	}
+	for name, rate := range config.MailerRates {
+		composite.SetRate(name, rate)
+	}
+	for name, size := range config.MailerSizes {
+		composite.SetMaxSize(name, size)
+	}
+	if config.BreakerFailures > 0 {
+		composite.SetBreaker(config.BreakerFailures, config.BreakerCooldown)
+	}
+
+	if len(config.Routes) == 0 {
+		return composite, composite, nil
+	}
 
-	http.HandleFunc("/", HttpMailerFunc(mailer))
-	http.ListenAndServe(":5050", nil)
+	router := NewRoutingMailer(composite)
+	for _, rule := range config.Routes {
+		pattern, name, err := parseRoute(rule)
+		if err != nil {
+			return nil, nil, err
+		}
+		provider, err := providerByName(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := router.AddRoute(pattern, provider); err != nil {
+			return nil, nil, err
+		}
+	}
+	return router, composite, nil
+}
+
+// sendingDomains allows the domain of
+// the default sender and the configured ones.
+func sendingDomains(config *AppConfig) []string {
+	domains := append([]string{}, config.SenderDomains...)
+	if domain, err := senderDomain(config.Sender); err == nil {
+		domains = append(domains, domain)
+	}
+	return domains
 }
 
-func NatsMailerFunc(m Mailer) nats.Handler {
-	return func(mail *mailStruct) {
+// NatsMailerFunc sends the mail and answers
+// the request with the error message, empty
+// if the mail was accepted.
+func NatsMailerFunc(conn *nats.EncodedConn, m Mailer) nats.Handler {
+	return func(subject, reply string, mail *mailStruct) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Recovered from panic: %s", scrubber.String(fmt.Sprint(r)))
+			}
+		}()
 		log.Infof("mailService: receiving NATS mail")
-		m.SendMail(mail.Subject, mail.Message, mail.Recipient)
+		result := ""
+		if err := m.SendMail(mail); err != nil {
+			result = err.Error()
+		}
+		if len(reply) > 0 {
+			conn.Publish(reply, result)
+		}
 	}
 }
 
@@ -127,9 +622,37 @@ func HttpMailerFunc(m Mailer) http.HandlerFunc {
 		mail := mailStruct{}
 		decoder := json.NewDecoder(req.Body)
 		decoder.Decode(&mail)
-		log.Infof("Sending mail %v", mail)
-		m.SendMail(mail.Subject, mail.Message, mail.Recipient)
+		mail.Token = req.Header.Get(TokenHeader)
+		log.Infof("Sending mail %v", &mail)
+		if err := m.SendMail(&mail); err != nil {
+			http.Error(rw, err.Error(), errorStatus(err))
+		}
+	}
+}
+
+// errorStatus maps the errors
+// of the send to HTTP status.
+func errorStatus(err error) int {
+	switch err {
+	case ErrMessageTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrMissingRecipient, ErrBadRecipient, ErrBadReplyTo, ErrNoMX, ErrUnknownTemplate, ErrScheduledTooFar:
+		return http.StatusBadRequest
+	case ErrUnknownCaller:
+		return http.StatusUnauthorized
+	case ErrForeignTemplate, ErrTemplateScope:
+		return http.StatusForbidden
+	case ErrAlreadyHeld:
+		return http.StatusConflict
+	case ErrQueueFull:
+		return http.StatusServiceUnavailable
+	case ErrDailyQuotaExceeded, ErrCallerRateExceeded:
+		return http.StatusTooManyRequests
+	}
+	if _, ok := err.(*RenderError); ok {
+		return http.StatusBadRequest
 	}
+	return http.StatusInternalServerError
 }
 
 type mailStruct struct {
@@ -137,70 +660,121 @@ type mailStruct struct {
 	Message   string
 	Subject   string
 	Recipient string
+	ReplyTo   string
+	Campaign  string
+	Provider  string
+	// Html alternative of the Message,
+	// which is kept as the text fallback
+	Html string
+	// Markdown is rendered to the Html and
+	// kept as the Message if it is empty
+	Markdown    string
+	Attachments []Attachment
+	// Calendar is the iCalendar invitation,
+	// METHOD:REQUEST unless it says otherwise
+	Calendar string
+	// Channels to deliver the message to,
+	// only email when empty
+	Channels []string
+	// Phone of the recipient for the sms channel
+	Phone string
+	// Devices of the recipient for the push channel
+	DeviceTokens []string
+	// URL of the recipient for the webhook channel
+	WebhookURL string
+	// Urgency picks the channels preferred by
+	// the recipient: low, normal or critical
+	Urgency string
+	// Custom headers e.g. List-Id, limited
+	// by the configured allowlist
+	Headers map[string]string
+	// Tags segment the analytics of the
+	// provider e.g. welcome, reset, digest
+	Tags []string
+	// Variables returned by the provider
+	// delivery webhooks e.g. user and request ID
+	Variables map[string]string
+	// DeliveryTime in RFC3339 defers
+	// the send, zero sends right away
+	DeliveryTime time.Time
+	// Priority high, normal or bulk,
+	// high priority mail is sent first
+	Priority string
+	// IdempotencyKey drops the repeated
+	// sends of the same mail within the TTL
+	IdempotencyKey string
+	// Template renders the Subject, Message
+	// and Html from the Data instead, without
+	// Template they are the templates themselves
+	Template string
+	Data     map[string]interface{}
+	// Open and click tracking of the provider
+	// on or off, empty follows the domain settings
+	// except clicks are off for transactional mail
+	Tracking       string
+	TrackingOpens  string
+	TrackingClicks string
+	// Caller is the sending service limited
+	// by its own quota, set by its Token
+	Caller string
+	// Token authenticates the Caller over
+	// NATS, over HTTP the TokenHeader does
+	Token string `json:"-"`
+	// ID of the mail to cancel it
+	// within the hold window
+	ID string
+	// ExpiresAt drops the mail still queued
+	// afterwards e.g. the stale 2FA code,
+	// zero never expires
+	ExpiresAt time.Time
+
+	// queueKey of the mail in the QueueStore,
+	// zero when the queue is in memory
+	queueKey uint64
+	// attempts failed so far and the time
+	// of the next one, kept by the store
+	attempts  int
+	notBefore time.Time
+	// booked once the warm-up ramp
+	// deferred the mail to its period
+	booked bool
+	// digests of the attachments
+	// kept apart by the store
+	blobs []string
 }
 
-func (m *mailStruct) String() string {
-	return fmt.Sprintf("Sender: %s , Recipient: %s, Subject: %s, Message: %s",
-		m.Sender,
-		m.Recipient,
-		m.Subject,
-		m.Message)
-}
-
-type MailGunMailer struct {
-	mailgun.Mailgun
-	sendChannel chan mailStruct
-	sender      string
-	cancel      context.CancelFunc
-}
-
-func NewMailGun(domain, apiKey, sender string) Mailer {
-	mg := mailgun.NewMailgun(domain, apiKey, "")
-	senderChan := make(chan mailStruct, 0)
-	ctx, cancel := context.WithCancel(context.TODO())
-	mailer := MailGunMailer{
-		mg,
-		senderChan,
-		sender,
-		cancel,
+// Validate rejects the mail with bad
+// addresses, the ReplyTo is rewritten
+// to its formatted address.
+func (m *mailStruct) Validate() error {
+	if len(m.Recipient) == 0 {
+		return ErrMissingRecipient
 	}
-	go func() {
-		for {
-			log.Debug("Waiting for message")
-			select {
-			case m := <-senderChan:
-				log.Debugf("Receiving message: %s", m.String())
-				message := mailgun.NewMessage(m.Sender, m.Subject, m.Message, m.Recipient)
-				response, id, err := mg.Send(message)
-				if err != nil {
-					log.Errorln(err)
-				}
-				log.Infof("Sending email to recipient %s\nreponse %s\nid %s", m.Recipient, response, id)
-			case <-ctx.Done():
-				log.Infoln("Closing goroutine to send mails")
-				return
-			}
-
-		}
-	}()
-	return &mailer
-}
-
-func (mgm *MailGunMailer) SendMail(subject, message, recipient string) error {
-	if mgm.sendChannel == nil {
-		return ErrMailerNotInitialized
+	if _, err := recipientDomain(m.Recipient); err != nil {
+		return err
 	}
-
-	mgm.sendChannel <- mailStruct{
-		mgm.sender,
-		message,
-		subject,
-		recipient,
+	if len(m.ReplyTo) > 0 {
+		replyTo, err := formatAddress(m.ReplyTo)
+		if err != nil {
+			return ErrBadReplyTo
+		}
+		m.ReplyTo = replyTo
 	}
-
 	return nil
 }
 
-func (mgm *MailGunMailer) Close() {
-	mgm.cancel()
+func (m *mailStruct) String() string {
+	// Message body is left out on purpose,
+	// it must never end up in the logs
+	return fmt.Sprintf("Sender: %s , Recipient: %s, ReplyTo: %s, Subject: %s, Message: %d bytes, Html: %d bytes, Attachments: %d, Campaign: %s, Provider: %s, Channels: %v",
+		m.Sender,
+		m.Recipient,
+		m.ReplyTo,
+		m.Subject,
+		len(m.Message),
+		len(m.Html),
+		len(m.Attachments),
+		m.Campaign,
+		m.Provider,
+		m.Channels)
 }
@@ -1 +1,118 @@
 package main
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/mailgun-go"
+)
+
+// MailgunMaxTags is the limit
+// of tags on a single message.
+const MailgunMaxTags = 3
+
+// Tracking toggles of the mail,
+// empty keeps the default.
+const (
+	TrackingOn  = "on"
+	TrackingOff = "off"
+)
+
+func init() {
+	RegisterMailer("mailgun", func() (Mailer, error) {
+		return NewMailGun(appConfig.Domain, appConfig.ApiKey, appConfig.Sender), nil
+	})
+}
+
+type MailGunMailer struct {
+	mailgun.Mailgun
+	sender string
+}
+
+func NewMailGun(domain, apiKey, sender string) Mailer {
+	mg := mailgun.NewMailgun(domain, apiKey, "")
+	return &MailGunMailer{
+		mg,
+		sender,
+	}
+}
+
+func (mgm *MailGunMailer) SendMail(mail *mailStruct) error {
+	message := mailgun.NewMessage(senderOf(mail, mgm.sender), mail.Subject, mail.Message, mail.Recipient)
+	if len(mail.Html) > 0 {
+		message.SetHtml(mail.Html)
+	}
+	if replyTo, err := formatAddress(mail.ReplyTo); err == nil {
+		message.AddHeader("Reply-To", replyTo)
+	}
+	for name, value := range priorityHeaders(mail.Priority) {
+		message.AddHeader(name, value)
+	}
+	for name, value := range mail.Headers {
+		message.AddHeader(name, value)
+	}
+	for i, tag := range mail.Tags {
+		if i == MailgunMaxTags {
+			log.Warnf("Mailgun keeps only %d tags, dropping %v", MailgunMaxTags, mail.Tags[i:])
+			break
+		}
+		message.AddTag(tag)
+	}
+	if len(mail.Tracking) > 0 {
+		message.SetTracking(mail.Tracking == TrackingOn)
+	}
+	if len(mail.TrackingOpens) > 0 {
+		message.SetTrackingOpens(mail.TrackingOpens == TrackingOn)
+	}
+	if clicks := trackingClicks(mail); len(clicks) > 0 {
+		message.SetTrackingClicks(clicks == TrackingOn)
+	}
+	if !mail.DeliveryTime.IsZero() {
+		message.SetDeliveryTime(mail.DeliveryTime)
+	}
+	for name, value := range mail.Variables {
+		if err := message.AddVariable(name, value); err != nil {
+			return err
+		}
+	}
+	for _, attachment := range mail.Attachments {
+		if attachment.Inline() {
+			// Mailgun references inline files by name
+			message.AddReaderInline(attachment.ContentID, ioutil.NopCloser(bytes.NewReader(attachment.Data)))
+			continue
+		}
+		message.AddBufferAttachment(attachment.Filename, attachment.Data)
+	}
+	if calendar, ok := calendarAttachment(mail); ok {
+		message.AddBufferAttachment(calendar.Filename, calendar.Data)
+	}
+	response, id, err := mgm.Send(message)
+	if err != nil {
+		return err
+	}
+	log.Infof("Sending email to recipient %s\nreponse %s\nid %s", mail.Recipient, response, id)
+	return nil
+}
+
+// trackingClicks keeps the links of the
+// transactional mail e.g. password reset
+// unless the mail asks otherwise, the
+// campaign mail follows the domain settings.
+func trackingClicks(mail *mailStruct) string {
+	if len(mail.TrackingClicks) > 0 {
+		return mail.TrackingClicks
+	}
+	if len(mail.Campaign) == 0 || mail.Priority == PriorityHigh {
+		return TrackingOff
+	}
+	return ""
+}
+
+// Check validates the sending domain.
+func (mgm *MailGunMailer) Check() error {
+	_, _, _, err := mgm.GetSingleDomain(mgm.Domain())
+	return err
+}
+
+func (mgm *MailGunMailer) Close() {}
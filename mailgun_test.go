@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestTrackingClicks(t *testing.T) {
+	cases := []struct {
+		mail     mailStruct
+		expected string
+	}{
+		{mailStruct{Subject: "Reset password"}, TrackingOff},
+		{mailStruct{Campaign: "digest", Priority: PriorityHigh}, TrackingOff},
+		{mailStruct{Campaign: "digest"}, ""},
+		{mailStruct{TrackingClicks: TrackingOn}, TrackingOn},
+	}
+	for _, c := range cases {
+		if clicks := trackingClicks(&c.mail); clicks != c.expected {
+			t.Errorf("Expected click tracking %q for %+v, got %q", c.expected, c.mail, clicks)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+)
+
+// markdownPolicy keeps the formatting of the
+// rendered Markdown, the raw HTML of the source
+// e.g. the script or the event handler in the
+// Data of the caller is dropped.
+var markdownPolicy = bluemonday.UGCPolicy()
+
+// markdownLayout wraps the rendered Markdown, the
+// styles are inline as many clients drop the
+// style element of the head. The clients keeping
+// it darken the layout for the dark mode.
+var markdownLayout = template.Must(template.New("markdown").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8">
+<style>@media (prefers-color-scheme: dark) {
+.page { background-color:#121212 !important; }
+.content { background-color:#1e1e1e !important; color:#e0e0e0 !important; }
+}</style></head>
+<body class="page" style="margin:0;padding:0;background-color:#f4f4f4;">
+<div class="content" style="max-width:600px;margin:0 auto;padding:24px;background-color:#ffffff;font-family:Helvetica,Arial,sans-serif;font-size:15px;line-height:1.5;color:#333333;">
+{{.}}
+</div>
+</body>
+</html>
+`))
+
+// renderMarkdown returns the styled HTML
+// document of the Markdown source, the
+// rendered body is sanitized first.
+func renderMarkdown(source string) (string, error) {
+	var buf bytes.Buffer
+	body := template.HTML(markdownPolicy.SanitizeBytes(blackfriday.MarkdownCommon([]byte(source))))
+	if err := markdownLayout.Execute(&buf, body); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// MarkdownMailer renders the Markdown of the
+// mail to the Html, the source itself is the
+// plaintext fallback unless the Message is
+// set. The Html given by the mail is kept.
+type MarkdownMailer struct {
+	mailer Mailer
+}
+
+func NewMarkdownMailer(mailer Mailer) Mailer {
+	return &MarkdownMailer{mailer}
+}
+
+func (mm *MarkdownMailer) SendMail(mail *mailStruct) error {
+	if len(mail.Markdown) == 0 {
+		return mm.mailer.SendMail(mail)
+	}
+	m := *mail
+	if err := applyMarkdown(&m); err != nil {
+		return err
+	}
+	return mm.mailer.SendMail(&m)
+}
+
+// applyMarkdown fills the empty
+// bodies from the Markdown.
+func applyMarkdown(m *mailStruct) error {
+	if len(m.Markdown) == 0 {
+		return nil
+	}
+	if len(m.Html) == 0 {
+		html, err := renderMarkdown(m.Markdown)
+		if err != nil {
+			return &RenderError{"markdown", err}
+		}
+		m.Html = html
+	}
+	if len(m.Message) == 0 {
+		m.Message = m.Markdown
+	}
+	m.Markdown = ""
+	return nil
+}
+
+func (mm *MarkdownMailer) Close() {
+	mm.mailer.Close()
+}
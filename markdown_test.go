@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkdownMailer(t *testing.T) {
+	fake := &FakeMailer{}
+	mailer := NewTemplateMailer(NewMarkdownMailer(fake), NewDirTemplateStore(""))
+
+	err := mailer.SendMail(&mailStruct{
+		Markdown: "# Hello {{.Name}}\n\nYour **order** shipped.",
+		Data:     map[string]interface{}{"Name": "Radek"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := fake.sent[0]
+	if !strings.Contains(sent.Html, "<h1>Hello Radek</h1>") || !strings.Contains(sent.Html, "<strong>order</strong>") {
+		t.Errorf("Markdown not rendered %s", sent.Html)
+	}
+	if !strings.Contains(sent.Html, "font-family:") {
+		t.Errorf("Rendered Html should be styled %s", sent.Html)
+	}
+	if sent.Message != "# Hello Radek\n\nYour **order** shipped." {
+		t.Errorf("Markdown should be the plaintext fallback, got %q", sent.Message)
+	}
+
+	mailer.SendMail(&mailStruct{
+		Markdown: "Hello {{.Name}}\n\n[site]({{.Link}})",
+		Data: map[string]interface{}{
+			"Name": `<img src="x" onerror="alert(1)"><script>alert(2)</script>`,
+			"Link": "javascript:alert(3)",
+		},
+	})
+	if sent := fake.sent[1]; strings.Contains(sent.Html, "onerror") || strings.Contains(sent.Html, "<script") || strings.Contains(sent.Html, "javascript:") {
+		t.Errorf("Raw HTML of the Data should be dropped %s", sent.Html)
+	}
+
+	mailer.SendMail(&mailStruct{Markdown: "*hi*", Message: "hi", Html: "<p>hi</p>"})
+	if sent := fake.sent[2]; sent.Message != "hi" || sent.Html != "<p>hi</p>" {
+		t.Errorf("Given bodies should be kept %+v", sent)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// formatAddress parses the address and formats
+// it for the header, the name is quoted or RFC
+// 2047 encoded so it cannot break the header.
+func formatAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return parsed.String(), nil
+}
+
+// Line length of base64 encoded attachments
+const base64LineLength = 76
+
+// composeMessage renders the mail as an RFC 2822
+// message. The body is plain text or multipart/alternative
+// with the text fallback when the mail has HTML, wrapped
+// in multipart/mixed when the mail has attachments. The
+// inline images go with the HTML in multipart/related.
+func composeMessage(m *mailStruct, date time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.Sender)
+	fmt.Fprintf(&buf, "To: %s\r\n", m.Recipient)
+	if replyTo, err := formatAddress(m.ReplyTo); err == nil {
+		fmt.Fprintf(&buf, "Reply-To: %s\r\n", replyTo)
+	}
+	// Non-ASCII subject is RFC 2047 encoded,
+	// plain ASCII is written as is
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	priority := priorityHeaders(m.Priority)
+	for _, name := range sortedHeaders(priority) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, priority[name])
+	}
+	for _, name := range sortedHeaders(m.Headers) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, m.Headers[name])
+	}
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	inline, attached := splitAttachments(m.Attachments)
+	contentType, encoding, body := composeBody(m, inline)
+	if len(attached) == 0 {
+		fmt.Fprintf(&buf, "Content-Type: %s\r\n", contentType)
+		if len(encoding) > 0 {
+			fmt.Fprintf(&buf, "Content-Transfer-Encoding: %s\r\n", encoding)
+		}
+		buf.WriteString("\r\n")
+		buf.Write(body)
+		return buf.Bytes()
+	}
+
+	var mixed bytes.Buffer
+	parts := multipart.NewWriter(&mixed)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	if len(encoding) > 0 {
+		header.Set("Content-Transfer-Encoding", encoding)
+	}
+	w, _ := parts.CreatePart(header)
+	w.Write(body)
+	for _, attachment := range attached {
+		writeAttachment(parts, attachment)
+	}
+	parts.Close()
+
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n", parts.Boundary())
+	buf.WriteString("\r\n")
+	buf.Write(mixed.Bytes())
+	return buf.Bytes()
+}
+
+// composeBody returns the content type, the
+// transfer encoding and the content of the
+// message body. The text is quoted-printable
+// with the CRLF line ends, so it reaches the
+// recipient as it was signed. The calendar
+// invitation is the last alternative, so the
+// mail clients show it as the actionable invite.
+func composeBody(m *mailStruct, inline []Attachment) (string, string, []byte) {
+	if len(m.Html) == 0 && len(m.Calendar) == 0 {
+		var body bytes.Buffer
+		qp := quotedprintable.NewWriter(&body)
+		qp.Write([]byte(m.Message))
+		qp.Close()
+		return "text/plain; charset=UTF-8", "quoted-printable", body.Bytes()
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	writePart(parts, "text/plain; charset=UTF-8", m.Message)
+	if len(m.Html) > 0 {
+		writeHtml(parts, m.Html, inline)
+	}
+	if len(m.Calendar) > 0 {
+		writePart(parts, calendarContentType(m.Calendar), m.Calendar)
+	}
+	parts.Close()
+	return "multipart/alternative; boundary=" + parts.Boundary(), "", body.Bytes()
+}
+
+// canonicalLines turns the bare CR and LF
+// line ends of the content into CRLF, as
+// the SMTP transfer sends them.
+func canonicalLines(content []byte) []byte {
+	normalized := bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1)
+	normalized = bytes.Replace(normalized, []byte("\r"), []byte("\n"), -1)
+	return bytes.Replace(normalized, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// writeHtml writes the HTML part, with the
+// inline images in multipart/related.
+func writeHtml(parts *multipart.Writer, html string, inline []Attachment) {
+	if len(inline) == 0 {
+		writePart(parts, "text/html; charset=UTF-8", html)
+		return
+	}
+
+	var related bytes.Buffer
+	relatedParts := multipart.NewWriter(&related)
+	writePart(relatedParts, "text/html; charset=UTF-8", html)
+	for _, attachment := range inline {
+		writeAttachment(relatedParts, attachment)
+	}
+	relatedParts.Close()
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "multipart/related; boundary="+relatedParts.Boundary())
+	w, _ := parts.CreatePart(header)
+	w.Write(related.Bytes())
+}
+
+// splitAttachments separates the inline images,
+// which make sense only with the HTML body.
+func splitAttachments(attachments []Attachment) ([]Attachment, []Attachment) {
+	var inline, attached []Attachment
+	for _, attachment := range attachments {
+		if attachment.Inline() {
+			inline = append(inline, attachment)
+		} else {
+			attached = append(attached, attachment)
+		}
+	}
+	return inline, attached
+}
+
+func writePart(parts *multipart.Writer, contentType, content string) {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	w, _ := parts.CreatePart(header)
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(content))
+	qp.Close()
+}
+
+func writeAttachment(parts *multipart.Writer, attachment Attachment) {
+	disposition := "attachment"
+	header := textproto.MIMEHeader{}
+	if attachment.Inline() {
+		disposition = "inline"
+		header.Set("Content-ID", "<"+attachment.ContentID+">")
+	}
+	header.Set("Content-Type", attachment.MIMEType())
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{
+		"filename": attachment.Filename,
+	}))
+	w, _ := parts.CreatePart(header)
+
+	encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+	for len(encoded) > base64LineLength {
+		w.Write([]byte(encoded[:base64LineLength] + "\r\n"))
+		encoded = encoded[base64LineLength:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
+
+// describeMessage returns the MIME tree of the
+// composed message e.g. multipart/mixed(
+// multipart/alternative(text/plain, text/html),
+// application/pdf).
+func describeMessage(message []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return "invalid"
+	}
+	return describePart(msg.Header.Get("Content-Type"), msg.Body)
+}
+
+func describePart(contentType string, body io.Reader) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "invalid"
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return mediaType
+	}
+	reader := multipart.NewReader(body, params["boundary"])
+	parts := []string{}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		parts = append(parts, describePart(part.Header.Get("Content-Type"), part))
+	}
+	return mediaType + "(" + strings.Join(parts, ", ") + ")"
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func TestComposeMultipartMessage(t *testing.T) {
+	content := composeMessage(&mailStruct{
+		Sender:    "info@suricata.com",
+		Recipient: "radek@suricata.com",
+		Subject:   "Hello",
+		Message:   "Hello Radek",
+		Html:      "<p>Hello Radek</p>",
+	}, time.Now())
+
+	msg, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Expected multipart message, got %s", mediaType)
+	}
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	expected := []string{"Hello Radek", "<p>Hello Radek</p>"}
+	for _, body := range expected {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Reader decodes quoted-printable
+		decoded, _ := ioutil.ReadAll(part)
+		if string(decoded) != body {
+			t.Errorf("Expected part %s, got %s", body, decoded)
+		}
+	}
+}
+
+func TestComposeMessageWithAttachment(t *testing.T) {
+	content := composeMessage(&mailStruct{
+		Sender:    "info@suricata.com",
+		Recipient: "radek@suricata.com",
+		Message:   "Your invoice",
+		Attachments: []Attachment{
+			{Filename: "invoice.pdf", Data: []byte("%PDF-1.4")},
+		},
+	}, time.Now())
+
+	msg, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+
+	body, _ := reader.NextPart()
+	if text, _ := ioutil.ReadAll(body); string(text) != "Your invoice" {
+		t.Errorf("Bad body part %s", text)
+	}
+
+	attachment, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.FileName() != "invoice.pdf" || attachment.Header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("Bad attachment header %v", attachment.Header)
+	}
+	encoded, _ := ioutil.ReadAll(attachment)
+	if decoded, _ := base64.StdEncoding.DecodeString(string(encoded)); string(decoded) != "%PDF-1.4" {
+		t.Errorf("Bad attachment content %s", encoded)
+	}
+}
+
+func TestComposeMessageWithInlineImage(t *testing.T) {
+	content := composeMessage(&mailStruct{
+		Message: "Suricata",
+		Html:    `<img src="cid:logo">`,
+		Attachments: []Attachment{
+			{Filename: "logo.png", ContentID: "logo", Data: []byte("png")},
+		},
+	}, time.Now())
+
+	msg, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Inline only mail should not be mixed, got %s", mediaType)
+	}
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	reader.NextPart()
+	related, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ = mime.ParseMediaType(related.Header.Get("Content-Type"))
+	if mediaType != "multipart/related" {
+		t.Fatalf("Expected related HTML part, got %s", mediaType)
+	}
+
+	relatedReader := multipart.NewReader(related, params["boundary"])
+	relatedReader.NextPart()
+	image, err := relatedReader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Header.Get("Content-ID") != "<logo>" {
+		t.Errorf("Bad inline image header %v", image.Header)
+	}
+}
+
+func TestComposeMessageWithReplyTo(t *testing.T) {
+	content := composeMessage(&mailStruct{
+		Sender:    "info@suricata.com",
+		Recipient: "radek@suricata.com",
+		ReplyTo:   "support@suricata.com",
+		Subject:   "Hello",
+		Message:   "Hello Radek",
+	}, time.Now())
+
+	msg, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replyTo := msg.Header.Get("Reply-To"); replyTo != "<support@suricata.com>" {
+		t.Errorf("Expected Reply-To <support@suricata.com>, got %s", replyTo)
+	}
+
+	content = composeMessage(&mailStruct{
+		Sender:    "info@suricata.com",
+		Recipient: "radek@suricata.com",
+		ReplyTo:   "support@suricata.com\r\nBcc: spam@example.com",
+		Message:   "Hello Radek",
+	}, time.Now())
+	if msg, err = mail.ReadMessage(bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Header.Get("Bcc")) > 0 || len(msg.Header.Get("Reply-To")) > 0 {
+		t.Errorf("Malformed Reply-To should be left out, got %v", msg.Header)
+	}
+}
+
+func TestComposeMessageWithUTF8Subject(t *testing.T) {
+	subjects := []string{"Hello", "Příliš žluťoučký kůň úpěl ďábelské ódy"}
+	for _, subject := range subjects {
+		content := composeMessage(&mailStruct{
+			Sender:    "info@suricata.com",
+			Recipient: "radek@suricata.com",
+			Subject:   subject,
+			Message:   "Hello Radek",
+		}, time.Now())
+
+		msg, err := mail.ReadMessage(bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := msg.Header.Get("Subject")
+		for _, r := range raw {
+			if r > 127 {
+				t.Fatalf("Subject header should be ASCII, got %s", raw)
+			}
+		}
+		decoded, err := new(mime.WordDecoder).DecodeHeader(raw)
+		if err != nil || decoded != subject {
+			t.Errorf("Expected subject %s, got %s %v", subject, decoded, err)
+		}
+	}
+}
+
+func TestComposeMessageWithCalendar(t *testing.T) {
+	ics := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nSUMMARY:Standup\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	content := composeMessage(&mailStruct{
+		Sender:    "info@suricata.com",
+		Recipient: "radek@suricata.com",
+		Message:   "Standup at 9",
+		Calendar:  ics,
+	}, time.Now())
+
+	msg, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Expected multipart message, got %s", mediaType)
+	}
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	reader.NextPart()
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	decoded, _ := ioutil.ReadAll(part)
+	if mediaType != "text/calendar" || params["method"] != "REQUEST" || string(decoded) != ics {
+		t.Errorf("Expected calendar invitation, got %s %v %q", mediaType, params, decoded)
+	}
+}
+
+func TestDescribeMessage(t *testing.T) {
+	content := composeMessage(&mailStruct{
+		Recipient: "radek@suricata.com",
+		Message:   "Your invoice",
+		Html:      "<p>Your invoice</p>",
+		Attachments: []Attachment{
+			{Filename: "invoice.pdf", Data: []byte("%PDF-1.4")},
+		},
+	}, time.Now())
+
+	expected := "multipart/mixed(multipart/alternative(text/plain, text/html), application/pdf)"
+	if structure := describeMessage(content); structure != expected {
+		t.Errorf("Expected %s, got %s", expected, structure)
+	}
+}
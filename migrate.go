@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// MigrateCommand runs the migrations
+// of the configured stores and exits.
+const MigrateCommand = "migrate"
+
+var (
+	ErrNewerSchema = fmt.Errorf("migrate: Store was migrated by the newer version")
+
+	metaBucket = []byte("meta")
+)
+
+// boltMigration moves the store to its Version,
+// the migrations run in order, each in its
+// own transaction with the version stored.
+type boltMigration struct {
+	Version     int
+	Description string
+	Migrate     func(tx *bolt.Tx, keyring *Keyring) error
+}
+
+func createBucket(bucket []byte) func(*bolt.Tx, *Keyring) error {
+	return func(tx *bolt.Tx, keyring *Keyring) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	}
+}
+
+var queueMigrations = []boltMigration{
+	{1, "Create the queue bucket", createBucket(boltQueueBucket)},
+	{2, "Keep the delivery state next to the mail", func(tx *bolt.Tx, keyring *Keyring) error {
+		return rewriteBucket(tx, boltQueueBucket, keyring, func(value []byte) ([]byte, error) {
+			m, err := decodeStored(value, nil)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(storedMail{&m, m.attempts, m.notBefore, m.booked, nil})
+		})
+	}},
+	{3, "Keep the attachments once in the blobs", func(tx *bolt.Tx, keyring *Keyring) error {
+		for _, bucket := range [][]byte{blobBucket, blobRefBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return rewriteBucket(tx, boltQueueBucket, keyring, func(value []byte) ([]byte, error) {
+			m, err := decodeStored(value, nil)
+			if err != nil {
+				return nil, err
+			}
+			stored, err := putBlobs(tx, &m, keyring)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(storedMail{stored, m.attempts, m.notBefore, m.booked, stored.blobs})
+		})
+	}},
+}
+
+var deadLetterMigrations = []boltMigration{
+	{1, "Create the dead letter bucket", createBucket(deadLetterBucket)},
+	{2, "Give the dead letters their reason", func(tx *bolt.Tx, keyring *Keyring) error {
+		return rewriteBucket(tx, deadLetterBucket, keyring, func(value []byte) ([]byte, error) {
+			letter := deadLetter{}
+			if err := json.Unmarshal(value, &letter); err != nil {
+				return nil, err
+			}
+			// Only the transient failure
+			// was retried before it failed
+			if len(letter.Reason) == 0 && letter.Attempts > 1 {
+				letter.Reason = ReasonExhausted
+			} else if len(letter.Reason) == 0 {
+				letter.Reason = ReasonPermanent
+			}
+			return json.Marshal(letter)
+		})
+	}},
+}
+
+var approvalMigrations = []boltMigration{
+	{1, "Create the approval bucket", createBucket(approvalBucket)},
+}
+
+// rewriteBucket passes the opened values of the
+// bucket through the rewrite and seals them
+// again by the keyring.
+func rewriteBucket(tx *bolt.Tx, bucket []byte, keyring *Keyring, rewrite func([]byte) ([]byte, error)) error {
+	b := tx.Bucket(bucket)
+	rewritten := map[string][]byte{}
+	err := b.ForEach(func(key, value []byte) error {
+		plain, err := keyring.Open(value)
+		if err != nil {
+			return err
+		}
+		if plain, err = rewrite(plain); err != nil {
+			return err
+		}
+		if rewritten[string(key)], err = keyring.Seal(plain); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key, value := range rewritten {
+		if err := b.Put([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the version
+// of the store, zero for the new one.
+func schemaVersion(db *bolt.DB, store string) (int, error) {
+	version := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(metaBucket); meta != nil {
+			if value := meta.Get([]byte(store)); len(value) == 8 {
+				version = int(binary.BigEndian.Uint64(value))
+			}
+		}
+		return nil
+	})
+	return version, err
+}
+
+// migrateBolt runs the migrations of the store
+// newer than its version. The store of the
+// newer version than known is refused.
+func migrateBolt(db *bolt.DB, store string, migrations []boltMigration, keyring *Keyring) error {
+	version, err := schemaVersion(db, store)
+	if err != nil {
+		return err
+	}
+	if latest := migrations[len(migrations)-1].Version; version > latest {
+		return ErrNewerSchema
+	}
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+		err := db.Update(func(tx *bolt.Tx) error {
+			if err := migration.Migrate(tx, keyring); err != nil {
+				return err
+			}
+			meta, err := tx.CreateBucketIfNotExists(metaBucket)
+			if err != nil {
+				return err
+			}
+			return meta.Put([]byte(store), boltKey(uint64(migration.Version)))
+		})
+		if err != nil {
+			return fmt.Errorf("migrate: %s %d failed: %s", store, migration.Version, err)
+		}
+		log.Infof("Migrated %s to %d: %s", store, migration.Version, migration.Description)
+	}
+	return nil
+}
+
+// openBolt opens the BoltDB file of the store,
+// migrates it and seals its buckets again by
+// the active key of the keyring.
+func openBolt(path, store string, migrations []boltMigration, keyring *Keyring, buckets ...[]byte) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = migrateBolt(db, store, migrations, keyring)
+	for _, bucket := range buckets {
+		if err == nil {
+			err = keyring.resealBucket(db, bucket)
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// MigrateStores migrates the configured BoltDB
+// stores, which are also migrated on startup.
+// It runs by the migrate command before the
+// deploy, the stores must not be open.
+func MigrateStores() error {
+	keyring, err := ParseKeyring(encryptionConfig.Keys)
+	if err != nil {
+		return err
+	}
+	stores := []struct {
+		path, store string
+		migrations  []boltMigration
+		buckets     [][]byte
+	}{
+		{appConfig.QueuePath, "queue", queueMigrations, [][]byte{boltQueueBucket, blobBucket}},
+		{deadLetterConfig.Path, "deadletters", deadLetterMigrations, [][]byte{deadLetterBucket}},
+		{approvalConfig.Path, "approvals", approvalMigrations, [][]byte{approvalBucket}},
+	}
+	for _, s := range stores {
+		if len(s.path) == 0 {
+			continue
+		}
+		db, err := openBolt(s.path, s.store, s.migrations, keyring, s.buckets...)
+		if err != nil {
+			return err
+		}
+		version, _ := schemaVersion(db, s.store)
+		db.Close()
+		log.Infof("Store %s in %s is at version %d", s.store, s.path, version)
+	}
+	return nil
+}
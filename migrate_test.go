@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestMigrateBolt(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migrate")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadletter.db")
+
+	// Dead letter stored before the reasons
+	db, _ := bolt.Open(path, 0600, nil)
+	db.Update(func(tx *bolt.Tx) error {
+		bucket, _ := tx.CreateBucket(deadLetterBucket)
+		bucket.NextSequence()
+		value, _ := json.Marshal(map[string]interface{}{"Mail": mailStruct{Recipient: "radek@example.com"}, "Attempts": 5, "Failed": time.Now()})
+		return bucket.Put(boltKey(1), value)
+	})
+	if version, _ := schemaVersion(db, "deadletters"); version != 0 {
+		t.Fatalf("Unversioned store should be at zero, got %d", version)
+	}
+	db.Close()
+
+	store, err := NewDeadLetterStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, _ := store.List(ReasonExhausted)
+	if len(list) != 1 || list[0].Recipient != "radek@example.com" {
+		t.Errorf("Old dead letter should get its reason, got %+v", list)
+	}
+	if version, _ := schemaVersion(store.db, "deadletters"); version != deadLetterMigrations[len(deadLetterMigrations)-1].Version {
+		t.Errorf("Store should be at the latest version, got %d", version)
+	}
+	store.Add(&mailStruct{}, ReasonValidation, ErrBadSender, 1, time.Now())
+	if key, _ := boltKeyNext(store.db); key != 3 {
+		t.Errorf("Migration should keep the sequence, next is %d", key)
+	}
+
+	newer := append(deadLetterMigrations, boltMigration{99, "Future", createBucket([]byte("future"))})
+	if err := migrateBolt(store.db, "deadletters", newer, nil); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if _, err := NewDeadLetterStore(path, nil); err != ErrNewerSchema {
+		t.Errorf("Store of the newer version should be refused, got %v", err)
+	}
+}
+
+func boltKeyNext(db *bolt.DB) (uint64, error) {
+	var next uint64
+	err := db.View(func(tx *bolt.Tx) error {
+		next = tx.Bucket(deadLetterBucket).Sequence() + 1
+		return nil
+	})
+	return next, err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nats-io/nats"
+)
+
+type pingStruct struct {
+	Name       string
+	Version    string
+	QueueDepth int
+	Uptime     string
+}
+
+// PingFunc answers the liveness requests
+// with the instance metadata encoded as JSON,
+// so any NATS client can read it.
+func PingFunc(nc *nats.Conn, queue *QueuedMailer) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		if len(msg.Reply) == 0 {
+			return
+		}
+		out, err := json.Marshal(pingStruct{
+			Name:       appConfig.Name,
+			Version:    Version,
+			QueueDepth: queue.Depth(),
+			Uptime:     time.Since(startTime).String(),
+		})
+		if err != nil {
+			log.Errorln(err)
+			return
+		}
+		if err := nc.Publish(msg.Reply, out); err != nil {
+			log.Errorln(err)
+		}
+	}
+}
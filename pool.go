@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// TLSError is the failed STARTTLS of the
+// server e.g. by its expired certificate,
+// another server of the domain may
+// still accept the mail.
+type TLSError struct {
+	Host string
+	Err  error
+}
+
+func (e *TLSError) Error() string {
+	return fmt.Sprintf("smtp: STARTTLS with %s failed: %s", e.Host, e.Err)
+}
+
+func isTLSFailure(err error) bool {
+	_, ok := err.(*TLSError)
+	return ok
+}
+
+// smtpPool keeps the idle connections per
+// server address for the next mail, so
+// the burst to one destination does not
+// dial for every message. The idle one
+// is checked by NOOP before it is used,
+// after maxMessages it is replaced.
+type smtpPool struct {
+	dial        func(addr string) (net.Conn, *smtp.Client, error)
+	timeout     time.Duration
+	maxIdle     int
+	idleTimeout time.Duration
+	maxMessages int
+
+	mutex sync.Mutex
+	idle  map[string][]*pooledClient
+}
+
+type pooledClient struct {
+	*smtp.Client
+	conn net.Conn
+	addr string
+	used time.Time
+	sent int
+}
+
+func newSmtpPool(dial func(addr string) (net.Conn, *smtp.Client, error), timeout time.Duration, maxIdle int, idleTimeout time.Duration) *smtpPool {
+	return &smtpPool{
+		dial:        dial,
+		timeout:     timeout,
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		idle:        make(map[string][]*pooledClient),
+	}
+}
+
+// get takes the idle connection to the
+// address or dials new one, reused
+// tells which of them it is.
+func (p *smtpPool) get(addr string) (c *pooledClient, reused bool, err error) {
+	now := time.Now()
+	p.mutex.Lock()
+	for clients := p.idle[addr]; len(clients) > 0; clients = p.idle[addr] {
+		c = clients[len(clients)-1]
+		p.idle[addr] = clients[:len(clients)-1]
+		if now.Sub(c.used) >= p.idleTimeout {
+			c.Close()
+			continue
+		}
+		p.mutex.Unlock()
+		c.conn.SetDeadline(now.Add(p.timeout))
+		if c.Noop() == nil {
+			return c, true, nil
+		}
+		c.Close()
+		p.mutex.Lock()
+	}
+	p.mutex.Unlock()
+
+	c, err = p.fresh(addr)
+	return c, false, err
+}
+
+func (p *smtpPool) fresh(addr string) (*pooledClient, error) {
+	conn, client, err := p.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledClient{Client: client, conn: conn, addr: addr, used: time.Now()}, nil
+}
+
+// put keeps the connection for the next mail,
+// unless it failed other than by the reply
+// of the server or there are enough idle.
+func (p *smtpPool) put(c *pooledClient, err error) {
+	if _, reply := err.(*textproto.Error); err != nil && !reply {
+		c.Close()
+		return
+	}
+	if c.Reset() != nil {
+		c.Close()
+		return
+	}
+	c.used = time.Now()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.idle[c.addr]) >= p.maxIdle || (p.maxMessages > 0 && c.sent >= p.maxMessages) {
+		c.quit()
+		return
+	}
+	p.idle[c.addr] = append(p.idle[c.addr], c)
+}
+
+// send delivers the message over the pooled
+// connection, the one closed by the server
+// meanwhile is replaced by the new one.
+func (p *smtpPool) send(addr, from string, to []string, message []byte) error {
+	c, reused, err := p.get(addr)
+	if err != nil {
+		return err
+	}
+	err = c.deliver(p.timeout, from, to, message)
+	if _, reply := err.(*textproto.Error); err != nil && !reply && reused {
+		c.Close()
+		if c, err = p.fresh(addr); err != nil {
+			return err
+		}
+		err = c.deliver(p.timeout, from, to, message)
+	}
+	p.put(c, err)
+	return err
+}
+
+func (c *pooledClient) deliver(timeout time.Duration, from string, to []string, message []byte) error {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	c.sent++
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := c.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// dialSmtp connects to the server over STARTTLS
+// if the server offers it, and authenticates if
+// the auth is set. The hostname is used in the
+// greeting, localhost if empty.
+func dialSmtp(addr, hostname string, auth smtp.Auth, timeout time.Duration) (net.Conn, *smtp.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := handshake(c, host, hostname, auth); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return conn, c, nil
+}
+
+func handshake(c *smtp.Client, host, hostname string, auth smtp.Auth) error {
+	if len(hostname) > 0 {
+		if err := c.Hello(hostname); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return &TLSError{host, err}
+		}
+	}
+	if auth != nil {
+		return c.Auth(auth)
+	}
+	return nil
+}
+
+// quit says goodbye to the server,
+// the connection is closed anyway.
+func (c *pooledClient) quit() {
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	c.Quit()
+	c.Close()
+}
+
+func (p *smtpPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, clients := range p.idle {
+		for _, c := range clients {
+			c.quit()
+		}
+	}
+	p.idle = make(map[string][]*pooledClient)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// PreferencesKey is the etcd directory with the
+// JSON encoded Preferences keyed by recipient.
+const PreferencesKey = "/mail/preferences"
+
+// Urgency categories of the notifications
+const (
+	UrgencyLow      = "low"
+	UrgencyNormal   = "normal"
+	UrgencyCritical = "critical"
+)
+
+// Preferences of the recipient list the channels
+// per urgency in the order they are tried
+// e.g. {"critical": ["sms", "push", "email"]}.
+type Preferences map[string][]string
+
+// Channels returns the preferred channels
+// for the urgency, normal by default.
+func (p Preferences) Channels(urgency string) []string {
+	if len(urgency) == 0 {
+		urgency = UrgencyNormal
+	}
+	return p[urgency]
+}
+
+type PreferenceStore interface {
+	Preferences(recipient string) (Preferences, error)
+}
+
+// EtcdPreferenceStore reads the
+// preferences of the recipient from etcd.
+type EtcdPreferenceStore struct {
+	endpoint string
+}
+
+func NewEtcdPreferenceStore(endpoint string) PreferenceStore {
+	return &EtcdPreferenceStore{endpoint}
+}
+
+func (s *EtcdPreferenceStore) Preferences(recipient string) (Preferences, error) {
+	value, ok, err := loadEtcdValue(s.endpoint, PreferencesKey+"/"+url.PathEscape(recipient))
+	if err != nil || !ok {
+		return nil, err
+	}
+	prefs := Preferences{}
+	if err := json.Unmarshal([]byte(value), &prefs); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// preferredChannels returns the channels the recipient
+// wants for the urgency of the mail, nil if the
+// recipient has no preference.
+func preferredChannels(store PreferenceStore, mail *mailStruct) []string {
+	if store == nil {
+		return nil
+	}
+	prefs, err := store.Preferences(mail.Recipient)
+	if err != nil {
+		log.Errorf("Cannot load preferences of %s: %s", mail.Recipient, err)
+		return nil
+	}
+	return prefs.Channels(mail.Urgency)
+}
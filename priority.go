@@ -0,0 +1,30 @@
+package main
+
+// Priority levels of the mail, the high
+// priority mail e.g. password reset is sent
+// before the normal and the bulk mail.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityBulk   = "bulk"
+)
+
+// priorityHeaders returns the headers telling
+// the mail clients and the receiving servers
+// the priority, none for the normal mail.
+func priorityHeaders(priority string) map[string]string {
+	switch priority {
+	case PriorityHigh:
+		return map[string]string{
+			"X-Priority": "1 (Highest)",
+			"Importance": "high",
+		}
+	case PriorityBulk:
+		return map[string]string{
+			"X-Priority": "5 (Lowest)",
+			"Importance": "low",
+			"Precedence": "bulk",
+		}
+	}
+	return nil
+}
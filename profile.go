@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Profiles bundle the settings
+// of the environment.
+const (
+	ProfileDev     = "dev"
+	ProfileStaging = "staging"
+	ProfileProd    = "prod"
+	ProfileMailhog = "mailhog"
+)
+
+// StagingRate limits each provider in
+// staging unless configured otherwise.
+const StagingRate = 1.0
+
+var (
+	ErrUnknownProfile    = fmt.Errorf("profile: Unknown profile")
+	ErrCatchAllRequired  = fmt.Errorf("profile: Staging requires the CatchAll recipient")
+	ErrProdMisconfigured = fmt.Errorf("profile: Prod must not capture or rewrite the mail")
+)
+
+// applyProfile overrides the configuration
+// with the settings of the selected profile.
+// The configuration which does not fit the
+// profile is rejected, so e.g. the staging
+// settings cannot end up in prod.
+func applyProfile(config *AppConfig, smtp *SmtpConfig) error {
+	switch config.Profile {
+	case "":
+	case ProfileDev:
+		// Dry run, the mail is only written to disk
+		log.Warnf("Profile dev: all mail is written to %s", fileConfig.Dir)
+		config.Mailers = []string{"file"}
+		config.Routes = nil
+		config.Channels = nil
+	case ProfileStaging:
+		if len(config.CatchAll) == 0 {
+			return ErrCatchAllRequired
+		}
+		log.Warnf("Profile staging: all mail is sent to %s", config.CatchAll)
+		// Other channels would reach real people
+		config.Channels = nil
+		if config.MailerRates == nil {
+			config.MailerRates = map[string]float64{}
+		}
+		for _, name := range config.Mailers {
+			if _, ok := config.MailerRates[name]; !ok {
+				config.MailerRates[name] = StagingRate
+			}
+		}
+	case ProfileProd:
+		if len(config.CatchAll) > 0 || len(sandboxConfig.Addr) > 0 {
+			return ErrProdMisconfigured
+		}
+		for _, name := range config.Mailers {
+			if name == "file" {
+				return ErrProdMisconfigured
+			}
+		}
+	case ProfileMailhog:
+		log.Warnf("Profile mailhog: all mail is captured by %s:1025", smtp.Host)
+		config.Mailers = []string{"smtp"}
+		config.Routes = nil
+		smtp.Port = "1025"
+		if len(smtp.CaptureURL) == 0 {
+			smtp.CaptureURL = fmt.Sprintf("http://%s:8025", smtp.Host)
+		}
+	default:
+		return fmt.Errorf("%s: %s", ErrUnknownProfile, config.Profile)
+	}
+	return nil
+}
+
+// CatchAllMailer sends all the mail to single
+// recipient, the original one is kept in
+// the X-Original-To header.
+type CatchAllMailer struct {
+	mailer    Mailer
+	recipient string
+}
+
+func NewCatchAllMailer(mailer Mailer, recipient string) Mailer {
+	return &CatchAllMailer{
+		mailer:    mailer,
+		recipient: recipient,
+	}
+}
+
+func (cm *CatchAllMailer) SendMail(mail *mailStruct) error {
+	m := *mail
+	m.Headers = map[string]string{"X-Original-To": mail.Recipient}
+	for name, value := range mail.Headers {
+		m.Headers[name] = value
+	}
+	m.Recipient = cm.recipient
+	return cm.mailer.SendMail(&m)
+}
+
+func (cm *CatchAllMailer) Close() {
+	cm.mailer.Close()
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestApplyProfile(t *testing.T) {
+	config := &AppConfig{Profile: ProfileStaging, Mailers: []string{"mailgun", "smtp"}, MailerRates: map[string]float64{"smtp": 5}}
+	if applyProfile(config, &SmtpConfig{}) != ErrCatchAllRequired {
+		t.Error("Staging without CatchAll should be rejected")
+	}
+	config.CatchAll = "qa@suricata.com"
+	config.Channels = []string{"sms"}
+	if err := applyProfile(config, &SmtpConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if config.MailerRates["mailgun"] != StagingRate || config.MailerRates["smtp"] != 5 || len(config.Channels) != 0 {
+		t.Errorf("Unexpected staging config %v %v", config.MailerRates, config.Channels)
+	}
+
+	config.Profile = ProfileProd
+	if applyProfile(config, &SmtpConfig{}) != ErrProdMisconfigured {
+		t.Error("Prod with CatchAll should be rejected")
+	}
+
+	config.Profile = "prd"
+	if applyProfile(config, &SmtpConfig{}) == nil {
+		t.Error("Unknown profile should be rejected")
+	}
+}
+
+func TestCatchAllMailer(t *testing.T) {
+	fake := &FakeMailer{}
+	mailer := NewCatchAllMailer(fake, "qa@suricata.com")
+	mailer.SendMail(&mailStruct{Recipient: "radek@suricata.com"})
+	if fake.sent[0].Recipient != "qa@suricata.com" || fake.sent[0].Headers["X-Original-To"] != "radek@suricata.com" {
+		t.Errorf("Mail should be rewritten to the catch-all, got %v", fake.sent[0])
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const FcmSendURL = "https://fcm.googleapis.com/fcm/send"
+
+var (
+	ErrMissingDeviceTokens = fmt.Errorf("pushchannel: DeviceTokens are missing")
+
+	fcmConfig = &FcmConfig{}
+)
+
+type FcmConfig struct {
+	ServerKey string
+}
+
+func init() {
+	RegisterConfig("fcm", fcmConfig)
+	RegisterChannel("push", func() (Mailer, error) {
+		return NewPushChannel(fcmConfig.ServerKey), nil
+	})
+}
+
+// PushChannel sends the subject and the text as
+// a notification to the DeviceTokens of the mail
+// through FCM, which relays to APNs for iOS.
+type PushChannel struct {
+	sendURL   string
+	serverKey string
+	client    *http.Client
+}
+
+func NewPushChannel(serverKey string) Mailer {
+	return &PushChannel{
+		sendURL:   FcmSendURL,
+		serverKey: serverKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type fcmNotification struct {
+	RegistrationIDs []string `json:"registration_ids"`
+	Notification    struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	} `json:"notification"`
+}
+
+func (pc *PushChannel) SendMail(mail *mailStruct) error {
+	if len(mail.DeviceTokens) == 0 {
+		return ErrMissingDeviceTokens
+	}
+
+	notification := fcmNotification{RegistrationIDs: mail.DeviceTokens}
+	notification.Notification.Title = mail.Subject
+	notification.Notification.Body = mail.Message
+	out, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", pc.sendURL, bytes.NewReader(out))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "key="+pc.serverKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := pc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pushchannel: FCM returned %d", resp.StatusCode)
+	}
+
+	result := struct {
+		Success int `json:"success"`
+		Failure int `json:"failure"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Success == 0 {
+		return fmt.Errorf("pushchannel: No device accepted the notification")
+	}
+	log.Infof("Push for %s delivered to %d devices, %d failed", mail.Recipient, result.Success, result.Failure)
+	return nil
+}
+
+func (pc *PushChannel) Close() {}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Policies of the full queue, block waits
+// for the room, reject fails the mail and
+// shed drops the oldest mail for it.
+const (
+	QueueBlock      = "block"
+	QueueReject     = "reject"
+	QueueShedOldest = "shed"
+)
+
+var (
+	ErrQueueFull       = fmt.Errorf("queuedmailer: Queue is full")
+	ErrScheduledTooFar = fmt.Errorf("queuedmailer: DeliveryTime is too far ahead")
+	ErrMailExpired     = fmt.Errorf("queuedmailer: Mail expired before it was sent")
+)
+
+// QueuedMailer hands the messages over
+// the channel to the worker goroutines which
+// send them through the wrapped mailer, so the
+// HTTP and NATS handlers do not wait for
+// the provider. The high priority mail is
+// taken first and the bulk mail last, the
+// expired mail is dropped. The optional
+// limiter caps the send rate of all
+// the workers together, the throttled
+// recipient domains have their own
+// queues and rates on top of it. The mail
+// the wrapped mailer retries later waits in
+// the store, or in memory without one, as
+// well as the mail scheduled by its
+// DeliveryTime up to the scheduleMax. The
+// expired mail is kept by the optional
+// deadLetters.
+type QueuedMailer struct {
+	mailer      Mailer
+	sendChannel chan mailStruct
+	highChannel chan mailStruct
+	bulkChannel chan mailStruct
+	store       QueueStore
+	stop        chan struct{}
+	stopOnce    sync.Once
+	taking      sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+	ramp        *WarmupRamp
+	reputation  *ReputationGuard
+	limiter     *TokenBucket
+	domains     map[string]*domainQueue
+	delayed     *delayQueue
+	scheduleMax time.Duration
+	policy      string
+	deadLetters *DeadLetterStore
+	pending     int64
+	expired     int64
+	shed        int64
+	drain       drainMeter
+}
+
+func NewQueuedMailer(mailer Mailer, ramp *WarmupRamp, workers, buffer int) *QueuedMailer {
+	senderChan := make(chan mailStruct, buffer)
+	ctx, cancel := context.WithCancel(context.TODO())
+	queue := &QueuedMailer{
+		mailer:      mailer,
+		sendChannel: senderChan,
+		highChannel: make(chan mailStruct, buffer),
+		bulkChannel: make(chan mailStruct, buffer),
+		policy:      QueueBlock,
+		stop:        make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+		ramp:        ramp,
+		delayed:     newDelayQueue(),
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go queue.work(ctx)
+	}
+	go queue.release(ctx)
+	return queue
+}
+
+// work sends the mail taken from the channels
+// until the context is done, the workers send
+// concurrently with each other.
+func (q *QueuedMailer) work(ctx context.Context) {
+	for {
+		log.Debug("Waiting for message")
+		m, ok := q.next(ctx)
+		if !ok || !q.deliver(ctx, m) {
+			log.Infoln("Closing goroutine to send mails")
+			return
+		}
+	}
+}
+
+// deliver sends the mail within the send rate,
+// false if the context is done while waiting
+// for it. The mail over the warm-up ramp is
+// postponed to its period, not waited for,
+// so is the mail held back by the reputation
+// guard.
+func (q *QueuedMailer) deliver(ctx context.Context, m mailStruct) bool {
+	log.Debugf("Receiving message: %s", m.String())
+	if !m.booked {
+		if wait := q.ramp.Reserve(m.Campaign, time.Now()); wait > 0 {
+			log.Infof("Campaign %s warming up, delaying message for %s", m.Campaign, wait)
+			m.booked = true
+			q.postpone(m, time.Now().Add(wait))
+			atomic.AddInt64(&q.pending, -1)
+			return true
+		}
+	}
+	if wait := q.reputation.Reserve(m.Campaign, time.Now()); wait > 0 {
+		log.Infof("Campaign %s held back by its reputation, delaying message for %s", m.Campaign, wait)
+		q.postpone(m, time.Now().Add(wait))
+		atomic.AddInt64(&q.pending, -1)
+		return true
+	}
+	if wait := q.limiter.Reserve(time.Now()); wait > 0 {
+		log.Debugf("Send rate exceeded, delaying message for %s", wait)
+		if !sleep(ctx, wait) {
+			return false
+		}
+	}
+	if m.Expired(time.Now()) {
+		atomic.AddInt64(&q.expired, 1)
+		log.Warnf("Dropping mail expired at %s: %s", m.ExpiresAt, m.String())
+		if q.deadLetters != nil {
+			if err := q.deadLetters.Add(&m, ReasonExpired, ErrMailExpired, m.attempts, time.Now()); err != nil {
+				log.Errorf("Cannot keep the dead letter to %s: %s", m.Recipient, err)
+			}
+		}
+	} else if err := q.mailer.SendMail(&m); err != nil {
+		if retry, ok := err.(*RetryError); ok {
+			m.attempts = retry.Attempts
+			if len(retry.Channels) > 0 {
+				m.Channels = retry.Channels
+			}
+			q.postpone(m, retry.At)
+			atomic.AddInt64(&q.pending, -1)
+			return true
+		}
+		log.Errorln(err)
+	} else {
+		q.reputation.Sent(m.Campaign, m.Recipient, time.Now())
+	}
+	q.forget(&m)
+	atomic.AddInt64(&q.pending, -1)
+	q.drain.mark(time.Now())
+	return true
+}
+
+// postpone keeps the mail in the store and
+// hands it to the workers again once due.
+// The mail of the shared store is taken
+// by any of the instances then.
+func (q *QueuedMailer) postpone(m mailStruct, at time.Time) {
+	m.notBefore = at
+	if q.store != nil && m.queueKey != 0 {
+		err := q.store.Delay(&m)
+		if err != nil {
+			log.Errorf("Cannot keep the delayed mail in the queue store: %s", err)
+		}
+		if _, ok := q.store.(SharedQueueStore); ok && err == nil {
+			return
+		}
+	}
+	q.delayed.push(m)
+}
+
+// release hands the delayed mail
+// to the workers as it is due.
+func (q *QueuedMailer) release(ctx context.Context) {
+	for {
+		due, wait := q.delayed.due(time.Now())
+		for _, m := range due {
+			ok := q.enqueue(m, ctx.Done())
+			q.delayed.released()
+			if !ok {
+				return
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-q.delayed.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// sleep waits unless the context is done first.
+func sleep(ctx context.Context, wait time.Duration) bool {
+	select {
+	case <-time.After(wait):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// next takes the waiting mail of the highest
+// priority, or waits for any mail.
+func (q *QueuedMailer) next(ctx context.Context) (mailStruct, bool) {
+	select {
+	case m := <-q.highChannel:
+		return m, true
+	default:
+	}
+	select {
+	case m := <-q.highChannel:
+		return m, true
+	case m := <-q.sendChannel:
+		return m, true
+	default:
+	}
+	select {
+	case m := <-q.highChannel:
+		return m, true
+	case m := <-q.sendChannel:
+		return m, true
+	case m := <-q.bulkChannel:
+		return m, true
+	case <-ctx.Done():
+		return mailStruct{}, false
+	}
+}
+
+func (q *QueuedMailer) SendMail(mail *mailStruct) error {
+	if q.sendChannel == nil {
+		return ErrMailerNotInitialized
+	}
+
+	m := *mail
+	if now := time.Now(); m.DeliveryTime.After(now) {
+		if q.scheduleMax > 0 && m.DeliveryTime.Sub(now) > q.scheduleMax {
+			return ErrScheduledTooFar
+		}
+		// The queue holds the mail, the
+		// provider sends it right away
+		m.notBefore = m.DeliveryTime
+		m.DeliveryTime = time.Time{}
+	}
+	if q.store != nil {
+		key, err := q.store.Put(&m)
+		if err != nil {
+			return err
+		}
+		// Shared mail is taken from the
+		// store by any of the instances
+		if _, ok := q.store.(SharedQueueStore); ok {
+			return nil
+		}
+		m.queueKey = key
+	}
+	if !m.notBefore.IsZero() {
+		log.Infof("Mail for %s scheduled at %s", m.Recipient, m.notBefore)
+		q.delayed.push(m)
+		return nil
+	}
+	if q.throttled(m) {
+		return nil
+	}
+	switch q.policy {
+	case QueueReject:
+		return q.offer(m)
+	case QueueShedOldest:
+		q.shedOldest(m)
+	default:
+		q.enqueue(m, nil)
+	}
+	return nil
+}
+
+func (q *QueuedMailer) channel(priority string) chan mailStruct {
+	switch priority {
+	case PriorityHigh:
+		return q.highChannel
+	case PriorityBulk:
+		return q.bulkChannel
+	}
+	return q.sendChannel
+}
+
+// offer hands the mail to the goroutine
+// only if the channel has room for it.
+func (q *QueuedMailer) offer(m mailStruct) error {
+	atomic.AddInt64(&q.pending, 1)
+	select {
+	case q.channel(m.Priority) <- m:
+		return nil
+	default:
+	}
+	atomic.AddInt64(&q.pending, -1)
+	q.forget(&m)
+	return ErrQueueFull
+}
+
+// shedOldest makes the room for the mail
+// by dropping the oldest one of the
+// same priority when the channel is full.
+// Without the buffer there is none to drop.
+func (q *QueuedMailer) shedOldest(m mailStruct) {
+	channel := q.channel(m.Priority)
+	if cap(channel) == 0 {
+		q.enqueue(m, nil)
+		return
+	}
+	atomic.AddInt64(&q.pending, 1)
+	for {
+		select {
+		case channel <- m:
+			return
+		default:
+		}
+		select {
+		case old := <-channel:
+			atomic.AddInt64(&q.pending, -1)
+			atomic.AddInt64(&q.shed, 1)
+			q.forget(&old)
+			log.Warnf("Queue full, dropping the oldest mail: %s", old.String())
+		default:
+		}
+	}
+}
+
+// forget removes the mail sent
+// or dropped from the queue store.
+func (q *QueuedMailer) forget(m *mailStruct) {
+	if q.store == nil || m.queueKey == 0 {
+		return
+	}
+	if err := q.store.Delete(m.queueKey); err != nil {
+		log.Errorf("Cannot remove mail from the queue store: %s", err)
+	}
+}
+
+// enqueue hands the mail to the goroutine,
+// unless the done channel is closed first.
+func (q *QueuedMailer) enqueue(m mailStruct, done <-chan struct{}) bool {
+	if q.throttled(m) {
+		return true
+	}
+	atomic.AddInt64(&q.pending, 1)
+	channel := q.channel(m.Priority)
+	select {
+	case channel <- m:
+		return true
+	case <-done:
+		atomic.AddInt64(&q.pending, -1)
+		return false
+	}
+}
+
+// QueueStore keeps the accepted mail outside
+// of the process until it is sent. Pending
+// returns the mail left unsent by the
+// previous run of the instance.
+type QueueStore interface {
+	Put(mail *mailStruct) (uint64, error)
+	// Delay keeps the mail put off by
+	// its notBefore under its key
+	Delay(mail *mailStruct) error
+	Delete(key uint64) error
+	Pending() ([]mailStruct, error)
+	Close()
+}
+
+// SharedQueueStore is shared by the instances,
+// each mail is taken by exactly one of them.
+type SharedQueueStore interface {
+	QueueStore
+	// Take waits for the next mail with
+	// its key set until done is closed
+	Take(done <-chan struct{}) (mailStruct, bool, error)
+	Depth() (int, error)
+}
+
+// Persist keeps the accepted mail in the store
+// until it is sent. The mail left there by the
+// previous run is queued again. The mail of
+// the shared store is sent as it is taken.
+func (q *QueuedMailer) Persist(store QueueStore) error {
+	stored, err := store.Pending()
+	if err != nil {
+		return err
+	}
+	q.store = store
+	if len(stored) > 0 {
+		log.Infof("Resuming %d mails queued before restart", len(stored))
+	}
+	q.taking.Add(1)
+	go func() {
+		defer q.taking.Done()
+		for _, m := range stored {
+			if m.notBefore.After(time.Now()) {
+				q.delayed.push(m)
+				continue
+			}
+			if !q.enqueue(m, q.stop) {
+				return
+			}
+		}
+		if shared, ok := store.(SharedQueueStore); ok {
+			q.take(shared)
+		}
+	}()
+	return nil
+}
+
+// take feeds the goroutine with the mail
+// of the shared store until stopped.
+func (q *QueuedMailer) take(shared SharedQueueStore) {
+	for {
+		m, ok, err := shared.Take(q.stop)
+		if err != nil {
+			log.Errorf("Cannot take mail from the shared queue: %s", err)
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-q.stop:
+				return
+			}
+		}
+		if !ok || !q.enqueue(m, q.stop) {
+			return
+		}
+	}
+}
+
+// Depth returns the number of messages
+// accepted but not sent yet, all of
+// them in the shared store.
+func (q *QueuedMailer) Depth() int {
+	if shared, ok := q.store.(SharedQueueStore); ok {
+		if depth, err := shared.Depth(); err == nil {
+			return depth + int(atomic.LoadInt64(&q.pending))
+		}
+	}
+	return int(atomic.LoadInt64(&q.pending))
+}
+
+// Delayed returns the number of messages
+// put off by the instance, the shared
+// store keeps them apart from it.
+func (q *QueuedMailer) Delayed() int {
+	return q.delayed.size()
+}
+
+// Expired returns the number of
+// messages dropped as expired.
+func (q *QueuedMailer) Expired() int {
+	return int(atomic.LoadInt64(&q.expired))
+}
+
+// Shed returns the number of messages
+// dropped to make room for the newer.
+func (q *QueuedMailer) Shed() int {
+	return int(atomic.LoadInt64(&q.shed))
+}
+
+// DrainRate returns the recent number
+// of messages sent per second.
+func (q *QueuedMailer) DrainRate() float64 {
+	return q.drain.get()
+}
+
+// Expired tells whether the mail
+// is not worth sending anymore.
+func (m *mailStruct) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
+
+// Drain stops taking the mail of the store and
+// waits until the mail accepted by the instance
+// is sent, false if the timeout passes first.
+// The mail left in the store is resumed by the
+// next run. Without the store the delayed mail
+// due within the timeout is waited for as well,
+// false if any is left then.
+func (q *QueuedMailer) Drain(timeout time.Duration) bool {
+	q.stopTaking()
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&q.pending) > 0 || (q.store == nil && q.delayed.dueBy(deadline)) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return q.store != nil || q.delayed.size() == 0
+}
+
+func (q *QueuedMailer) stopTaking() {
+	q.stopOnce.Do(func() { close(q.stop) })
+}
+
+// Close stops the workers, the store is closed
+// once the mail being taken from it is back.
+func (q *QueuedMailer) Close() {
+	q.stopTaking()
+	q.taking.Wait()
+	q.cancel()
+	if delayed := q.Delayed(); delayed > 0 && q.store == nil {
+		log.Warnf("Dropping %d delayed mails, the queue is not persisted", delayed)
+	}
+	q.mailer.Close()
+	if q.store != nil {
+		q.store.Close()
+	}
+}
+
+// drainMeter keeps the moving
+// average of the send rate.
+type drainMeter struct {
+	mutex sync.Mutex
+	rate  float64
+	last  time.Time
+}
+
+func (d *drainMeter) mark(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.last.IsZero() {
+		if interval := now.Sub(d.last).Seconds(); interval > 0 {
+			d.rate = 0.8*d.rate + 0.2/interval
+		}
+	}
+	d.last = now
+}
+
+func (d *drainMeter) get() float64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.rate
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestQueuedMailerPriority(t *testing.T) {
+	queue := &QueuedMailer{
+		sendChannel: make(chan mailStruct, 1),
+		highChannel: make(chan mailStruct, 1),
+		bulkChannel: make(chan mailStruct, 1),
+	}
+	queue.bulkChannel <- mailStruct{Priority: PriorityBulk}
+	queue.sendChannel <- mailStruct{}
+	queue.highChannel <- mailStruct{Priority: PriorityHigh}
+
+	expected := []string{PriorityHigh, "", PriorityBulk}
+	for _, priority := range expected {
+		m, ok := queue.next(context.TODO())
+		if !ok || m.Priority != priority {
+			t.Errorf("Expected %q priority mail, got %q", priority, m.Priority)
+		}
+	}
+}
+
+func TestQueuedMailerDropsExpired(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	deadLetters, err := NewDeadLetterStore(filepath.Join(dir, "deadletter.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deadLetters.Close()
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, nil, 1, 0)
+	queue.deadLetters = deadLetters
+	defer queue.Close()
+
+	queue.SendMail(&mailStruct{ID: "1", ExpiresAt: time.Now().Add(-time.Second)})
+	queue.SendMail(&mailStruct{ID: "2", ExpiresAt: time.Now().Add(time.Minute)})
+	queue.SendMail(&mailStruct{ID: "3"})
+	for i := 0; i < 100 && queue.Depth() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if fake.count() != 2 || queue.Expired() != 1 {
+		t.Errorf("Expired mail should be dropped, sent %v", fake.sent)
+	}
+	if list, _ := deadLetters.List(ReasonExpired); len(list) != 1 {
+		t.Errorf("Expired mail should be dead letter, got %+v", list)
+	}
+}
+
+// fakeSharedStore hands the put
+// mail back over the channel.
+type fakeSharedStore struct {
+	mutex   sync.Mutex
+	taken   chan mailStruct
+	deleted []uint64
+	next    uint64
+}
+
+func (f *fakeSharedStore) Put(mail *mailStruct) (uint64, error) {
+	f.mutex.Lock()
+	f.next++
+	m := *mail
+	m.queueKey = f.next
+	f.mutex.Unlock()
+	f.taken <- m
+	return m.queueKey, nil
+}
+
+func (f *fakeSharedStore) Delay(mail *mailStruct) error {
+	f.taken <- *mail
+	return nil
+}
+
+func (f *fakeSharedStore) Delete(key uint64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deleted = append(f.deleted, key)
+	return nil
+}
+
+func (f *fakeSharedStore) Pending() ([]mailStruct, error) { return nil, nil }
+func (f *fakeSharedStore) Close()                         {}
+func (f *fakeSharedStore) Depth() (int, error)            { return len(f.taken), nil }
+
+func (f *fakeSharedStore) Take(done <-chan struct{}) (mailStruct, bool, error) {
+	select {
+	case m := <-f.taken:
+		return m, true, nil
+	case <-done:
+		return mailStruct{}, false, nil
+	}
+}
+
+func TestQueuedMailerSharedStore(t *testing.T) {
+	fake := &syncMailer{}
+	store := &fakeSharedStore{taken: make(chan mailStruct, 2)}
+	queue := NewQueuedMailer(fake, nil, 1, 0)
+	defer queue.Close()
+	queue.Persist(store)
+
+	queue.SendMail(&mailStruct{ID: "1"})
+	queue.SendMail(&mailStruct{ID: "2"})
+	for i := 0; i < 100 && (fake.count() < 2 || queue.Depth() > 0); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if fake.count() != 2 || len(store.deleted) != 2 {
+		t.Errorf("Taken mail should be sent once and deleted, sent %v deleted %v", fake.sent, store.deleted)
+	}
+}
+
+// blockingMailer waits for the release
+// and counts the sends in flight.
+type blockingMailer struct {
+	release  chan struct{}
+	inFlight int32
+}
+
+func (bm *blockingMailer) SendMail(mail *mailStruct) error {
+	atomic.AddInt32(&bm.inFlight, 1)
+	<-bm.release
+	atomic.AddInt32(&bm.inFlight, -1)
+	return nil
+}
+
+func (bm *blockingMailer) Close() {}
+
+func TestQueuedMailerWorkers(t *testing.T) {
+	fake := &blockingMailer{release: make(chan struct{})}
+	queue := NewQueuedMailer(fake, nil, 3, 0)
+	defer queue.Close()
+	defer close(fake.release)
+
+	for i := 0; i < 3; i++ {
+		queue.SendMail(&mailStruct{})
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&fake.inFlight) < 3; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if inFlight := atomic.LoadInt32(&fake.inFlight); inFlight != 3 {
+		t.Errorf("Workers should send at once, got %d in flight", inFlight)
+	}
+}
+
+func TestQueuedMailerFullPolicy(t *testing.T) {
+	queue := &QueuedMailer{
+		sendChannel: make(chan mailStruct, 1),
+		highChannel: make(chan mailStruct, 1),
+		bulkChannel: make(chan mailStruct, 1),
+		policy:      QueueReject,
+	}
+	if err := queue.SendMail(&mailStruct{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.SendMail(&mailStruct{ID: "2"}); err != ErrQueueFull || queue.Depth() != 1 {
+		t.Errorf("Mail should be rejected when full, got %v", err)
+	}
+
+	queue.policy = QueueShedOldest
+	queue.SendMail(&mailStruct{ID: "3"})
+	if m := <-queue.sendChannel; m.ID != "3" || queue.Shed() != 1 || queue.Depth() != 1 {
+		t.Errorf("Oldest mail should be shed, got %s", m.ID)
+	}
+}
+
+func TestQueuedMailerDrain(t *testing.T) {
+	fake := &blockingMailer{release: make(chan struct{})}
+	queue := NewQueuedMailer(fake, nil, 1, 1)
+	defer queue.Close()
+
+	queue.SendMail(&mailStruct{})
+	queue.SendMail(&mailStruct{})
+	if queue.Drain(10 * time.Millisecond) {
+		t.Error("Drain should time out while the mail is sent")
+	}
+	close(fake.release)
+	if !queue.Drain(time.Second) || queue.Depth() != 0 {
+		t.Errorf("Drain should wait for the queued mail, %d left", queue.Depth())
+	}
+}
+
+func TestQueuedMailerSendRate(t *testing.T) {
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, nil, 2, 2)
+	queue.limiter = NewTokenBucket(1, 1)
+	defer queue.Close()
+
+	queue.SendMail(&mailStruct{ID: "1"})
+	queue.SendMail(&mailStruct{ID: "2"})
+	time.Sleep(100 * time.Millisecond)
+	if fake.count() != 1 || queue.Depth() != 1 {
+		t.Errorf("Second mail should wait for the send rate, sent %v", fake.sent)
+	}
+}
+
+func TestQueuedMailerThrottle(t *testing.T) {
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, nil, 1, 0)
+	queue.Throttle("gmail.com", 1)
+	defer queue.Close()
+
+	for _, id := range []string{"1", "2", "3"} {
+		queue.SendMail(&mailStruct{ID: id, Recipient: "radek@gmail.com"})
+	}
+	queue.SendMail(&mailStruct{ID: "4", Recipient: "radek@seznam.cz"})
+	for i := 0; i < 100 && fake.count() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if fake.count() != 2 || queue.Depth() != 2 {
+		t.Errorf("Throttled domain should not hold the other mail, sent %v", fake.sent)
+	}
+}
+
+func TestQueuedMailerSchedule(t *testing.T) {
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, nil, 1, 0)
+	queue.scheduleMax = time.Hour
+	defer queue.Close()
+
+	now := time.Now()
+	if err := queue.SendMail(&mailStruct{ID: "far", DeliveryTime: now.Add(2 * time.Hour)}); err != ErrScheduledTooFar {
+		t.Errorf("Mail scheduled beyond the max should be rejected, got %v", err)
+	}
+	queue.SendMail(&mailStruct{ID: "later", DeliveryTime: now.Add(50 * time.Millisecond)})
+	queue.SendMail(&mailStruct{ID: "now", DeliveryTime: now.Add(-time.Minute)})
+	for i := 0; i < 100 && fake.count() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if fake.count() != 1 || queue.Delayed() != 1 {
+		t.Fatalf("Only the mail due should be sent, sent %v", fake.sent)
+	}
+	for i := 0; i < 200 && fake.count() < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if fake.count() != 2 || time.Now().Before(now.Add(50*time.Millisecond)) {
+		t.Errorf("Scheduled mail should be sent once due, sent %v", fake.sent)
+	}
+}
+
+func TestQueuedMailerWarmup(t *testing.T) {
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, NewWarmupRamp(1, 1, 50*time.Millisecond), 1, 0)
+	defer queue.Close()
+
+	queue.SendMail(&mailStruct{ID: "1", Campaign: "welcome"})
+	queue.SendMail(&mailStruct{ID: "2", Campaign: "welcome"})
+	queue.SendMail(&mailStruct{ID: "3"})
+	for i := 0; i < 100 && fake.count() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if fake.count() != 2 || queue.Delayed() != 1 {
+		t.Fatalf("Mail over the ramp should wait without the worker, sent %v", fake.sent)
+	}
+	for i := 0; i < 200 && fake.count() < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if fake.count() != 3 {
+		t.Errorf("Deferred mail should be sent in its period, sent %v", fake.sent)
+	}
+}
+
+func TestQueuedMailerDrainDelayed(t *testing.T) {
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, nil, 1, 0)
+	defer queue.Close()
+
+	queue.SendMail(&mailStruct{ID: "1", DeliveryTime: time.Now().Add(50 * time.Millisecond)})
+	if !queue.Drain(time.Second) || fake.count() != 1 {
+		t.Errorf("Delayed mail due within the timeout should be drained, sent %v", fake.sent)
+	}
+	queue.SendMail(&mailStruct{ID: "2", DeliveryTime: time.Now().Add(time.Hour)})
+	if queue.Drain(50 * time.Millisecond) {
+		t.Error("Delayed mail left in memory should fail the drain")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DefaultCaller is the key of the quota
+// of the callers not listed on their own.
+const DefaultCaller = "*"
+
+var (
+	ErrDailyQuotaExceeded = fmt.Errorf("quotamailer: Daily quota of the caller exceeded")
+	ErrCallerRateExceeded = fmt.Errorf("quotamailer: Send rate of the caller exceeded")
+
+	quotaConfig = &QuotaConfig{}
+)
+
+// QuotaConfig limits the callers by the Caller
+// of the mail e.g. billing:10000,*:50000,
+// the unlisted callers share nothing but
+// each gets the quota of *. The Caller is
+// set by its token, so only the configured
+// callers are counted.
+type QuotaConfig struct {
+	Daily map[string]int
+	Rate  map[string]float64
+	Burst map[string]int
+}
+
+func init() {
+	RegisterConfig("quota", quotaConfig)
+}
+
+// QuotaMailer rejects the mail of the caller
+// over its daily cap or burst before it is
+// queued, so one runaway service cannot use
+// up the provider quota of everyone.
+type QuotaMailer struct {
+	mailer Mailer
+	config *QuotaConfig
+	now    func() time.Time
+
+	mutex   sync.Mutex
+	callers map[string]*callerQuota
+}
+
+type callerQuota struct {
+	day    string
+	sent   int
+	bucket *TokenBucket
+}
+
+func NewQuotaMailer(mailer Mailer, config *QuotaConfig) *QuotaMailer {
+	return &QuotaMailer{
+		mailer:  mailer,
+		config:  config,
+		now:     time.Now,
+		callers: make(map[string]*callerQuota),
+	}
+}
+
+func (qm *QuotaMailer) SendMail(mail *mailStruct) error {
+	if err := qm.take(mail.Caller); err != nil {
+		log.Warnf("Rejecting mail of caller %q: %s", mail.Caller, err)
+		return err
+	}
+	return qm.mailer.SendMail(mail)
+}
+
+func (qm *QuotaMailer) take(caller string) error {
+	qm.mutex.Lock()
+	defer qm.mutex.Unlock()
+
+	now := qm.now()
+	quota, ok := qm.callers[caller]
+	if !ok {
+		quota = &callerQuota{}
+		if rate := rateOf(caller, qm.config.Rate); rate > 0 {
+			quota.bucket = NewTokenBucket(rate, limitOf(caller, qm.config.Burst))
+		}
+		qm.callers[caller] = quota
+	}
+
+	day := now.UTC().Format("2006-01-02")
+	if quota.day != day {
+		quota.day = day
+		quota.sent = 0
+	}
+	daily := limitOf(caller, qm.config.Daily)
+	if daily > 0 && quota.sent >= daily {
+		return ErrDailyQuotaExceeded
+	}
+	if !quota.bucket.Allow(now) {
+		return ErrCallerRateExceeded
+	}
+	quota.sent++
+	return nil
+}
+
+// limitOf returns the own limit of
+// the caller, or the default one.
+func limitOf(caller string, limits map[string]int) int {
+	if limit, ok := limits[caller]; ok {
+		return limit
+	}
+	return limits[DefaultCaller]
+}
+
+func rateOf(caller string, rates map[string]float64) float64 {
+	if rate, ok := rates[caller]; ok {
+		return rate
+	}
+	return rates[DefaultCaller]
+}
+
+func (qm *QuotaMailer) Close() {
+	qm.mailer.Close()
+}
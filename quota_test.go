@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaMailer(t *testing.T) {
+	fake := &FakeMailer{}
+	mailer := NewQuotaMailer(fake, &QuotaConfig{
+		Daily: map[string]int{"billing": 3, DefaultCaller: 100},
+		Rate:  map[string]float64{"newsletter": 1},
+		Burst: map[string]int{"newsletter": 2},
+	})
+	now := time.Date(2017, 5, 1, 23, 0, 0, 0, time.UTC)
+	mailer.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if err := mailer.SendMail(&mailStruct{Caller: "billing"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mailer.SendMail(&mailStruct{Caller: "billing"}) != ErrDailyQuotaExceeded {
+		t.Error("Fourth mail should exceed the daily quota")
+	}
+	if err := mailer.SendMail(&mailStruct{Caller: "signup"}); err != nil {
+		t.Errorf("Other caller should have own quota, got %s", err)
+	}
+
+	mailer.SendMail(&mailStruct{Caller: "newsletter"})
+	mailer.SendMail(&mailStruct{Caller: "newsletter"})
+	if mailer.SendMail(&mailStruct{Caller: "newsletter"}) != ErrCallerRateExceeded {
+		t.Error("Burst should be exhausted")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err := mailer.SendMail(&mailStruct{Caller: "billing"}); err != nil {
+		t.Errorf("Daily quota should reset next day, got %s", err)
+	}
+	if len(fake.sent) != 7 {
+		t.Errorf("Expected 7 mails sent, got %d", len(fake.sent))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBadRate = fmt.Errorf("ratelimit: Rate must be e.g. 10/s or 600/m")
+
+// TokenBucket refills rate tokens per second
+// up to the burst. Taking a token from an empty
+// bucket reserves it in the future and the
+// caller is told how long to wait for it.
+type TokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Reserve takes one token and returns
+// the time to wait before using it.
+func (b *TokenBucket) Reserve(now time.Time) time.Duration {
+	if b == nil || b.rate <= 0 {
+		return 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait blocks until the token is available.
+func (b *TokenBucket) Wait() {
+	if wait := b.Reserve(time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Allow takes one token if there is
+// any, nothing is reserved otherwise.
+func (b *TokenBucket) Allow(now time.Time) bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// ParseRate reads the rate per second of
+// the N/s, N/m or N/h value, N alone is
+// per second. Empty is zero.
+func ParseRate(value string) (float64, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+	unit := time.Second
+	if i := strings.LastIndex(value, "/"); i >= 0 {
+		switch value[i+1:] {
+		case "s":
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		default:
+			return 0, ErrBadRate
+		}
+		value = value[:i]
+	}
+	count, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || count < 0 {
+		return 0, ErrBadRate
+	}
+	return count / unit.Seconds(), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := NewTokenBucket(2, 2)
+	now := time.Now()
+
+	if bucket.Reserve(now) != 0 || bucket.Reserve(now) != 0 {
+		t.Error("Burst should not wait")
+	}
+	if wait := bucket.Reserve(now); wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait half a second, got %s", wait)
+	}
+	if wait := bucket.Reserve(now); wait != time.Second {
+		t.Errorf("Expected to wait a second, got %s", wait)
+	}
+
+	// Refill does not go over the burst
+	later := now.Add(time.Minute)
+	bucket.Reserve(later)
+	bucket.Reserve(later)
+	if bucket.Reserve(later) == 0 {
+		t.Error("Bucket should refill only up to the burst")
+	}
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	var bucket *TokenBucket
+	if bucket.Reserve(time.Now()) != 0 {
+		t.Error("Missing bucket should not limit")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for value, expected := range map[string]float64{"": 0, "5": 5, "10/s": 10, "120/m": 2, "3600/h": 1} {
+		if rate, err := ParseRate(value); err != nil || rate != expected {
+			t.Errorf("Expected %v for %q, got %v %v", expected, value, rate, err)
+		}
+	}
+	for _, value := range []string{"fast", "10/d", "-1/s"} {
+		if _, err := ParseRate(value); err != ErrBadRate {
+			t.Errorf("Expected error for %q, got %v", value, err)
+		}
+	}
+}
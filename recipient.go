@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var ErrNoMX = fmt.Errorf("mail: Recipient domain does not accept mail")
+
+// recipientDomain parses the RFC 5322 address
+// and returns its lower case domain.
+func recipientDomain(recipient string) (string, error) {
+	address, err := mail.ParseAddress(recipient)
+	if err != nil {
+		return "", ErrBadRecipient
+	}
+	at := strings.LastIndex(address.Address, "@")
+	if at < 1 || at == len(address.Address)-1 {
+		return "", ErrBadRecipient
+	}
+	return strings.ToLower(address.Address[at+1:]), nil
+}
+
+// MXChecker looks up whether the domain
+// accepts mail and caches the answers.
+type MXChecker struct {
+	ttl      time.Duration
+	lookupMX func(domain string) ([]*net.MX, error)
+	lookupIP func(host string) ([]net.IP, error)
+
+	mutex sync.Mutex
+	cache map[string]mxAnswer
+}
+
+type mxAnswer struct {
+	accepts bool
+	expires time.Time
+}
+
+func NewMXChecker(ttl time.Duration) *MXChecker {
+	return &MXChecker{
+		ttl:      ttl,
+		lookupMX: net.LookupMX,
+		lookupIP: net.LookupIP,
+		cache:    make(map[string]mxAnswer),
+	}
+}
+
+// Accepts reports whether the domain has MX,
+// or the address record used instead of it.
+// The null MX "." refuses any mail. When
+// DNS fails the domain is given benefit
+// of the doubt and nothing is cached.
+func (c *MXChecker) Accepts(domain string) bool {
+	now := time.Now()
+	c.mutex.Lock()
+	answer, ok := c.cache[domain]
+	c.mutex.Unlock()
+	if ok && now.Before(answer.expires) {
+		return answer.accepts
+	}
+
+	accepts, err := c.lookup(domain)
+	if err != nil {
+		log.Warnf("Cannot look up MX of %s: %s", domain, err)
+		return true
+	}
+	c.mutex.Lock()
+	c.cache[domain] = mxAnswer{accepts, now.Add(c.ttl)}
+	c.mutex.Unlock()
+	return accepts
+}
+
+func (c *MXChecker) lookup(domain string) (bool, error) {
+	records, err := c.lookupMX(domain)
+	if err == nil && len(records) > 0 {
+		return !(len(records) == 1 && records[0].Host == "."), nil
+	}
+	if err != nil && !notFound(err) {
+		return false, err
+	}
+	ips, err := c.lookupIP(domain)
+	if err != nil {
+		if notFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(ips) > 0, nil
+}
+
+func notFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && !dnsErr.Temporary() && !dnsErr.Timeout()
+}
+
+// RecipientValidator rejects the mail with
+// malformed recipient, or recipient domain
+// without MX if the checker is set, before
+// the mail is queued. Mail only for the other
+// channels needs no email recipient.
+type RecipientValidator struct {
+	mailer Mailer
+	mx     *MXChecker
+}
+
+func NewRecipientValidator(mailer Mailer, mx *MXChecker) Mailer {
+	return &RecipientValidator{
+		mailer: mailer,
+		mx:     mx,
+	}
+}
+
+func (rv *RecipientValidator) SendMail(mail *mailStruct) error {
+	if !sendsEmail(mail) {
+		return rv.mailer.SendMail(mail)
+	}
+	if err := mail.Validate(); err != nil {
+		return err
+	}
+	if rv.mx != nil {
+		domain, _ := recipientDomain(mail.Recipient)
+		if !rv.mx.Accepts(domain) {
+			return ErrNoMX
+		}
+	}
+	return rv.mailer.SendMail(mail)
+}
+
+func (rv *RecipientValidator) Close() {
+	rv.mailer.Close()
+}
+
+func sendsEmail(mail *mailStruct) bool {
+	if len(mail.Channels) == 0 {
+		return true
+	}
+	for _, channel := range mail.Channels {
+		if channel == EmailChannel {
+			return true
+		}
+	}
+	return false
+}
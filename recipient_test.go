@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRecipientDomain(t *testing.T) {
+	valid := map[string]string{
+		"radek@suricata.com":          "suricata.com",
+		"Radek <Radek@Suricata.COM>":  "suricata.com",
+		"\"radek test\"@suricata.com": "suricata.com",
+	}
+	for recipient, expected := range valid {
+		if domain, err := recipientDomain(recipient); err != nil || domain != expected {
+			t.Errorf("%s should have domain %s, got %s %v", recipient, expected, domain, err)
+		}
+	}
+	for _, recipient := range []string{"radek", "radek@", "@suricata.com", "radek@@suricata.com", "radek suricata.com"} {
+		if _, err := recipientDomain(recipient); err != ErrBadRecipient {
+			t.Errorf("%s should be rejected", recipient)
+		}
+	}
+}
+
+func TestRecipientValidator(t *testing.T) {
+	lookups := 0
+	mx := NewMXChecker(time.Hour)
+	mx.lookupMX = func(domain string) ([]*net.MX, error) {
+		lookups++
+		switch domain {
+		case "suricata.com":
+			return []*net.MX{{Host: "mx.suricata.com.", Pref: 10}}, nil
+		case "null.example.com":
+			return []*net.MX{{Host: "."}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: domain}
+	}
+	mx.lookupIP = func(host string) ([]net.IP, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+
+	fake := &FakeMailer{}
+	validator := NewRecipientValidator(fake, mx)
+
+	validator.SendMail(&mailStruct{Recipient: "radek@suricata.com"})
+	validator.SendMail(&mailStruct{Recipient: "info@suricata.com"})
+	if len(fake.sent) != 2 || lookups != 1 {
+		t.Errorf("Expected 2 mails with 1 cached lookup, got %d and %d", len(fake.sent), lookups)
+	}
+
+	for _, recipient := range []string{"radek@null.example.com", "radek@nowhere.example.com"} {
+		if err := validator.SendMail(&mailStruct{Recipient: recipient}); err != ErrNoMX {
+			t.Errorf("%s should be rejected, got %v", recipient, err)
+		}
+	}
+	if err := validator.SendMail(&mailStruct{Recipient: "radek"}); err != ErrBadRecipient {
+		t.Errorf("Expected ErrBadRecipient, got %v", err)
+	}
+	if err := validator.SendMail(&mailStruct{Recipient: "radek@suricata.com", ReplyTo: "a@b.com\r\nBcc: spam@example.com"}); err != ErrBadReplyTo {
+		t.Errorf("Expected ErrBadReplyTo, got %v", err)
+	}
+	replied := &mailStruct{Recipient: "radek@suricata.com", ReplyTo: "Podpora <support@suricata.com>"}
+	if err := validator.SendMail(replied); err != nil || replied.ReplyTo != `"Podpora" <support@suricata.com>` {
+		t.Errorf("ReplyTo should be formatted, got %q: %v", replied.ReplyTo, err)
+	}
+	if err := validator.SendMail(&mailStruct{Channels: []string{"sms"}, Phone: "+420123456789"}); err != nil {
+		t.Errorf("Mail for sms only needs no recipient, got %v", err)
+	}
+}
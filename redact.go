@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// RedactPath takes the ID of the
+	// archived mail to redact by POST
+	RedactPath = "/v1/archive/redact/"
+
+	// ArchiveIDHeader keeps the ID of the
+	// mail in its archived copy
+	ArchiveIDHeader = "X-Mail-ID"
+
+	redactedBody = "[redacted]"
+)
+
+var ErrNotArchived = fmt.Errorf("archive: Mail not found in the archive")
+
+// archiveID is the ID of the mail, the
+// mail without one gets a random ID.
+func archiveID(mail *mailStruct) (string, error) {
+	if len(mail.ID) > 0 {
+		return mail.ID, nil
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// archivedMessage composes the copy of the mail
+// for the archive with its archive ID, it
+// can be redacted by it later.
+func archivedMessage(mail *mailStruct, id string, now time.Time) []byte {
+	message := composeMessage(mail, now)
+	return append([]byte(fmt.Sprintf("%s: %s\r\n", ArchiveIDHeader, id)), message...)
+}
+
+// redactMessage replaces the body and the
+// attachments of the message with the ID,
+// the headers are kept. The message of
+// other ID is reported by ok.
+func redactMessage(message []byte, id string, now time.Time) (redacted []byte, ok bool) {
+	eol := []byte("\r\n")
+	if !bytes.Contains(message, eol) {
+		eol = []byte("\n")
+	}
+	end := bytes.Index(message, append(append([]byte{}, eol...), eol...))
+	if end < 0 {
+		end = len(message)
+	}
+
+	var buf bytes.Buffer
+	skipping := false
+	for _, line := range bytes.Split(message[:end], eol) {
+		// Continuation belongs to the previous header
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if !skipping {
+				buf.Write(line)
+				buf.Write(eol)
+			}
+			continue
+		}
+		field := bytes.SplitN(line, []byte(":"), 2)
+		name := strings.ToLower(string(bytes.TrimSpace(field[0])))
+		if name == strings.ToLower(ArchiveIDHeader) && len(field) == 2 && string(bytes.TrimSpace(field[1])) == id {
+			ok = true
+		}
+		skipping = name == "content-type" || name == "content-transfer-encoding"
+		if !skipping {
+			buf.Write(line)
+			buf.Write(eol)
+		}
+	}
+	if !ok {
+		return message, false
+	}
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=UTF-8%sX-Redacted: %s%s", eol, now.Format(time.RFC1123Z), eol)
+	buf.Write(eol)
+	buf.WriteString(redactedBody)
+	buf.Write(eol)
+	return buf.Bytes(), true
+}
+
+// redactSealed redacts the message sealed by
+// the keyring and seals it again, the plain
+// message is redacted as is.
+func redactSealed(message []byte, id string, now time.Time, keyring *Keyring) ([]byte, bool, error) {
+	sealed := bytes.TrimSpace(message)
+	if _, ok := sealedKey(sealed); !ok {
+		redacted, ok := redactMessage(message, id, now)
+		return redacted, ok, nil
+	}
+	plain, err := keyring.Open(sealed)
+	if err != nil {
+		return nil, false, err
+	}
+	redacted, ok := redactMessage(plain, id, now)
+	if !ok {
+		return message, false, nil
+	}
+	if redacted, err = keyring.Seal(redacted); err != nil {
+		return nil, false, err
+	}
+	return append(redacted, '\n'), true, nil
+}
+
+// Redact rewrites all the archived
+// messages with the ID in place.
+func (ma *MaildirArchive) Redact(id string, now time.Time) error {
+	found := false
+	for _, sub := range []string{"new", "cur"} {
+		files, err := ioutil.ReadDir(filepath.Join(ma.maildir.dir, sub))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			path := filepath.Join(ma.maildir.dir, sub, file.Name())
+			message, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			redacted, ok, err := redactSealed(message, id, now, ma.keyring)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			// Replace the file at once, the
+			// readers never see it partial
+			tmpPath := filepath.Join(ma.maildir.dir, "tmp", file.Name())
+			if err := ioutil.WriteFile(tmpPath, redacted, 0644); err != nil {
+				return err
+			}
+			if err := os.Rename(tmpPath, path); err != nil {
+				return err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return ErrNotArchived
+	}
+	return nil
+}
+
+// Redact rewrites the mbox files, the
+// current and the rotated ones, with
+// the messages with the ID.
+func (ma *MboxArchive) Redact(id string, now time.Time) error {
+	ma.mutex.Lock()
+	defer ma.mutex.Unlock()
+
+	paths, err := filepath.Glob(ma.path + "*")
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		redacted, ok, err := redactMbox(content, id, now, ma.keyring)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := ioutil.WriteFile(path+".tmp", redacted, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return ErrNotArchived
+	}
+	return nil
+}
+
+// redactMbox splits the mbox by the separator
+// lines, the escaped From in the bodies
+// cannot be taken for one.
+func redactMbox(content []byte, id string, now time.Time, keyring *Keyring) ([]byte, bool, error) {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	var out bytes.Buffer
+	found := false
+	start := 0
+	flush := func(end int) error {
+		message := bytes.Join(lines[start+1:end], nil)
+		out.Write(lines[start])
+		redacted, ok, err := redactSealed(message, id, now, keyring)
+		if err != nil {
+			return err
+		}
+		if ok {
+			out.Write(redacted)
+			out.WriteByte('\n')
+			found = true
+			return nil
+		}
+		out.Write(message)
+		return nil
+	}
+	for i, line := range lines {
+		if i > 0 && bytes.HasPrefix(line, []byte("From ")) {
+			if err := flush(i); err != nil {
+				return nil, false, err
+			}
+			start = i
+		}
+	}
+	if len(content) > 0 {
+		if err := flush(len(lines)); err != nil {
+			return nil, false, err
+		}
+	}
+	return out.Bytes(), found, nil
+}
+
+// RedactFunc redacts the archived mail by POST of
+// RedactPath with its ID. Only the admin of the
+// redact scope is let in, the request with the
+// reason goes to the audit before the mail is
+// redacted, it is not redacted unaudited.
+func RedactFunc(archive Archive, admins []*TemplateAccount, audit *AdminAudit) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		admin := authorizeAdmin(rw, req, admins, ScopeRedact)
+		if admin == nil {
+			return
+		}
+		id := strings.TrimPrefix(req.URL.Path, RedactPath)
+		reason := req.FormValue("reason")
+		if err := audit.Record(admin.Name, "redact", id, reason); err != nil {
+			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		switch err := archive.Redact(id, time.Now()); err {
+		case nil:
+		case ErrNotArchived:
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		default:
+			log.Errorf("Cannot redact mail %s: %s", id, err)
+			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Archived mail %s redacted by %s: %s", id, admin.Name, reason)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
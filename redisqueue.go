@@ -0,0 +1,246 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var redisConfig = &RedisConfig{}
+
+// RedisConfig of the queue shared by the
+// instances e.g. redis://localhost:6379/0,
+// empty URL keeps the queue per instance.
+type RedisConfig struct {
+	URL    string
+	Prefix string `default:"mail"`
+}
+
+func init() {
+	RegisterConfig("redis", redisConfig)
+}
+
+// redisPollTimeout is how long the idle
+// instance blocks on the normal list
+// before it looks at the others again.
+const redisPollTimeout = 1
+
+// promoteScript moves the delayed keys due by
+// ARGV[1] from the sorted set to the list,
+// so only one instance moves each of them.
+var promoteScript = redis.NewScript(2, `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, key in ipairs(due) do
+	redis.call('ZREM', KEYS[1], key)
+	redis.call('LPUSH', KEYS[2], key)
+end
+return #due
+`)
+
+// RedisQueue shares the queued mail among the
+// instances. The mail is kept in the hash by its
+// key, the lists per priority hold the keys. The
+// instance moves the key it takes to its own
+// processing list atomically, so no other one
+// sends the mail, and removes it once sent. The
+// delayed keys wait in the sorted sets per
+// priority scored by the time they are due. The
+// mail is sealed by the keyring, the one sealed
+// by the old key is sealed again when delayed.
+type RedisQueue struct {
+	pool       *redis.Pool
+	prefix     string
+	processing string
+	keyring    *Keyring
+}
+
+func NewRedisQueue(url, prefix, instance string, keyring *Keyring) *RedisQueue {
+	return &RedisQueue{
+		pool: &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 4 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(url)
+			},
+		},
+		prefix:     prefix,
+		processing: prefix + ":processing:" + instance,
+		keyring:    keyring,
+	}
+}
+
+func (r *RedisQueue) list(priority string) string {
+	switch priority {
+	case PriorityHigh, PriorityBulk:
+		return r.prefix + ":" + priority
+	}
+	return r.prefix + ":" + PriorityNormal
+}
+
+func (r *RedisQueue) delayed(priority string) string {
+	return r.list(priority) + ":delayed"
+}
+
+func (r *RedisQueue) Put(mail *mailStruct) (uint64, error) {
+	value, err := encodeStored(mail, r.keyring)
+	if err != nil {
+		return 0, err
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	key, err := redis.Uint64(conn.Do("INCR", r.prefix+":seq"))
+	if err != nil {
+		return 0, err
+	}
+	conn.Send("MULTI")
+	conn.Send("HSET", r.prefix+":mail", key, value)
+	if mail.notBefore.After(time.Now()) {
+		conn.Send("ZADD", r.delayed(mail.Priority), unixMillis(mail.notBefore), key)
+	} else {
+		conn.Send("LPUSH", r.list(mail.Priority), key)
+	}
+	_, err = conn.Do("EXEC")
+	return key, err
+}
+
+// Delay moves the taken mail put off to the
+// sorted set, any instance takes it once due.
+func (r *RedisQueue) Delay(mail *mailStruct) error {
+	value, err := encodeStored(mail, r.keyring)
+	if err != nil {
+		return err
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("HSET", r.prefix+":mail", mail.queueKey, value)
+	conn.Send("LREM", r.processing, 0, mail.queueKey)
+	conn.Send("ZADD", r.delayed(mail.Priority), unixMillis(mail.notBefore), mail.queueKey)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// promote moves the delayed
+// mail due by now to the lists.
+func (r *RedisQueue) promote(conn redis.Conn, now time.Time) error {
+	for _, priority := range []string{PriorityHigh, PriorityNormal, PriorityBulk} {
+		if _, err := promoteScript.Do(conn, r.delayed(priority), r.list(priority), unixMillis(now)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Take moves the oldest key of the highest
+// priority to the processing list, waiting
+// on the normal list when all are empty.
+func (r *RedisQueue) Take(done <-chan struct{}) (mailStruct, bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	for {
+		select {
+		case <-done:
+			return mailStruct{}, false, nil
+		default:
+		}
+		if err := r.promote(conn, time.Now()); err != nil {
+			return mailStruct{}, false, err
+		}
+		var key string
+		var err error
+		for _, priority := range []string{PriorityHigh, PriorityNormal, PriorityBulk} {
+			key, err = redis.String(conn.Do("RPOPLPUSH", r.list(priority), r.processing))
+			if err != redis.ErrNil {
+				break
+			}
+		}
+		if err == redis.ErrNil {
+			key, err = redis.String(conn.Do("BRPOPLPUSH", r.list(PriorityNormal), r.processing, redisPollTimeout))
+		}
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return mailStruct{}, false, err
+		}
+		m, err := r.load(conn, key)
+		if err == redis.ErrNil {
+			// Mail removed meanwhile
+			conn.Do("LREM", r.processing, 0, key)
+			continue
+		}
+		return m, err == nil, err
+	}
+}
+
+func (r *RedisQueue) load(conn redis.Conn, key string) (mailStruct, error) {
+	value, err := redis.Bytes(conn.Do("HGET", r.prefix+":mail", key))
+	if err != nil {
+		return mailStruct{}, err
+	}
+	m, err := decodeStored(value, r.keyring)
+	if err != nil {
+		return m, err
+	}
+	m.queueKey, err = strconv.ParseUint(key, 10, 64)
+	return m, err
+}
+
+func (r *RedisQueue) Delete(key uint64) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("LREM", r.processing, 0, key)
+	conn.Send("HDEL", r.prefix+":mail", key)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Pending returns the mail taken by the
+// instance but not sent before restart.
+func (r *RedisQueue) Pending() ([]mailStruct, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("LRANGE", r.processing, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	pending := []mailStruct{}
+	// The oldest key is the last one
+	for i := len(keys) - 1; i >= 0; i-- {
+		m, err := r.load(conn, keys[i])
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, m)
+	}
+	return pending, nil
+}
+
+// Depth returns the number of the mail
+// waiting in the lists of all priorities.
+func (r *RedisQueue) Depth() (int, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	depth := 0
+	for _, priority := range []string{PriorityHigh, PriorityNormal, PriorityBulk} {
+		length, err := redis.Int(conn.Do("LLEN", r.list(priority)))
+		if err != nil {
+			return 0, err
+		}
+		depth += length
+	}
+	return depth, nil
+}
+
+func (r *RedisQueue) Close() {
+	r.pool.Close()
+}
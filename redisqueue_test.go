@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+)
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// stored returns the keys of the mail kept.
+func stored(server *miniredis.Miniredis) []string {
+	keys, _ := server.HKeys("mail:mail")
+	return keys
+}
+
+func TestRedisQueue(t *testing.T) {
+	server := newTestRedis(t)
+	defer server.Close()
+	store := NewRedisQueue("redis://"+server.Addr(), "mail", "a", nil)
+	defer store.Close()
+
+	for _, m := range []mailStruct{
+		{ID: "bulk", Priority: PriorityBulk},
+		{ID: "normal"},
+		{ID: "high", Priority: PriorityHigh, Data: map[string]interface{}{"Name": "Radek"}},
+	} {
+		if _, err := store.Put(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if depth, _ := store.Depth(); depth != 3 {
+		t.Errorf("Expected 3 mails waiting, got %d", depth)
+	}
+
+	done := make(chan struct{})
+	taken := []mailStruct{}
+	for i := 0; i < 3; i++ {
+		m, ok, err := store.Take(done)
+		if !ok || err != nil {
+			t.Fatalf("Expected the mail, got %v", err)
+		}
+		taken = append(taken, m)
+	}
+	if taken[0].ID != "high" || taken[1].ID != "normal" || taken[2].ID != "bulk" {
+		t.Errorf("Mail should be taken by priority, got %v", taken)
+	}
+	if taken[0].Data["Name"] != "Radek" || taken[0].queueKey == 0 {
+		t.Errorf("Mail should be loaded with its key, got %+v", taken[0])
+	}
+	if depth, _ := store.Depth(); depth != 0 {
+		t.Errorf("Taken mail should not be waiting, got %d", depth)
+	}
+
+	for _, m := range taken[:2] {
+		if err := store.Delete(m.queueKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending, err := store.Pending()
+	if err != nil || len(pending) != 1 || pending[0].ID != "bulk" {
+		t.Errorf("Only the unsent mail should be processing, got %v: %v", pending, err)
+	}
+	if keys := stored(server); len(keys) != 1 {
+		t.Errorf("Sent mail should be removed, left %v", keys)
+	}
+
+	close(done)
+	if _, ok, _ := store.Take(done); ok {
+		t.Error("Take should stop once done")
+	}
+}
+
+func TestRedisQueueResumes(t *testing.T) {
+	server := newTestRedis(t)
+	defer server.Close()
+	url := "redis://" + server.Addr()
+
+	// The instance takes the mail and stops
+	// before it is sent
+	store := NewRedisQueue(url, "mail", "a", nil)
+	store.Put(&mailStruct{ID: "1"})
+	store.Put(&mailStruct{ID: "2"})
+	if _, _, err := store.Take(make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	other := NewRedisQueue(url, "mail", "b", nil)
+	defer other.Close()
+	if pending, _ := other.Pending(); len(pending) != 0 {
+		t.Errorf("Mail taken by another instance should not be resumed, got %v", pending)
+	}
+
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, nil, 1, 0)
+	defer queue.Close()
+	if err := queue.Persist(NewRedisQueue(url, "mail", "a", nil)); err != nil {
+		t.Fatal(err)
+	}
+	queue.SendMail(&mailStruct{ID: "3"})
+	for i := 0; i < 200 && fake.count() < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if fake.count() != 3 {
+		t.Fatalf("Resumed, waiting and new mail should be sent, sent %v", fake.sent)
+	}
+	for i := 0; i < 200 && len(stored(server)) > 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if keys := stored(server); len(keys) != 0 {
+		t.Errorf("Sent mail should be removed from the store, left %v", keys)
+	}
+}
+
+func TestRedisQueueDelay(t *testing.T) {
+	server := newTestRedis(t)
+	defer server.Close()
+	store := NewRedisQueue("redis://"+server.Addr(), "mail", "a", nil)
+	defer store.Close()
+
+	done := make(chan struct{})
+	store.Put(&mailStruct{ID: "1", Priority: PriorityHigh})
+	m, _, err := store.Take(done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.attempts = 1
+	m.notBefore = time.Now().Add(100 * time.Millisecond)
+	if err := store.Delay(&m); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := store.Pending(); len(pending) != 0 {
+		t.Errorf("Delayed mail should not be processing, got %v", pending)
+	}
+
+	taken, ok, err := store.Take(done)
+	if !ok || err != nil || taken.ID != "1" || taken.attempts != 1 {
+		t.Fatalf("Delayed mail should be taken with its attempts, got %+v: %v", taken, err)
+	}
+	if time.Now().Before(m.notBefore) {
+		t.Error("Delayed mail should not be taken before it is due")
+	}
+}
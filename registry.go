@@ -0,0 +1,52 @@
+package main
+
+import "fmt"
+
+// MailerFactory creates the mailer
+// from the loaded configuration.
+type MailerFactory func() (Mailer, error)
+
+var mailerFactories = map[string]MailerFactory{}
+
+// RegisterMailer makes the mailer available
+// by name, it is meant to be called from init.
+func RegisterMailer(name string, factory MailerFactory) {
+	if _, dup := mailerFactories[name]; dup {
+		panic(fmt.Sprintf("mail: Mailer %s registered twice", name))
+	}
+	mailerFactories[name] = factory
+}
+
+// RegisterConfig loads the config
+// from the env vars with given prefix.
+func RegisterConfig(prefix string, config interface{}) {
+	componentConfigs[prefix] = config
+}
+
+func newProvider(name string) (Mailer, error) {
+	factory, ok := mailerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("mail: Unknown mailer %s", name)
+	}
+	return factory()
+}
+
+var channelFactories = map[string]MailerFactory{}
+
+// RegisterChannel makes the non-email channel
+// (e.g. slack) available by name, it is meant
+// to be called from init.
+func RegisterChannel(name string, factory MailerFactory) {
+	if _, dup := channelFactories[name]; dup {
+		panic(fmt.Sprintf("mail: Channel %s registered twice", name))
+	}
+	channelFactories[name] = factory
+}
+
+func newChannel(name string) (Mailer, error) {
+	factory, ok := channelFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("mail: Unknown channel %s", name)
+	}
+	return factory()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// CacheStats of the cache since the start,
+// the HitRate is of all the lookups.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	HitRate float64
+	Entries int
+}
+
+// cacheCounter counts the lookups
+// of the cache as they go.
+type cacheCounter struct {
+	hits   uint64
+	misses uint64
+}
+
+func (c *cacheCounter) count(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+func (c *cacheCounter) stats(entries int) CacheStats {
+	stats := CacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: entries,
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(lookups)
+	}
+	return stats
+}
+
+// renderedBody is the output of the
+// template, each part set by it.
+type renderedBody struct {
+	subject, message, html, markdown string
+}
+
+// RenderCache keeps the bodies of the campaign
+// mail rendered from the same Data, so the
+// campaign sent to many recipients is rendered
+// once. It is keyed by the template version and
+// the hash of the Data, the least recently
+// used body is dropped over the size.
+type RenderCache struct {
+	size int
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	counter cacheCounter
+}
+
+type renderEntry struct {
+	key  string
+	body renderedBody
+}
+
+func NewRenderCache(size int) *RenderCache {
+	return &RenderCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// renderKey of the Data rendered by the version
+// of the template, the Data which cannot be
+// hashed is not cached.
+func renderKey(version string, data map[string]interface{}) (string, bool) {
+	// Keys of the maps are encoded sorted,
+	// so the same Data has the same hash
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(encoded)
+	return version + ":" + hex.EncodeToString(sum[:]), true
+}
+
+// Render fills the mail from the cached body
+// or renders it by the template and keeps it.
+func (c *RenderCache) Render(t *Template, mail *mailStruct) error {
+	if c == nil || c.size <= 0 || len(t.version) == 0 {
+		return t.Render(mail)
+	}
+	key, ok := renderKey(mail.Template+"@"+t.version, mail.Data)
+	if !ok {
+		return t.Render(mail)
+	}
+
+	c.mutex.Lock()
+	element, hit := c.entries[key]
+	var body renderedBody
+	if hit {
+		c.order.MoveToFront(element)
+		body = element.Value.(*renderEntry).body
+	}
+	c.mutex.Unlock()
+	c.counter.count(hit)
+	if hit {
+		t.fill(mail, body)
+		return nil
+	}
+
+	rendered := mailStruct{Data: mail.Data}
+	if err := t.Render(&rendered); err != nil {
+		return err
+	}
+	body = renderedBody{rendered.Subject, rendered.Message, rendered.Html, rendered.Markdown}
+	t.fill(mail, body)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.order.PushFront(&renderEntry{key, body})
+	}
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*renderEntry).key)
+	}
+	return nil
+}
+
+// Stats of the lookups of the cache.
+func (c *RenderCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mutex.Lock()
+	entries := c.order.Len()
+	c.mutex.Unlock()
+	return c.counter.stats(entries)
+}
+
+// fill sets the parts of the mail
+// the template renders from the body.
+func (t *Template) fill(mail *mailStruct, body renderedBody) {
+	if t.subject != nil {
+		mail.Subject = body.subject
+	}
+	if t.message != nil {
+		mail.Message = body.message
+	}
+	if t.html != nil {
+		mail.Html = body.html
+	}
+	if t.markdown != nil {
+		mail.Markdown = body.markdown
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Levels of the campaign guarded by
+// its hard bounces and complaints.
+const (
+	ReputationNormal = "normal"
+	ReputationSlowed = "slowed"
+	ReputationPaused = "paused"
+)
+
+var reputationConfig = &ReputationConfig{}
+
+// ReputationConfig guards the sender reputation
+// by the hard bounce and complaint rates of the
+// campaign mail sent within the Window. Over a
+// rate the campaign is slowed to the SlowRate,
+// over PauseFactor times it the campaign pauses
+// for PauseFor. Zero rate is not guarded. The
+// operators are alerted on the AlertWebhookURL
+// of Slack, else in the log only.
+type ReputationConfig struct {
+	HardBounceRate  float64       `default:"0.05"`
+	ComplaintRate   float64       `default:"0.001"`
+	MinSent         int           `default:"200"`
+	Window          time.Duration `default:"24h"`
+	SlowRate        string        `default:"1/s"`
+	PauseFactor     float64       `default:"2"`
+	PauseFor        time.Duration `default:"1h"`
+	AlertWebhookURL string
+}
+
+func init() {
+	RegisterConfig("reputation", reputationConfig)
+}
+
+// CampaignReputation of the campaign
+// within the current window.
+type CampaignReputation struct {
+	Campaign    string
+	Level       string
+	Sent        int
+	HardBounces int
+	Complaints  int
+	PausedUntil time.Time
+}
+
+type campaignGuard struct {
+	CampaignReputation
+	limiter *TokenBucket
+}
+
+// ReputationGuard holds back the campaign mail of
+// the campaigns whose recipients bounce or complain
+// too often. The bounces and complaints know the
+// recipient only, so the recipients of the sent
+// mail are kept for two windows to find the
+// campaign of them. The mail without the
+// Campaign is never held back.
+type ReputationGuard struct {
+	config   ReputationConfig
+	slowRate float64
+	// alert of the operators, nil logs only
+	alert Mailer
+
+	mutex      sync.Mutex
+	campaigns  map[string]*campaignGuard
+	recipients map[string]string
+	previous   map[string]string
+	since      time.Time
+}
+
+func NewReputationGuard(config ReputationConfig) (*ReputationGuard, error) {
+	slowRate, err := ParseRate(config.SlowRate)
+	if err != nil {
+		return nil, err
+	}
+	if config.PauseFactor < 1 {
+		config.PauseFactor = 1
+	}
+	return &ReputationGuard{
+		config:     config,
+		slowRate:   slowRate,
+		campaigns:  make(map[string]*campaignGuard),
+		recipients: make(map[string]string),
+		previous:   make(map[string]string),
+	}, nil
+}
+
+// rotate starts the new window, the counts of the
+// past one are dropped but its recipients are
+// kept for the late bounces. The paused campaign
+// stays paused until its PausedUntil.
+func (g *ReputationGuard) rotate(now time.Time) {
+	if g.since.IsZero() {
+		g.since = now
+	}
+	if now.Sub(g.since) < g.config.Window {
+		return
+	}
+	g.since = now
+	g.previous = g.recipients
+	g.recipients = make(map[string]string)
+	for name, c := range g.campaigns {
+		if now.Before(c.PausedUntil) {
+			c.Sent, c.HardBounces, c.Complaints = 0, 0, 0
+			continue
+		}
+		delete(g.campaigns, name)
+	}
+}
+
+func (g *ReputationGuard) campaign(name string) *campaignGuard {
+	c, ok := g.campaigns[name]
+	if !ok {
+		c = &campaignGuard{CampaignReputation: CampaignReputation{Campaign: name, Level: ReputationNormal}}
+		g.campaigns[name] = c
+	}
+	return c
+}
+
+// Reserve returns how long the mail of the campaign
+// has to wait, zero sends it now. The slowed
+// campaign is let through at the SlowRate.
+func (g *ReputationGuard) Reserve(campaign string, now time.Time) time.Duration {
+	if g == nil || len(campaign) == 0 {
+		return 0
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.rotate(now)
+	c, ok := g.campaigns[campaign]
+	if !ok {
+		return 0
+	}
+	if now.Before(c.PausedUntil) {
+		return c.PausedUntil.Sub(now)
+	}
+	if c.Level == ReputationPaused {
+		// Paused long enough, the rates
+		// decide once more with new mail
+		c.Level = ReputationSlowed
+	}
+	if c.Level == ReputationSlowed && g.slowRate > 0 && !c.limiter.Allow(now) {
+		return time.Duration(float64(time.Second) / g.slowRate)
+	}
+	return 0
+}
+
+// Sent counts the campaign mail sent
+// to the recipient within the window.
+func (g *ReputationGuard) Sent(campaign, recipient string, now time.Time) {
+	if g == nil || len(campaign) == 0 {
+		return
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.rotate(now)
+	g.campaign(campaign).Sent++
+	g.recipients[strings.ToLower(recipient)] = campaign
+}
+
+// Bounce counts the hard bounce
+// against the campaign of the recipient.
+func (g *ReputationGuard) Bounce(bounce Bounce, now time.Time) {
+	if bounce.Kind != BounceHard {
+		return
+	}
+	g.count(bounce.Recipient, now, func(c *campaignGuard) { c.HardBounces++ })
+}
+
+// Complaint counts the spam complaint
+// against the campaign of the recipient.
+func (g *ReputationGuard) Complaint(recipient string, now time.Time) {
+	g.count(recipient, now, func(c *campaignGuard) { c.Complaints++ })
+}
+
+func (g *ReputationGuard) count(recipient string, now time.Time, add func(*campaignGuard)) {
+	if g == nil {
+		return
+	}
+
+	g.mutex.Lock()
+	g.rotate(now)
+	recipient = strings.ToLower(recipient)
+	name, ok := g.recipients[recipient]
+	if !ok {
+		name, ok = g.previous[recipient]
+	}
+	if !ok {
+		g.mutex.Unlock()
+		return
+	}
+	c := g.campaign(name)
+	add(c)
+	before := c.Level
+	reason := g.assess(c, now)
+	alert := c.CampaignReputation
+	g.mutex.Unlock()
+
+	if alert.Level != before {
+		g.raise(alert, reason)
+	}
+}
+
+// assess sets the level of the campaign by
+// the worse of its rates, the level is
+// never lowered within the window.
+func (g *ReputationGuard) assess(c *campaignGuard, now time.Time) string {
+	if c.Sent < g.config.MinSent || c.Sent == 0 {
+		return ""
+	}
+	level, reason := ReputationNormal, ""
+	for _, r := range []struct {
+		name      string
+		count     int
+		threshold float64
+	}{
+		{"hard bounce", c.HardBounces, g.config.HardBounceRate},
+		{"complaint", c.Complaints, g.config.ComplaintRate},
+	} {
+		if r.threshold <= 0 {
+			continue
+		}
+		rate := float64(r.count) / float64(c.Sent)
+		switch {
+		case rate >= r.threshold*g.config.PauseFactor:
+			level = ReputationPaused
+			reason = fmt.Sprintf("%s rate %.2f%% over %.2f%%", r.name, rate*100, r.threshold*g.config.PauseFactor*100)
+		case rate >= r.threshold && level == ReputationNormal:
+			level = ReputationSlowed
+			reason = fmt.Sprintf("%s rate %.2f%% over %.2f%%", r.name, rate*100, r.threshold*100)
+		}
+	}
+	switch {
+	case level == ReputationPaused && c.Level != ReputationPaused:
+		c.Level = level
+		c.PausedUntil = now.Add(g.config.PauseFor)
+	case level == ReputationSlowed && c.Level == ReputationNormal:
+		c.Level = level
+	}
+	if c.Level != ReputationNormal && c.limiter == nil {
+		// Slowed once the pause is over
+		c.limiter = NewTokenBucket(g.slowRate, 1)
+	}
+	return reason
+}
+
+// raise alerts the operators of
+// the campaign held back.
+func (g *ReputationGuard) raise(c CampaignReputation, reason string) {
+	log.Errorf("Campaign %s %s by its %s of %d sent", c.Campaign, c.Level, reason, c.Sent)
+	if g.alert == nil {
+		return
+	}
+	err := g.alert.SendMail(&mailStruct{
+		Subject: fmt.Sprintf("Campaign %s %s", c.Campaign, c.Level),
+		Message: fmt.Sprintf("The %s of the %d mail sent, %d hard bounces and %d complaints.", reason, c.Sent, c.HardBounces, c.Complaints),
+	})
+	if err != nil {
+		log.Errorf("Cannot alert on campaign %s: %s", c.Campaign, err)
+	}
+}
+
+// Campaigns lists the reputation of
+// the campaigns held back or watched.
+func (g *ReputationGuard) Campaigns() []CampaignReputation {
+	if g == nil {
+		return nil
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	list := make([]CampaignReputation, 0, len(g.campaigns))
+	for _, c := range g.campaigns {
+		list = append(list, c.CampaignReputation)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Campaign < list[j].Campaign })
+	return list
+}
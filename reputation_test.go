@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReputationGuard(t *testing.T) {
+	guard, err := NewReputationGuard(ReputationConfig{
+		HardBounceRate: 0.05,
+		ComplaintRate:  0.01,
+		MinSent:        100,
+		Window:         24 * time.Hour,
+		SlowRate:       "1/s",
+		PauseFactor:    2,
+		PauseFor:       time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts := &FakeMailer{}
+	guard.alert = alerts
+
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		guard.Sent("newsletter", fmt.Sprintf("user%d@example.com", i), now)
+	}
+	guard.Sent("", "reset@example.com", now)
+	for i := 0; i < 4; i++ {
+		guard.Bounce(Bounce{Recipient: fmt.Sprintf("USER%d@example.com", i), Kind: BounceHard}, now)
+	}
+	guard.Bounce(Bounce{Recipient: "user5@example.com", Kind: BounceSoft}, now)
+	guard.Bounce(Bounce{Recipient: "reset@example.com", Kind: BounceHard}, now)
+	if wait := guard.Reserve("newsletter", now); wait > 0 || len(alerts.sent) > 0 {
+		t.Fatalf("Campaign under the rates should not be held back, got %s", wait)
+	}
+
+	guard.Bounce(Bounce{Recipient: "user4@example.com", Kind: BounceHard}, now)
+	if len(alerts.sent) != 1 || alerts.sent[0].Subject != "Campaign newsletter slowed" {
+		t.Fatalf("Operators should be alerted of the slowed campaign, got %+v", alerts.sent)
+	}
+	if wait := guard.Reserve("newsletter", now); wait > 0 {
+		t.Errorf("Slowed campaign should send within its rate, got %s", wait)
+	}
+	if wait := guard.Reserve("newsletter", now); wait != time.Second {
+		t.Errorf("Slowed campaign over its rate should wait, got %s", wait)
+	}
+	if wait := guard.Reserve("onboarding", now); wait > 0 {
+		t.Errorf("Other campaign should not be held back, got %s", wait)
+	}
+
+	guard.Complaint("user10@example.com", now)
+	guard.Complaint("user11@example.com", now)
+	if len(alerts.sent) != 2 || alerts.sent[1].Subject != "Campaign newsletter paused" {
+		t.Fatalf("Operators should be alerted of the paused campaign, got %+v", alerts.sent)
+	}
+	if wait := guard.Reserve("newsletter", now.Add(time.Minute)); wait != 59*time.Minute {
+		t.Errorf("Paused campaign should wait for the pause, got %s", wait)
+	}
+	campaigns := guard.Campaigns()
+	if len(campaigns) != 1 || campaigns[0].Level != ReputationPaused || campaigns[0].HardBounces != 5 || campaigns[0].Complaints != 2 {
+		t.Errorf("Unexpected reputation %+v", campaigns)
+	}
+
+	// Past the pause the campaign is slowed, the
+	// next window forgets the counts but not
+	// the recipients of the late reports
+	later := now.Add(2 * time.Hour)
+	guard.Reserve("newsletter", later)
+	if wait := guard.Reserve("newsletter", later); wait != time.Second {
+		t.Errorf("Campaign should be slowed after the pause, got %s", wait)
+	}
+	next := now.Add(25 * time.Hour)
+	guard.Complaint("user12@example.com", next)
+	campaigns = guard.Campaigns()
+	if wait := guard.Reserve("newsletter", next); wait > 0 || len(campaigns) != 1 || campaigns[0].Level != ReputationNormal || campaigns[0].Complaints != 1 {
+		t.Errorf("New window should start over, got %s %+v", wait, campaigns)
+	}
+}
+
+func TestQueuedMailerReputation(t *testing.T) {
+	guard, _ := NewReputationGuard(ReputationConfig{HardBounceRate: 0.5, MinSent: 1, Window: time.Hour, SlowRate: "1/s", PauseFactor: 1, PauseFor: time.Hour})
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, nil, 1, 0)
+	queue.reputation = guard
+	defer queue.Close()
+
+	queue.SendMail(&mailStruct{ID: "1", Recipient: "radek@example.com", Campaign: "newsletter"})
+	for i := 0; i < 100 && len(guard.Campaigns()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	guard.Bounce(Bounce{Recipient: "radek@example.com", Kind: BounceHard}, time.Now())
+
+	queue.SendMail(&mailStruct{ID: "2", Recipient: "info@example.com", Campaign: "newsletter"})
+	queue.SendMail(&mailStruct{ID: "3", Recipient: "info@example.com"})
+	for i := 0; i < 100 && fake.count() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if len(fake.sent) != 2 || fake.sent[1] != "3" {
+		t.Errorf("Mail of the paused campaign should be postponed, sent %v", fake.sent)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/mailgun-go"
+)
+
+var retryConfig = &RetryConfig{}
+
+// RetryConfig of the failed sends, the wait
+// doubles from Initial up to Max, zero
+// Attempts disables the retries.
+type RetryConfig struct {
+	Attempts int           `default:"5"`
+	Initial  time.Duration `default:"30s"`
+	Max      time.Duration `default:"30m"`
+}
+
+func init() {
+	RegisterConfig("retry", retryConfig)
+}
+
+// isTransient tells the failure worth another
+// attempt, the rate limit or the outage of the
+// provider. The invalid address is not one,
+// the channels failed together are transient
+// only if all of them are.
+func isTransient(err error) bool {
+	if _, ok := err.(*RetryError); ok {
+		return true
+	}
+	if channels, ok := err.(*ChannelError); ok {
+		for _, failure := range channels.Failed {
+			if !isTransient(failure) {
+				return false
+			}
+		}
+		return len(channels.Failed) > 0
+	}
+	if response, ok := err.(*mailgun.UnexpectedResponseError); ok {
+		return response.Actual == http.StatusTooManyRequests || response.Actual >= 500
+	}
+	return err == ErrCircuitOpen || isTemporary(err) || isUnreachable(err)
+}
+
+// RetryError puts the mail failed by the
+// transient error off until At, the queue
+// keeps it meanwhile. Only the failed
+// Channels are tried again.
+type RetryError struct {
+	Err      error
+	At       time.Time
+	Attempts int
+	Channels []string
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("retrymailer: Retrying at %s after %d attempts: %s", e.At.Format(time.RFC3339), e.Attempts, e.Err)
+}
+
+// RetryMailer puts the mail failed by the transient
+// error off by the exponential backoff with jitter,
+// the queue sends it again then, until the attempts
+// run out. The mail given up or failed for good
+// goes to the dead letters.
+type RetryMailer struct {
+	mailer   Mailer
+	attempts int
+	initial  time.Duration
+	max      time.Duration
+	// deadLetters keep the mail failed
+	// after the retries, nil drops it
+	deadLetters *DeadLetterStore
+	// idempotency releases the key of
+	// the mail failed for good
+	idempotency *IdempotentMailer
+}
+
+func NewRetryMailer(mailer Mailer, config *RetryConfig) *RetryMailer {
+	return &RetryMailer{
+		mailer:   mailer,
+		attempts: config.Attempts,
+		initial:  config.Initial,
+		max:      config.Max,
+	}
+}
+
+func (rm *RetryMailer) SendMail(mail *mailStruct) error {
+	err := rm.mailer.SendMail(mail)
+	if retry, ok := err.(*RetryError); ok {
+		// Put off by the mailer
+		// along its own schedule
+		return retry
+	}
+	attempt := mail.attempts + 1
+	switch {
+	case err == nil:
+		if attempt > 1 {
+			log.Infof("Retried mail to %s sent after %d attempts", mail.Recipient, attempt)
+		}
+		return nil
+	case !isTransient(err):
+		rm.fail(mail, failureReason(err), err, attempt)
+		return err
+	case attempt > rm.attempts:
+		log.Errorf("Mail to %s given up after %d attempts", mail.Recipient, attempt)
+		rm.fail(mail, ReasonExhausted, err, attempt)
+		return err
+	}
+	wait := rm.backoff(attempt)
+	log.Warnf("Sending mail to %s failed, retrying in %s: %s", mail.Recipient, wait, err)
+	retry := &RetryError{Err: err, At: time.Now().Add(wait), Attempts: attempt}
+	if channels, ok := err.(*ChannelError); ok {
+		// The delivered channels do
+		// not get the mail again
+		retry.Channels = channels.Channels()
+	}
+	return retry
+}
+
+// backoff returns the wait before the retry,
+// attempt counts the failures so far. The half
+// of the wait is random, so the mail failed
+// together does not retry together.
+func (rm *RetryMailer) backoff(attempt int) time.Duration {
+	wait := rm.initial
+	for i := 1; i < attempt && wait < rm.max; i++ {
+		wait *= 2
+	}
+	if wait > rm.max {
+		wait = rm.max
+	}
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// fail keeps the dead letter and lets the
+// IdempotencyKey of the mail be sent again.
+func (rm *RetryMailer) fail(m *mailStruct, reason string, failure error, attempts int) {
+	if rm.idempotency != nil && len(m.IdempotencyKey) > 0 {
+		rm.idempotency.Release(m.IdempotencyKey)
+	}
+	if rm.deadLetters == nil {
+		return
+	}
+	if err := rm.deadLetters.Add(m, reason, failure, attempts, time.Now()); err != nil {
+		log.Errorf("Cannot keep the dead letter to %s: %s", m.Recipient, err)
+	}
+}
+
+func (rm *RetryMailer) Close() {
+	rm.mailer.Close()
+	if rm.deadLetters != nil {
+		rm.deadLetters.Close()
+	}
+}
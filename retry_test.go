@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go"
+)
+
+// failingMailer fails with the
+// errors in order, then sends.
+type failingMailer struct {
+	mutex  sync.Mutex
+	errors []error
+	sent   int
+}
+
+func (fm *failingMailer) SendMail(mail *mailStruct) error {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	if len(fm.errors) > 0 {
+		err := fm.errors[0]
+		fm.errors = fm.errors[1:]
+		return err
+	}
+	fm.sent++
+	return nil
+}
+
+func (fm *failingMailer) Close() {}
+
+func (fm *failingMailer) count() int {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	return fm.sent
+}
+
+func TestRetryMailer(t *testing.T) {
+	outage := &mailgun.UnexpectedResponseError{Actual: 503}
+	fake := &failingMailer{errors: []error{&mailgun.UnexpectedResponseError{Actual: 429}, outage, outage}}
+	mailer := NewRetryMailer(fake, &RetryConfig{Attempts: 2, Initial: time.Second, Max: time.Minute})
+	defer mailer.Close()
+
+	m := &mailStruct{Recipient: "radek@example.com"}
+	for attempt := 1; attempt <= 2; attempt++ {
+		err := mailer.SendMail(m)
+		retry, ok := err.(*RetryError)
+		if !ok || retry.Attempts != attempt || !retry.At.After(time.Now()) {
+			t.Fatalf("Transient failure should be put off, got %v", err)
+		}
+		m.attempts = retry.Attempts
+	}
+	if err := mailer.SendMail(m); err != outage {
+		t.Errorf("Mail should be given up after the attempts, got %v", err)
+	}
+
+	invalid := &mailgun.UnexpectedResponseError{Actual: 400}
+	fake.errors = []error{invalid}
+	if err := mailer.SendMail(&mailStruct{}); err != invalid {
+		t.Errorf("Permanent failure should not be retried, got %v", err)
+	}
+}
+
+func TestQueuedMailerRetry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	store, err := NewBoltQueue(filepath.Join(dir, "queue.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &failingMailer{errors: []error{
+		&mailgun.UnexpectedResponseError{Actual: 429},
+		&mailgun.UnexpectedResponseError{Actual: 503},
+	}}
+	queue := NewQueuedMailer(NewRetryMailer(fake, &RetryConfig{Attempts: 3, Initial: 2 * time.Millisecond, Max: 4 * time.Millisecond}), nil, 1, 0)
+	defer queue.Close()
+	queue.Persist(store)
+
+	queue.SendMail(&mailStruct{Recipient: "radek@example.com"})
+	for i := 0; i < 100 && (fake.count() == 0 || queue.Depth() > 0); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if fake.count() != 1 || queue.Delayed() != 0 {
+		t.Errorf("Mail should be sent on the third attempt")
+	}
+	if pending, _ := store.Pending(); len(pending) != 0 {
+		t.Errorf("Sent mail should be removed from the store, left %v", pending)
+	}
+}
+
+func TestQueuedMailerRetryResumes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+	store, err := NewBoltQueue(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &failingMailer{errors: []error{&mailgun.UnexpectedResponseError{Actual: 503}}}
+	queue := NewQueuedMailer(NewRetryMailer(fake, &RetryConfig{Attempts: 3, Initial: time.Hour, Max: time.Hour}), nil, 1, 0)
+	queue.Persist(store)
+	queue.SendMail(&mailStruct{Recipient: "radek@example.com"})
+	for i := 0; i < 100 && queue.Delayed() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	queue.Close()
+
+	if store, err = NewBoltQueue(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := store.Pending()
+	if len(pending) != 1 || pending[0].attempts != 1 || pending[0].notBefore.Before(time.Now().Add(time.Minute)) {
+		t.Fatalf("Mail waiting for retry should be kept with its attempts, got %+v", pending)
+	}
+	queue = NewQueuedMailer(fake, nil, 1, 0)
+	defer queue.Close()
+	queue.Persist(store)
+	for i := 0; i < 100 && queue.Delayed() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if queue.Delayed() != 1 || fake.count() != 0 {
+		t.Errorf("Resumed mail should wait for its retry")
+	}
+}
+
+func TestRetryMailerBackoff(t *testing.T) {
+	mailer := NewRetryMailer(&FakeMailer{}, &RetryConfig{Attempts: 10, Initial: time.Second, Max: 5 * time.Second})
+	for attempt, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 8: 5 * time.Second} {
+		if wait := mailer.backoff(attempt); wait < expected/2 || wait > expected {
+			t.Errorf("Attempt %d should wait about %s, got %s", attempt, expected, wait)
+		}
+	}
+}
+
+func TestQueuedMailerScheduleResumes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+	store, err := NewBoltQueue(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, nil, 1, 0)
+	queue.Persist(store)
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	queue.SendMail(&mailStruct{ID: "1", DeliveryTime: at})
+	queue.Close()
+
+	if store, err = NewBoltQueue(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := store.Pending()
+	if len(pending) != 1 || !pending[0].notBefore.Equal(at) {
+		t.Fatalf("Scheduled mail should be kept until its DeliveryTime, got %+v", pending)
+	}
+	queue = NewQueuedMailer(fake, nil, 1, 0)
+	defer queue.Close()
+	queue.Persist(store)
+	for i := 0; i < 100 && queue.Delayed() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if queue.Delayed() != 1 || fake.count() != 0 {
+		t.Errorf("Resumed mail should wait for its DeliveryTime")
+	}
+}
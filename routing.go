@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+var ErrBadRoute = fmt.Errorf("routingmailer: Route must be in form pattern=mailer")
+
+// RoutingMailer picks the mailer by the domain
+// of the recipient. Routes are matched in order
+// they were added, the fallback is used when
+// no route matches or the mail requests
+// a specific provider.
+type RoutingMailer struct {
+	routes   []route
+	fallback Mailer
+}
+
+type route struct {
+	pattern string
+	mailer  Mailer
+}
+
+func NewRoutingMailer(fallback Mailer) *RoutingMailer {
+	return &RoutingMailer{
+		fallback: fallback,
+	}
+}
+
+// AddRoute sends mail for domains matching the
+// pattern (e.g. *.corp.example.com) via the mailer.
+func (r *RoutingMailer) AddRoute(pattern string, mailer Mailer) error {
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	r.routes = append(r.routes, route{pattern, mailer})
+	return nil
+}
+
+func (r *RoutingMailer) SendMail(mail *mailStruct) error {
+	if len(mail.Provider) > 0 {
+		return r.fallback.SendMail(mail)
+	}
+	return r.route(mail.Recipient).SendMail(mail)
+}
+
+func (r *RoutingMailer) route(recipient string) Mailer {
+	domain := strings.ToLower(recipient[strings.LastIndex(recipient, "@")+1:])
+	domain = strings.TrimSuffix(domain, ">")
+	for _, rt := range r.routes {
+		if ok, _ := path.Match(rt.pattern, domain); ok {
+			return rt.mailer
+		}
+	}
+	return r.fallback
+}
+
+func (r *RoutingMailer) Close() {
+	closed := map[Mailer]bool{}
+	for _, rt := range r.routes {
+		if !closed[rt.mailer] {
+			rt.mailer.Close()
+			closed[rt.mailer] = true
+		}
+	}
+	if !closed[r.fallback] {
+		r.fallback.Close()
+	}
+}
+
+// parseRoute splits the configured
+// rule into pattern and mailer name.
+func parseRoute(rule string) (string, string, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", ErrBadRoute
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestRoutingMailer(t *testing.T) {
+	internal := &FakeMailer{}
+	fallback := &FakeMailer{}
+
+	router := NewRoutingMailer(fallback)
+	if err := router.AddRoute("*.corp.example.com", internal); err != nil {
+		t.Fatal(err)
+	}
+
+	router.SendMail(&mailStruct{Recipient: "radek@mail.Corp.Example.com"})
+	router.SendMail(&mailStruct{Recipient: "radek@corp.example.com"})
+	router.SendMail(&mailStruct{Recipient: "radek@gmail.com"})
+
+	if len(internal.sent) != 1 {
+		t.Errorf("Expected one internal mail, got %d", len(internal.sent))
+	}
+	if len(fallback.sent) != 2 {
+		t.Errorf("Expected two fallback mails, got %d", len(fallback.sent))
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	pattern, name, err := parseRoute("*.corp.example.com=smtp")
+	if err != nil || pattern != "*.corp.example.com" || name != "smtp" {
+		t.Errorf("Bad route parsed %s %s %v", pattern, name, err)
+	}
+
+	if _, _, err := parseRoute("smtp"); err != ErrBadRoute {
+		t.Error("Route without mailer should be rejected")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var sandboxConfig = &SandboxConfig{}
+
+// SandboxConfig points all the outgoing
+// mail to a capturing SMTP server like
+// MailHog or Mailtrap.
+type SandboxConfig struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+func init() {
+	RegisterConfig("sandbox", sandboxConfig)
+}
+
+// newSandboxMailer ignores the providers,
+// routes and per message provider choice,
+// so no real user can be mailed.
+func newSandboxMailer(config *SandboxConfig, sender string) (Mailer, error) {
+	host, port, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Warnln("***************************************************")
+	log.Warnln("*  SANDBOX MODE: no mail leaves this service      *")
+	log.Warnf("*  all mail is captured by %s", config.Addr)
+	log.Warnln("***************************************************")
+	return NewSmtpMailer(host, port, config.Username, config.Password, sender), nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TemplateScreenshotsDir of the template keeps
+// the screenshots per version of its files
+// e.g. welcome/.screenshots/VERSION/mobile.png.
+const TemplateScreenshotsDir = ".screenshots"
+
+// maxScreenshotSize of the image
+// returned by the provider.
+const maxScreenshotSize = 16 * 1024 * 1024
+
+var (
+	ErrBadViewport      = fmt.Errorf("screenshots: Viewport must be name:width")
+	ErrNoScreenshots    = fmt.Errorf("screenshots: Rendering preview provider is not configured")
+	ErrScreenshotFailed = fmt.Errorf("screenshots: Rendering preview provider failed")
+
+	screenshotConfig = &ScreenshotConfig{}
+)
+
+// ScreenshotConfig points to the rendering preview
+// provider e.g. the headless browser service, it
+// gets the JSON with the Html and the Width and
+// returns the PNG. Without the URL the screenshots
+// cannot be taken.
+type ScreenshotConfig struct {
+	URL   string
+	Token string
+	// Viewports as name:width in pixels
+	Viewports []string      `default:"desktop:1200,mobile:375"`
+	Timeout   time.Duration `default:"30s"`
+}
+
+func init() {
+	RegisterConfig("screenshot", screenshotConfig)
+}
+
+// TemplateScreenshot of the template rendered
+// with its sample data, the Version is of
+// the template files it was taken of.
+type TemplateScreenshot struct {
+	Template string
+	Version  string
+	Viewport string
+	Time     time.Time
+}
+
+type viewport struct {
+	name  string
+	width int
+}
+
+// ParseViewports reads the name:width entries.
+func ParseViewports(entries []string) ([]viewport, error) {
+	viewports := make([]viewport, 0, len(entries))
+	for _, entry := range entries {
+		fields := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(fields) != 2 || len(fields[0]) == 0 || filepath.Base(fields[0]) != fields[0] || strings.HasPrefix(fields[0], ".") {
+			return nil, ErrBadViewport
+		}
+		width, err := strconv.Atoi(fields[1])
+		if err != nil || width <= 0 {
+			return nil, ErrBadViewport
+		}
+		viewports = append(viewports, viewport{fields[0], width})
+	}
+	return viewports, nil
+}
+
+// Screenshotter takes the screenshots of the
+// templates by the rendering preview provider
+// and keeps them with the template.
+type Screenshotter struct {
+	url       string
+	token     string
+	viewports []viewport
+	client    *http.Client
+}
+
+func NewScreenshotter(url, token string, viewports []viewport, timeout time.Duration) *Screenshotter {
+	return &Screenshotter{
+		url:       url,
+		token:     token,
+		viewports: viewports,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+// Capture renders the current version of the
+// template with its sample data and takes its
+// screenshot in every viewport. The template
+// without the Html is shown as the text.
+func (s *Screenshotter) Capture(store *DirTemplateStore, name string, now time.Time) ([]TemplateScreenshot, error) {
+	t, err := store.Template(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.Sample(name)
+	if err != nil {
+		return nil, &RenderError{name, err}
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	m, err := renderFixture(t, data)
+	if err != nil {
+		return nil, &RenderError{name, err}
+	}
+	doc := m.Html
+	if len(doc) == 0 {
+		doc = "<pre>" + html.EscapeString(m.Message) + "</pre>"
+	}
+
+	dir := filepath.Join(store.dir, name, TemplateScreenshotsDir, t.version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	shots := make([]TemplateScreenshot, 0, len(s.viewports))
+	for _, v := range s.viewports {
+		image, err := s.take(doc, v.width)
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dir, v.name+".png")
+		if err = ioutil.WriteFile(path+".tmp", image, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		shots = append(shots, TemplateScreenshot{name, t.version, v.name, now})
+	}
+	return shots, nil
+}
+
+func (s *Screenshotter) take(doc string, width int) ([]byte, error) {
+	body, _ := json.Marshal(struct {
+		Html  string
+		Width int
+	}{doc, width})
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "image/png")
+	if len(s.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Warnf("Cannot reach the rendering preview provider: %s", err)
+		return nil, ErrScreenshotFailed
+	}
+	defer resp.Body.Close()
+	image, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxScreenshotSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || len(image) > maxScreenshotSize || !bytes.HasPrefix(image, []byte("\x89PNG")) {
+		return nil, ErrScreenshotFailed
+	}
+	return image, nil
+}
+
+// Screenshots lists the screenshots of
+// the template, the oldest version first.
+func (s *DirTemplateStore) Screenshots(name string) ([]TemplateScreenshot, error) {
+	if !validTemplateName(name) {
+		return nil, ErrUnknownTemplate
+	}
+	shots := []TemplateScreenshot{}
+	dir := filepath.Join(s.dir, name, TemplateScreenshotsDir)
+	versions, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return shots, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		files, err := ioutil.ReadDir(filepath.Join(dir, version.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if viewport := strings.TrimSuffix(file.Name(), ".png"); viewport != file.Name() {
+				shots = append(shots, TemplateScreenshot{name, version.Name(), viewport, file.ModTime()})
+			}
+		}
+	}
+	// Versions are the times of the files
+	sort.SliceStable(shots, func(i, j int) bool {
+		return len(shots[i].Version) < len(shots[j].Version) ||
+			len(shots[i].Version) == len(shots[j].Version) && shots[i].Version < shots[j].Version
+	})
+	return shots, nil
+}
+
+// Screenshot returns the image of the
+// template version in the viewport.
+func (s *DirTemplateStore) Screenshot(name, version, viewport string) ([]byte, error) {
+	if !validTemplateName(name) || !validTemplateName(version) || !validTemplateName(viewport) {
+		return nil, ErrUnknownTemplate
+	}
+	image, err := ioutil.ReadFile(filepath.Join(s.dir, name, TemplateScreenshotsDir, version, viewport+".png"))
+	if os.IsNotExist(err) {
+		return nil, ErrUnknownTemplate
+	}
+	return image, err
+}
+
+// screenshotsFunc answers the screenshots of
+// the template: POST takes them of the current
+// version, GET lists them or with the version
+// and the viewport returns the image.
+func screenshotsFunc(store *DirTemplateStore, screenshots *Screenshotter, name, author string, rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == "GET" && len(req.URL.Query().Get("version")) > 0:
+		query := req.URL.Query()
+		image, err := store.Screenshot(name, query.Get("version"), query.Get("viewport"))
+		if err == ErrUnknownTemplate {
+			http.NotFound(rw, req)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "image/png")
+		rw.Write(image)
+	case req.Method == "GET":
+		shots, err := store.Screenshots(name)
+		if err == ErrUnknownTemplate {
+			http.NotFound(rw, req)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(shots)
+	case req.Method == "POST":
+		if screenshots == nil {
+			http.Error(rw, ErrNoScreenshots.Error(), http.StatusNotImplemented)
+			return
+		}
+		shots, err := screenshots.Capture(store, name, time.Now())
+		switch err {
+		case nil:
+		case ErrUnknownTemplate:
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		case ErrScreenshotFailed:
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		default:
+			renderErrorStatus(rw, err)
+			return
+		}
+		log.Infof("Screenshots of template %s taken by %s", name, author)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		json.NewEncoder(rw).Encode(shots)
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
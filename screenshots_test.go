@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScreenshots(t *testing.T) {
+	widths := []int{}
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		shot := struct {
+			Html  string
+			Width int
+		}{}
+		json.NewDecoder(req.Body).Decode(&shot)
+		if req.Header.Get("Authorization") != "Bearer secret" || !strings.Contains(shot.Html, "Hello Radek") {
+			http.Error(rw, "Bad request", http.StatusBadRequest)
+			return
+		}
+		widths = append(widths, shot.Width)
+		rw.Write([]byte("\x89PNG" + shot.Html))
+	}))
+	defer provider.Close()
+
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	store := NewDirTemplateStore(dir)
+	store.Write("welcome", TemplateHtmlFile, "<p>Hello {{.Name}}</p>", "radek", time.Now())
+	store.Write("welcome", TemplateSampleFile, `{"Name": "Radek"}`, "radek", time.Now())
+	viewports, err := ParseViewports([]string{"desktop:1200", "mobile:375"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := TemplatesFunc(store, nil, NewScreenshotter(provider.URL, "secret", viewports, time.Second))
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest(method, TemplatesPath+path, nil))
+		return rw
+	}
+
+	if rw := do("POST", "welcome/screenshots"); rw.Code != http.StatusCreated {
+		t.Fatalf("Screenshots should be taken, got %d %s", rw.Code, rw.Body)
+	}
+	if len(widths) != 2 || widths[0] != 1200 || widths[1] != 375 {
+		t.Errorf("Screenshot should be taken per viewport, got %v", widths)
+	}
+	first, _ := store.Template("welcome")
+
+	// New version keeps the screenshots of the old one
+	later := time.Now().Add(time.Second)
+	store.Write("welcome", TemplateHtmlFile, "<h1>Hello {{.Name}}</h1>", "radek", later)
+	os.Chtimes(dir+"/welcome/"+TemplateHtmlFile, later, later)
+	do("POST", "welcome/screenshots")
+
+	shots := []TemplateScreenshot{}
+	json.NewDecoder(do("GET", "welcome/screenshots").Body).Decode(&shots)
+	if len(shots) != 4 || shots[0].Version != first.version || shots[3].Version == first.version {
+		t.Fatalf("Screenshots should be kept per version, got %+v", shots)
+	}
+	rw := do("GET", "welcome/screenshots?version="+first.version+"&viewport=mobile")
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "image/png" || !strings.Contains(rw.Body.String(), "<p>Hello Radek</p>") {
+		t.Errorf("Screenshot of the old version should be returned, got %d %s", rw.Code, rw.Body)
+	}
+	if rw := do("GET", "welcome/screenshots?version=../..&viewport=mobile"); rw.Code != http.StatusNotFound {
+		t.Errorf("Version out of the directory should not be found, got %d", rw.Code)
+	}
+	if names, _ := store.Names(); len(names) != 1 {
+		t.Errorf("Screenshots should not be listed as templates, got %v", names)
+	}
+
+	store.Write("broken", TemplateHtmlFile, "<p>{{.Missing}}</p>", "radek", time.Now())
+	if rw := do("POST", "broken/screenshots"); rw.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Template failing with its sample should not be shot, got %d", rw.Code)
+	}
+	if rw := do("POST", "missing/screenshots"); rw.Code != http.StatusNotFound {
+		t.Errorf("Missing template should not be found, got %d", rw.Code)
+	}
+	if _, err := ParseViewports([]string{"../x:100"}); err != ErrBadViewport {
+		t.Errorf("Viewport name out of the directory should be refused, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const scrubbed = "***"
+
+// Scrubber removes secrets and message bodies
+// from everything that leaves the service as a
+// log entry or an error report.
+type Scrubber struct {
+	fields  map[string]bool
+	mutex   sync.RWMutex
+	secrets []string
+}
+
+// NewScrubber masks the values of given
+// field names and any occurrence of the
+// secret values.
+func NewScrubber(fields []string, secrets ...string) *Scrubber {
+	s := &Scrubber{
+		fields: make(map[string]bool, len(fields)),
+	}
+	for _, field := range fields {
+		s.fields[strings.ToLower(field)] = true
+	}
+	s.AddSecrets(secrets...)
+	return s
+}
+
+// AddSecrets masks also the new secret values,
+// the old ones are kept masked.
+func (s *Scrubber) AddSecrets(secrets ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, secret := range secrets {
+		if len(secret) > 0 {
+			s.secrets = append(s.secrets, secret)
+		}
+	}
+}
+
+func (s *Scrubber) String(str string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, secret := range s.secrets {
+		str = strings.Replace(str, secret, scrubbed, -1)
+	}
+	return str
+}
+
+func (s *Scrubber) Fields(data log.Fields) log.Fields {
+	clean := make(log.Fields, len(data))
+	for key, value := range data {
+		if s.fields[strings.ToLower(key)] {
+			clean[key] = scrubbed
+			continue
+		}
+		if str, ok := value.(string); ok {
+			value = s.String(str)
+		} else if err, ok := value.(error); ok {
+			value = s.String(err.Error())
+		}
+		clean[key] = value
+	}
+	return clean
+}
+
+// ScrubHook runs every log entry through
+// the scrubber. It has to be added before
+// hooks shipping logs out of the service.
+type ScrubHook struct {
+	scrubber *Scrubber
+}
+
+func NewScrubHook(scrubber *Scrubber) *ScrubHook {
+	return &ScrubHook{scrubber}
+}
+
+func (h *ScrubHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
+	}
+}
+
+func (h *ScrubHook) Fire(entry *log.Entry) error {
+	entry.Message = h.scrubber.String(entry.Message)
+	entry.Data = h.scrubber.Fields(entry.Data)
+	return nil
+}
+
+// RecoverFunc turns a panic in the handler into
+// a 500 response and a scrubbed error report.
+func RecoverFunc(scrubber *Scrubber, h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Recovered from panic: %s", scrubber.String(fmt.Sprint(r)))
+				http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		h(rw, req)
+	}
+}
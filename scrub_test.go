@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestScrubber(t *testing.T) {
+	scrubber := NewScrubber([]string{"ApiKey", "Message"}, "key-123")
+
+	if msg := scrubber.String("request failed for key-123"); msg != "request failed for ***" {
+		t.Errorf("Secret not scrubbed: %s", msg)
+	}
+
+	fields := scrubber.Fields(log.Fields{
+		"apikey":    "key-123",
+		"Message":   "Hello, your password is ...",
+		"Recipient": "radek@suricata.com",
+		"error":     fmt.Errorf("bad key key-123"),
+	})
+
+	if fields["apikey"] != scrubbed || fields["Message"] != scrubbed {
+		t.Errorf("Fields not scrubbed: %v", fields)
+	}
+	if fields["Recipient"] != "radek@suricata.com" {
+		t.Error("Other fields should be kept")
+	}
+	if fields["error"] != "bad key ***" {
+		t.Errorf("Secret in error not scrubbed: %v", fields["error"])
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+var (
+	ErrBadSender        = fmt.Errorf("sendermailer: Sender is not an email address")
+	ErrSenderNotAllowed = fmt.Errorf("sendermailer: Sender domain is not allowed")
+)
+
+// SenderMailer rejects the mail with the Sender
+// outside of the allowed sending domains, so
+// the callers cannot spoof foreign addresses.
+// Mail without Sender goes from the default one.
+type SenderMailer struct {
+	mailer  Mailer
+	domains map[string]bool
+}
+
+func NewSenderMailer(mailer Mailer, domains []string) Mailer {
+	sm := &SenderMailer{
+		mailer:  mailer,
+		domains: make(map[string]bool),
+	}
+	for _, domain := range domains {
+		sm.domains[strings.ToLower(strings.TrimSpace(domain))] = true
+	}
+	return sm
+}
+
+func (sm *SenderMailer) SendMail(m *mailStruct) error {
+	if len(m.Sender) == 0 {
+		return sm.mailer.SendMail(m)
+	}
+	domain, err := senderDomain(m.Sender)
+	if err != nil {
+		return err
+	}
+	if !sm.domains[domain] {
+		return fmt.Errorf("%s: %s", ErrSenderNotAllowed, domain)
+	}
+	return sm.mailer.SendMail(m)
+}
+
+func (sm *SenderMailer) Close() {
+	sm.mailer.Close()
+}
+
+// senderDomain returns the lower case domain
+// of the address e.g. "Info <info@suricata.com>".
+func senderDomain(sender string) (string, error) {
+	address, err := mail.ParseAddress(sender)
+	if err != nil {
+		return "", ErrBadSender
+	}
+	at := strings.LastIndex(address.Address, "@")
+	if at < 0 {
+		return "", ErrBadSender
+	}
+	return strings.ToLower(address.Address[at+1:]), nil
+}
+
+// senderOf returns the Sender of the mail
+// or the default sender of the provider.
+func senderOf(m *mailStruct, sender string) string {
+	if len(m.Sender) > 0 {
+		return m.Sender
+	}
+	return sender
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestSenderMailer(t *testing.T) {
+	fake := &FakeMailer{}
+	mailer := NewSenderMailer(fake, []string{"suricata.com", "Support.Suricata.com"})
+
+	senders := []string{"", "info@suricata.com", "Help <help@support.suricata.com>"}
+	for _, sender := range senders {
+		if err := mailer.SendMail(&mailStruct{Sender: sender}); err != nil {
+			t.Errorf("Sender %q should be allowed: %s", sender, err)
+		}
+	}
+
+	if err := mailer.SendMail(&mailStruct{Sender: "ceo@example.com"}); err == nil {
+		t.Error("Foreign sender domain should be rejected")
+	}
+	if err := mailer.SendMail(&mailStruct{Sender: "info"}); err != ErrBadSender {
+		t.Errorf("Expected ErrBadSender, got %v", err)
+	}
+	if len(fake.sent) != len(senders) {
+		t.Errorf("Expected %d mails sent, got %d", len(senders), len(fake.sent))
+	}
+}
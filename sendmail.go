@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var sendmailConfig = &SendmailConfig{}
+
+type SendmailConfig struct {
+	Command string `default:"/usr/sbin/sendmail -t"`
+}
+
+func init() {
+	RegisterConfig("sendmail", sendmailConfig)
+	RegisterMailer("sendmail", func() (Mailer, error) {
+		mailer, err := NewSendmailMailer(sendmailConfig.Command, appConfig.Sender)
+		if err != nil {
+			return nil, err
+		}
+		mailer.returnPath = appConfig.ReturnPath
+		return mailer, nil
+	})
+}
+
+// SendmailMailer pipes the composed message
+// to the local command, no outbound HTTP
+// call is made by the service. The bounces
+// go to the returnPath given by -f if set.
+type SendmailMailer struct {
+	command    []string
+	sender     string
+	returnPath string
+}
+
+func NewSendmailMailer(command, sender string) (*SendmailMailer, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("sendmailmailer: Command not configured")
+	}
+	return &SendmailMailer{
+		command: args,
+		sender:  sender,
+	}, nil
+}
+
+func (sm *SendmailMailer) SendMail(mail *mailStruct) error {
+	m := *mail
+	m.Sender = senderOf(mail, sm.sender)
+
+	var stderr bytes.Buffer
+	args := sm.command[1:]
+	if len(sm.returnPath) > 0 {
+		args = append(append([]string{}, args...), "-f", sm.returnPath)
+	}
+	cmd := exec.Command(sm.command[0], args...)
+	cmd.Stdin = bytes.NewReader(composeMessage(&m, time.Now()))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("sendmailmailer: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	log.Infof("Mail to %s piped to %s", m.Recipient, sm.command[0])
+	return nil
+}
+
+// Check verifies the command is installed.
+func (sm *SendmailMailer) Check() error {
+	_, err := exec.LookPath(sm.command[0])
+	return err
+}
+
+func (sm *SendmailMailer) Close() {}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendmailMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "message")
+
+	mailer, err := NewSendmailMailer("tee "+out, "info@suricata.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.SendMail(&mailStruct{Recipient: "radek@suricata.com", Message: "Test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := ioutil.ReadFile(out)
+	if !strings.Contains(string(content), "To: radek@suricata.com\r\n") {
+		t.Errorf("Message not piped to command: %s", content)
+	}
+
+	failing, _ := NewSendmailMailer("false", "info@suricata.com")
+	if failing.SendMail(&mailStruct{}) == nil {
+		t.Error("Failing command should return error")
+	}
+}
+
+func TestSendmailMailerReturnPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "sendmail")
+	out := filepath.Join(dir, "args")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+out+"\n"), 0755)
+
+	mailer, err := NewSendmailMailer(script+" -t", "info@suricata.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer.returnPath = "bounces@suricata.com"
+	if err := mailer.SendMail(&mailStruct{Recipient: "radek@suricata.com", Message: "Test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	args, _ := ioutil.ReadFile(out)
+	if strings.TrimSpace(string(args)) != "-t -f bounces@suricata.com" {
+		t.Errorf("Return path should be the envelope sender, got %s", args)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nats-io/nats"
+	"golang.org/x/net/context"
+)
+
+var ErrShuttingDown = fmt.Errorf("mail: Service is shutting down")
+
+// Shutdown stops the instance in order, so the
+// accepted mail is not lost: the intake stops,
+// the held mail is released to the queue, the
+// queue drains within the timeout, the NATS
+// connection is flushed and the instance leaves
+// the registry before the exit. The server,
+// conn, holding, queue and intake are set as
+// they are built, the ones not built yet
+// are skipped.
+type Shutdown struct {
+	server  *http.Server
+	conn    *nats.EncodedConn
+	holding *HoldingMailer
+	queue   *QueuedMailer
+	intake  Mailer
+	timeout time.Duration
+	stop    chan struct{}
+	mutex   sync.Mutex
+	subs    []*nats.Subscription
+	closing bool
+}
+
+func NewShutdown(timeout time.Duration) *Shutdown {
+	return &Shutdown{
+		timeout: timeout,
+		stop:    make(chan struct{}),
+	}
+}
+
+// Done is closed as the shutdown
+// begins, it stops the watchers.
+func (s *Shutdown) Done() <-chan struct{} {
+	return s.stop
+}
+
+// Subscribe keeps the subscription to
+// stop it first on the shutdown, none
+// is made once the shutdown began.
+func (s *Shutdown) Subscribe(subscribe func() (*nats.Subscription, error)) (*nats.Subscription, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closing {
+		return nil, ErrShuttingDown
+	}
+	sub, err := subscribe()
+	if err == nil && sub != nil {
+		s.subs = append(s.subs, sub)
+	}
+	return sub, err
+}
+
+// Run shuts down on the first signal.
+func (s *Shutdown) Run(signals <-chan os.Signal) {
+	sig := <-signals
+	log.Infof("Received %s, shutting down", sig)
+	s.Stop()
+}
+
+// Stop shuts the instance down, the mail still
+// queued or delayed after the timeout is
+// dropped unless the queue is persisted.
+func (s *Shutdown) Stop() {
+	s.mutex.Lock()
+	s.closing = true
+	close(s.stop)
+	for _, sub := range s.subs {
+		// Already unsubscribed by the
+		// standby is fine as well
+		sub.Unsubscribe()
+	}
+	s.subs = nil
+	s.mutex.Unlock()
+	if s.conn != nil {
+		if err := s.conn.Flush(); err != nil {
+			log.Errorf("Cannot flush NATS connection: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	ctx, cancel := context.WithDeadline(context.TODO(), deadline)
+	defer cancel()
+	if s.server != nil {
+		if err := s.server.Shutdown(ctx); err != nil {
+			log.Errorf("Cannot finish HTTP requests: %s", err)
+		}
+	}
+
+	if s.holding != nil {
+		s.holding.Release()
+	}
+	if s.queue != nil {
+		if s.queue.Drain(deadline.Sub(time.Now())) {
+			log.Infoln("Queue drained")
+		} else {
+			log.Warnf("Shutdown timeout passed with %d mails queued and %d delayed", s.queue.Depth(), s.queue.Delayed())
+		}
+	}
+	if s.intake != nil {
+		s.intake.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+
+	if registryClient != nil {
+		if err := registryClient.Unregister(); err != nil {
+			log.Errorf("Cannot deregister from etcd: %s", err)
+		}
+	}
+	log.Infoln("Shutdown complete")
+}
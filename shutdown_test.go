@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go"
+)
+
+func TestShutdownReleasesHeld(t *testing.T) {
+	fake := &syncMailer{}
+	queue := NewQueuedMailer(fake, nil, 1, 0)
+	holding := NewHoldingMailer(queue, map[string]time.Duration{"chat": 50 * time.Millisecond})
+	shutdown := NewShutdown(time.Second)
+	shutdown.holding, shutdown.queue, shutdown.intake = holding, queue, holding
+
+	holding.SendMail(&mailStruct{ID: "1", Campaign: "chat"})
+	shutdown.Stop()
+	if fake.count() != 1 {
+		t.Errorf("Held mail should be sent within the timeout, sent %v", fake.sent)
+	}
+	select {
+	case <-shutdown.Done():
+	default:
+		t.Error("Done should be closed")
+	}
+}
+
+func TestShutdownKeepsDelayed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "shutdown")
+	defer os.RemoveAll(dir)
+	store, err := NewBoltQueue(filepath.Join(dir, "queue.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &failingMailer{errors: []error{&mailgun.UnexpectedResponseError{Actual: 503}}}
+	queue := NewQueuedMailer(NewRetryMailer(fake, &RetryConfig{Attempts: 3, Initial: time.Hour, Max: time.Hour}), nil, 1, 0)
+	queue.Persist(store)
+	approval := NewApprovalMailer(queue, []string{"contract"}, time.Hour)
+	if err := approval.Persist(filepath.Join(dir, "approval.db"), nil); err != nil {
+		t.Fatal(err)
+	}
+	shutdown := NewShutdown(100 * time.Millisecond)
+	shutdown.queue, shutdown.intake = queue, approval
+
+	approval.SendMail(&mailStruct{ID: "1", Recipient: "radek@example.com"})
+	approval.SendMail(&mailStruct{ID: "2", Template: "contract"})
+	for i := 0; i < 100 && queue.Delayed() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	shutdown.Stop()
+
+	if store, err = NewBoltQueue(filepath.Join(dir, "queue.db"), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if pending, _ := store.Pending(); len(pending) != 1 || pending[0].attempts != 1 {
+		t.Errorf("Mail waiting for retry should be kept, got %v", pending)
+	}
+	approval = NewApprovalMailer(&syncMailer{}, []string{"contract"}, time.Hour)
+	if err := approval.Persist(filepath.Join(dir, "approval.db"), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer approval.Close()
+	if pending := approval.Pending(); len(pending) != 1 {
+		t.Errorf("Mail pending approval should be kept, got %v", pending)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var ErrMessageTooLarge = fmt.Errorf("mail: Message exceeds the size limit")
+
+// Size returns the size of the bodies
+// and the attachment data of the mail.
+func (m *mailStruct) Size() int64 {
+	size := int64(len(m.Message) + len(m.Html) + len(m.Calendar))
+	for _, attachment := range m.Attachments {
+		size += int64(len(attachment.Data))
+	}
+	return size
+}
+
+// SizeLimitMailer rejects the oversized mail
+// before it is queued, so the caller gets the
+// error instead of the failing provider call.
+type SizeLimitMailer struct {
+	mailer  Mailer
+	maxSize int64
+}
+
+func NewSizeLimitMailer(mailer Mailer, maxSize int64) Mailer {
+	return &SizeLimitMailer{
+		mailer:  mailer,
+		maxSize: maxSize,
+	}
+}
+
+func (sm *SizeLimitMailer) SendMail(mail *mailStruct) error {
+	if size := mail.Size(); sm.maxSize > 0 && size > sm.maxSize {
+		log.Warnf("Rejecting mail for %s of %d bytes, limit is %d", mail.Recipient, size, sm.maxSize)
+		return ErrMessageTooLarge
+	}
+	return sm.mailer.SendMail(mail)
+}
+
+func (sm *SizeLimitMailer) Close() {
+	sm.mailer.Close()
+}
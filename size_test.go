@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSizeLimitMailer(t *testing.T) {
+	fake := &FakeMailer{}
+	mailer := NewSizeLimitMailer(fake, 10)
+
+	if err := mailer.SendMail(&mailStruct{Message: "Hello"}); err != nil {
+		t.Error(err)
+	}
+	oversized := &mailStruct{Message: "Hello", Attachments: []Attachment{{Data: []byte("Radek!")}}}
+	if mailer.SendMail(oversized) != ErrMessageTooLarge {
+		t.Error("Oversized mail should be rejected")
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"Recipient":"radek@suricata.com","Message":"Hello Radek"}`))
+	HttpMailerFunc(mailer)(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var slackConfig = &SlackConfig{}
+
+type SlackConfig struct {
+	WebhookURL string
+}
+
+func init() {
+	RegisterConfig("slack", slackConfig)
+	RegisterChannel("slack", func() (Mailer, error) {
+		return NewSlackChannel(slackConfig.WebhookURL), nil
+	})
+}
+
+// SlackChannel posts the subject and the
+// text of the message to the incoming webhook.
+type SlackChannel struct {
+	webhookURL string
+	client     *http.Client
+}
+
+func NewSlackChannel(webhookURL string) Mailer {
+	return &SlackChannel{
+		webhookURL: webhookURL,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (sc *SlackChannel) SendMail(mail *mailStruct) error {
+	out, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("*%s*\n%s", mail.Subject, mail.Message),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := sc.client.Post(sc.webhookURL, "application/json", bytes.NewReader(out))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slackchannel: Webhook returned %d", resp.StatusCode)
+	}
+	log.Infof("Message for %s posted to Slack", mail.Recipient)
+	return nil
+}
+
+func (sc *SlackChannel) Close() {}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadSMIMECert = fmt.Errorf("smime: Certificate is not PEM encoded RSA certificate")
+	ErrBadSMIMEKey  = fmt.Errorf("smime: Key is not RSA private key")
+
+	smimeConfig = &SMIMEConfig{}
+)
+
+// SMIMEConfig holds the PEM encoded certificate
+// and its key the mail of the SMTP and direct
+// mailers is signed by, empty disables it.
+type SMIMEConfig struct {
+	Cert string
+	Key  string
+}
+
+func init() {
+	RegisterConfig("smime", smimeConfig)
+}
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSA           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+)
+
+// PKCS #7 structures of RFC 2315
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7Attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// SMIMESigner wraps the composed message
+// into multipart/signed with the detached
+// PKCS #7 signature as in RFC 8551.
+type SMIMESigner struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+func NewSMIMESigner(cert, key string) (*SMIMESigner, error) {
+	block, _ := pem.Decode([]byte(cert))
+	if block == nil {
+		return nil, ErrBadSMIMECert
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, ErrBadSMIMECert
+	}
+	rsaKey, err := parseRSAKey(key)
+	if err != nil {
+		return nil, ErrBadSMIMEKey
+	}
+	return &SMIMESigner{parsed, rsaKey}, nil
+}
+
+// configuredSMIMESigner is nil without
+// the certificate.
+func configuredSMIMESigner(config *SMIMEConfig) (*SMIMESigner, error) {
+	if len(config.Cert) == 0 {
+		return nil, nil
+	}
+	return NewSMIMESigner(config.Cert, config.Key)
+}
+
+// Sign moves the content headers and the body
+// into the first part of multipart/signed, the
+// other headers stay. The single part body is
+// quoted-printable encoded, so no relay
+// alters the signed content, and the line
+// ends are made CRLF before the digest.
+func (s *SMIMESigner) Sign(message []byte, now time.Time) ([]byte, error) {
+	message = canonicalLines(message)
+	end := bytes.Index(message, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, fmt.Errorf("smime: Message has no body")
+	}
+	body := message[end+4:]
+
+	var header, entity bytes.Buffer
+	encoded := false
+	multipartBody := false
+	target := &header
+	for _, field := range strings.SplitAfter(string(message[:end+2]), "\r\n") {
+		// Continuation goes with its field
+		if strings.HasPrefix(field, " ") || strings.HasPrefix(field, "\t") {
+			target.WriteString(field)
+			continue
+		}
+		name := strings.ToLower(strings.SplitN(field, ":", 2)[0])
+		switch name {
+		case "content-type":
+			multipartBody = strings.HasPrefix(strings.ToLower(strings.TrimSpace(field[len(name)+1:])), "multipart/")
+			target = &entity
+		case "content-transfer-encoding":
+			encoded = true
+			target = &entity
+		default:
+			target = &header
+		}
+		target.WriteString(field)
+	}
+	if !encoded && !multipartBody {
+		entity.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+		var qp bytes.Buffer
+		w := quotedprintable.NewWriter(&qp)
+		w.Write(body)
+		w.Close()
+		body = qp.Bytes()
+	}
+	entity.WriteString("\r\n")
+	entity.Write(body)
+
+	signature, err := s.signature(entity.Bytes(), now)
+	if err != nil {
+		return nil, err
+	}
+
+	var signed bytes.Buffer
+	parts := multipart.NewWriter(&signed)
+	// The entity goes as is, the part
+	// headers are its own headers
+	fmt.Fprintf(&signed, "--%s\r\n", parts.Boundary())
+	signed.Write(entity.Bytes())
+	signed.WriteString("\r\n")
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Content-Type", "application/pkcs7-signature; name=smime.p7s")
+	partHeader.Set("Content-Transfer-Encoding", "base64")
+	partHeader.Set("Content-Disposition", "attachment; filename=smime.p7s")
+	w, _ := parts.CreatePart(partHeader)
+	encodedSignature := base64.StdEncoding.EncodeToString(signature)
+	for len(encodedSignature) > base64LineLength {
+		w.Write([]byte(encodedSignature[:base64LineLength] + "\r\n"))
+		encodedSignature = encodedSignature[base64LineLength:]
+	}
+	w.Write([]byte(encodedSignature + "\r\n"))
+	parts.Close()
+
+	fmt.Fprintf(&header, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=%s\r\n", parts.Boundary())
+	header.WriteString("\r\n")
+	header.Write(signed.Bytes())
+	return header.Bytes(), nil
+}
+
+// signature returns the DER encoded detached
+// SignedData of the content with the signed
+// content type, digest and signing time.
+func (s *SMIMESigner) signature(content []byte, now time.Time) ([]byte, error) {
+	digest := sha256.Sum256(content)
+	values := []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidData},
+		{oidSigningTime, now.UTC()},
+		{oidMessageDigest, digest[:]},
+	}
+	signed := make([]interface{}, 0, len(values))
+	for _, attribute := range values {
+		value, err := derSet(attribute.value)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, pkcs7Attribute{attribute.oid, value})
+	}
+	attributes, err := derSet(signed...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Signed are the attributes
+	// with the SET OF tag
+	attributesDigest := sha256.Sum256(attributes.FullBytes)
+	encryptedDigest, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, attributesDigest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	signedData, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: s.cert.Raw},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version:                   1,
+			IssuerAndSerialNumber:     pkcs7IssuerAndSerial{asn1.RawValue{FullBytes: s.cert.RawIssuer}, s.cert.SerialNumber},
+			DigestAlgorithm:           sha256Algorithm,
+			AuthenticatedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attributes.Bytes},
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue},
+			EncryptedDigest:           encryptedDigest,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+}
+
+// derSet encodes the values as DER SET OF,
+// which orders them by their encoding.
+func derSet(values ...interface{}) (asn1.RawValue, error) {
+	encoded := make([][]byte, 0, len(values))
+	for _, value := range values {
+		der, err := asn1.Marshal(value)
+		if err != nil {
+			return asn1.RawValue{}, err
+		}
+		encoded = append(encoded, der)
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+	set := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(encoded, nil)}
+	full, err := asn1.Marshal(set)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	set.FullBytes = full
+	return set, nil
+}
+
+// signMessage applies the signers set, the DKIM
+// signature goes last over the S/MIME one.
+func signMessage(message []byte, now time.Time, smime *SMIMESigner, dkim *DKIMSigner) ([]byte, error) {
+	var err error
+	if smime != nil {
+		if message, err = smime.Sign(message, now); err != nil {
+			return nil, err
+		}
+	}
+	if dkim != nil {
+		return dkim.Sign(message, now)
+	}
+	return message, nil
+}
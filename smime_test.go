@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func testSMIMESigner(t *testing.T) (*SMIMESigner, string) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "info@suricata.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		EmailAddresses: []string{"info@suricata.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	signer, err := NewSMIMESigner(string(cert), string(pemKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, string(cert)
+}
+
+func TestSMIMESigner(t *testing.T) {
+	signer, _ := testSMIMESigner(t)
+	signed, err := signer.Sign(composeMessage(&mailStruct{
+		Sender:    "info@suricata.com",
+		Recipient: "radek@suricata.com",
+		Subject:   "Hello",
+		Message:   "Příliš\nžluťoučký kůň",
+	}, time.Now()), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Subject") != "Hello" {
+		t.Error("Headers should stay on the message")
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/signed" || params["protocol"] != "application/pkcs7-signature" {
+		t.Fatalf("Expected multipart/signed, got %s", mediaType)
+	}
+
+	// Signed entity is the raw first part
+	body, _ := ioutil.ReadAll(msg.Body)
+	delimiter := []byte("--" + params["boundary"])
+	start := bytes.Index(body, delimiter) + len(delimiter) + 2
+	entity := body[start : start+bytes.Index(body[start:], append([]byte("\r\n"), delimiter...))]
+	if !bytes.HasPrefix(entity, []byte("Content-Type: text/plain")) {
+		t.Errorf("Expected the content headers in the entity: %s", entity)
+	}
+	if bytes.Contains(bytes.Replace(entity, []byte("\r\n"), nil, -1), []byte("\n")) {
+		t.Errorf("Signed entity should have the CRLF line ends: %q", entity)
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	reader.NextPart()
+	part, _ := reader.NextPart()
+	encoded, _ := ioutil.ReadAll(part)
+	signature, _ := base64.StdEncoding.DecodeString(string(bytes.Replace(encoded, []byte("\r\n"), nil, -1)))
+
+	// Unwrap the signer info
+	var contentInfo pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(signature, &contentInfo); err != nil {
+		t.Fatal(err)
+	}
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		t.Fatal(err)
+	}
+	info := signedData.SignerInfos[0]
+	attributes := info.AuthenticatedAttributes.Bytes
+	setHeader, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attributes})
+	digest := sha256.Sum256(setHeader)
+	if err := rsa.VerifyPKCS1v15(&signer.key.PublicKey, crypto.SHA256, digest[:], info.EncryptedDigest); err != nil {
+		t.Errorf("Signature does not verify: %s", err)
+	}
+	entityDigest := sha256.Sum256(entity)
+	if !bytes.Contains(attributes, entityDigest[:]) {
+		t.Error("Signed attributes miss the digest of the entity")
+	}
+}
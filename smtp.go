@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var smtpConfig = &SmtpConfig{}
+
+type SmtpConfig struct {
+	Host     string `default:"localhost"`
+	Port     string `default:"25"`
+	Username string
+	Password string
+	// Web UI of the server capturing
+	// the mail in the mailhog profile
+	CaptureURL string
+	// DKIM signing is enabled by the PEM
+	// encoded RSA key, the domain defaults
+	// to the domain of the sender
+	DKIMKey      string
+	DKIMSelector string `default:"mail"`
+	DKIMDomain   string
+	// Relays e.g. backup.example.com:25 tried
+	// in order when the previous one is down
+	// or rejects the mail temporarily
+	BackupHosts []string
+	// Retries of the temporarily rejected
+	// mail e.g. by greylisting, empty fails
+	RetrySchedule []time.Duration `default:"1m,5m,15m,1h"`
+	// Pool of the relay connections, each of
+	// them is replaced after MaxMessages
+	Timeout     time.Duration `default:"1m"`
+	MaxIdle     int           `default:"2"`
+	IdleTimeout time.Duration `default:"30s"`
+	MaxMessages int           `default:"100"`
+}
+
+func init() {
+	RegisterConfig("smtp", smtpConfig)
+	RegisterMailer("smtp", func() (Mailer, error) {
+		mailer := NewSmtpMailer(smtpConfig.Host,
+			smtpConfig.Port,
+			smtpConfig.Username,
+			smtpConfig.Password,
+			appConfig.Sender)
+		mailer.returnPath = appConfig.ReturnPath
+		mailer.pool.timeout = smtpConfig.Timeout
+		mailer.pool.maxIdle = smtpConfig.MaxIdle
+		mailer.pool.idleTimeout = smtpConfig.IdleTimeout
+		mailer.pool.maxMessages = smtpConfig.MaxMessages
+		for _, backup := range smtpConfig.BackupHosts {
+			if err := mailer.AddRelay(backup, smtpConfig.Username, smtpConfig.Password); err != nil {
+				return nil, err
+			}
+		}
+		signer, err := configuredDKIMSigner(smtpConfig, appConfig.Sender)
+		if err != nil {
+			return nil, err
+		}
+		mailer.signer = signer
+		if mailer.smime, err = configuredSMIMESigner(smimeConfig); err != nil {
+			return nil, err
+		}
+		return NewGreylistMailer(mailer, smtpConfig.RetrySchedule), nil
+	})
+}
+
+// SmtpMailer delivers the messages
+// to the configured SMTP relays over
+// the pooled connections, S/MIME and
+// DKIM signed if the signers are set.
+// The bounces go to the returnPath if set.
+type SmtpMailer struct {
+	relays     []smtpRelay
+	pool       *smtpPool
+	sender     string
+	returnPath string
+	signer     *DKIMSigner
+	smime      *SMIMESigner
+}
+
+type smtpRelay struct {
+	addr string
+	auth smtp.Auth
+}
+
+func newSmtpRelay(host, port, username, password string) smtpRelay {
+	var auth smtp.Auth
+	if len(username) > 0 {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return smtpRelay{net.JoinHostPort(host, port), auth}
+}
+
+func NewSmtpMailer(host, port, username, password, sender string) *SmtpMailer {
+	sm := &SmtpMailer{
+		relays: []smtpRelay{newSmtpRelay(host, port, username, password)},
+		sender: sender,
+	}
+	sm.pool = newSmtpPool(sm.dial, time.Minute, 2, 30*time.Second)
+	return sm
+}
+
+func (sm *SmtpMailer) dial(addr string) (net.Conn, *smtp.Client, error) {
+	for _, relay := range sm.relays {
+		if relay.addr == addr {
+			return dialSmtp(addr, "", relay.auth, sm.pool.timeout)
+		}
+	}
+	return nil, nil, fmt.Errorf("smtpmailer: Unknown relay %s", addr)
+}
+
+// AddRelay adds the backup relay
+// given as host:port.
+func (sm *SmtpMailer) AddRelay(addr, username, password string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	sm.relays = append(sm.relays, newSmtpRelay(host, port, username, password))
+	return nil
+}
+
+func (sm *SmtpMailer) SendMail(mail *mailStruct) error {
+	m := *mail
+	m.Sender = senderOf(mail, sm.sender)
+
+	recipient, err := addressOf(m.Recipient)
+	if err != nil {
+		return ErrBadRecipient
+	}
+	from := m.Sender
+	if len(sm.returnPath) > 0 {
+		from = sm.returnPath
+	}
+	if from, err = addressOf(from); err != nil {
+		return ErrBadSender
+	}
+
+	now := time.Now()
+	message, err := signMessage(composeMessage(&m, now), now, sm.smime, sm.signer)
+	if err != nil {
+		return err
+	}
+
+	for _, relay := range sm.relays {
+		err = sm.pool.send(relay.addr, from, []string{recipient}, message)
+		if err == nil {
+			log.Infof("Mail to %s relayed through %s", m.Recipient, relay.addr)
+			return nil
+		}
+		if !isTemporary(err) && !isUnreachable(err) && !isTLSFailure(err) {
+			return err
+		}
+		log.Warnf("Relay %s failed for %s: %s", relay.addr, m.Recipient, err)
+	}
+	return err
+}
+
+// Check verifies the relay accepts connections.
+func (sm *SmtpMailer) Check() error {
+	c, err := smtp.Dial(sm.relays[0].addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Noop(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (sm *SmtpMailer) Close() {
+	sm.pool.close()
+}
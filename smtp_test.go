@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSmtpMailerPool(t *testing.T) {
+	server := newFakeSmtpServer(t)
+	defer server.listener.Close()
+
+	mailer := NewSmtpMailer("127.0.0.1", server.port(), "", "", "Suricata <info@suricata.com>")
+	defer mailer.Close()
+	mailer.pool.maxMessages = 2
+
+	for i := 0; i < 3; i++ {
+		if err := mailer.SendMail(&mailStruct{Recipient: "Radek <radek@suricata.com>", Message: "Hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.recipients) != 3 || server.recipients[0] != "<radek@suricata.com>" {
+		t.Errorf("Expected 3 mails relayed to the bare address, got %v", server.recipients)
+	}
+	if server.senders[0] != "<info@suricata.com>" {
+		t.Errorf("Expected the bare sender, got %v", server.senders)
+	}
+	if server.connections != 2 {
+		t.Errorf("Connection should be replaced after 2 mails, got %d connections", server.connections)
+	}
+
+	if mailer.SendMail(&mailStruct{Recipient: "radek@suricata.com>\r\nDATA"}) != ErrBadRecipient {
+		t.Error("Malformed recipient should be rejected")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ActiveKey is the etcd lease
+// of the active instance.
+const ActiveKey = "/mail/active"
+
+// Standby runs the instance in active-passive
+// mode. All instances compete for the lease
+// in etcd and only the holder dispatches the
+// mail. The standby takes over once the lease
+// of the active instance expires.
+type Standby struct {
+	endpoint string
+	name     string
+	active   int32
+	// OnChange is called when the
+	// instance gains or loses the lease
+	OnChange func(active bool)
+}
+
+func NewStandby(endpoint, name string) *Standby {
+	return &Standby{
+		endpoint: endpoint,
+		name:     name,
+	}
+}
+
+// Active reports whether the
+// instance holds the lease.
+func (s *Standby) Active() bool {
+	return atomic.LoadInt32(&s.active) == 1
+}
+
+// Watch acquires or refreshes the lease in given
+// interval until stop is closed. The lease
+// expires after three missed refreshes.
+func (s *Standby) Watch(interval time.Duration, stop <-chan struct{}) {
+	for {
+		s.setActive(s.hold(3 * interval))
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Standby) hold(ttl time.Duration) bool {
+	conditions := url.Values{"prevExist": {"false"}}
+	if s.Active() {
+		conditions = url.Values{"prevValue": {s.name}}
+	}
+	ok, err := swapEtcdValue(s.endpoint, ActiveKey, s.name, ttl, conditions)
+	if err != nil {
+		// Without etcd nobody can tell who is
+		// active, keep the current role
+		log.Errorf("Cannot hold active lease: %s", err)
+		return s.Active()
+	}
+	return ok
+}
+
+func (s *Standby) setActive(active bool) {
+	value := int32(0)
+	if active {
+		value = 1
+	}
+	if atomic.SwapInt32(&s.active, value) == value {
+		return
+	}
+	if active {
+		log.Infof("Instance %s is active", s.name)
+	} else {
+		log.Warnf("Instance %s lost the lease, going standby", s.name)
+	}
+	if s.OnChange != nil {
+		s.OnChange(active)
+	}
+}
+
+// Func rejects the mail with 503
+// while the instance is standby.
+func (s *Standby) Func(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !s.Active() {
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "Instance is standby", http.StatusServiceUnavailable)
+			return
+		}
+		h(rw, req)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeLease serves the etcd v2 conditional
+// PUT of the single lease key.
+func fakeLease() *httptest.Server {
+	var mutex sync.Mutex
+	holder := ""
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		req.ParseForm()
+		switch {
+		case req.Form.Get("prevExist") == "false" && len(holder) > 0:
+			rw.WriteHeader(http.StatusPreconditionFailed)
+		case len(req.Form.Get("prevValue")) > 0 && req.Form.Get("prevValue") != holder:
+			rw.WriteHeader(http.StatusPreconditionFailed)
+		default:
+			holder = req.Form.Get("value")
+			rw.WriteHeader(http.StatusCreated)
+		}
+	}))
+}
+
+func TestStandby(t *testing.T) {
+	etcd := fakeLease()
+	defer etcd.Close()
+
+	changes := []bool{}
+	active := NewStandby(etcd.URL, "mail1")
+	active.OnChange = func(a bool) { changes = append(changes, a) }
+	standby := NewStandby(etcd.URL, "mail2")
+
+	active.setActive(active.hold(0))
+	standby.setActive(standby.hold(0))
+	if !active.Active() || standby.Active() {
+		t.Fatal("First instance should hold the lease")
+	}
+
+	// Refresh keeps the lease
+	active.setActive(active.hold(0))
+	if !active.Active() || len(changes) != 1 {
+		t.Errorf("Active instance should keep the lease, changes %v", changes)
+	}
+
+	rec := httptest.NewRecorder()
+	standby.Func(func(rw http.ResponseWriter, req *http.Request) {})(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Standby should reject the mail, got %d", rec.Code)
+	}
+}
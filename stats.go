@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StatsPath reports the usage of the
+// templates and their caches since
+// the start, and the reputation of
+// the campaigns.
+const StatsPath = "/v1/stats"
+
+// TemplateUsage of one template, the Sent
+// per Caller and the render durations
+// in milliseconds.
+type TemplateUsage struct {
+	Template    string
+	Sent        uint64
+	Failures    uint64
+	Callers     map[string]uint64
+	RenderAvgMs float64
+	RenderMaxMs float64
+
+	renders uint64
+	render  time.Duration
+	max     time.Duration
+}
+
+// TemplateStats counts the mail rendered
+// per template, the inline templates
+// are counted as InlineTemplate.
+type TemplateStats struct {
+	mutex sync.Mutex
+	usage map[string]*TemplateUsage
+}
+
+func NewTemplateStats() *TemplateStats {
+	return &TemplateStats{usage: make(map[string]*TemplateUsage)}
+}
+
+// Record the mail of the caller rendered
+// in the duration, the failed render
+// is not counted as sent.
+func (s *TemplateStats) Record(template, caller string, render time.Duration, failed bool) {
+	if s == nil {
+		return
+	}
+	if len(caller) == 0 {
+		caller = DefaultCaller
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	usage, ok := s.usage[template]
+	if !ok {
+		usage = &TemplateUsage{Template: template, Callers: make(map[string]uint64)}
+		s.usage[template] = usage
+	}
+	usage.renders++
+	usage.render += render
+	if render > usage.max {
+		usage.max = render
+	}
+	if failed {
+		usage.Failures++
+		return
+	}
+	usage.Sent++
+	usage.Callers[caller]++
+}
+
+// Usage lists the templates by name.
+func (s *TemplateStats) Usage() []TemplateUsage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]TemplateUsage, 0, len(s.usage))
+	for _, usage := range s.usage {
+		u := *usage
+		u.Callers = make(map[string]uint64, len(usage.Callers))
+		for caller, sent := range usage.Callers {
+			u.Callers[caller] = sent
+		}
+		u.RenderAvgMs = milliseconds(usage.render) / float64(usage.renders)
+		u.RenderMaxMs = milliseconds(usage.max)
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Template < list[j].Template })
+	return list
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type statsStruct struct {
+	Templates []TemplateUsage
+	// Lookups of the parsed templates
+	// and of the rendered bodies
+	TemplateCache CacheStats
+	RenderCache   CacheStats
+	Campaigns     []CampaignReputation
+}
+
+// StatsFunc answers the usage of the
+// templates to the admins of ScopeStats.
+func StatsFunc(templates *TemplateStats, store *DirTemplateStore, renders *RenderCache, reputation *ReputationGuard, admins []*TemplateAccount) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if authorizeAdmin(rw, req, admins, ScopeStats) == nil {
+			return
+		}
+		if req.Method != "GET" {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(statsStruct{templates.Usage(), store.Stats(), renders.Stats(), reputation.Campaigns()})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemplateStats(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "welcome"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "welcome", TemplateSubjectFile), []byte("Welcome {{.Name}}"), 0644)
+
+	mailer := NewTemplateMailer(&FakeMailer{}, NewDirTemplateStore(dir))
+	mailer.stats = NewTemplateStats()
+	name := map[string]interface{}{"Name": "Radek"}
+	mailer.SendMail(&mailStruct{Template: "welcome", Caller: "billing", Data: name})
+	mailer.SendMail(&mailStruct{Template: "welcome", Caller: "billing", Data: name})
+	mailer.SendMail(&mailStruct{Template: "welcome", Data: name})
+	mailer.SendMail(&mailStruct{Template: "welcome", Caller: "chat", Data: map[string]interface{}{}})
+	mailer.SendMail(&mailStruct{Subject: "{{.Name", Data: name})
+
+	admins, _ := ParseTemplateAccounts([]string{"ops:secret:stats", "support:other:cancel"})
+	handler := StatsFunc(mailer.stats, mailer.store.(*DirTemplateStore), nil, nil, admins)
+	req := httptest.NewRequest("GET", StatsPath, nil)
+	req.Header.Set("Authorization", "Bearer other")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Admin without the scope should be refused, got %d", rec.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	stats := statsStruct{}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Templates) != 2 {
+		t.Fatalf("Expected the inline and welcome usage, got %+v", stats.Templates)
+	}
+	inline, welcome := stats.Templates[0], stats.Templates[1]
+	if inline.Template != InlineTemplate || inline.Failures != 1 || inline.Sent != 0 {
+		t.Errorf("Broken inline template should count as failed, got %+v", inline)
+	}
+	if welcome.Sent != 3 || welcome.Failures != 1 || welcome.Callers["billing"] != 2 || welcome.Callers[DefaultCaller] != 1 || welcome.Callers["chat"] != 0 {
+		t.Errorf("Unexpected usage of the template %+v", welcome)
+	}
+	if stats.TemplateCache.Hits != 3 || stats.TemplateCache.Misses != 1 || stats.TemplateCache.Entries != 1 {
+		t.Errorf("Parsed template should be looked up in the cache, got %+v", stats.TemplateCache)
+	}
+	if welcome.RenderAvgMs <= 0 || welcome.RenderMaxMs < welcome.RenderAvgMs {
+		t.Errorf("Render durations should be measured, got %+v", welcome)
+	}
+}
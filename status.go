@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type statusStruct struct {
+	Name       string
+	Version    string
+	Uptime     string
+	Profile    string `json:",omitempty"`
+	Mailers    []string
+	Providers  []ProviderStatus `json:",omitempty"`
+	CaptureURL string           `json:",omitempty"`
+}
+
+// StatusFunc describes the running instance,
+// in the capture profiles it links the inbox
+// with the captured messages. The chain
+// is nil in the sandbox mode.
+func StatusFunc(config *AppConfig, smtp *SmtpConfig, chain *CompositeMailer) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		status := statusStruct{
+			Name:       config.Name,
+			Version:    Version,
+			Uptime:     time.Since(startTime).String(),
+			Profile:    config.Profile,
+			Mailers:    config.Mailers,
+			CaptureURL: smtp.CaptureURL,
+		}
+		if chain != nil {
+			status.Providers = chain.Status()
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(status)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// Files of the template directory,
+// each of them is optional.
+const (
+	TemplateSubjectFile  = "subject.txt"
+	TemplateMessageFile  = "message.txt"
+	TemplateHtmlFile     = "message.html"
+	TemplateMarkdownFile = "message.md"
+)
+
+var (
+	ErrUnknownTemplate = fmt.Errorf("templatemailer: Template not found")
+	ErrForeignTemplate = fmt.Errorf("templatemailer: Template is in the namespace of another caller")
+	ErrNoCallers       = fmt.Errorf("templatemailer: Namespaces need the callers with their tokens")
+
+	templateConfig = &TemplateConfig{}
+)
+
+// TemplateConfig points to the directory with
+// a directory per template e.g. templates/welcome,
+// or per namespace e.g. templates/marketing/welcome.
+type TemplateConfig struct {
+	Dir string `default:"./templates"`
+	// Accounts managing the templates e.g.
+	// marketing:TOKEN:marketing/*|shared/*,
+	// none leaves the management open
+	Accounts []string
+	// Namespaces per Caller, the mail uses
+	// the templates of its Caller and of
+	// the Shared namespace only. The Caller
+	// is known by its token, so the callers
+	// must be configured
+	Namespaces bool
+	Shared     string `default:"shared"`
+	// DarkMode declares the Html supports the
+	// dark color scheme, so the clients do not
+	// invert it on their own
+	DarkMode bool
+	// Rates of the classes the template
+	// policies refer to e.g. digest:100/m
+	RateClasses map[string]string
+	// RenderCacheSize bodies of the campaign
+	// mail are kept rendered, zero renders
+	// each mail
+	RenderCacheSize int `default:"1000"`
+}
+
+func init() {
+	RegisterConfig("template", templateConfig)
+}
+
+// RenderError is the failure of the
+// template with the data of the mail.
+type RenderError struct {
+	Template string
+	Err      error
+}
+
+func (e *RenderError) Error() string {
+	return fmt.Sprintf("templatemailer: Cannot render %s: %s", e.Template, e.Err)
+}
+
+// Template renders the subject and the
+// bodies of the mail from the Data.
+type Template struct {
+	subject  *texttemplate.Template
+	message  *texttemplate.Template
+	html     *htmltemplate.Template
+	markdown *texttemplate.Template
+	policy   *TemplatePolicy
+	// version of the files, empty
+	// for the inline template
+	version string
+}
+
+// Render fills the mail from the template,
+// missing Data key is an error.
+func (t *Template) Render(mail *mailStruct) error {
+	var buf bytes.Buffer
+	if t.subject != nil {
+		if err := t.subject.Execute(&buf, mail.Data); err != nil {
+			return err
+		}
+		mail.Subject = strings.TrimSpace(buf.String())
+	}
+	if t.message != nil {
+		buf.Reset()
+		if err := t.message.Execute(&buf, mail.Data); err != nil {
+			return err
+		}
+		mail.Message = buf.String()
+	}
+	if t.html != nil {
+		buf.Reset()
+		if err := t.html.Execute(&buf, mail.Data); err != nil {
+			return err
+		}
+		mail.Html = buf.String()
+	}
+	if t.markdown != nil {
+		buf.Reset()
+		if err := t.markdown.Execute(&buf, mail.Data); err != nil {
+			return err
+		}
+		mail.Markdown = buf.String()
+	}
+	return nil
+}
+
+type TemplateStore interface {
+	Template(name string) (*Template, error)
+}
+
+// DirTemplateStore loads the templates from
+// the directory and reparses them once
+// their files change.
+type DirTemplateStore struct {
+	dir string
+
+	mutex   sync.Mutex
+	loaded  map[string]*loadedTemplate
+	counter cacheCounter
+}
+
+type loadedTemplate struct {
+	template *Template
+	modTime  time.Time
+}
+
+func NewDirTemplateStore(dir string) *DirTemplateStore {
+	return &DirTemplateStore{
+		dir:    dir,
+		loaded: make(map[string]*loadedTemplate),
+	}
+}
+
+func (s *DirTemplateStore) Template(name string) (*Template, error) {
+	// Name must not escape the directory
+	if !validTemplateName(name) {
+		return nil, ErrUnknownTemplate
+	}
+	dir := filepath.Join(s.dir, name)
+	modTime, err := latestModTime(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	loaded, ok := s.loaded[name]
+	hit := ok && !modTime.After(loaded.modTime)
+	s.counter.count(hit)
+	if hit {
+		return loaded.template, nil
+	}
+	t, err := parseTemplate(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	t.version = strconv.FormatInt(modTime.UnixNano(), 10)
+	s.loaded[name] = &loadedTemplate{t, modTime}
+	return t, nil
+}
+
+// Stats of the lookups of the parsed templates.
+func (s *DirTemplateStore) Stats() CacheStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.counter.stats(len(s.loaded))
+}
+
+func latestModTime(dir string) (time.Time, error) {
+	latest := time.Time{}
+	found := false
+	for _, file := range []string{TemplateSubjectFile, TemplateMessageFile, TemplateHtmlFile, TemplateMarkdownFile, TemplatePolicyFile} {
+		info, err := os.Stat(filepath.Join(dir, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return latest, err
+		}
+		// Policy alone is not the template
+		found = found || file != TemplatePolicyFile
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	if !found {
+		return latest, ErrUnknownTemplate
+	}
+	return latest, nil
+}
+
+func parseTemplate(dir, name string) (*Template, error) {
+	t := &Template{}
+	read := func(file string) (string, bool, error) {
+		content, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return string(content), err == nil, err
+	}
+
+	if content, ok, err := read(TemplateSubjectFile); err != nil {
+		return nil, err
+	} else if ok {
+		if t.subject, err = texttemplate.New(name).Option("missingkey=error").Parse(content); err != nil {
+			return nil, err
+		}
+	}
+	if content, ok, err := read(TemplateMessageFile); err != nil {
+		return nil, err
+	} else if ok {
+		if t.message, err = texttemplate.New(name).Option("missingkey=error").Parse(content); err != nil {
+			return nil, err
+		}
+	}
+	if content, ok, err := read(TemplateHtmlFile); err != nil {
+		return nil, err
+	} else if ok {
+		if t.html, err = htmltemplate.New(name).Option("missingkey=error").Parse(content); err != nil {
+			return nil, err
+		}
+	}
+	if content, ok, err := read(TemplateMarkdownFile); err != nil {
+		return nil, err
+	} else if ok {
+		if t.markdown, err = texttemplate.New(name).Option("missingkey=error").Parse(content); err != nil {
+			return nil, err
+		}
+	}
+	if content, ok, err := read(TemplatePolicyFile); err != nil {
+		return nil, err
+	} else if ok {
+		if t.policy, err = parseTemplatePolicy([]byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// InlineTemplate is the name reported
+// for the templates given by the mail.
+const InlineTemplate = "inline"
+
+// TemplateMailer renders the mail with the
+// Template set from the named template and
+// the Data, before it is queued. The mail
+// with only the Data uses its own Subject,
+// Message and Html as the templates. The
+// policy of the named template applies.
+type TemplateMailer struct {
+	mailer Mailer
+	store  TemplateStore
+	// shared namespace enables the
+	// namespaces per Caller if set
+	shared string
+	// callers granted the scopes and the rate
+	// classes the template policies refer to
+	callers     []*CallerAccount
+	rateClasses map[string]*TokenBucket
+	// stats of the usage, nil counts none
+	stats *TemplateStats
+	// renders of the campaign mail,
+	// nil renders each of them
+	renders *RenderCache
+}
+
+func NewTemplateMailer(mailer Mailer, store TemplateStore) *TemplateMailer {
+	return &TemplateMailer{
+		mailer: mailer,
+		store:  store,
+	}
+}
+
+// resolve finds the named template. With the
+// namespaces the name without one is looked up
+// in the namespace of the caller first, then in
+// the shared one. The name returned is the full
+// name of the template found.
+func (tm *TemplateMailer) resolve(name, caller string) (*Template, string, error) {
+	if len(tm.shared) == 0 {
+		t, err := tm.store.Template(name)
+		return t, name, err
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		if namespace := name[:i]; namespace != caller && namespace != tm.shared {
+			return nil, name, ErrForeignTemplate
+		}
+		t, err := tm.store.Template(name)
+		return t, name, err
+	}
+	for _, namespace := range []string{caller, tm.shared} {
+		if len(namespace) == 0 {
+			continue
+		}
+		t, err := tm.store.Template(namespace + "/" + name)
+		if err != ErrUnknownTemplate {
+			return t, namespace + "/" + name, err
+		}
+	}
+	return nil, name, ErrUnknownTemplate
+}
+
+func (tm *TemplateMailer) SendMail(mail *mailStruct) error {
+	if len(mail.Template) == 0 && len(mail.Data) == 0 {
+		return tm.mailer.SendMail(mail)
+	}
+
+	name := mail.Template
+	var t *Template
+	var err error
+	if len(name) > 0 {
+		t, name, err = tm.resolve(name, mail.Caller)
+		if err != nil {
+			return err
+		}
+	} else {
+		name = InlineTemplate
+		if t, err = inlineTemplate(mail); err != nil {
+			tm.stats.Record(name, mail.Caller, 0, true)
+			return &RenderError{name, err}
+		}
+	}
+
+	m := *mail
+	if len(mail.Template) > 0 {
+		m.Template = name
+	}
+	if err := tm.applyPolicy(&m, t.policy, time.Now()); err != nil {
+		return err
+	}
+	start := time.Now()
+	if len(m.Campaign) > 0 {
+		// Campaign mail often has the same Data
+		err = tm.renders.Render(t, &m)
+	} else {
+		err = t.Render(&m)
+	}
+	tm.stats.Record(name, mail.Caller, time.Since(start), err != nil)
+	if err != nil {
+		return &RenderError{name, err}
+	}
+	return tm.mailer.SendMail(&m)
+}
+
+// inlineTemplate parses the Subject,
+// Message, Html and Markdown of the mail.
+func inlineTemplate(mail *mailStruct) (*Template, error) {
+	t := &Template{}
+	var err error
+	if t.subject, err = texttemplate.New(InlineTemplate).Option("missingkey=error").Parse(mail.Subject); err != nil {
+		return nil, err
+	}
+	if t.message, err = texttemplate.New(InlineTemplate).Option("missingkey=error").Parse(mail.Message); err != nil {
+		return nil, err
+	}
+	if len(mail.Html) > 0 {
+		if t.html, err = htmltemplate.New(InlineTemplate).Option("missingkey=error").Parse(mail.Html); err != nil {
+			return nil, err
+		}
+	}
+	if len(mail.Markdown) > 0 {
+		if t.markdown, err = texttemplate.New(InlineTemplate).Option("missingkey=error").Parse(mail.Markdown); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (tm *TemplateMailer) Close() {
+	tm.mailer.Close()
+}
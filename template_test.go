@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTemplateMailer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "welcome"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "welcome", TemplateSubjectFile), []byte("Welcome {{.Name}}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "welcome", TemplateMessageFile), []byte("Hello {{.Name}}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "welcome", TemplateHtmlFile), []byte("<p>Hello {{.Name}}</p>"), 0644)
+
+	fake := &FakeMailer{}
+	mailer := NewTemplateMailer(fake, NewDirTemplateStore(dir))
+
+	err := mailer.SendMail(&mailStruct{
+		Template: "welcome",
+		Data:     map[string]interface{}{"Name": "<Radek>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := fake.sent[0]
+	if sent.Subject != "Welcome <Radek>" || sent.Message != "Hello <Radek>" || sent.Html != "<p>Hello &lt;Radek&gt;</p>" {
+		t.Errorf("Unexpected rendered mail %+v", sent)
+	}
+
+	if mailer.SendMail(&mailStruct{Template: "../welcome"}) != ErrUnknownTemplate {
+		t.Error("Template outside of the directory should not be found")
+	}
+	if mailer.SendMail(&mailStruct{Template: "reset"}) != ErrUnknownTemplate {
+		t.Error("Missing template should not be found")
+	}
+	if _, ok := mailer.SendMail(&mailStruct{Template: "welcome"}).(*RenderError); !ok {
+		t.Error("Missing data should fail the render")
+	}
+}
+
+func TestTemplateMailerInline(t *testing.T) {
+	fake := &FakeMailer{}
+	mailer := NewTemplateMailer(fake, NewDirTemplateStore(""))
+
+	err := mailer.SendMail(&mailStruct{
+		Subject: "Hello {{.Name}}",
+		Message: "Your code is {{.Code}}",
+		Html:    "<b>{{.Code}}</b>",
+		Data:    map[string]interface{}{"Name": "Radek", "Code": "<42>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := fake.sent[0]
+	if sent.Subject != "Hello Radek" || sent.Message != "Your code is <42>" || sent.Html != "<b>&lt;42&gt;</b>" {
+		t.Errorf("Unexpected rendered mail %+v", sent)
+	}
+
+	// Mail without Data is sent as is
+	mailer.SendMail(&mailStruct{Subject: "Hello {{.Name}}"})
+	if fake.sent[1].Subject != "Hello {{.Name}}" {
+		t.Error("Mail without Data should not be rendered")
+	}
+}
+
+func TestTemplateMailerNamespaces(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"billing/invoice", "marketing/invoice", "shared/welcome"} {
+		os.MkdirAll(filepath.Join(dir, name), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name, TemplateSubjectFile), []byte(name), 0644)
+	}
+
+	fake := &FakeMailer{}
+	mailer := NewTemplateMailer(fake, NewDirTemplateStore(dir))
+	mailer.shared = "shared"
+
+	mailer.SendMail(&mailStruct{Template: "invoice", Caller: "billing"})
+	mailer.SendMail(&mailStruct{Template: "welcome", Caller: "billing"})
+	mailer.SendMail(&mailStruct{Template: "shared/welcome", Caller: "marketing"})
+	expected := []string{"billing/invoice", "shared/welcome", "shared/welcome"}
+	for i, sent := range fake.sent {
+		if sent.Subject != expected[i] || sent.Template != expected[i] {
+			t.Errorf("Expected %s template, got %+v", expected[i], sent)
+		}
+	}
+	if len(fake.sent) != len(expected) {
+		t.Errorf("Expected %d mails, got %d", len(expected), len(fake.sent))
+	}
+
+	if err := mailer.SendMail(&mailStruct{Template: "marketing/invoice", Caller: "billing"}); err != ErrForeignTemplate {
+		t.Errorf("Template of other caller should be refused, got %v", err)
+	}
+	if err := mailer.SendMail(&mailStruct{Template: "invoice", Caller: "support"}); err != ErrUnknownTemplate {
+		t.Errorf("Template of other caller should not be found, got %v", err)
+	}
+
+	callers, _ := ParseCallers([]string{"billing:secret"})
+	authenticated := NewCallerMailer(mailer, callers)
+	authenticated.SendMail(&mailStruct{Template: "invoice", Caller: "marketing", Token: "secret"})
+	if last := fake.sent[len(fake.sent)-1]; last.Template != "billing/invoice" {
+		t.Errorf("Namespace should be of the authenticated caller, got %s", last.Template)
+	}
+	if err := authenticated.SendMail(&mailStruct{Template: "marketing/invoice", Caller: "marketing"}); err != ErrUnknownCaller {
+		t.Errorf("Named caller without its token should be refused, got %v", err)
+	}
+}
+
+func TestTemplateMailerPolicy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	write := func(name, file, content string) {
+		os.MkdirAll(filepath.Join(dir, name), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name, file), []byte(content), 0644)
+	}
+	write("newsletter", TemplateSubjectFile, "News")
+	write("newsletter", TemplatePolicyFile, `{"Category": "marketing", "Priority": "bulk", "RateClass": "digest", "Tracking": "on"}`)
+	write("reset", TemplateSubjectFile, "Reset")
+	write("reset", TemplatePolicyFile, `{"Scope": "security"}`)
+	write("broken", TemplateSubjectFile, "Broken")
+	write("broken", TemplatePolicyFile, `{"Priority": "urgent"}`)
+
+	callers, _ := ParseCallers([]string{"auth:secret:security|billing", "chat:other"})
+	fake := &FakeMailer{}
+	mailer := NewTemplateMailer(fake, NewDirTemplateStore(dir))
+	mailer.callers = callers
+	mailer.rateClasses, _ = ParseRateClasses(map[string]string{"digest": "1/m"})
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		err := mailer.SendMail(&mailStruct{Template: "newsletter", Data: map[string]interface{}{}, Priority: PriorityHigh, TrackingClicks: TrackingOff})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := fake.sent[0]
+	if sent.Priority != PriorityBulk || sent.Tracking != TrackingOn || len(sent.TrackingClicks) > 0 || sent.Campaign != "newsletter" || len(sent.Tags) != 1 || sent.Tags[0] != CategoryMarketing {
+		t.Errorf("Policy should set the mail, got %+v", sent)
+	}
+	if !sent.DeliveryTime.IsZero() || fake.sent[1].DeliveryTime.Sub(now) < 50*time.Second {
+		t.Errorf("Mail over the rate of its class should be deferred, got %v", fake.sent[1].DeliveryTime)
+	}
+
+	if err := mailer.SendMail(&mailStruct{Template: "reset", Caller: "chat", Data: map[string]interface{}{}}); err != ErrTemplateScope {
+		t.Errorf("Caller without the scope should be refused, got %v", err)
+	}
+	if err := mailer.SendMail(&mailStruct{Template: "reset", Caller: "auth", Data: map[string]interface{}{}}); err != nil {
+		t.Errorf("Caller with the scope should send, got %v", err)
+	}
+	if _, err := mailer.store.Template("broken"); err != ErrBadTemplatePolicy {
+		t.Errorf("Unknown priority should fail the policy, got %v", err)
+	}
+	if err := parseTemplateFile(TemplatePolicyFile, `{"Limit": 5}`); err != ErrBadTemplatePolicy {
+		t.Errorf("Unknown field should fail the policy, got %v", err)
+	}
+}
+
+func TestTemplateMailerRenderCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "digest"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "digest", TemplateSubjectFile), []byte("Digest {{.Week}}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "digest", TemplateHtmlFile), []byte("<p>{{.Week}}</p>"), 0644)
+
+	fake := &FakeMailer{}
+	store := NewDirTemplateStore(dir)
+	mailer := NewTemplateMailer(fake, store)
+	mailer.renders = NewRenderCache(1)
+	week := func(week int) *mailStruct {
+		return &mailStruct{Template: "digest", Campaign: "digest", Message: "Plain", Data: map[string]interface{}{"Week": week}}
+	}
+	for _, mail := range []*mailStruct{week(1), week(1), week(2), week(1)} {
+		if err := mailer.SendMail(mail); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := mailer.renders.Stats(); stats.Hits != 1 || stats.Misses != 3 || stats.Entries != 1 || stats.HitRate != 0.25 {
+		t.Errorf("Same Data should be rendered once within the size, got %+v", stats)
+	}
+	if sent := fake.sent[1]; sent.Subject != "Digest 1" || sent.Html != "<p>1</p>" || sent.Message != "Plain" {
+		t.Errorf("Cached body should fill the rendered parts only, got %+v", sent)
+	}
+
+	// New version of the template is rendered anew
+	later := time.Now().Add(time.Second)
+	ioutil.WriteFile(filepath.Join(dir, "digest", TemplateSubjectFile), []byte("Weekly {{.Week}}"), 0644)
+	os.Chtimes(filepath.Join(dir, "digest", TemplateSubjectFile), later, later)
+	mailer.SendMail(week(1))
+	if sent := fake.sent[4]; sent.Subject != "Weekly 1" {
+		t.Errorf("Changed template should not use the cached body, got %q", sent.Subject)
+	}
+
+	mailer.SendMail(&mailStruct{Template: "digest", Data: map[string]interface{}{"Week": 2}})
+	if stats := mailer.renders.Stats(); stats.Hits+stats.Misses != 5 {
+		t.Errorf("Mail out of the campaign should not be cached, got %+v", stats)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var ErrBadTemplateAccount = fmt.Errorf("templatemailer: Account must be name:token:scope|scope")
+
+// TemplateAccount manages the templates its
+// scopes match e.g. marketing/*, which does not
+// match the templates without the namespace.
+type TemplateAccount struct {
+	Name   string
+	token  string
+	scopes []string
+}
+
+// ParseTemplateAccounts reads the accounts
+// of the name:token:scope|scope entries.
+func ParseTemplateAccounts(entries []string) ([]*TemplateAccount, error) {
+	accounts := make([]*TemplateAccount, 0, len(entries))
+	for _, entry := range entries {
+		fields := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(fields) != 3 || len(fields[0]) == 0 || len(fields[1]) == 0 {
+			return nil, ErrBadTemplateAccount
+		}
+		account := &TemplateAccount{Name: fields[0], token: fields[1]}
+		for _, scope := range strings.Split(fields[2], "|") {
+			if _, err := path.Match(scope, ""); err != nil || len(scope) == 0 {
+				return nil, ErrBadTemplateAccount
+			}
+			account.scopes = append(account.scopes, scope)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
+
+func (a *TemplateAccount) Allows(template string) bool {
+	for _, scope := range a.scopes {
+		if ok, _ := path.Match(scope, template); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateTemplateAccount returns the account
+// of the bearer token of the request, or nil.
+func authenticateTemplateAccount(accounts []*TemplateAccount, req *http.Request) *TemplateAccount {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	for _, account := range accounts {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(account.token)) == 1 {
+			return account
+		}
+	}
+	return nil
+}
+
+// templateAccountTokens lists the
+// tokens for the log scrubber.
+func templateAccountTokens(accounts []*TemplateAccount) []string {
+	tokens := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		tokens = append(tokens, account.token)
+	}
+	return tokens
+}
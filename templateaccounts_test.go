@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTemplateAccounts(t *testing.T) {
+	if _, err := ParseTemplateAccounts([]string{"marketing:secret"}); err != ErrBadTemplateAccount {
+		t.Error("Account without scopes should be rejected")
+	}
+	accounts, err := ParseTemplateAccounts([]string{"marketing:m-token:marketing/*|shared/*", "ops:o-token:*/*|*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	store := NewDirTemplateStore(dir)
+	handler := TemplatesFunc(store, accounts, nil)
+	do := func(token, name string) int {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", TemplatesPath+name+"/"+TemplateSubjectFile, strings.NewReader("Hello"))
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		handler(rw, req)
+		return rw.Code
+	}
+
+	if code := do("", "marketing/newsletter"); code != http.StatusUnauthorized {
+		t.Errorf("Missing token should be unauthorized, got %d", code)
+	}
+	if code := do("x-token", "marketing/newsletter"); code != http.StatusUnauthorized {
+		t.Errorf("Unknown token should be unauthorized, got %d", code)
+	}
+	if code := do("m-token", "marketing/newsletter"); code != http.StatusNoContent {
+		t.Errorf("Account should manage its namespace, got %d", code)
+	}
+	if code := do("m-token", "transactional/reset"); code != http.StatusForbidden {
+		t.Errorf("Account should not manage other namespace, got %d", code)
+	}
+	if code := do("m-token", "reset"); code != http.StatusForbidden {
+		t.Errorf("Account should not manage templates without namespace, got %d", code)
+	}
+	if code := do("o-token", "transactional/reset"); code != http.StatusNoContent {
+		t.Errorf("Account with wildcard should manage any template, got %d", code)
+	}
+
+	changes, _ := store.History("marketing/newsletter")
+	if len(changes) != 1 || changes[0].Author != "marketing" {
+		t.Errorf("Account should be the author, got %+v", changes)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TemplatesPath manages the template files by
+// TemplatesPath/name/file, TemplatesPath/name/history
+// lists the changes of the template.
+const TemplatesPath = "/v1/templates/"
+
+// TemplateAuditFile in the template directory
+// logs the changes, one JSON per line.
+const TemplateAuditFile = ".audit.jsonl"
+
+// diffContext lines are kept
+// around the changed ones.
+const diffContext = 3
+
+var (
+	ErrUnknownTemplateFile = fmt.Errorf("templatemailer: Unknown template file")
+	ErrBadTemplateSample   = fmt.Errorf("templatemailer: Sample data is not JSON")
+)
+
+// TemplateChange is the audited edit
+// of one file of the template.
+type TemplateChange struct {
+	Time     time.Time
+	Author   string
+	Template string
+	File     string
+	Diff     string
+}
+
+// validTemplateName keeps the name within the
+// directory, it may be in one namespace
+// e.g. marketing/welcome.
+func validTemplateName(name string) bool {
+	segments := strings.Split(name, "/")
+	if len(segments) > 2 {
+		return false
+	}
+	for _, segment := range segments {
+		if len(segment) == 0 || filepath.Base(segment) != segment || strings.HasPrefix(segment, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTemplateFile rejects the content
+// the file would fail to load with.
+func parseTemplateFile(file, content string) error {
+	var err error
+	switch file {
+	case TemplateSubjectFile, TemplateMessageFile, TemplateMarkdownFile:
+		_, err = texttemplate.New(file).Parse(content)
+	case TemplateHtmlFile:
+		_, err = htmltemplate.New(file).Parse(content)
+	case TemplateSampleFile:
+		if len(content) > 0 && !json.Valid([]byte(content)) {
+			err = ErrBadTemplateSample
+		}
+	case TemplatePolicyFile:
+		if len(content) > 0 {
+			_, err = parseTemplatePolicy([]byte(content))
+		}
+	default:
+		return ErrUnknownTemplateFile
+	}
+	return err
+}
+
+// Write replaces the file of the template and
+// logs the change, empty content removes it.
+// The content is checked by parseTemplateFile.
+func (s *DirTemplateStore) Write(name, file, content, author string, now time.Time) error {
+	if !validTemplateName(name) {
+		return ErrUnknownTemplate
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path := filepath.Join(s.dir, name, file)
+	before, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	diff := unifiedDiff(string(before), content)
+	if len(diff) == 0 {
+		return nil
+	}
+	if len(content) == 0 {
+		err = os.Remove(path)
+	} else if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+		// Replace the file at once, the
+		// store never loads it partial
+		if err = ioutil.WriteFile(path+".tmp", []byte(content), 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	delete(s.loaded, name)
+	return s.audit(TemplateChange{now, author, name, file, diff})
+}
+
+func (s *DirTemplateStore) audit(change TemplateChange) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, TemplateAuditFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(change)
+}
+
+// History returns the changes of
+// the template, the oldest first.
+func (s *DirTemplateStore) History(name string) ([]TemplateChange, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changes := []TemplateChange{}
+	f, err := os.Open(filepath.Join(s.dir, TemplateAuditFile))
+	if os.IsNotExist(err) {
+		return changes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		change := TemplateChange{}
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			return nil, err
+		}
+		if change.Template == name {
+			changes = append(changes, change)
+		}
+	}
+	return changes, scanner.Err()
+}
+
+// unifiedDiff returns the hunks of the changed
+// lines with diffContext lines around them,
+// empty when the texts are the same.
+func unifiedDiff(before, after string) string {
+	a, b := splitLines(before), splitLines(after)
+	// common[i][j] is the length of the longest
+	// common subsequence of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				common[i][j] = common[i+1][j+1] + 1
+			case common[i+1][j] > common[i][j+1]:
+				common[i][j] = common[i+1][j]
+			default:
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	type edit struct {
+		op     byte
+		line   string
+		ai, bi int
+	}
+	edits := []edit{}
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || common[i+1][j] >= common[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var out bytes.Buffer
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// The hunk goes on while the next
+		// change is close enough to join
+		end := k
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(edits) && edits[run].op == ' ' {
+				run++
+			}
+			if run < len(edits) && run-end <= 2*diffContext {
+				end = run
+				continue
+			}
+			if run-end > diffContext {
+				run = end + diffContext
+			}
+			end = run
+			break
+		}
+
+		removed, added := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				removed++
+			}
+			if e.op != '-' {
+				added++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(edits[start].ai, removed), hunkRange(edits[start].bi, added))
+		for _, e := range edits[start:end] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			out.WriteByte('\n')
+		}
+		k = end
+	}
+	return out.String()
+}
+
+// hunkRange starts the empty range
+// before the line, as diff -u does.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+func splitLines(text string) []string {
+	if len(text) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// TemplatesFunc replaces the template file by PUT
+// with the body, removes it by DELETE and lists
+// the changes of the template by GET of history.
+// Its screenshots are taken by POST of screenshots.
+// With the accounts only the account allowed the
+// template may do so, it is the author of the
+// change. Otherwise it is the remote address.
+func TemplatesFunc(store *DirTemplateStore, accounts []*TemplateAccount, screenshots *Screenshotter) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		path := strings.TrimPrefix(req.URL.Path, TemplatesPath)
+		i := strings.LastIndex(path, "/")
+		if i < 0 {
+			http.NotFound(rw, req)
+			return
+		}
+		name, file := path[:i], path[i+1:]
+		author := req.RemoteAddr
+		if len(accounts) > 0 {
+			account := authenticateTemplateAccount(accounts, req)
+			if account == nil {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			if !account.Allows(name) {
+				log.Warnf("Account %s denied template %s", account.Name, name)
+				http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			author = account.Name
+		}
+
+		if file == "screenshots" {
+			screenshotsFunc(store, screenshots, name, author, rw, req)
+			return
+		}
+
+		var content []byte
+		switch {
+		case req.Method == "GET" && file == "history":
+			changes, err := store.History(name)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(changes)
+			return
+		case req.Method == "PUT":
+			var err error
+			if content, err = ioutil.ReadAll(req.Body); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case req.Method == "DELETE":
+		default:
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := parseTemplateFile(file, string(content)); err == ErrUnknownTemplateFile {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err := store.Write(name, file, string(content), author, time.Now()); err {
+		case nil:
+		case ErrUnknownTemplate:
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		default:
+			log.Errorf("Cannot change template %s/%s: %s", name, file, err)
+			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Template %s/%s changed by %s", name, file, author)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
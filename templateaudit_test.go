@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	before := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	after := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	expected := "@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n@@ -8,3 +8,4 @@\n h\n i\n j\n+k\n"
+	if diff := unifiedDiff(before, after); diff != expected {
+		t.Errorf("Unexpected diff\n%s", diff)
+	}
+	if diff := unifiedDiff(before, before); len(diff) > 0 {
+		t.Errorf("Same texts should not differ, got %s", diff)
+	}
+}
+
+func TestTemplatesFunc(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	store := NewDirTemplateStore(dir)
+	handler := TemplatesFunc(store, nil, nil)
+	do := func(method, path, body string) int {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest(method, TemplatesPath+path, strings.NewReader(body)))
+		return rw.Code
+	}
+
+	if code := do("PUT", "welcome/"+TemplateSubjectFile, "Welcome {{.Name}}"); code != http.StatusNoContent {
+		t.Fatalf("Template file should be written, got %d", code)
+	}
+	do("PUT", "welcome/"+TemplateSubjectFile, "Hi {{.Name}}")
+	if code := do("PUT", "welcome/"+TemplateHtmlFile, "<p>{{.Name</p>"); code != http.StatusBadRequest {
+		t.Errorf("Broken template should be rejected, got %d", code)
+	}
+	if code := do("PUT", "welcome/script.sh", "rm -rf /"); code != http.StatusNotFound {
+		t.Errorf("Unknown file should not be written, got %d", code)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "welcome", TemplateSubjectFile)); string(content) != "Hi {{.Name}}" {
+		t.Errorf("Unexpected template file %q", content)
+	}
+
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", TemplatesPath+"welcome/history", nil))
+	changes := []TemplateChange{}
+	json.NewDecoder(rw.Body).Decode(&changes)
+	if len(changes) != 2 || changes[1].Diff != "@@ -1,1 +1,1 @@\n-Welcome {{.Name}}\n+Hi {{.Name}}\n" || len(changes[1].Author) == 0 {
+		t.Errorf("Unexpected history %+v", changes)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TemplatePolicyFile of the template directory
+// sets how its mail is sent, whatever the
+// mail itself asks for.
+const TemplatePolicyFile = "policy.json"
+
+// Categories of the templates, the
+// marketing mail is of its campaign.
+const (
+	CategoryTransactional = "transactional"
+	CategoryMarketing     = "marketing"
+)
+
+var (
+	ErrBadTemplatePolicy = fmt.Errorf("templatemailer: Policy has an unknown category, priority or tracking")
+	ErrTemplateScope     = fmt.Errorf("templatemailer: Caller lacks the scope the template requires")
+	ErrUnknownRateClass  = fmt.Errorf("templatemailer: Rate class of the template is not configured")
+)
+
+// TemplatePolicy of the template, the empty
+// field leaves the mail as it is. The Scope
+// must be granted to the Caller, the RateClass
+// shares its configured rate with the other
+// templates of the class.
+type TemplatePolicy struct {
+	Category  string
+	Priority  string
+	RateClass string
+	Tracking  string
+	Scope     string
+}
+
+// parseTemplatePolicy reads the policy,
+// the unknown field or value is an error.
+func parseTemplatePolicy(content []byte) (*TemplatePolicy, error) {
+	policy := &TemplatePolicy{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(policy); err != nil {
+		return nil, ErrBadTemplatePolicy
+	}
+	switch policy.Category {
+	case "", CategoryTransactional, CategoryMarketing:
+	default:
+		return nil, ErrBadTemplatePolicy
+	}
+	switch policy.Priority {
+	case "", PriorityHigh, PriorityNormal, PriorityBulk:
+	default:
+		return nil, ErrBadTemplatePolicy
+	}
+	switch policy.Tracking {
+	case "", TrackingOn, TrackingOff:
+	default:
+		return nil, ErrBadTemplatePolicy
+	}
+	return policy, nil
+}
+
+// ParseRateClasses reads the rate of
+// each class e.g. digest:100/m.
+func ParseRateClasses(rates map[string]string) (map[string]*TokenBucket, error) {
+	classes := make(map[string]*TokenBucket, len(rates))
+	for class, value := range rates {
+		rate, err := ParseRate(value)
+		if err != nil {
+			return nil, err
+		}
+		classes[class] = NewTokenBucket(rate, int(rate))
+	}
+	return classes, nil
+}
+
+// applyPolicy checks the Caller has the scope
+// and sets the mail by the policy. The mail
+// over the rate of its class is deferred.
+func (tm *TemplateMailer) applyPolicy(m *mailStruct, policy *TemplatePolicy, now time.Time) error {
+	if policy == nil {
+		return nil
+	}
+	if len(policy.Scope) > 0 && !callerAllows(tm.callers, m.Caller, policy.Scope) {
+		return ErrTemplateScope
+	}
+	if len(policy.RateClass) > 0 {
+		class, ok := tm.rateClasses[policy.RateClass]
+		if !ok {
+			return ErrUnknownRateClass
+		}
+		if due := now.Add(class.Reserve(now)); due.After(now) && due.After(m.DeliveryTime) {
+			m.DeliveryTime = due
+		}
+	}
+	if len(policy.Category) > 0 {
+		m.Tags = append(append([]string{}, m.Tags...), policy.Category)
+	}
+	if policy.Category == CategoryMarketing && len(m.Campaign) == 0 {
+		m.Campaign = m.Template
+	}
+	if len(policy.Priority) > 0 {
+		m.Priority = policy.Priority
+	}
+	if len(policy.Tracking) > 0 {
+		m.Tracking = policy.Tracking
+		m.TrackingOpens = ""
+		m.TrackingClicks = ""
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// domainQueue holds the mail of the throttled
+// recipient domain, so the domain backing up
+// does not hold the workers sending the
+// mail of the other domains. It is not
+// bounded by the queue policy.
+type domainQueue struct {
+	domain  string
+	limiter *TokenBucket
+	mutex   sync.Mutex
+	mail    []mailStruct
+	ready   chan struct{}
+}
+
+func (d *domainQueue) push(m mailStruct) {
+	d.mutex.Lock()
+	d.mail = append(d.mail, m)
+	d.mutex.Unlock()
+	select {
+	case d.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (d *domainQueue) pop() (mailStruct, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.mail) == 0 {
+		return mailStruct{}, false
+	}
+	m := d.mail[0]
+	d.mail[0] = mailStruct{}
+	d.mail = d.mail[1:]
+	return m, true
+}
+
+// Throttle sends the mail to the recipient
+// domain at most rate messages per second,
+// from its own queue. It is meant to be
+// called before the first mail.
+func (q *QueuedMailer) Throttle(domain string, rate float64) {
+	if q.domains == nil {
+		q.domains = make(map[string]*domainQueue)
+	}
+	d := &domainQueue{
+		domain:  domain,
+		limiter: NewTokenBucket(rate, int(rate)),
+		ready:   make(chan struct{}, 1),
+	}
+	q.domains[domain] = d
+	go q.throttle(q.ctx, d)
+}
+
+// throttled hands the mail of the
+// throttled domain to its queue.
+func (q *QueuedMailer) throttled(m mailStruct) bool {
+	if len(q.domains) == 0 {
+		return false
+	}
+	domain, err := recipientDomain(m.Recipient)
+	if err != nil {
+		return false
+	}
+	d, ok := q.domains[domain]
+	if !ok {
+		return false
+	}
+	atomic.AddInt64(&q.pending, 1)
+	d.push(m)
+	return true
+}
+
+// throttle sends the mail of the domain
+// queue within its rate until the
+// context is done.
+func (q *QueuedMailer) throttle(ctx context.Context, d *domainQueue) {
+	for {
+		m, ok := d.pop()
+		if !ok {
+			select {
+			case <-d.ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if wait := d.limiter.Reserve(time.Now()); wait > 0 {
+			log.Debugf("Domain %s throttled, delaying message for %s", d.domain, wait)
+			if !sleep(ctx, wait) {
+				return
+			}
+		}
+		if !q.deliver(ctx, m) {
+			return
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenCache keeps the OAuth access token
+// and fetches new one shortly before the
+// cached one expires.
+type tokenCache struct {
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// tokenFetcher returns the token
+// and its lifetime in seconds.
+type tokenFetcher func() (string, int, error)
+
+func (c *tokenCache) get(fetch tokenFetcher) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.token) > 0 && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	token, expiresIn, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	c.expires = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const TwilioAPIURL = "https://api.twilio.com/2010-04-01"
+
+var (
+	ErrMissingPhone = fmt.Errorf("twiliochannel: Phone is missing")
+
+	twilioConfig = &TwilioConfig{}
+)
+
+type TwilioConfig struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+	// Text of the SMS rendered from the mail
+	Template string `default:"{{.Subject}}: {{.Message}}"`
+	// Messages per second
+	Rate float64 `default:"1"`
+}
+
+func init() {
+	RegisterConfig("twilio", twilioConfig)
+	RegisterChannel("sms", func() (Mailer, error) {
+		return NewTwilioChannel(twilioConfig.AccountSID,
+			twilioConfig.AuthToken,
+			twilioConfig.From,
+			twilioConfig.Template,
+			twilioConfig.Rate)
+	})
+}
+
+// TwilioChannel sends the message as SMS
+// to the Phone of the mail, throttled
+// independently of the mail providers.
+type TwilioChannel struct {
+	apiURL     string
+	accountSID string
+	authToken  string
+	from       string
+	template   *template.Template
+	limiter    *TokenBucket
+	client     *http.Client
+}
+
+func NewTwilioChannel(accountSID, authToken, from, text string, rate float64) (Mailer, error) {
+	tmpl, err := template.New("sms").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &TwilioChannel{
+		apiURL:     TwilioAPIURL,
+		accountSID: accountSID,
+		authToken:  authToken,
+		from:       from,
+		template:   tmpl,
+		limiter:    NewTokenBucket(rate, int(rate)),
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (tc *TwilioChannel) SendMail(mail *mailStruct) error {
+	if len(mail.Phone) == 0 {
+		return ErrMissingPhone
+	}
+
+	var text bytes.Buffer
+	if err := tc.template.Execute(&text, mail); err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("To", mail.Phone)
+	form.Set("From", tc.from)
+	form.Set("Body", text.String())
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/Accounts/%s/Messages.json", tc.apiURL, tc.accountSID), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(tc.accountSID, tc.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	tc.limiter.Wait()
+	resp, err := tc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("twiliochannel: API returned %d", resp.StatusCode)
+	}
+	log.Infof("SMS for %s sent to %s", mail.Recipient, mail.Phone)
+	return nil
+}
+
+func (tc *TwilioChannel) Close() {}
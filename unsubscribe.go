@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/url"
+	texttemplate "text/template"
+)
+
+var unsubscribeConfig = &UnsubscribeConfig{}
+
+// UnsubscribeConfig enables the unsubscribe
+// link by the URL template e.g.
+// https://suricata.com/unsubscribe?email={{query .Recipient}}&campaign={{query .Campaign}}
+// with the fields of the mail.
+type UnsubscribeConfig struct {
+	URL    string
+	Mailto string
+}
+
+func init() {
+	RegisterConfig("unsubscribe", unsubscribeConfig)
+}
+
+// UnsubscribeMailer adds the List-Unsubscribe
+// headers and the footer link to the bulk
+// and campaign mail, the transactional
+// mail is left as is.
+type UnsubscribeMailer struct {
+	mailer Mailer
+	url    *texttemplate.Template
+	mailto string
+}
+
+func NewUnsubscribeMailer(mailer Mailer, urlTemplate, mailto string) (Mailer, error) {
+	t, err := texttemplate.New("unsubscribe").
+		Funcs(texttemplate.FuncMap{"query": url.QueryEscape}).
+		Parse(urlTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &UnsubscribeMailer{
+		mailer: mailer,
+		url:    t,
+		mailto: mailto,
+	}, nil
+}
+
+func (um *UnsubscribeMailer) SendMail(mail *mailStruct) error {
+	if mail.Priority != PriorityBulk && len(mail.Campaign) == 0 {
+		return um.mailer.SendMail(mail)
+	}
+
+	var buf bytes.Buffer
+	if err := um.url.Execute(&buf, mail); err != nil {
+		return &RenderError{"unsubscribe", err}
+	}
+	link := buf.String()
+
+	m := *mail
+	m.Headers = map[string]string{}
+	for name, value := range mail.Headers {
+		m.Headers[name] = value
+	}
+	unsubscribe := fmt.Sprintf("<%s>", link)
+	if len(um.mailto) > 0 {
+		unsubscribe += fmt.Sprintf(", <mailto:%s>", um.mailto)
+	}
+	m.Headers["List-Unsubscribe"] = unsubscribe
+	// One click unsubscribe of RFC 8058
+	m.Headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+
+	m.Message += fmt.Sprintf("\n\n--\nUnsubscribe: %s\n", link)
+	if len(m.Html) > 0 {
+		m.Html += fmt.Sprintf("<p><a href=\"%s\">Unsubscribe</a></p>", html.EscapeString(link))
+	}
+	return um.mailer.SendMail(&m)
+}
+
+func (um *UnsubscribeMailer) Close() {
+	um.mailer.Close()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnsubscribeMailer(t *testing.T) {
+	fake := &FakeMailer{}
+	mailer, err := NewUnsubscribeMailer(fake,
+		"https://suricata.com/unsubscribe?email={{query .Recipient}}&campaign={{query .Campaign}}",
+		"unsubscribe@suricata.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer.SendMail(&mailStruct{Recipient: "radek@suricata.com", Subject: "Reset password"})
+	if len(fake.sent[0].Headers) != 0 {
+		t.Error("Transactional mail should not get the unsubscribe link")
+	}
+
+	mailer.SendMail(&mailStruct{
+		Recipient: "radek+news@suricata.com",
+		Campaign:  "digest",
+		Message:   "News",
+		Html:      "<p>News</p>",
+	})
+	sent := fake.sent[1]
+	link := "https://suricata.com/unsubscribe?email=radek%2Bnews%40suricata.com&campaign=digest"
+	if sent.Headers["List-Unsubscribe"] != "<"+link+">, <mailto:unsubscribe@suricata.com>" {
+		t.Errorf("Unexpected List-Unsubscribe %s", sent.Headers["List-Unsubscribe"])
+	}
+	if !strings.Contains(sent.Message, link) || !strings.Contains(sent.Html, "Unsubscribe</a>") {
+		t.Errorf("Footer link missing in %q %q", sent.Message, sent.Html)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// WarmupRamp limits the number of messages sent
+// per campaign while the campaign warms up. The
+// first period allows Initial messages and every
+// following period multiplies the allowance by Factor.
+// The campaign idle for the warmupIdle periods
+// is forgotten and warms up again.
+type WarmupRamp struct {
+	Initial int
+	Factor  float64
+	Period  time.Duration
+
+	mutex     sync.Mutex
+	campaigns map[string]*campaignRamp
+	pruned    time.Time
+}
+
+// warmupIdle is the number of periods
+// the campaign is remembered without mail.
+const warmupIdle = 7
+
+// campaignRamp books the messages of the periods
+// from the first one on, the past ones are dropped.
+type campaignRamp struct {
+	start  time.Time
+	first  int
+	booked []int
+	last   time.Time
+}
+
+func NewWarmupRamp(initial int, factor float64, period time.Duration) *WarmupRamp {
+	return &WarmupRamp{
+		Initial:   initial,
+		Factor:    factor,
+		Period:    period,
+		campaigns: make(map[string]*campaignRamp),
+	}
+}
+
+// Enabled reports whether the ramp
+// limits anything at all.
+func (r *WarmupRamp) Enabled() bool {
+	return r != nil && r.Initial > 0 && r.Period > 0
+}
+
+// Reserve books one message of given campaign
+// into the first period with free capacity and
+// returns how long the caller has to wait before
+// the message can be sent.
+func (r *WarmupRamp) Reserve(campaign string, now time.Time) time.Duration {
+	if !r.Enabled() || len(campaign) == 0 {
+		return 0
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.prune(now)
+	c, ok := r.campaigns[campaign]
+	if !ok {
+		c = &campaignRamp{start: now}
+		r.campaigns[campaign] = c
+	}
+
+	period := int(now.Sub(c.start) / r.Period)
+	if passed := period - c.first; passed > 0 {
+		if passed > len(c.booked) {
+			passed = len(c.booked)
+		}
+		c.booked = c.booked[passed:]
+		c.first = period
+	}
+	for ; ; period++ {
+		for len(c.booked) <= period-c.first {
+			c.booked = append(c.booked, 0)
+		}
+		if c.booked[period-c.first] < r.allowance(period) {
+			c.booked[period-c.first]++
+			break
+		}
+	}
+
+	opens := c.start.Add(time.Duration(period) * r.Period)
+	if opens.After(c.last) {
+		c.last = opens
+	}
+	if opens.Before(now) {
+		return 0
+	}
+	return opens.Sub(now)
+}
+
+// prune forgets the idle campaigns,
+// checked once in the period.
+func (r *WarmupRamp) prune(now time.Time) {
+	if now.Sub(r.pruned) < r.Period {
+		return
+	}
+	r.pruned = now
+	for name, c := range r.campaigns {
+		if now.Sub(c.last) > warmupIdle*r.Period {
+			delete(r.campaigns, name)
+		}
+	}
+}
+
+func (r *WarmupRamp) allowance(period int) int {
+	factor := r.Factor
+	if factor < 1 {
+		factor = 1
+	}
+	allowed := float64(r.Initial) * math.Pow(factor, float64(period))
+	if allowed > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(allowed)
+}
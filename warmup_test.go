@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWarmupRamp(t *testing.T) {
+	ramp := NewWarmupRamp(2, 2, time.Hour)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if wait := ramp.Reserve("welcome", now); wait != 0 {
+			t.Errorf("Message %d should not wait, got %s", i, wait)
+		}
+	}
+
+	// Third message of first hour goes to
+	// the second period which allows 4 messages
+	for i := 0; i < 4; i++ {
+		if wait := ramp.Reserve("welcome", now); wait != time.Hour {
+			t.Errorf("Message should wait an hour, got %s", wait)
+		}
+	}
+
+	if wait := ramp.Reserve("welcome", now); wait != 2*time.Hour {
+		t.Errorf("Message should wait two hours, got %s", wait)
+	}
+
+	if wait := ramp.Reserve("digest", now); wait != 0 {
+		t.Error("Campaigns should be ramped independently")
+	}
+}
+
+func TestWarmupRampDisabled(t *testing.T) {
+	ramp := NewWarmupRamp(0, 2, time.Hour)
+	for i := 0; i < 10; i++ {
+		if ramp.Reserve("welcome", time.Now()) != 0 {
+			t.Error("Disabled ramp should never delay")
+		}
+	}
+}
+
+func TestWarmupRampPrunes(t *testing.T) {
+	ramp := NewWarmupRamp(1, 2, time.Hour)
+	now := time.Now()
+
+	ramp.Reserve("welcome", now)
+	ramp.Reserve("welcome", now)
+	ramp.Reserve("digest", now)
+	later := now.Add(5 * time.Hour)
+	ramp.Reserve("welcome", later)
+	if c := ramp.campaigns["welcome"]; c.first != 5 || len(c.booked) != 1 {
+		t.Errorf("Past periods should be dropped, got %d from %d", len(c.booked), c.first)
+	}
+
+	ramp.Reserve("welcome", now.Add(9*time.Hour))
+	if _, ok := ramp.campaigns["digest"]; ok || len(ramp.campaigns) != 1 {
+		t.Errorf("Idle campaign should be forgotten, got %v", ramp.campaigns)
+	}
+	if wait := ramp.Reserve("digest", now.Add(9*time.Hour)); wait != 0 {
+		t.Errorf("Forgotten campaign should warm up again, got %s", wait)
+	}
+}
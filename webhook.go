@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const SignatureHeader = "X-Mail-Signature"
+
+var (
+	ErrMissingWebhookURL = fmt.Errorf("webhookchannel: WebhookURL is missing")
+
+	webhookConfig = &WebhookConfig{}
+)
+
+type WebhookConfig struct {
+	// Key of the HMAC signature
+	Secret string
+}
+
+func init() {
+	RegisterConfig("webhook", webhookConfig)
+	RegisterChannel("webhook", func() (Mailer, error) {
+		return NewWebhookChannel(webhookConfig.Secret), nil
+	})
+}
+
+type webhookPayload struct {
+	Recipient string
+	Subject   string
+	Message   string
+	Html      string `json:",omitempty"`
+}
+
+// WebhookChannel posts the message as JSON to
+// the WebhookURL of the mail, signed by HMAC
+// SHA-256 of the body in the signature header.
+type WebhookChannel struct {
+	secret []byte
+	client *http.Client
+}
+
+func NewWebhookChannel(secret string) Mailer {
+	return &WebhookChannel{
+		secret: []byte(secret),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (wc *WebhookChannel) SendMail(mail *mailStruct) error {
+	if len(mail.WebhookURL) == 0 {
+		return ErrMissingWebhookURL
+	}
+
+	out, err := json.Marshal(webhookPayload{
+		Recipient: mail.Recipient,
+		Subject:   mail.Subject,
+		Message:   mail.Message,
+		Html:      mail.Html,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", mail.WebhookURL, bytes.NewReader(out))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, "sha256="+sign(wc.secret, out))
+
+	resp, err := wc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhookchannel: Webhook returned %d", resp.StatusCode)
+	}
+	log.Infof("Message for %s posted to webhook", mail.Recipient)
+	return nil
+}
+
+func (wc *WebhookChannel) Close() {}
+
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/hmac"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookChannel(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		expected := "sha256=" + sign([]byte("secret"), body)
+		if !hmac.Equal([]byte(req.Header.Get(SignatureHeader)), []byte(expected)) {
+			t.Error("Bad signature")
+		}
+		received++
+	}))
+	defer server.Close()
+
+	channel := NewWebhookChannel("secret")
+	if err := channel.SendMail(&mailStruct{WebhookURL: server.URL, Subject: "Alert"}); err != nil {
+		t.Fatal(err)
+	}
+	if received != 1 {
+		t.Error("Webhook not called")
+	}
+
+	if channel.SendMail(&mailStruct{}) != ErrMissingWebhookURL {
+		t.Error("Mail without URL should be rejected")
+	}
+}